@@ -3,34 +3,358 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/smallnest/aiagents/tool"
 )
 
 // PlanningAgent orchestrates task planning and subagent execution.
 type PlanningAgent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	config             AgentConfig
+	mu                 sync.RWMutex // guards messages, lastTasks, lastResults and scratchpad
 	messages           []openai.ChatCompletionMessage
+	lastTasks          []Task      // tasks of the last executed plan
+	lastResults        []Result    // results of lastTasks, for Retry
+	scratchpad         *Scratchpad // of the last executed plan, for Retry
 	subagents          map[TaskType]Subagent
 	interactionHandler InteractionHandler
+	usage              *usageTracker
+	examples           []openai.ChatCompletionMessage // few-shot planner messages from PlanExamples
 }
 
 // AgentConfig holds the configuration for the planning agent.
 type AgentConfig struct {
-	APIKey     string
-	APIBase    string
+	APIKey  string
+	APIBase string
+	// Client, if set, sends every model request instead of a client for
+	// APIKey and APIBase, e.g. a MockClient in tests. Usage tracking,
+	// tracing and MaxConcurrentAPICalls only apply to the built client.
+	// RETRIEVE tasks need a Client that is also an Embedder.
+	Client     ChatCompleter
 	Model      string
 	Verbose    bool
-	RenderHTML bool
+	RenderHTML bool // same as FinalFormat html; ignored if FinalFormat is set
 	OutputDir  string
+
+	// FinalFormat is the format the caller wants the final report in.
+	// Empty uses FinalFormatHTML if RenderHTML is set, else FinalFormatTerm.
+	// With FinalFormatMarkdown or FinalFormatNone RENDER tasks are removed
+	// from plans and the report is returned as markdown.
+	FinalFormat FinalFormat
+	// OutputStrategy selects the final output among the task results.
+	// Empty means OutputPreferRender.
+	OutputStrategy OutputStrategy
+	// ReportRule fixes plans whose PPT, PODCAST or RENDER tasks have no
+	// REPORT before them. Empty means ReportRuleAuto.
+	ReportRule ReportRule
+
+	// DisableWebSearch runs plans offline: the planner is told not to
+	// search, SEARCH tasks are removed from plans, and searches queued while
+	// running, e.g. by compare analyses, return no results without
+	// contacting any search API. Useful for testing prompts, working only
+	// with the knowledge base, and CI runs without search keys.
+	DisableWebSearch bool
+
+	// ConversationContext selects the messages of the conversation given
+	// to the planner, the chat and the subagents as the user's context, see
+	// PlanningAgent.AddDeveloperMessage. Empty means ContextAll.
+	ConversationContext ContextMode
+	// Manifest makes RunFull save the report, the podcast script and a
+	// manifest.json listing every artifact under OutputDir/runs.
+	Manifest bool
+
+	// HTMLFragment makes RENDER tasks produce an HTML fragment for
+	// embedding in another page instead of a complete document with
+	// <head> and <body>. Only used when FinalFormat is FinalFormatHTML, or
+	// for the HTML of RenderConfig.Both.
+	HTMLFragment bool
+	// MaxRenderBytes is the markdown size above which RENDER tasks split
+	// the HTML into pages, returned in Result.Metadata["pages"]. Zero
+	// disables pagination.
+	MaxRenderBytes int
+	// Render lays out the terminal text of FinalFormatTerm, and with Both
+	// renders HTML and terminal text together. The zero value uses
+	// DefaultRenderConfig.
+	Render RenderConfig
+
+	// MaxTasks caps the number of tasks accepted from the planner.
+	// Zero means no limit.
+	MaxTasks int
+	// Planner controls the size of the plans the planner is asked for.
+	Planner PlanConfig
+	// PlanExamples are shown to the planner as earlier requests and the
+	// plans made for them, steering it toward the same decomposition.
+	PlanExamples []PlanExample
+	// AllowedTaskTypes restricts which task types a plan may contain.
+	// Empty means every registered subagent type is allowed.
+	AllowedTaskTypes []TaskType
+
+	// MaxAnalyzeAttempts limits how many times an ANALYZE task may request
+	// more information (MISSING_INFO) before it must work with what it has.
+	// Zero uses the default of 2; a negative value disables the requests.
+	MaxAnalyzeAttempts int
+	// Ensemble runs ANALYZE tasks on several models and synthesizes their
+	// analyses. The zero value analyzes with Model only.
+	Ensemble EnsembleConfig
+
+	// MaxReportContinuations limits how many times a report cut off at the
+	// model's output token limit is continued with another request. Zero
+	// uses the default of 3; a negative value disables continuation.
+	MaxReportContinuations int
+
+	// MaxReportContextBytes is the size of the context of a REPORT task
+	// above which it is first summarized in chunks, and the report written
+	// from the summaries. Zero uses the default of 100000; a negative
+	// value disables summarizing.
+	MaxReportContextBytes int
+
+	// CompactThreshold is the estimated token count of the conversation
+	// history above which Plan and Chat first summarize older turns.
+	// Zero disables automatic compaction.
+	CompactThreshold int
+	// KeepRecentTurns is how many recent turns CompactHistory keeps
+	// verbatim. Zero uses the default of 4.
+	KeepRecentTurns int
+	// PlannerHistoryLimit caps the estimated tokens of the conversation
+	// context given to the planner, keeping the developer instructions and
+	// the most recent requests, so long sessions do not bloat the planning
+	// prompt. Unlike CompactThreshold it drops older requests without a
+	// summary and leaves the history itself unchanged. Zero means no limit.
+	PlannerHistoryLimit int
+
+	// Prompts overrides built-in system prompts, keyed by component
+	// (see the Prompt* constants). Missing keys use the defaults.
+	Prompts map[string]string
+
+	// Email configures the SMTP server used by EMAIL tasks.
+	Email EmailConfig
+
+	// Knowledge configures the knowledge base searched by RETRIEVE tasks.
+	// RETRIEVE is only available if Knowledge.Paths is set.
+	Knowledge KnowledgeConfig
+
+	// PPT configures the presentation subagent.
+	PPT PPTConfig
+
+	// Podcast configures the speakers and language of podcast scripts.
+	Podcast PodcastConfig
+
+	// Language is the output language of the subagents, such as "English".
+	// LanguageAuto uses the language of the latest user request. Empty
+	// keeps the default Chinese output.
+	Language string
+
+	// Checkpoints adds a checkpoint before every PPT and PODCAST task of a
+	// reviewed plan, so the expensive generation steps need a second
+	// confirmation after the report is ready.
+	Checkpoints bool
+
+	// Search restricts the domains web searches may return.
+	Search SearchConfig
+
+	// SearchGuidance asks the user for guidance between search reflection
+	// iterations when the interaction handler implements GuidanceHandler.
+	SearchGuidance bool
+
+	// ContextRules selects which earlier task outputs are injected into
+	// each task type's context; see DefaultContextRules, which is used when
+	// nil. Task types missing from the map receive every earlier output.
+	ContextRules map[TaskType][]TaskType
+
+	// AbortOnTimeout stops the plan when a task exceeds its
+	// "timeout_seconds" parameter. By default the task is recorded as
+	// failed and execution continues with the next task.
+	AbortOnTimeout bool
+
+	// Capabilities selects the optional API features used with the model,
+	// see ProbeCapabilities. The zero value is safe for any endpoint.
+	Capabilities Capabilities
+
+	// UseToolCalling makes the planner request the plan through the
+	// create_plan function tool instead of parsing free-form JSON text.
+	// Leave it off for endpoints that do not support tools. It is the same
+	// as setting Capabilities.Tools.
+	UseToolCalling bool
+
+	// MaxCostUSD caps the estimated cost of executing a plan. Execute stops
+	// with ErrBudgetExceeded before a task that would likely exceed it,
+	// judging by the average cost of the tasks run so far. Zero disables
+	// the cap.
+	MaxCostUSD float64
+	// ModelPrices overrides DefaultModelPrices for cost estimation.
+	ModelPrices map[string]ModelPrice
+
+	// Trace records the API requests and raw responses of each task in
+	// Result.Metadata["trace"] as []TraceEntry, and appends them to a JSON
+	// lines file in OutputDir/traces, for debugging prompts. The API key is
+	// redacted.
+	Trace bool
+
+	// MaxConcurrentAPICalls caps the API requests in flight across every
+	// agent in the process configured with the same value, e.g. all web
+	// sessions, to stay below organization rate limits. Requests wait for
+	// a free slot. Zero disables the cap.
+	MaxConcurrentAPICalls int
+
+	// FallbackModel is used by the planner when the primary model fails
+	// to produce a valid plan twice in a row. Empty disables the fallback.
+	FallbackModel string
+}
+
+// PlanConfig controls how thoroughly the planner decomposes requests. The
+// zero value asks for short plans of about 3-5 tasks.
+type PlanConfig struct {
+	// MinTasks and MaxTasks bound the number of tasks in a plan; zero
+	// leaves that side open. The planner is asked for a plan within the
+	// bounds, a plan with too few tasks is requested again and the tasks
+	// beyond MaxTasks are dropped.
+	MinTasks int
+	MaxTasks int
+	// Guidance is an extra planner instruction about the plan size, e.g.
+	// "深入研究时为每个子问题安排单独的 SEARCH 和 ANALYZE 任务".
+	Guidance string
 }
 
+// prompt returns the planner instruction about the plan size.
+func (c PlanConfig) prompt() string {
+	var rule string
+	switch {
+	case c.MinTasks > 0 && c.MaxTasks > 0:
+		rule = fmt.Sprintf("计划应包含 %d-%d 个任务，复杂或包含多个方面的请求应充分分解。", c.MinTasks, c.MaxTasks)
+	case c.MinTasks > 0:
+		rule = fmt.Sprintf("计划应至少包含 %d 个任务，复杂或包含多个方面的请求应充分分解。", c.MinTasks)
+	case c.MaxTasks > 0:
+		rule = fmt.Sprintf("保持计划重点突出，最多包含 %d 个任务。", c.MaxTasks)
+	case c.Guidance == "":
+		rule = "保持计划简单且重点突出。通常 3-5 个任务就足够了。"
+	}
+	return strings.TrimSpace(rule + "\n" + c.Guidance)
+}
+
+// FinalFormat is a format for the final report, see AgentConfig.FinalFormat.
+type FinalFormat string
+
+const (
+	FinalFormatMarkdown FinalFormat = "markdown" // raw markdown, rendered by the caller
+	FinalFormatHTML     FinalFormat = "html"     // HTML rendered by a RENDER task
+	FinalFormatTerm     FinalFormat = "term"     // terminal text rendered by a RENDER task
+	FinalFormatNone     FinalFormat = "none"     // no final rendering, e.g. for exports only
+)
+
+// ParseFinalFormat parses a final format name.
+func ParseFinalFormat(s string) (FinalFormat, error) {
+	switch f := FinalFormat(strings.ToLower(strings.TrimSpace(s))); f {
+	case FinalFormatMarkdown, FinalFormatHTML, FinalFormatTerm, FinalFormatNone:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown final format %q (want markdown, html, term or none)", s)
+}
+
+// rendered reports whether plans end with a RENDER task for the format.
+func (f FinalFormat) rendered() bool {
+	return f == FinalFormatHTML || f == FinalFormatTerm
+}
+
+// OutputStrategy selects the final output of a run, see
+// AgentConfig.OutputStrategy.
+type OutputStrategy string
+
+const (
+	// OutputPreferRender uses the last RENDER result, falling back to the
+	// last REPORT result and then to all outputs concatenated.
+	OutputPreferRender OutputStrategy = "prefer-render"
+	// OutputPreferReport uses the last REPORT result, i.e. the markdown,
+	// falling back to the last RENDER result and then to all outputs
+	// concatenated.
+	OutputPreferReport OutputStrategy = "prefer-report"
+	// OutputConcatenateAll concatenates the outputs of every successful
+	// task.
+	OutputConcatenateAll OutputStrategy = "concatenate-all"
+)
+
+// ParseOutputStrategy parses an output strategy name.
+func ParseOutputStrategy(s string) (OutputStrategy, error) {
+	switch o := OutputStrategy(strings.ToLower(strings.TrimSpace(s))); o {
+	case OutputPreferRender, OutputPreferReport, OutputConcatenateAll:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown output strategy %q (want prefer-render, prefer-report or concatenate-all)", s)
+}
+
+// ReportRule says how plans are fixed when a task that works on the report
+// has no REPORT task before it, see AgentConfig.ReportRule.
+type ReportRule string
+
+const (
+	// ReportRuleAuto moves a later REPORT task before the first task that
+	// needs it, or inserts a new REPORT task if the plan has none.
+	ReportRuleAuto ReportRule = "auto"
+	// ReportRuleReorder only moves a later REPORT task; plans without one
+	// are left as they are.
+	ReportRuleReorder ReportRule = "reorder"
+	// ReportRuleOff leaves plans as the planner made them.
+	ReportRuleOff ReportRule = "off"
+)
+
+// ContextMode selects the history messages injected as the user's context
+// into planning, chat and task execution, see AgentConfig.ConversationContext.
+type ContextMode string
+
+const (
+	// ContextAll injects the developer instructions, which take precedence,
+	// and the user requests of the conversation.
+	ContextAll ContextMode = "all"
+	// ContextInstructions only injects the developer instructions.
+	ContextInstructions ContextMode = "instructions"
+	// ContextNone injects nothing; the planner and subagents only see the
+	// current request.
+	ContextNone ContextMode = "none"
+)
+
+// ParseContextMode parses a context mode name.
+func ParseContextMode(s string) (ContextMode, error) {
+	switch m := ContextMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case ContextAll, ContextInstructions, ContextNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown context mode %q (want all, instructions or none)", s)
+}
+
+// ParseReportRule parses a report rule name.
+func ParseReportRule(s string) (ReportRule, error) {
+	switch r := ReportRule(strings.ToLower(strings.TrimSpace(s))); r {
+	case ReportRuleAuto, ReportRuleReorder, ReportRuleOff:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown report rule %q (want auto, reorder or off)", s)
+}
+
+// Keys for AgentConfig.Prompts.
+const (
+	PromptPlanner = "planner"
+	PromptChat    = "chat"
+	PromptSearch  = "search" // reflection step of the search loop
+	PromptAnalyze = "analyze"
+	PromptReport  = "report"
+	PromptPodcast = "podcast"
+	PromptPPT     = "ppt"
+	PromptChart   = "chart"
+	PromptExtract = "extract"
+)
+
 // NewPlanningAgent creates and initializes a new PlanningAgent.
 func NewPlanningAgent(config AgentConfig, interactionHandler InteractionHandler) (*PlanningAgent, error) {
-	if config.APIKey == "" {
+	if config.APIKey == "" && config.Client == nil {
 		return nil, fmt.Errorf("API key is required")
 	}
 	if config.Model == "" {
@@ -39,12 +363,78 @@ func NewPlanningAgent(config AgentConfig, interactionHandler InteractionHandler)
 	if config.OutputDir == "" {
 		config.OutputDir = "generated" // Default output directory
 	}
+	if config.KeepRecentTurns == 0 {
+		config.KeepRecentTurns = 4
+	}
+	if config.MaxAnalyzeAttempts == 0 {
+		config.MaxAnalyzeAttempts = 2
+	}
+	if config.FinalFormat == "" {
+		config.FinalFormat = FinalFormatTerm
+		if config.RenderHTML {
+			config.FinalFormat = FinalFormatHTML
+		}
+	} else if _, err := ParseFinalFormat(string(config.FinalFormat)); err != nil {
+		return nil, err
+	}
+	// Both chooses the outputs rather than the layout, so it keeps the defaults
+	if both := config.Render.Both; config.Render == (RenderConfig{Both: both}) {
+		config.Render = DefaultRenderConfig
+		config.Render.Both = both
+	}
+	if err := config.Search.validate(); err != nil {
+		return nil, err
+	}
+	if config.OutputStrategy == "" {
+		config.OutputStrategy = OutputPreferRender
+	} else if _, err := ParseOutputStrategy(string(config.OutputStrategy)); err != nil {
+		return nil, err
+	}
+	if config.ReportRule == "" {
+		config.ReportRule = ReportRuleAuto
+	} else if _, err := ParseReportRule(string(config.ReportRule)); err != nil {
+		return nil, err
+	}
+	if config.DisableWebSearch {
+		config.Search.Disabled = true
+	}
+	if config.ConversationContext == "" {
+		config.ConversationContext = ContextAll
+	} else if _, err := ParseContextMode(string(config.ConversationContext)); err != nil {
+		return nil, err
+	}
+	if config.UseToolCalling {
+		config.Capabilities.Tools = true
+	}
+	if config.MaxReportContinuations == 0 {
+		config.MaxReportContinuations = 3
+	}
+	if config.MaxReportContextBytes == 0 {
+		config.MaxReportContextBytes = 100000
+	}
+	examples, err := planExampleMessages(config.PlanExamples)
+	if err != nil {
+		return nil, err
+	}
 
 	openaiConfig := openai.DefaultConfig(config.APIKey)
 	if config.APIBase != "" {
 		openaiConfig.BaseURL = config.APIBase
 	}
-	client := openai.NewClientWithConfig(openaiConfig)
+	usage := newUsageTracker(config.ModelPrices)
+	var transport http.RoundTripper = &usageTransport{base: http.DefaultTransport, tracker: usage}
+	if config.Trace {
+		transport = &traceTransport{base: transport, secret: config.APIKey}
+	}
+	if config.MaxConcurrentAPICalls > 0 {
+		transport = &limitTransport{base: transport, sem: apiSemaphore(config.MaxConcurrentAPICalls)}
+	}
+	transport = &heartbeatTransport{base: transport}
+	openaiConfig.HTTPClient = &http.Client{Transport: transport}
+	var client ChatCompleter = openai.NewClientWithConfig(openaiConfig)
+	if config.Client != nil {
+		client = config.Client
+	}
 
 	agent := &PlanningAgent{
 		client:             client,
@@ -52,21 +442,157 @@ func NewPlanningAgent(config AgentConfig, interactionHandler InteractionHandler)
 		messages:           []openai.ChatCompletionMessage{},
 		subagents:          make(map[TaskType]Subagent),
 		interactionHandler: interactionHandler,
+		usage:              usage,
+		examples:           examples,
 	}
 
 	// Initialize subagents
-	agent.subagents[TaskTypeSearch] = NewSearchSubagent(client, config.Model, config.Verbose, interactionHandler)
-	agent.subagents[TaskTypeAnalyze] = NewAnalysisSubagent(client, config.Model, config.Verbose, interactionHandler)
-	agent.subagents[TaskTypeReport] = NewReportSubagent(client, config.Model, config.Verbose, interactionHandler)
-	agent.subagents[TaskTypeRender] = NewRenderSubagent(config.Verbose, config.RenderHTML, interactionHandler)
-	agent.subagents[TaskTypePodcast] = NewPodcastSubagent(client, config.Model, config.Verbose, interactionHandler)
-	agent.subagents[TaskTypePPT] = NewPPTSubagent(client, config.Model, config.Verbose, interactionHandler, config.OutputDir)
+	agent.subagents[TaskTypeSearch] = NewSearchSubagent(client, config.Model, config.Verbose, interactionHandler, config.Prompts[PromptSearch], config.SearchGuidance, config.Search)
+	agent.subagents[TaskTypeAnalyze] = NewAnalysisSubagent(client, config.Model, config.Verbose, interactionHandler, config.Prompts[PromptAnalyze], config.MaxAnalyzeAttempts, config.Capabilities.Vision, config.Ensemble)
+	agent.subagents[TaskTypeReport] = NewReportSubagent(client, config.Model, config.Verbose, interactionHandler, config.Prompts[PromptReport], config.MaxReportContinuations, config.Capabilities.Streaming, config.MaxReportContextBytes)
+	agent.subagents[TaskTypeRender] = NewRenderSubagent(config.Verbose, config.FinalFormat, config.HTMLFragment, config.MaxRenderBytes, config.Render, interactionHandler)
+	agent.subagents[TaskTypePodcast] = NewPodcastSubagent(client, config.Model, config.Verbose, interactionHandler, config.Podcast, config.Prompts[PromptPodcast], config.Capabilities.JSONMode)
+	agent.subagents[TaskTypePPT] = NewPPTSubagent(client, config.Model, config.Verbose, interactionHandler, config.OutputDir, config.PPT, config.Prompts[PromptPPT], config.Capabilities)
+	agent.subagents[TaskTypeChart] = NewChartSubagent(client, config.Model, config.Verbose, interactionHandler, config.OutputDir, config.Prompts[PromptChart], config.Capabilities.JSONMode)
+	agent.subagents[TaskTypeExtract] = NewExtractSubagent(client, config.Model, config.Verbose, interactionHandler, config.Prompts[PromptExtract], config.Capabilities.JSONMode)
+	agent.subagents[TaskTypeExport] = NewExportSubagent(config.Verbose, interactionHandler, config.OutputDir)
+	agent.subagents[TaskTypeEmail] = NewEmailSubagent(config.Verbose, interactionHandler, config.OutputDir, config.Email)
+	if len(config.Knowledge.Paths) > 0 {
+		embedder, ok := client.(Embedder)
+		if !ok {
+			return nil, fmt.Errorf("the knowledge base needs a client that creates embeddings")
+		}
+		agent.subagents[TaskTypeRetrieve] = NewRetrieveSubagent(embedder, config.Verbose, interactionHandler, config.Knowledge)
+	}
 
 	return agent, nil
 }
 
+// Preflight validates the subagents that implement Validator and returns the
+// errors of the unavailable ones, keyed by task type. Tasks of these types
+// will fail or degrade when executed.
+func (a *PlanningAgent) Preflight() map[TaskType]error {
+	unavailable := make(map[TaskType]error)
+	for taskType, subagent := range a.subagents {
+		validator, ok := subagent.(Validator)
+		if !ok {
+			continue
+		}
+		if err := validator.Validate(); err != nil {
+			unavailable[taskType] = err
+			a.warn(fmt.Sprintf("⚠️ 子代理 %s 不可用: %v", taskType, err))
+		}
+	}
+	return unavailable
+}
+
+// taskDescriptions describes the task types for SupportedTasks, in the
+// order they are listed.
+var taskDescriptions = []struct {
+	taskType    TaskType
+	description string
+}{
+	{TaskTypeSearch, "执行网络搜索以收集信息"},
+	{TaskTypeRetrieve, "在本地知识库中检索相关内容"},
+	{TaskTypeAnalyze, "分析和综合收集到的信息"},
+	{TaskTypeExtract, "提取数值和表格数据，整理为结构化表格"},
+	{TaskTypeChart, "根据数据生成图表图片"},
+	{TaskTypeReport, "根据分析数据生成格式化报告"},
+	{TaskTypeRender, "将 Markdown 报告渲染为最终格式"},
+	{TaskTypePodcast, "根据报告生成播客脚本"},
+	{TaskTypePPT, "根据报告生成幻灯片"},
+	{TaskTypeExport, "将报告导出为 Word 或 PDF 文档"},
+	{TaskTypeEmail, "通过邮件发送报告及导出的文件"},
+}
+
+// SupportedTasks returns the task types that plans of the agent can
+// contain: those with a registered subagent that AllowedTaskTypes and
+// DisableWebSearch permit. Preflight reports which of them lack their
+// dependencies.
+func (a *PlanningAgent) SupportedTasks() []TaskType {
+	allowed := make(map[TaskType]bool, len(a.config.AllowedTaskTypes))
+	for _, t := range a.config.AllowedTaskTypes {
+		allowed[t] = true
+	}
+
+	var supported []TaskType
+	for _, d := range taskDescriptions {
+		if _, registered := a.subagents[d.taskType]; !registered {
+			continue
+		}
+		if (len(allowed) > 0 && !allowed[d.taskType]) || (d.taskType == TaskTypeSearch && a.config.DisableWebSearch) {
+			continue
+		}
+		supported = append(supported, d.taskType)
+	}
+	return supported
+}
+
+// DescribeTask returns what tasks of type t do, or "" if the agent does not
+// support t.
+func (a *PlanningAgent) DescribeTask(t TaskType) string {
+	if !slices.Contains(a.SupportedTasks(), t) {
+		return ""
+	}
+	for _, d := range taskDescriptions {
+		if d.taskType == t {
+			return d.description
+		}
+	}
+	return ""
+}
+
 // Plan decomposes a user request into subtasks.
 func (a *PlanningAgent) Plan(ctx context.Context, userRequest string) (*Plan, error) {
+	return a.plan(ctx, planRequest(userRequest))
+}
+
+// planRequest is the user message asking the planner for a plan.
+func planRequest(userRequest string) string {
+	return fmt.Sprintf("为该请求创建计划：%s", userRequest)
+}
+
+// planExampleMessages turns examples into user and assistant message pairs,
+// as if the planner had answered each request with its plan.
+func planExampleMessages(examples []PlanExample) ([]openai.ChatCompletionMessage, error) {
+	var messages []openai.ChatCompletionMessage
+	for i, example := range examples {
+		if strings.TrimSpace(example.Request) == "" || len(example.Plan.Tasks) == 0 {
+			return nil, fmt.Errorf("plan example %d needs a request and at least one task", i+1)
+		}
+		plan, err := json.Marshal(example.Plan)
+		if err != nil {
+			return nil, fmt.Errorf("plan example %d: %w", i+1, err)
+		}
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: planRequest(example.Request)},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: string(plan)},
+		)
+	}
+	return messages, nil
+}
+
+// RevisePlan asks the planner to apply the user's modification to plan,
+// which was created for userRequest. Unlike planning the modification from
+// scratch, the revised plan keeps the topic and the tasks the user did not
+// ask to change.
+func (a *PlanningAgent) RevisePlan(ctx context.Context, userRequest string, plan *Plan, modification string) (*Plan, error) {
+	current, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode plan: %w", err)
+	}
+	return a.plan(ctx, fmt.Sprintf(`原始请求：%s
+
+当前计划：
+%s
+
+用户要求的修改：%s
+
+请在当前计划的基础上应用用户要求的修改，保留未要求修改的任务和主题，返回修改后的完整计划。`, userRequest, current, modification))
+}
+
+// plan asks the planner model for a plan with the given user message.
+func (a *PlanningAgent) plan(ctx context.Context, request string) (*Plan, error) {
 	if a.config.Verbose {
 		fmt.Println("🧠 规划 Agent")
 	}
@@ -74,50 +600,64 @@ func (a *PlanningAgent) Plan(ctx context.Context, userRequest string) (*Plan, er
 		a.interactionHandler.Log("🧠 正在规划...")
 	}
 
+	a.maybeCompactHistory(ctx)
+
 	systemPrompt := `你是一个规划 Agent，负责将用户请求分解为子任务。
 你可以使用以下 Subagent：
-- SEARCH: 执行网络搜索以收集信息
-- ANALYZE: 分析和综合收集到的信息
-- REPORT: 根据分析数据生成格式化报告
+- SEARCH: 执行网络搜索以收集信息 (可选参数: {"query": "...", "max_results": 10, "region": "cn-zh", "include_domains": ["*.gov"], "exclude_domains": ["example.com"], "wikipedia_language": "zh", "wikipedia_section": "历史", "wikipedia_full": true}；仅需链接列表时使用 {"mode": "links"}；仅当用户要求限定来源时设置 include_domains/exclude_domains；仅当用户指定维基百科的语言版本或章节时设置 wikipedia_*，不需要维基百科时设置 "wikipedia": false)
+- ANALYZE: 分析和综合收集到的信息 (对比类请求使用参数: {"mode": "compare", "entities": ["X", "Y"]}；用户提供图像 URL 或本地图像路径并要求分析图像时，使用参数: {"images": ["https://...", "./chart.png"]})
+- REPORT: 根据分析数据生成格式化报告 (可选参数: {"style": "brief|executive|deep|bullet"})
 - PODCAST: 根据报告生成播客脚本 (TaskType: PODCAST)
 - PPT: 根据报告生成幻灯片 (HTML) (TaskType: PPT)
-- RENDER: 将 Markdown 内容渲染为终端友好的格式
+- CHART: 根据数据生成图表图片，返回可嵌入报告的 Markdown 图片 (参数: {"chart_type": "bar|line|pie"})
+- EXTRACT: 从收集到的信息中提取数值和表格数据，整理为结构化表格 (可选参数: {"schema": "年份, 营收 (亿元), 同比增长 (%)"})
+- EXPORT: 将报告导出为文档文件 (参数: {"format": "docx|pdf"})
+- EMAIL: 通过邮件发送报告，并附带之前导出的文件 (参数: {"to": ["x@y.com"], "subject": "..."})
+- RENDER: 将 Markdown 内容渲染为终端友好的格式` + a.knowledgePrompt() + a.ensemblePrompt() + a.offlinePrompt() + `
 
 对于给定的用户请求，创建一个包含任务序列的计划。
 每个任务应包含：
-- type: SEARCH, ANALYZE, REPORT, PODCAST, PPT, 或 RENDER 之一
+- id: 任务在计划中的唯一标识，由小写类型名和序号组成 (例如 "search1", "analyze1")
+- type: SEARCH, ANALYZE, REPORT, PODCAST, PPT, CHART, EXTRACT, EXPORT, EMAIL, 或 RENDER 之一
 - description:  Subagent 应该做什么
-- parameters: 任务的可选参数 (例如: {"query": "搜索词"})
+- parameters: 任务的可选参数 (例如: {"query": "搜索词"})；任何任务都可以设置 "timeout_seconds" 限制执行时间
+- inputs: 可选，该任务需要其输出的之前任务的 id 列表 (例如 ["search1", "analyze1"])；省略时按任务类型自动选择之前任务的输出
+- checkpoint: 可选，为 true 时在执行该任务前暂停并请求用户确认 (适用于耗时或昂贵的步骤)
 
 重要提示：
+- 当用户只需要链接或来源列表 (例如 "给我几个关于X的链接") 时，计划只包含一个参数为 {"mode": "links"} 的 SEARCH 任务和一个 RENDER 任务，不要包含 ANALYZE 或 REPORT。
+- 当用户要求比较多个对象 (例如 "比较 X 和 Y") 时，ANALYZE 任务使用 compare 模式，它会为每个对象自动追加搜索。
+- 当计划包含多个分支 (例如分别搜索和分析不同的子主题) 时，为每个任务设置 inputs，使其只接收所需分支的输出。
 - 仅在用户明确请求播客时包含 PODCAST 任务。
 - 仅在用户明确请求幻灯片或演示文稿时包含 PPT 任务。
-- 在 REPORT 任务之后始终包含 RENDER 任务，以生成最终的文本报告。
+- 根据用户意图为 REPORT 设置 style: "一句话总结" 等极简请求使用 brief，管理层摘要使用 executive，要点列举使用 bullet，深入研究使用 deep；未明确要求时省略 style，生成默认的完整报告。
+- 当报告涉及可量化的数据时，可以在 REPORT 任务之前包含 CHART 任务，以便报告嵌入图表。
+- 对于财务、统计等依赖精确数字的请求，在 SEARCH 之后、CHART 和 REPORT 之前包含 EXTRACT 任务；已知需要的指标时在 "schema" 中列出列名。
+- 仅在用户要求导出文档时包含 EXPORT 任务 (例如 "导出为Word" 使用 {"format": "docx"}，"导出为PDF" 使用 {"format": "pdf"})，放在 REPORT 任务之后。
+- 仅在用户要求发送报告 (例如 "生成报告并发送到 x@y.com") 时包含 EMAIL 任务，放在 REPORT 及 EXPORT/PPT 任务之后，并在 "to" 中填写用户给出的邮箱地址。
+` + renderRule(a.config.FinalFormat) + `
 
 仅返回具有此结构的有效 JSON 对象：
 {
   "description": "总体计划描述",
+  "topic": "请求的主题 (例如 \"量子计算\")，在任务描述和参数中保持原样使用",
   "tasks": [
-    {"type": "SEARCH", "description": "...", "parameters": {"query": "..."}},
-    {"type": "ANALYZE", "description": "..."},
-    {"type": "REPORT", "description": "..."},
-    {"type": "PPT", "description": "根据报告生成幻灯片"},
-    {"type": "RENDER", "description": "渲染报告"}
+    {"id": "search1", "type": "SEARCH", "description": "...", "parameters": {"query": "..."}},
+    {"id": "analyze1", "type": "ANALYZE", "description": "...", "inputs": ["search1"]},
+    {"id": "report1", "type": "REPORT", "description": "...", "inputs": ["analyze1"]},
+    {"id": "ppt1", "type": "PPT", "description": "根据报告生成幻灯片", "inputs": ["report1"]},
+    {"id": "render1", "type": "RENDER", "description": "渲染报告", "inputs": ["report1"]}
   ]
 }
 
-保持计划简单且重点突出。通常 3-5 个任务就足够了。`
-
-	// Inject global context from history
-	var globalContextBuilder strings.Builder
-	for _, msg := range a.messages {
-		if msg.Role == openai.ChatMessageRoleDeveloper {
-			globalContextBuilder.WriteString(fmt.Sprintf("User: %s\n", msg.Content))
-		}
+` + a.config.Planner.prompt()
+	if override := a.config.Prompts[PromptPlanner]; override != "" {
+		systemPrompt = override
 	}
 
-	if globalContextBuilder.Len() > 0 {
-		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContextBuilder.String()
+	// Inject global context from history
+	if globalContext := a.limitedGlobalContext(a.config.PlannerHistoryLimit); globalContext != "" {
+		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContext
 	}
 
 	messages := []openai.ChatCompletionMessage{
@@ -127,39 +667,111 @@ func (a *PlanningAgent) Plan(ctx context.Context, userRequest string) (*Plan, er
 		},
 	}
 
+	// Few-shot examples of the user's preferred decompositions
+	messages = append(messages, a.examples...)
+
 	messages = append(messages, openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
-		Content: fmt.Sprintf("为该请求创建计划：%s", userRequest),
+		Content: request,
 	})
 
 	req := openai.ChatCompletionRequest{
-		Model:       a.config.Model,
 		Messages:    messages,
 		Temperature: 0,
 	}
+	// Prefer tool calling, then JSON mode, then parsing JSON out of the text
+	switch {
+	case a.config.Capabilities.Tools:
+		req.Tools = []openai.Tool{planTool}
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: planTool.Function.Name},
+		}
+	case a.config.Capabilities.JSONMode:
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
 
-	resp, err := a.client.CreateChatCompletion(ctx, req)
+	// Try the primary model, then the fallback model, each plannerAttempts times
+	models := []string{a.config.Model}
+	if a.config.FallbackModel != "" && a.config.FallbackModel != a.config.Model {
+		models = append(models, a.config.FallbackModel)
+	}
+	var plan, short *Plan
+	var err error
+	var planModel, shortModel string
+attempts:
+	for _, model := range models {
+		if model != a.config.Model {
+			a.warn(fmt.Sprintf("⚠️ 主模型规划失败，切换到备用模型 %s", model))
+		}
+		req.Model = model
+		for attempt := 1; attempt <= plannerAttempts; attempt++ {
+			plan, err = a.requestPlan(ctx, req)
+			if err == nil && len(plan.Tasks) < a.config.Planner.MinTasks {
+				err = fmt.Errorf("计划只有 %d 个任务，少于最少 %d 个", len(plan.Tasks), a.config.Planner.MinTasks)
+				if short == nil {
+					req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+						Role:    openai.ChatMessageRoleUser,
+						Content: fmt.Sprintf("上一个计划的任务太少。请更充分地分解请求，返回至少包含 %d 个任务的完整计划。", a.config.Planner.MinTasks),
+					})
+				}
+				short, shortModel = plan, model
+			} else if err == nil {
+				planModel = model
+				break attempts
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			a.warn(fmt.Sprintf("⚠️ 规划失败 (模型 %s, 第 %d/%d 次): %v", model, attempt, plannerAttempts, err))
+		}
+	}
+	if err != nil && short != nil {
+		// A short plan is better than none
+		plan, planModel, err = short, shortModel, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create plan: %w", err)
+		return nil, err
 	}
 
-	content := resp.Choices[0].Message.Content
+	a.validatePlan(plan)
 
-	// Clean up the content if it contains markdown code blocks
-	if len(content) > 0 {
-		// Remove ```json prefix if present
-		if idx := strings.Index(content, "```json"); idx != -1 {
-			content = content[idx+7:]
-		} else if idx := strings.Index(content, "```"); idx != -1 {
-			content = content[idx+3:]
+	if a.config.Verbose {
+		fmt.Printf("📋 计划 (模型: %s): %s\n", planModel, plan.Description)
+		for i, task := range plan.Tasks {
+			fmt.Printf("  %d. [%s] %s\n", i+1, task.Type, task.Description)
 		}
+		fmt.Println()
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(fmt.Sprintf("📋 计划已生成 (模型: %s): %s", planModel, plan.Description))
+	}
 
-		// Remove closing ``` if present
-		if idx := strings.LastIndex(content, "```"); idx != -1 {
-			content = content[:idx]
-		}
+	return plan, nil
+}
+
+// plannerAttempts is how many times Plan asks each model for a plan.
+const plannerAttempts = 2
+
+// requestPlan sends one planning request and parses the plan from the reply.
+func (a *PlanningAgent) requestPlan(ctx context.Context, req openai.ChatCompletionRequest) (*Plan, error) {
+	resp, err := a.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create plan: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("failed to create plan: empty response")
+	}
 
-		content = strings.TrimSpace(content)
+	// Prefer the structured tool call arguments; fall back to the message text
+	// for endpoints that ignore tools or answer in plain content.
+	message := resp.Choices[0].Message
+	content := stripCodeFence(message.Content)
+	for _, call := range message.ToolCalls {
+		if call.Function.Name == planTool.Function.Name {
+			content = call.Function.Arguments
+			break
+		}
 	}
 
 	// Parse the JSON response
@@ -167,19 +779,315 @@ func (a *PlanningAgent) Plan(ctx context.Context, userRequest string) (*Plan, er
 	if err := json.Unmarshal([]byte(content), &plan); err != nil {
 		return nil, fmt.Errorf("failed to parse plan JSON: %w\nResponse: %s", err, content)
 	}
+	return &plan, nil
+}
 
-	if a.config.Verbose {
-		fmt.Printf("📋 计划: %s\n", plan.Description)
-		for i, task := range plan.Tasks {
-			fmt.Printf("  %d. [%s] %s\n", i+1, task.Type, task.Description)
+// planTool is the function schema used when the planner runs with tool calling.
+var planTool = openai.Tool{
+	Type: openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{
+		Name:        "create_plan",
+		Description: "Create a plan of subtasks for the user request",
+		Parameters: jsonschema.Definition{
+			Type: jsonschema.Object,
+			Properties: map[string]jsonschema.Definition{
+				"description": {
+					Type:        jsonschema.String,
+					Description: "Overall plan description",
+				},
+				"topic": {
+					Type:        jsonschema.String,
+					Description: "Main subject of the request, used verbatim in task descriptions and parameters",
+				},
+				"tasks": {
+					Type: jsonschema.Array,
+					Items: &jsonschema.Definition{
+						Type: jsonschema.Object,
+						Properties: map[string]jsonschema.Definition{
+							"id": {
+								Type:        jsonschema.String,
+								Description: "Unique ID of the task in the plan, e.g. \"search1\"",
+							},
+							"type": {
+								Type:        jsonschema.String,
+								Description: "Task type handled by a subagent",
+								Enum: []string{
+									string(TaskTypeSearch), string(TaskTypeAnalyze), string(TaskTypeReport),
+									string(TaskTypeRender), string(TaskTypePodcast), string(TaskTypePPT),
+									string(TaskTypeChart), string(TaskTypeExport), string(TaskTypeEmail),
+									string(TaskTypeRetrieve), string(TaskTypeExtract),
+								},
+							},
+							"description": {
+								Type:        jsonschema.String,
+								Description: "What the subagent should do",
+							},
+							"parameters": {
+								Type:                 jsonschema.Object,
+								Description:          "Optional task parameters, e.g. {\"query\": \"...\"}",
+								AdditionalProperties: true,
+							},
+							"inputs": {
+								Type:        jsonschema.Array,
+								Items:       &jsonschema.Definition{Type: jsonschema.String},
+								Description: "IDs of the earlier tasks whose outputs this task needs; omit to select them by task type",
+							},
+							"checkpoint": {
+								Type:        jsonschema.Boolean,
+								Description: "Pause for user confirmation before this task",
+							},
+						},
+						Required: []string{"type", "description"},
+					},
+				},
+			},
+			Required: []string{"description", "tasks"},
+		},
+	},
+}
+
+// stripCodeFence removes a surrounding markdown code block (```json ... ```) if present.
+func stripCodeFence(content string) string {
+	if idx := strings.Index(content, "```json"); idx != -1 {
+		content = content[idx+7:]
+	} else if idx := strings.Index(content, "```"); idx != -1 {
+		content = content[idx+3:]
+	}
+	if idx := strings.LastIndex(content, "```"); idx != -1 {
+		content = content[:idx]
+	}
+	return strings.TrimSpace(content)
+}
+
+// defaultJSONRepairs is how many times invalid JSON output is sent back to
+// the model for correction when a config leaves MaxRepairs at zero.
+const defaultJSONRepairs = 2
+
+// jsonRepairs returns the number of corrections for a MaxRepairs setting:
+// zero means defaultJSONRepairs and a negative value none.
+func jsonRepairs(maxRepairs int) int {
+	switch {
+	case maxRepairs == 0:
+		return defaultJSONRepairs
+	case maxRepairs < 0:
+		return 0
+	}
+	return maxRepairs
+}
+
+// jsonArrayHint asks for the JSON array of a prompt wrapped in an object
+// under key, since response_format only allows objects in JSON mode.
+func jsonArrayHint(key string) string {
+	return fmt.Sprintf("\n\n将上述 JSON 数组放在一个 JSON 对象的 %q 字段中输出，例如 {%q: [...]}。", key, key)
+}
+
+// unwrapJSONArray strips a code fence from content and, if it is a JSON
+// object, returns the array under key, so array replies parse with or
+// without JSON mode.
+func unwrapJSONArray(content, key string) string {
+	content = stripCodeFence(content)
+	if !strings.HasPrefix(content, "{") {
+		return content
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &obj); err != nil {
+		return content
+	}
+	if array, ok := obj[key]; ok {
+		return string(array)
+	}
+	return content
+}
+
+// knowledgePrompt describes RETRIEVE to the planner if a knowledge base is
+// configured.
+func (a *PlanningAgent) knowledgePrompt() string {
+	if _, ok := a.subagents[TaskTypeRetrieve]; !ok {
+		return ""
+	}
+	return `
+- RETRIEVE: 在用户自己的知识库 (已索引的本地文档) 中检索相关内容 (参数: {"query": "...", "top_k": 4})
+
+已配置知识库：当请求可能涉及用户自己的文档、项目或内部资料时，在 SEARCH 之前或与其并列包含 RETRIEVE 任务，ANALYZE 会同时使用两者的结果；仅当用户明确只需要知识库内容时可以省略 SEARCH。`
+}
+
+// offlinePrompt tells the planner not to search when web search is
+// disabled.
+func (a *PlanningAgent) offlinePrompt() string {
+	if !a.config.DisableWebSearch {
+		return ""
+	}
+	return `
+
+网络搜索已禁用：不要创建 SEARCH 任务，ANALYZE 也不要使用 compare 模式。仅基于知识库 (RETRIEVE，如已配置)、用户提供的内容和模型已有的知识完成请求。`
+}
+
+// ensemblePrompt describes the "ensemble" ANALYZE parameter to the planner
+// when ensembles are configured but not used for every analysis.
+func (a *PlanningAgent) ensemblePrompt() string {
+	if len(a.config.Ensemble.Models) < 2 || a.config.Ensemble.Enabled {
+		return ""
+	}
+	return `
+
+已配置多模型集成分析：对于高风险或需要谨慎判断的分析 (例如医疗、法律、投资决策)，为 ANALYZE 任务设置参数 {"ensemble": true}，由多个模型独立分析后综合并标出分歧。`
+}
+
+// renderRule is the planner instruction about RENDER tasks for format.
+func renderRule(format FinalFormat) string {
+	if format.rendered() {
+		return "- 在 REPORT 任务之后始终包含 RENDER 任务，以生成最终的文本报告。"
+	}
+	return "- 不要包含 RENDER 任务，报告的 Markdown 将直接返回给调用方。"
+}
+
+// validatePlan drops tasks with disallowed or unknown types and truncates
+// plans longer than MaxTasks or Planner.MaxTasks, logging a warning for
+// each adjustment. RENDER tasks are dropped if the final format does not
+// need them.
+func (a *PlanningAgent) validatePlan(plan *Plan) {
+	allowed := make(map[TaskType]bool, len(a.config.AllowedTaskTypes))
+	for _, t := range a.config.AllowedTaskTypes {
+		allowed[t] = true
+	}
+
+	tasks := make([]Task, 0, len(plan.Tasks))
+	for _, task := range plan.Tasks {
+		if task.Type == TaskTypeRender && !a.config.FinalFormat.rendered() {
+			if a.interactionHandler != nil {
+				a.interactionHandler.Log(fmt.Sprintf("已跳过 RENDER 任务，最终格式为 %s", a.config.FinalFormat))
+			}
+			continue
 		}
-		fmt.Println()
+		if task.Type == TaskTypeSearch && a.config.DisableWebSearch {
+			a.warn(fmt.Sprintf("⚠️ 网络搜索已禁用，已移除搜索任务: %s", task.Description))
+			continue
+		}
+		_, registered := a.subagents[task.Type]
+		if !registered || (len(allowed) > 0 && !allowed[task.Type]) {
+			a.warn(fmt.Sprintf("⚠️ 已移除不允许的任务类型: [%s] %s", task.Type, task.Description))
+			continue
+		}
+		tasks = append(tasks, task)
 	}
-	if a.interactionHandler != nil {
-		a.interactionHandler.Log(fmt.Sprintf("📋 计划已生成: %s", plan.Description))
+
+	if len(allowed) == 0 || allowed[TaskTypeReport] {
+		tasks = a.ensureReport(tasks)
 	}
 
-	return &plan, nil
+	maxTasks := a.config.MaxTasks
+	if m := a.config.Planner.MaxTasks; m > 0 && (maxTasks == 0 || m < maxTasks) {
+		maxTasks = m
+	}
+	if maxTasks > 0 && len(tasks) > maxTasks {
+		a.warn(fmt.Sprintf("⚠️ 计划包含 %d 个任务，已截断为 %d 个", len(tasks), maxTasks))
+		tasks = tasks[:maxTasks]
+	}
+
+	plan.Tasks = a.validateInputs(tasks)
+}
+
+// validateInputs drops duplicate task IDs and the inputs that do not name
+// an earlier task, e.g. one removed by validatePlan, logging a warning for
+// each.
+func (a *PlanningAgent) validateInputs(tasks []Task) []Task {
+	earlier := make(map[string]bool, len(tasks))
+	for i, task := range tasks {
+		if task.ID != "" && earlier[task.ID] {
+			a.warn(fmt.Sprintf("⚠️ 任务 ID %q 重复，已移除 [%s] %s 的 ID", task.ID, task.Type, task.Description))
+			task.ID = ""
+		}
+		var inputs []string
+		for _, id := range task.Inputs {
+			if earlier[id] {
+				inputs = append(inputs, id)
+			} else {
+				a.warn(fmt.Sprintf("⚠️ [%s] %s 的输入 %q 不是之前的任务，已忽略", task.Type, task.Description, id))
+			}
+		}
+		task.Inputs = inputs
+		if task.ID != "" {
+			earlier[task.ID] = true
+		}
+		tasks[i] = task
+	}
+	return tasks
+}
+
+// needsReport reports whether task works on the report of an earlier
+// REPORT task. Tasks given their content and the RENDER task of a links
+// search, which renders the links, do not need one.
+func needsReport(task Task, earlier []Task) bool {
+	switch task.Type {
+	case TaskTypePPT, TaskTypePodcast:
+		return !task.HasParam("content")
+	case TaskTypeRender:
+		for _, t := range earlier {
+			if t.Type == TaskTypeSearch && t.StringParam("mode") == "links" {
+				return false
+			}
+		}
+		return !task.HasParam("content")
+	}
+	return false
+}
+
+// ensureReport applies the report rule to tasks, so PPT, PODCAST and
+// RENDER tasks do not fall back to their descriptions for lack of a report.
+func (a *PlanningAgent) ensureReport(tasks []Task) []Task {
+	if a.config.ReportRule == ReportRuleOff {
+		return tasks
+	}
+
+	first := -1
+	for i, task := range tasks {
+		if task.Type == TaskTypeReport {
+			return tasks
+		}
+		if needsReport(task, tasks[:i]) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return tasks
+	}
+
+	fixed := make([]Task, 0, len(tasks)+1)
+	fixed = append(fixed, tasks[:first]...)
+	report := -1
+	for i := first + 1; i < len(tasks); i++ {
+		if tasks[i].Type == TaskTypeReport {
+			report = i
+			break
+		}
+	}
+	switch {
+	case report >= 0:
+		a.warn(fmt.Sprintf("⚠️ [%s] 任务需要报告，已将 REPORT 任务移到它之前", tasks[first].Type))
+		fixed = append(fixed, tasks[report])
+	case a.config.ReportRule == ReportRuleAuto:
+		a.warn(fmt.Sprintf("⚠️ [%s] 任务需要报告，已在它之前插入 REPORT 任务", tasks[first].Type))
+		fixed = append(fixed, Task{Type: TaskTypeReport, Description: "根据收集和分析的信息撰写报告"})
+	default:
+		return tasks
+	}
+	for i := first; i < len(tasks); i++ {
+		if i != report {
+			fixed = append(fixed, tasks[i])
+		}
+	}
+	return fixed
+}
+
+// warn reports a warning to the terminal (in verbose mode) and the user interface.
+func (a *PlanningAgent) warn(message string) {
+	if a.config.Verbose {
+		fmt.Println(message)
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(message)
+	}
 }
 
 // PlanWithReview creates a plan and optionally allows the user to review and modify it.
@@ -207,23 +1115,106 @@ func (a *PlanningAgent) PlanWithReview(ctx context.Context, userRequest string)
 			break
 		}
 
-		// Re-plan with the user's modification
+		// Revise the current plan with the user's modification
 		if a.config.Verbose {
-			fmt.Printf("🔄 根据用户反馈重新规划: %s\n\n", modification)
+			fmt.Printf("🔄 根据用户反馈修改计划: %s\n\n", modification)
 		}
-		a.interactionHandler.Log(fmt.Sprintf("🔄 根据用户反馈重新规划: %s", modification))
+		a.interactionHandler.Log(fmt.Sprintf("🔄 根据用户反馈修改计划: %s", modification))
 
-		plan, err = a.Plan(ctx, modification)
+		plan, err = a.RevisePlan(ctx, userRequest, plan, modification)
 		if err != nil {
 			return nil, fmt.Errorf("re-planning failed: %w", err)
 		}
 	}
 
+	if a.config.Checkpoints {
+		addCheckpoints(plan)
+	}
+
 	return plan, nil
 }
 
+// addCheckpoints marks the PPT and PODCAST tasks of plan as checkpoints.
+func addCheckpoints(plan *Plan) {
+	for i := range plan.Tasks {
+		switch plan.Tasks[i].Type {
+		case TaskTypePPT, TaskTypePodcast:
+			plan.Tasks[i].Checkpoint = true
+		}
+	}
+}
+
 // Execute runs the plan by executing each task with the appropriate subagent.
+// The tasks and results are kept so single tasks can be re-run with Retry.
+// When a subagent fails with an error, Execute stops and returns the results
+// so far, ending with the failed one, and a *TaskError.
 func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, error) {
+	state := &runState{scratchpad: NewScratchpad()}
+	results, err := a.execute(ctx, plan, state)
+	if results != nil {
+		// results[i] is the result of plan.Tasks[i]
+		tasks := make([]Task, len(results))
+		for i := range results {
+			tasks[i] = requeuedTask(plan.Tasks[i])
+		}
+		a.mu.Lock()
+		a.lastTasks, a.lastResults, a.scratchpad = tasks, results, state.scratchpad
+		a.mu.Unlock()
+	}
+	return results, err
+}
+
+// Scratchpad returns the scratchpad shared by the tasks of the last executed
+// plan, or nil if no plan was executed.
+func (a *PlanningAgent) Scratchpad() *Scratchpad {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.scratchpad
+}
+
+// Retry re-runs the last task of type taskType from the last executed plan,
+// reusing the outputs of the tasks before it instead of running them again.
+// The new result replaces the old one, so later retries build on it.
+func (a *PlanningAgent) Retry(ctx context.Context, taskType TaskType) ([]Result, error) {
+	a.mu.RLock()
+	tasks, lastResults, scratchpad := a.lastTasks, a.lastResults, a.scratchpad
+	a.mu.RUnlock()
+
+	index := -1
+	for i, task := range tasks {
+		if task.Type == taskType {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("no %s task in the last plan", taskType)
+	}
+
+	// The scratchpad keeps the values of every task of the last run, so the
+	// retried task sees what its predecessors stored
+	state := &runState{scratchpad: scratchpad}
+	for i := 0; i < index; i++ {
+		if lastResults[i].Success {
+			state.add(tasks[i], lastResults[i])
+		}
+	}
+
+	task := requeuedTask(tasks[index])
+	results, err := a.execute(ctx, &Plan{Description: "Retry " + string(taskType), Tasks: []Task{task}}, state)
+	if err == nil && len(results) > 0 {
+		a.mu.Lock()
+		if len(a.lastResults) == len(lastResults) {
+			updated := append([]Result(nil), a.lastResults...)
+			updated[index] = results[0]
+			a.lastResults = updated
+		}
+		a.mu.Unlock()
+	}
+	return results, err
+}
+
+// execute runs the tasks of plan, starting from the outputs in state.
+func (a *PlanningAgent) execute(ctx context.Context, plan *Plan, state *runState) ([]Result, error) {
 	if a.config.Verbose {
 		fmt.Println("🔍 正在执行计划...")
 		fmt.Println()
@@ -231,12 +1222,30 @@ func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, erro
 
 	results := make([]Result, 0, len(plan.Tasks))
 
-	var contextData []string
+	startCost := a.usage.snapshot().CostUSD
+
+	contextRules := a.config.ContextRules
+	if contextRules == nil {
+		contextRules = DefaultContextRules
+	}
+
+	language := ""
+	if a.config.Language != "" {
+		language = resolveLanguage(a.config.Language, a.lastUserRequest())
+	}
+
+	tracePath := filepath.Join(a.config.OutputDir, "traces", fmt.Sprintf("trace_%d.jsonl", time.Now().UnixNano()))
 
 	// Use a loop index that can be modified to support dynamic task insertion
 	for i := 0; i < len(plan.Tasks); i++ {
 		task := plan.Tasks[i]
 
+		// Stop once the run is canceled, even if the last subagent swallowed
+		// the error of its context
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("plan canceled before task %d: %w", i+1, err)
+		}
+
 		if a.config.Verbose {
 			fmt.Printf("📍 步骤 %d/%d: [%s] %s\n", i+1, len(plan.Tasks), task.Type, task.Description)
 		}
@@ -244,29 +1253,67 @@ func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, erro
 			a.interactionHandler.Log(fmt.Sprintf("📍 步骤 %d/%d: [%s] %s", i+1, len(plan.Tasks), task.Type, task.Description))
 		}
 
+		// Stop before a task that would likely exceed the budget
+		if a.config.MaxCostUSD > 0 && i > 0 {
+			spent := a.usage.snapshot().CostUSD - startCost
+			if projected := spent + spent/float64(i); projected > a.config.MaxCostUSD {
+				a.warn(fmt.Sprintf("💰 预计成本 $%.4f 将超出预算 $%.4f，已停止执行 (完成 %d/%d 个任务)", projected, a.config.MaxCostUSD, i, len(plan.Tasks)))
+				return results, fmt.Errorf("%w: spent $%.4f of $%.4f after %d tasks", ErrBudgetExceeded, spent, a.config.MaxCostUSD, i)
+			}
+		}
+
+		// Pause at checkpoints until the user confirms
+		if task.Checkpoint && a.interactionHandler != nil {
+			approved, err := a.interactionHandler.ConfirmAction(
+				fmt.Sprintf("检查点: 是否继续执行步骤 %d/%d [%s] %s", i+1, len(plan.Tasks), task.Type, task.Description),
+				map[string]interface{}{
+					"checkpoint": true,
+					"step":       i + 1,
+					"task_type":  string(task.Type),
+				})
+			if err != nil {
+				return nil, fmt.Errorf("checkpoint confirmation failed: %w", err)
+			}
+			if !approved {
+				if a.config.Verbose {
+					fmt.Printf("⏸️  已在检查点停止执行 (完成 %d/%d 个任务)\n", i, len(plan.Tasks))
+				}
+				a.interactionHandler.Log(fmt.Sprintf("⏸️ 已在检查点停止执行 (完成 %d/%d 个任务)", i, len(plan.Tasks)))
+				return results, nil
+			}
+		}
+
 		// Inject global context from history
 		if task.Parameters == nil {
 			task.Parameters = make(map[string]interface{})
 		}
-		var globalContextBuilder strings.Builder
-		for _, msg := range a.messages {
-			if msg.Role == openai.ChatMessageRoleUser {
-				globalContextBuilder.WriteString(fmt.Sprintf("User: %s\n", msg.Content))
-			}
+		task.Parameters["global_context"] = a.globalContext()
+		if _, ok := task.Parameters["language"]; !ok && language != "" {
+			task.Parameters["language"] = language
+		}
+		if len(state.sources) > 0 {
+			task.Parameters["sources"] = append([]tool.SearchResult(nil), state.sources...)
+		}
+		if len(state.files) > 0 {
+			task.Parameters[FilesKey] = append([]string(nil), state.files...)
+		}
+		if state.scratchpad != nil {
+			task.Parameters[ScratchpadKey] = state.scratchpad
+		}
+		if state.noSources() {
+			task.Parameters[noSourcesKey] = true
+		} else {
+			delete(task.Parameters, noSourcesKey)
 		}
-		task.Parameters["global_context"] = globalContextBuilder.String()
 
-		// Inject context from previous tasks
-		if len(contextData) > 0 {
-			if task.Parameters == nil {
-				task.Parameters = make(map[string]interface{})
-			}
-			// If context already exists in parameters, append to it
-			if existingContext, ok := task.Parameters["context"].([]string); ok {
-				task.Parameters["context"] = append(existingContext, contextData...)
-			} else {
-				task.Parameters["context"] = contextData
-			}
+		// Inject the outputs of the declared inputs, or else the relevant
+		// context from previous tasks
+		outputs := selectInputs(state.outputs, task.Inputs)
+		if len(outputs) == 0 {
+			outputs = selectContext(state.outputs, task.Type, contextRules)
+		}
+		if len(outputs) > 0 {
+			task.Parameters[OutputsKey] = append(taskOutputs(task), outputs...)
 		}
 
 		subagent, ok := a.subagents[task.Type]
@@ -274,9 +1321,38 @@ func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, erro
 			return nil, fmt.Errorf("unknown task type: %s", task.Type)
 		}
 
-		result, err := subagent.Execute(ctx, task)
+		taskCtx, cancel := ctx, context.CancelFunc(func() {})
+		timeout := taskTimeout(task)
+		if timeout > 0 {
+			taskCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		taskCtx = withHeartbeatTarget(taskCtx, a.interactionHandler, task.Type)
+		var trace *taskTrace
+		if a.config.Trace {
+			taskCtx, trace = withTrace(taskCtx)
+		}
+		result, err := subagent.Execute(taskCtx, task)
+		timedOut := errors.Is(taskCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+		cancel()
+
+		if timedOut {
+			result = Result{
+				TaskType:  task.Type,
+				Success:   false,
+				Error:     fmt.Sprintf("任务超时 (%s)", timeout),
+				ErrorKind: ErrTimeout,
+			}
+			err = nil
+			if a.config.AbortOnTimeout {
+				err = fmt.Errorf("timed out after %s: %w", timeout, context.DeadlineExceeded)
+			}
+		}
+		if trace != nil {
+			a.recordTrace(tracePath, task, &result, trace.list())
+		}
 		if err != nil {
-			return nil, fmt.Errorf("task %d failed: %w", i+1, err)
+			result = failedResult(task, result, err)
+			return append(results, result), &TaskError{Index: i + 1, Result: result, Err: err}
 		}
 
 		results = append(results, result)
@@ -294,12 +1370,13 @@ func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, erro
 				// Insert new tasks at the current position + 1
 				// We need to create a new slice to avoid modifying the original plan array in place if it was smaller
 				// But here plan.Tasks is a slice, so we can use append tricks
+				newTasks := linkNewTasks(plan.Tasks, task, result.NewTasks)
 				rear := append([]Task{}, plan.Tasks[i+1:]...)
-				plan.Tasks = append(plan.Tasks[:i+1], append(result.NewTasks, rear...)...)
+				plan.Tasks = append(plan.Tasks[:i+1], append(newTasks, rear...)...)
 			}
 
-			// Accumulate output for next tasks
-			contextData = append(contextData, fmt.Sprintf("Output from %s task:\n%s", task.Type, result.Output))
+			// Accumulate output and sources for next tasks
+			state.add(task, result)
 
 			if a.config.Verbose {
 				fmt.Printf("  ✓ 完成\n\n")
@@ -320,86 +1397,342 @@ func (a *PlanningAgent) Execute(ctx context.Context, plan *Plan) ([]Result, erro
 	return results, nil
 }
 
-// Run is the main entry point that plans and executes a user request.
-func (a *PlanningAgent) Run(ctx context.Context, userRequest string) (string, error) {
-	// Create a plan
-	plan, err := a.Plan(ctx, userRequest)
-	if err != nil {
-		return "", err
+// recordTrace adds the API calls of a task to its result and the trace file.
+func (a *PlanningAgent) recordTrace(path string, task Task, result *Result, entries []TraceEntry) {
+	if result.Metadata == nil {
+		result.Metadata = make(map[string]interface{})
 	}
+	result.Metadata["trace"] = entries
+	if err := writeTrace(path, task, entries); err != nil {
+		a.warn(fmt.Sprintf("⚠️ 写入跟踪日志失败: %v", err))
+	}
+}
 
-	// Execute the plan
-	results, err := a.Execute(ctx, plan)
-	if err != nil {
-		return "", err
+// taskTimeout returns the duration from the task's "timeout_seconds"
+// parameter, or zero if it is unset or invalid.
+func taskTimeout(task Task) time.Duration {
+	seconds := task.FloatParam("timeout_seconds")
+	if seconds <= 0 {
+		return 0
 	}
+	return time.Duration(seconds * float64(time.Second))
+}
 
-	// Extract the final output (typically from the RENDER or REPORT task)
-	var finalOutput string
-	for i := len(results) - 1; i >= 0; i-- {
-		if (results[i].TaskType == TaskTypeRender || results[i].TaskType == TaskTypeReport) && results[i].Success {
-			finalOutput = results[i].Output
+// RunOutput collects the artifacts produced by executing a plan.
+type RunOutput struct {
+	// Report is the final rendered report, or the concatenated task
+	// outputs when the plan produced no report.
+	Report string
+	// ReportPages holds every page of a paginated report; Report is the
+	// first. Nil when the report was not paginated.
+	ReportPages   []string
+	PodcastScript []DialogueLine
+	PPTUrl        string
+	// PPTSourceZip is the URL of the zipped presentation source, if any.
+	PPTSourceZip string
+	Results      []Result
+	// Manifest lists the files produced by the run. It is only set by
+	// PlanningAgent.Output, which knows the output directory.
+	Manifest *Manifest
+}
+
+// NewRunOutput extracts the report, podcast script and PPT URL from results
+// with OutputPreferRender. The last successful result of each kind wins.
+func NewRunOutput(results []Result) *RunOutput {
+	return newRunOutput(results, OutputPreferRender)
+}
+
+// Output extracts the artifacts of results like NewRunOutput, selecting the
+// report with the configured output strategy.
+func (a *PlanningAgent) Output(results []Result) *RunOutput {
+	out := newRunOutput(results, a.config.OutputStrategy)
+	out.Manifest = newManifest(results, a.config.OutputDir)
+	return out
+}
+
+// FinalOutput returns the final output of results selected with the
+// configured output strategy.
+func (a *PlanningAgent) FinalOutput(results []Result) string {
+	return a.Output(results).Report
+}
+
+func newRunOutput(results []Result, strategy OutputStrategy) *RunOutput {
+	out := &RunOutput{Results: results}
+
+	var preferred []TaskType
+	switch strategy {
+	case OutputPreferReport:
+		preferred = []TaskType{TaskTypeReport, TaskTypeRender}
+	case OutputConcatenateAll:
+	default:
+		preferred = []TaskType{TaskTypeRender, TaskTypeReport}
+	}
+	for _, taskType := range preferred {
+		if result, ok := lastResult(results, taskType); ok {
+			out.Report = result.Output
+			out.ReportPages, _ = result.Metadata["pages"].([]string)
 			break
 		}
 	}
 
-	// If no report was generated, concatenate all outputs
-	if finalOutput == "" {
+	for i := len(results) - 1; i >= 0; i-- {
+		result := results[i]
+		if !result.Success {
+			continue
+		}
+		switch result.TaskType {
+		case TaskTypePodcast:
+			if script, ok := result.Metadata["script"].([]DialogueLine); ok && out.PodcastScript == nil {
+				out.PodcastScript = script
+			}
+		case TaskTypePPT:
+			if url, ok := result.Metadata["ppt_url"].(string); ok && out.PPTUrl == "" {
+				out.PPTUrl = url
+			}
+			if zip, ok := result.Metadata["source_zip"].(string); ok && out.PPTSourceZip == "" {
+				out.PPTSourceZip = zip
+			}
+		}
+	}
+
+	// If no report was generated or wanted, concatenate all outputs
+	if out.Report == "" {
 		for _, result := range results {
 			if result.Success {
-				finalOutput += result.Output + "\n\n"
+				out.Report += result.Output + "\n\n"
 			}
 		}
 	}
 
-	return finalOutput, nil
+	return out
+}
+
+// lastResult returns the last successful result of taskType.
+func lastResult(results []Result, taskType TaskType) (Result, bool) {
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].Success && results[i].TaskType == taskType {
+			return results[i], true
+		}
+	}
+	return Result{}, false
+}
+
+// Run is the main entry point that plans and executes a user request.
+// It returns only the final report; use RunFull for all artifacts.
+func (a *PlanningAgent) Run(ctx context.Context, userRequest string) (string, error) {
+	out, err := a.RunFull(ctx, userRequest)
+	if out == nil {
+		return "", err
+	}
+	return out.Report, err
+}
+
+// RunFull plans and executes a user request and returns every artifact.
+func (a *PlanningAgent) RunFull(ctx context.Context, userRequest string) (*RunOutput, error) {
+	// Create a plan
+	plan, err := a.Plan(ctx, userRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Execute the plan; a budget stop still returns the partial output
+	results, err := a.Execute(ctx, plan)
+	if err != nil && !errors.Is(err, ErrBudgetExceeded) {
+		return nil, err
+	}
+
+	out := a.Output(results)
+	if a.config.Manifest {
+		if err := a.SaveManifest(out); err != nil {
+			a.warn(fmt.Sprintf("⚠️ 保存产物清单失败: %v", err))
+		}
+	}
+	return out, err
+}
+
+// Usage returns the token usage and estimated cost of all LLM calls made by
+// the agent and its subagents so far.
+func (a *PlanningAgent) Usage() Usage {
+	return a.usage.snapshot()
 }
 
 // AddUserMessage adds a user message to the conversation history.
 func (a *PlanningAgent) AddUserMessage(content string) {
-	a.messages = append(a.messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: content,
-	})
+	a.appendMessage(openai.ChatMessageRoleUser, content)
 }
 
 // AddDeveloperMessage adds a developer message to the conversation history.
+// Developer messages are standing instructions, such as "answer in
+// English", rather than requests to plan. They reach the planner, the chat
+// and every subagent, and take precedence over the user requests of the
+// conversation, which reach them too unless AgentConfig.ConversationContext
+// says otherwise. The current request itself always decides what is
+// planned.
 func (a *PlanningAgent) AddDeveloperMessage(content string) {
-	a.messages = append(a.messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleDeveloper,
-		Content: content,
-	})
+	a.appendMessage(openai.ChatMessageRoleDeveloper, content)
 }
 
 // AddAssistantMessage adds an assistant message to the conversation history.
 func (a *PlanningAgent) AddAssistantMessage(content string) {
-	a.messages = append(a.messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleAssistant,
-		Content: content,
-	})
+	a.appendMessage(openai.ChatMessageRoleAssistant, content)
 }
 
 // ClearHistory clears the conversation history.
 func (a *PlanningAgent) ClearHistory() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	a.messages = []openai.ChatCompletionMessage{}
 }
 
+// ClearContext removes the context and instructions added with
+// AddDeveloperMessage but keeps the conversation, including the summary of
+// compacted turns.
+func (a *PlanningAgent) ClearContext() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	messages := make([]openai.ChatCompletionMessage, 0, len(a.messages))
+	for _, msg := range a.messages {
+		if msg.Role == openai.ChatMessageRoleDeveloper && !strings.HasPrefix(msg.Content, summaryPrefix) {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	a.messages = messages
+}
+
+// History returns a copy of the conversation history.
+func (a *PlanningAgent) History() []openai.ChatCompletionMessage {
+	return a.history()
+}
+
+func (a *PlanningAgent) appendMessage(role, content string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.messages = append(a.messages, openai.ChatCompletionMessage{
+		Role:    role,
+		Content: content,
+	})
+}
+
+// lastUserRequest returns the content of the latest user message.
+func (a *PlanningAgent) lastUserRequest() string {
+	history := a.history()
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == openai.ChatMessageRoleUser {
+			return history[i].Content
+		}
+	}
+	return ""
+}
+
+// globalContext formats the conversation context selected by
+// AgentConfig.ConversationContext: the developer instructions first, as they
+// take precedence, then the user requests in order. It returns "" if there
+// is none.
+func (a *PlanningAgent) globalContext() string {
+	return a.limitedGlobalContext(0)
+}
+
+// limitedGlobalContext formats the conversation context like globalContext,
+// keeping the developer instructions and as many of the most recent user
+// requests as fit in limit estimated tokens. If the most recent request
+// alone does not fit, it is truncated. Zero means no limit.
+func (a *PlanningAgent) limitedGlobalContext(limit int) string {
+	if a.config.ConversationContext == ContextNone {
+		return ""
+	}
+	var instructions, requests []string
+	for _, msg := range a.history() {
+		switch msg.Role {
+		case openai.ChatMessageRoleDeveloper:
+			instructions = append(instructions, msg.Content)
+		case openai.ChatMessageRoleUser:
+			if a.config.ConversationContext != ContextInstructions {
+				requests = append(requests, msg.Content)
+			}
+		}
+	}
+
+	omitted := 0
+	truncated := false
+	if limit > 0 {
+		// Instructions take precedence, so requests get what they leave
+		budget := limit
+		for _, instruction := range instructions {
+			budget -= estimateTokens([]openai.ChatCompletionMessage{{Content: instruction}})
+		}
+		kept := 0
+		for i := len(requests) - 1; i >= 0; i-- {
+			tokens := estimateTokens([]openai.ChatCompletionMessage{{Content: requests[i]}})
+			if tokens > budget {
+				// Keep what fits of the most recent request beyond the
+				// per-message overhead
+				if kept == 0 && budget > 4 {
+					requests[i] = truncateTokens(requests[i], budget)
+					truncated = true
+					kept++
+				}
+				break
+			}
+			budget -= tokens
+			kept++
+		}
+		omitted = len(requests) - kept
+		requests = requests[omitted:]
+	}
+
+	var sb strings.Builder
+	if len(instructions) > 0 {
+		sb.WriteString("用户指令 (优先于下面的请求，与当前请求冲突时以当前请求为准):\n")
+		for _, instruction := range instructions {
+			sb.WriteString(fmt.Sprintf("- %s\n", instruction))
+		}
+	}
+	if len(requests) > 0 {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("本次对话中用户的请求 (按时间顺序):\n")
+		for _, request := range requests {
+			sb.WriteString(fmt.Sprintf("User: %s\n", request))
+		}
+	}
+	if omitted > 0 || truncated {
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		if omitted > 0 {
+			sb.WriteString(fmt.Sprintf("(已省略更早的 %d 条消息)\n", omitted))
+		}
+		if truncated {
+			sb.WriteString("(最近的请求过长，已截断)\n")
+		}
+	}
+	return sb.String()
+}
+
+// history returns a snapshot of the messages so callers can iterate
+// without holding the lock while a plan runs in another goroutine.
+func (a *PlanningAgent) history() []openai.ChatCompletionMessage {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]openai.ChatCompletionMessage(nil), a.messages...)
+}
+
 // Chat performs a simple chat interaction without planning.
 func (a *PlanningAgent) Chat(ctx context.Context, userRequest string) (string, error) {
 	// Add user message
 	a.AddUserMessage(userRequest)
+	a.maybeCompactHistory(ctx)
 
 	// Inject global context from history
-	var globalContextBuilder strings.Builder
-	for _, msg := range a.messages {
-		if msg.Role == openai.ChatMessageRoleUser {
-			globalContextBuilder.WriteString(fmt.Sprintf("User: %s\n", msg.Content))
-		}
-	}
-
+	history := a.history()
 	systemPrompt := "你是一个乐于助人的助手。"
-	if globalContextBuilder.Len() > 0 {
-		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContextBuilder.String()
+	if override := a.config.Prompts[PromptChat]; override != "" {
+		systemPrompt = override
+	}
+	if globalContext := a.globalContext(); globalContext != "" {
+		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContext
 	}
 
 	messages := []openai.ChatCompletionMessage{
@@ -408,7 +1741,7 @@ func (a *PlanningAgent) Chat(ctx context.Context, userRequest string) (string, e
 			Content: systemPrompt,
 		},
 	}
-	messages = append(messages, a.messages...)
+	messages = append(messages, history...)
 
 	req := openai.ChatCompletionRequest{
 		Model:    a.config.Model,
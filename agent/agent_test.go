@@ -0,0 +1,2618 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/smallnest/aiagents/tool"
+)
+
+// newFakeLLM starts a server that speaks the chat completions API and
+// answers every request with the content returned by reply.
+func newFakeLLM(t *testing.T, reply func(req map[string]interface{}) string) *httptest.Server {
+	t.Helper()
+	return newFakeLLMMessage(t, func(req map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"role":    "assistant",
+			"content": reply(req),
+		}
+	})
+}
+
+// newFakeLLMMessage is like newFakeLLM but lets reply build the whole
+// assistant message, e.g. to return tool calls.
+func newFakeLLMMessage(t *testing.T, reply func(req map[string]interface{}) map[string]interface{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "chat.completion",
+			"choices": []map[string]interface{}{
+				{
+					"index":         0,
+					"finish_reason": "stop",
+					"message":       reply(req),
+				},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newFakeClient returns an OpenAI client talking to srv.
+func newFakeClient(srv *httptest.Server) *openai.Client {
+	config := openai.DefaultConfig("test")
+	config.BaseURL = srv.URL
+	return openai.NewClientWithConfig(config)
+}
+
+// sequentialReplies returns a reply function answering with replies in
+// order, repeating the last one, and a counter of the requests seen.
+func sequentialReplies(replies ...string) (func(map[string]interface{}) string, *int) {
+	var mu sync.Mutex
+	calls := 0
+	return func(map[string]interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		reply := replies[min(calls, len(replies)-1)]
+		calls++
+		return reply
+	}, &calls
+}
+
+func TestConcurrentHistoryAccess(t *testing.T) {
+	srv := newFakeLLM(t, func(map[string]interface{}) string {
+		return `{"description": "test", "tasks": [{"type": "SEARCH", "description": "search"}]}`
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			a.AddUserMessage("hello")
+			a.AddDeveloperMessage("be brief")
+		}()
+		go func() {
+			defer wg.Done()
+			a.AddAssistantMessage("world")
+			if i%5 == 0 {
+				a.ClearHistory()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := a.Plan(context.Background(), "topic"); err != nil {
+				t.Errorf("Plan failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.ClearHistory()
+	a.AddUserMessage("one")
+	a.AddAssistantMessage("two")
+	if got := len(a.History()); got != 2 {
+		t.Errorf("expected 2 messages after clear, got %d", got)
+	}
+}
+
+func TestClearContext(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.AddDeveloperMessage(summaryPrefix + "earlier turns")
+	a.AddDeveloperMessage("answer in English")
+	a.AddUserMessage("go vs rust")
+	a.AddAssistantMessage("report")
+	a.AddDeveloperMessage("be brief")
+
+	a.ClearContext()
+	history := a.History()
+	if len(history) != 3 {
+		t.Fatalf("expected the summary and the conversation to be kept, got %+v", history)
+	}
+	for _, msg := range history[1:] {
+		if msg.Role == openai.ChatMessageRoleDeveloper {
+			t.Errorf("context message kept: %+v", msg)
+		}
+	}
+
+	a.ClearHistory()
+	if len(a.History()) != 0 {
+		t.Errorf("expected an empty history, got %+v", a.History())
+	}
+}
+
+func TestConversationContext(t *testing.T) {
+	var prompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return `{"description": "plan", "tasks": [{"type": "SEARCH", "description": "s"}]}`
+	})
+
+	for _, tc := range []struct {
+		mode                   ContextMode
+		instructions, requests bool
+	}{
+		{"", true, true},
+		{ContextInstructions, true, false},
+		{ContextNone, false, false},
+	} {
+		a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, ConversationContext: tc.mode}, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		a.AddUserMessage("compare go and rust")
+		a.AddAssistantMessage("report")
+		a.AddDeveloperMessage("answer in English")
+		if _, err := a.Plan(context.Background(), "now add python"); err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+
+		if got := strings.Contains(prompt, "- answer in English"); got != tc.instructions {
+			t.Errorf("mode %q: instructions in planner prompt: %v", tc.mode, got)
+		}
+		if got := strings.Contains(prompt, "User: compare go and rust"); got != tc.requests {
+			t.Errorf("mode %q: earlier requests in planner prompt: %v", tc.mode, got)
+		}
+		if tc.instructions && tc.requests && strings.Index(prompt, "answer in English") > strings.Index(prompt, "compare go and rust") {
+			t.Errorf("instructions should come first:\n%s", prompt)
+		}
+		if a.globalContext() != "" && !strings.Contains(prompt, a.globalContext()) {
+			t.Errorf("mode %q: planner and subagents should get the same context", tc.mode)
+		}
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", ConversationContext: "recent"}, nil); err == nil {
+		t.Error("expected an error for an unknown context mode")
+	}
+}
+
+func TestPlannerHistoryLimit(t *testing.T) {
+	var prompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return `{"description": "plan", "tasks": [{"type": "SEARCH", "description": "s"}]}`
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, PlannerHistoryLimit: 30}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.AddDeveloperMessage("answer in English")
+	for i := 1; i <= 5; i++ {
+		a.AddUserMessage(fmt.Sprintf("request number %d about go", i))
+		a.AddAssistantMessage("report")
+	}
+	if _, err := a.Plan(context.Background(), "now add python"); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+
+	if strings.Contains(prompt, "request number 1 ") {
+		t.Errorf("expected the oldest requests to be dropped:\n%s", prompt)
+	}
+	if !strings.Contains(prompt, "- answer in English") {
+		t.Errorf("expected the instruction to be kept:\n%s", prompt)
+	}
+	if !strings.Contains(prompt, "User: request number 5 about go") || !strings.Contains(prompt, "已省略更早的") {
+		t.Errorf("expected the latest request and a note about the omitted ones:\n%s", prompt)
+	}
+	if !strings.Contains(a.globalContext(), "request number 1 ") {
+		t.Error("subagents should still get the whole context")
+	}
+
+	// The latest request alone is over the limit
+	a.ClearHistory()
+	a.AddUserMessage("an old request")
+	a.AddUserMessage(strings.Repeat("很长的请求", 20))
+	limited := a.limitedGlobalContext(30)
+	if !strings.Contains(limited, "User: 很长的请求") || !strings.Contains(limited, "...") || strings.Contains(limited, "old request") {
+		t.Errorf("expected only the truncated latest request:\n%s", limited)
+	}
+	if !strings.Contains(limited, "已省略更早的 1 条消息") || !strings.Contains(limited, "已截断") {
+		t.Errorf("expected notes about the omitted and truncated requests:\n%s", limited)
+	}
+	if tokens := estimateTokens([]openai.ChatCompletionMessage{{Content: strings.TrimPrefix(strings.Split(limited, "\n")[1], "User: ")}}); tokens > 30 {
+		t.Errorf("truncated request has %d tokens, more than the limit", tokens)
+	}
+}
+
+func TestValidatePlan(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{
+		APIKey:           "test",
+		MaxTasks:         2,
+		AllowedTaskTypes: []TaskType{TaskTypeSearch, TaskTypeReport, TaskTypeRender},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	plan := &Plan{Tasks: []Task{
+		{Type: TaskTypeSearch},
+		{Type: "VIDEO"},
+		{Type: TaskTypePPT},
+		{Type: TaskTypeReport},
+		{Type: TaskTypeRender},
+	}}
+	a.validatePlan(plan)
+
+	if len(plan.Tasks) != 2 {
+		t.Fatalf("expected 2 tasks, got %d", len(plan.Tasks))
+	}
+	if plan.Tasks[0].Type != TaskTypeSearch || plan.Tasks[1].Type != TaskTypeReport {
+		t.Errorf("unexpected tasks after validation: %+v", plan.Tasks)
+	}
+}
+
+func TestPlanWithToolCalling(t *testing.T) {
+	srv := newFakeLLMMessage(t, func(req map[string]interface{}) map[string]interface{} {
+		if _, ok := req["tools"]; !ok {
+			t.Error("expected tools in the request")
+		}
+		return map[string]interface{}{
+			"role": "assistant",
+			"tool_calls": []map[string]interface{}{
+				{
+					"id":   "call_1",
+					"type": "function",
+					"function": map[string]interface{}{
+						"name":      "create_plan",
+						"arguments": `{"description": "tool plan", "tasks": [{"type": "SEARCH", "description": "search", "parameters": {"query": "go"}}]}`,
+					},
+				},
+			},
+		}
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, UseToolCalling: true}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	plan, err := a.Plan(context.Background(), "go")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if plan.Description != "tool plan" || len(plan.Tasks) != 1 || plan.Tasks[0].Parameters["query"] != "go" {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+}
+
+// blockingSubagent waits until its context is done.
+type blockingSubagent struct{}
+
+func (blockingSubagent) Type() TaskType { return TaskTypeSearch }
+
+func (blockingSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	<-ctx.Done()
+	return Result{}, ctx.Err()
+}
+
+func TestExecuteTaskTimeout(t *testing.T) {
+	plan := func() *Plan {
+		return &Plan{Tasks: []Task{
+			{Type: TaskTypeSearch, Parameters: map[string]interface{}{"timeout_seconds": 0.05}},
+			{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": "done"}},
+		}}
+	}
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = blockingSubagent{}
+
+	results, err := a.Execute(context.Background(), plan())
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0].Success || results[0].ErrorKind != ErrTimeout {
+		t.Errorf("expected a timeout result, got %+v", results[0])
+	}
+	if !results[1].Success {
+		t.Errorf("expected the next task to run, got %+v", results[1])
+	}
+
+	a.config.AbortOnTimeout = true
+	if _, err := a.Execute(context.Background(), plan()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected DeadlineExceeded when aborting, got %v", err)
+	}
+}
+
+// stubSubagent returns a fixed successful output.
+type stubSubagent struct {
+	taskType TaskType
+	output   string
+}
+
+func (s stubSubagent) Type() TaskType { return s.taskType }
+
+func (s stubSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	return Result{TaskType: s.taskType, Success: true, Output: s.output}, nil
+}
+
+func TestAnalyzeMissingInfoLimit(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// Only the prompt repeated at the limit gets an answer
+		if messages := req["messages"].([]interface{}); len(messages) > 2 {
+			return "final analysis"
+		}
+		return "MISSING_INFO: more data"
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = stubSubagent{taskType: TaskTypeSearch, output: "search results"}
+
+	results, err := a.Execute(context.Background(), &Plan{Tasks: []Task{
+		{Type: TaskTypeAnalyze, Description: "analyze"},
+	}})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	// The initial analysis plus two re-queues, each preceded by a search,
+	// and the last one asked again
+	if calls != 4 {
+		t.Errorf("expected 4 analysis calls, got %d", calls)
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(results))
+	}
+	if last := results[len(results)-1]; last.TaskType != TaskTypeAnalyze || len(last.NewTasks) != 0 || last.Output != "final analysis" {
+		t.Errorf("expected the final analysis to proceed without re-queueing, got %+v", last)
+	}
+}
+
+// checkpointHandler records checkpoint confirmations and answers with approve.
+type checkpointHandler struct {
+	approve bool
+	asked   []string
+}
+
+func (h *checkpointHandler) ReviewPlan(plan *Plan) (string, error)                { return "", nil }
+func (h *checkpointHandler) ConfirmPodcastGeneration(report string) (bool, error) { return true, nil }
+func (h *checkpointHandler) Log(message string)                                   {}
+
+func (h *checkpointHandler) ConfirmAction(description string, details map[string]interface{}) (bool, error) {
+	h.asked = append(h.asked, details["task_type"].(string))
+	return h.approve, nil
+}
+
+func TestExecuteCheckpoint(t *testing.T) {
+	h := &checkpointHandler{}
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, h)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeReport] = stubSubagent{taskType: TaskTypeReport, output: "report"}
+
+	plan := &Plan{Tasks: []Task{
+		{Type: TaskTypeReport},
+		{Type: TaskTypePPT},
+		{Type: TaskTypeRender},
+	}}
+	addCheckpoints(plan)
+
+	results, err := a.Execute(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(h.asked) != 1 || h.asked[0] != string(TaskTypePPT) {
+		t.Errorf("expected one checkpoint before PPT, got %v", h.asked)
+	}
+	if len(results) != 1 || results[0].TaskType != TaskTypeReport {
+		t.Errorf("expected execution to stop after the report, got %+v", results)
+	}
+}
+
+func TestAnalyzeCompareMode(t *testing.T) {
+	var systemPrompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		messages := req["messages"].([]interface{})
+		systemPrompt = messages[0].(map[string]interface{})["content"].(string)
+		return "| 维度 | Go | Rust |\n|---|---|---|"
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = stubSubagent{taskType: TaskTypeSearch, output: "search results"}
+
+	results, err := a.Execute(context.Background(), &Plan{Tasks: []Task{
+		{Type: TaskTypeAnalyze, Description: "compare", Parameters: map[string]interface{}{
+			"mode":     "compare",
+			"entities": []interface{}{"Go", "Rust"},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	var types []TaskType
+	for _, r := range results {
+		types = append(types, r.TaskType)
+	}
+	want := []TaskType{TaskTypeAnalyze, TaskTypeSearch, TaskTypeSearch, TaskTypeAnalyze}
+	if len(types) != len(want) {
+		t.Fatalf("expected tasks %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("expected tasks %v, got %v", want, types)
+		}
+	}
+	if !strings.Contains(systemPrompt, "对比") || !strings.Contains(systemPrompt, "Go, Rust") {
+		t.Errorf("compare instructions missing from system prompt: %q", systemPrompt)
+	}
+}
+
+// streamHandler collects streamed deltas.
+type streamHandler struct {
+	checkpointHandler
+	deltas []string
+}
+
+func (h *streamHandler) StreamDelta(taskType TaskType, delta string) {
+	h.deltas = append(h.deltas, delta)
+}
+
+func TestReportStreaming(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{"# Re", "port"} {
+			data, _ := json.Marshal(map[string]interface{}{
+				"object":  "chat.completion.chunk",
+				"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{"content": delta}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	h := &streamHandler{}
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Capabilities: Capabilities{Streaming: true}}, h)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	result, err := a.subagents[TaskTypeReport].Execute(context.Background(), Task{Type: TaskTypeReport, Description: "report"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if result.Output != "# Report" {
+		t.Errorf("unexpected report %q", result.Output)
+	}
+	if strings.Join(h.deltas, "|") != "# Re|port" {
+		t.Errorf("unexpected deltas %q", h.deltas)
+	}
+}
+
+func TestCompactHistory(t *testing.T) {
+	srv := newFakeLLM(t, func(map[string]interface{}) string {
+		return "summary"
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, KeepRecentTurns: 2}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		a.AddUserMessage(fmt.Sprintf("question %d", i))
+		a.AddAssistantMessage(fmt.Sprintf("answer %d", i))
+	}
+
+	if err := a.CompactHistory(context.Background()); err != nil {
+		t.Fatalf("CompactHistory failed: %v", err)
+	}
+
+	history := a.History()
+	if len(history) != 5 {
+		t.Fatalf("expected summary plus 2 turns (5 messages), got %d", len(history))
+	}
+	if history[0].Content != summaryPrefix+"summary" {
+		t.Errorf("unexpected summary message %q", history[0].Content)
+	}
+	if history[1].Content != "question 3" || history[4].Content != "answer 4" {
+		t.Errorf("recent turns not kept verbatim: %+v", history[1:])
+	}
+
+	// Compacting again has nothing older than the kept turns
+	if err := a.CompactHistory(context.Background()); err != nil {
+		t.Fatalf("second CompactHistory failed: %v", err)
+	}
+	if got := len(a.History()); got != 5 {
+		t.Errorf("expected history to stay at 5 messages, got %d", got)
+	}
+}
+
+func TestCompactHistoryEmptySummary(t *testing.T) {
+	clients := map[string]ChatCompleter{
+		"empty":      &MockClient{Replies: []string{"  "}},
+		"no choices": filteredClient{&MockClient{Replies: []string{"summary"}}, 0},
+	}
+	for name, client := range clients {
+		a, err := NewPlanningAgent(AgentConfig{Client: client, KeepRecentTurns: 1}, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			a.AddUserMessage(fmt.Sprintf("question %d", i))
+			a.AddAssistantMessage(fmt.Sprintf("answer %d", i))
+		}
+
+		if err := a.CompactHistory(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if history := a.History(); len(history) != 6 || history[0].Content != "question 0" {
+			t.Errorf("%s: expected the history to be unchanged, got %+v", name, history)
+		}
+	}
+}
+
+func TestRenderMarkdownSafeHTML(t *testing.T) {
+	got := RenderMarkdownSafeHTML("# Title\n\n<script>alert(1)</script>\n\nText <img src=x onerror=alert(2)> [bad](javascript:alert(3)) [good](https://go.dev) ![chart](/generated/charts/a.svg)")
+	for _, bad := range []string{"<script", "onerror", "javascript:"} {
+		if strings.Contains(got, bad) {
+			t.Errorf("expected %q to be dropped:\n%s", bad, got)
+		}
+	}
+	for _, want := range []string{"<h1", `href="https://go.dev"`, `src="/generated/charts/a.svg"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestRenderHTMLFragment(t *testing.T) {
+	task := Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": "# Title\n\nBody"}}
+
+	page, err := NewRenderSubagent(false, FinalFormatHTML, false, 0, RenderConfig{}, nil).Execute(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.Output, "<html") || !strings.Contains(page.Output, "<body>") {
+		t.Errorf("expected a complete page, got %q", page.Output)
+	}
+
+	fragment, err := NewRenderSubagent(false, FinalFormatHTML, true, 0, RenderConfig{}, nil).Execute(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(fragment.Output, "<html") || strings.Contains(fragment.Output, "<head") || strings.Contains(fragment.Output, "<body") {
+		t.Errorf("expected a fragment, got %q", fragment.Output)
+	}
+	if !strings.Contains(fragment.Output, `<h1 id="title">Title</h1>`) {
+		t.Errorf("fragment missing heading: %q", fragment.Output)
+	}
+}
+
+func TestRenderPagination(t *testing.T) {
+	section := "## Section\n\n" + strings.Repeat("text ", 40) + "\n\n```\ncode\n\nmore code\n```\n\n"
+	content := strings.Repeat(section, 5)
+
+	result, err := NewRenderSubagent(false, FinalFormatHTML, true, 500, RenderConfig{}, nil).Execute(context.Background(), Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": content}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Metadata["markdown"] != content {
+		t.Error("raw markdown missing from metadata")
+	}
+	pages, _ := result.Metadata["pages"].([]string)
+	if len(pages) < 2 {
+		t.Fatalf("expected several pages, got %d", len(pages))
+	}
+	if result.Output != pages[0] {
+		t.Error("output should be the first page")
+	}
+	for i, page := range pages {
+		if strings.Count(page, "<pre>") != strings.Count(page, "</pre>") {
+			t.Errorf("page %d splits a code block: %q", i, page)
+		}
+	}
+	if out := NewRunOutput([]Result{result}); !reflect.DeepEqual(out.ReportPages, pages) {
+		t.Error("RunOutput.ReportPages not set")
+	}
+
+	if got := splitMarkdown(content, 500); strings.Join(got, "") != content {
+		t.Error("splitMarkdown lost content")
+	}
+
+	small, err := NewRenderSubagent(false, FinalFormatHTML, true, 500, RenderConfig{}, nil).Execute(context.Background(), Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": section}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := small.Metadata["pages"]; ok {
+		t.Error("small report should not be paginated")
+	}
+}
+
+func TestSelectContext(t *testing.T) {
+	outputs := []TaskOutput{
+		{TaskType: TaskTypeSearch, Output: "raw results"},
+		{TaskType: TaskTypeSearch, Output: "raw results"},
+		{TaskType: TaskTypeAnalyze, Output: "analysis"},
+		{TaskType: TaskTypeReport, Output: "report"},
+	}
+
+	tests := []struct {
+		name     string
+		outputs  []TaskOutput
+		taskType TaskType
+		rules    map[TaskType][]TaskType
+		want     []TaskOutput
+	}{
+		{
+			name:     "analyze deduplicates search",
+			outputs:  outputs,
+			taskType: TaskTypeAnalyze,
+			rules:    DefaultContextRules,
+			want:     []TaskOutput{{TaskType: TaskTypeSearch, Output: "raw results"}},
+		},
+		{
+			name:     "report gets analysis only",
+			outputs:  outputs,
+			taskType: TaskTypeReport,
+			rules:    DefaultContextRules,
+			want:     []TaskOutput{{TaskType: TaskTypeAnalyze, Output: "analysis"}},
+		},
+		{
+			name:     "falls back to everything without relevant output",
+			outputs:  outputs[:2],
+			taskType: TaskTypeReport,
+			rules:    DefaultContextRules,
+			want:     []TaskOutput{{TaskType: TaskTypeSearch, Output: "raw results"}},
+		},
+		{
+			name:     "no rule keeps everything",
+			outputs:  outputs,
+			taskType: TaskTypeReport,
+			rules:    map[TaskType][]TaskType{},
+			want: []TaskOutput{
+				{TaskType: TaskTypeSearch, Output: "raw results"},
+				{TaskType: TaskTypeAnalyze, Output: "analysis"},
+				{TaskType: TaskTypeReport, Output: "report"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectContext(tt.outputs, tt.taskType, tt.rules)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestOutput(t *testing.T) {
+	task := Task{Parameters: map[string]interface{}{OutputsKey: []TaskOutput{
+		{TaskType: TaskTypeReport, Output: "old report"},
+		{TaskType: TaskTypeReport, Output: " report \n"},
+		{TaskType: TaskTypeAnalyze, Output: "Output from REPORT task:\nnot a report"},
+	}}}
+	if got, ok := latestOutput(task, TaskTypeReport); !ok || got != "report" {
+		t.Errorf("got %q, want the latest REPORT output", got)
+	}
+	if got, ok := latestOutput(task, TaskTypeChart); !ok || got != "Output from REPORT task:\nnot a report" {
+		t.Errorf("got %q, want the last output", got)
+	}
+	if _, ok := latestOutput(Task{}, TaskTypeReport); ok {
+		t.Error("expected no output without prior tasks")
+	}
+	if got := reportContent(task); got != "report" {
+		t.Errorf("reportContent got %q", got)
+	}
+}
+
+// recordingSubagent records the tasks it executes.
+type recordingSubagent struct {
+	taskType TaskType
+	tasks    *[]Task
+}
+
+func (s recordingSubagent) Type() TaskType { return s.taskType }
+
+func (s recordingSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	*s.tasks = append(*s.tasks, task)
+	return Result{TaskType: s.taskType, Success: true, Output: task.Description}, nil
+}
+
+func TestTaskInputs(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	var searches, analyses, reports []Task
+	a.subagents[TaskTypeSearch] = recordingSubagent{TaskTypeSearch, &searches}
+	a.subagents[TaskTypeAnalyze] = recordingSubagent{TaskTypeAnalyze, &analyses}
+	a.subagents[TaskTypeReport] = recordingSubagent{TaskTypeReport, &reports}
+
+	plan := &Plan{Tasks: []Task{
+		{ID: "search1", Type: TaskTypeSearch, Description: "go"},
+		{ID: "search2", Type: TaskTypeSearch, Description: "rust"},
+		{ID: "analyze1", Type: TaskTypeAnalyze, Description: "analyze go", Inputs: []string{"search1"}},
+		{ID: "analyze1", Type: TaskTypeAnalyze, Description: "analyze rust", Inputs: []string{"search2"}},
+		{ID: "report1", Type: TaskTypeReport, Description: "report", Inputs: []string{"analyze1", "missing"}},
+	}}
+	a.validatePlan(plan)
+	if plan.Tasks[3].ID != "" || !reflect.DeepEqual(plan.Tasks[4].Inputs, []string{"analyze1"}) {
+		t.Fatalf("expected the duplicate ID and the unknown input to be dropped, got %+v", plan.Tasks)
+	}
+
+	if _, err := a.Execute(context.Background(), plan); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	want := []TaskOutput{{TaskType: TaskTypeSearch, Output: "rust", TaskID: "search2"}}
+	if got := taskOutputs(analyses[1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the declared input, got %+v", got)
+	}
+	want = []TaskOutput{{TaskType: TaskTypeAnalyze, Output: "analyze go", TaskID: "analyze1"}}
+	if got := taskOutputs(reports[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the declared input, got %+v", got)
+	}
+	if text := contextText(reports[0]); !strings.HasPrefix(text, "Output from ANALYZE task analyze1:") {
+		t.Errorf("expected the task ID in the context, got %q", text)
+	}
+}
+
+func TestLinkNewTasks(t *testing.T) {
+	tasks := []Task{
+		{ID: "search1", Type: TaskTypeSearch},
+		{ID: "analyze1", Type: TaskTypeAnalyze, Inputs: []string{"search1"}},
+	}
+	newTasks := linkNewTasks(tasks, tasks[1], []Task{
+		{Type: TaskTypeSearch, Description: "more"},
+		requeuedTask(tasks[1]),
+	})
+	if newTasks[0].ID != "search2" || !reflect.DeepEqual(newTasks[1].Inputs, []string{"search1", "search2"}) {
+		t.Errorf("expected the new search to feed the re-queued task, got %+v", newTasks)
+	}
+	if len(tasks[1].Inputs) != 1 {
+		t.Errorf("linkNewTasks modified the inputs of the original task: %v", tasks[1].Inputs)
+	}
+}
+
+func TestPlanTemplate(t *testing.T) {
+	plan := &Plan{
+		Description: "Research Go generics",
+		Topic:       "Go generics",
+		Tasks: []Task{
+			{Type: TaskTypeSearch, Description: "Search for Go generics", Parameters: map[string]interface{}{
+				"query":           "Go generics tutorial",
+				OutputsKey:        []TaskOutput{{TaskType: TaskTypeSearch, Output: "stale"}},
+				"_internal":       true,
+				"timeout_seconds": float64(30),
+			}},
+			{Type: TaskTypeAnalyze, Description: "Compare", Parameters: map[string]interface{}{
+				"mode":     "compare",
+				"entities": []interface{}{"Go generics", "Rust traits"},
+			}},
+		},
+	}
+
+	tmpl, err := plan.ToTemplate()
+	if err != nil {
+		t.Fatalf("ToTemplate failed: %v", err)
+	}
+	if got := tmpl.Tasks[0].Parameters["query"]; got != "{{topic}} tutorial" {
+		t.Errorf("query not parameterized: %v", got)
+	}
+	if _, ok := tmpl.Tasks[0].Parameters[OutputsKey]; ok {
+		t.Error("context should be dropped from the template")
+	}
+	if _, ok := tmpl.Tasks[0].Parameters["_internal"]; ok {
+		t.Error("internal parameters should be dropped from the template")
+	}
+	if plan.Tasks[0].Parameters["query"] != "Go generics tutorial" {
+		t.Error("ToTemplate modified the original plan")
+	}
+
+	if _, err := tmpl.Instantiate(nil); err == nil {
+		t.Error("expected an error for a missing variable")
+	}
+
+	var tasks []Task
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = recordingSubagent{TaskTypeSearch, &tasks}
+	a.subagents[TaskTypeAnalyze] = recordingSubagent{TaskTypeAnalyze, &tasks}
+
+	results, err := a.ExecuteTemplate(context.Background(), tmpl, map[string]string{"topic": "Zig comptime"})
+	if err != nil {
+		t.Fatalf("ExecuteTemplate failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if got := tasks[0].Parameters["query"]; got != "Zig comptime tutorial" {
+		t.Errorf("unexpected query: %v", got)
+	}
+	if got := tasks[0].Parameters["timeout_seconds"]; got != float64(30) {
+		t.Errorf("non-string parameter changed: %v", got)
+	}
+	if got := tasks[1].Parameters["entities"]; !reflect.DeepEqual(got, []interface{}{"Zig comptime", "Rust traits"}) {
+		t.Errorf("unexpected entities: %v", got)
+	}
+}
+
+func TestPlanFallbackModel(t *testing.T) {
+	var mu sync.Mutex
+	var models []string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		model, _ := req["model"].(string)
+		models = append(models, model)
+		if model == "primary" {
+			return "not json"
+		}
+		return `{"description": "fallback plan", "tasks": [{"type": "REPORT", "description": "report"}]}`
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Model: "primary", FallbackModel: "backup"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	plan, err := a.Plan(context.Background(), "go")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if plan.Description != "fallback plan" {
+		t.Errorf("unexpected plan: %+v", plan)
+	}
+	if want := []string{"primary", "primary", "backup"}; !reflect.DeepEqual(models, want) {
+		t.Errorf("models tried = %v, want %v", models, want)
+	}
+
+	// Without a fallback the error surfaces after the retries
+	models = nil
+	a.config.FallbackModel = ""
+	if _, err := a.Plan(context.Background(), "go"); err == nil {
+		t.Error("expected an error without a fallback model")
+	}
+	if len(models) != plannerAttempts {
+		t.Errorf("expected %d attempts, got %v", plannerAttempts, models)
+	}
+}
+
+func TestReportStyle(t *testing.T) {
+	var mu sync.Mutex
+	var systemPrompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		messages := req["messages"].([]interface{})
+		systemPrompt = messages[0].(map[string]interface{})["content"].(string)
+		return "ok"
+	})
+	r := NewReportSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 0, false, 0)
+
+	for style, want := range reportStyleInstructions {
+		if _, err := r.Execute(context.Background(), Task{Type: TaskTypeReport, Parameters: map[string]interface{}{"style": style}}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(systemPrompt, want) {
+			t.Errorf("style %q: instruction missing from prompt %q", style, systemPrompt)
+		}
+	}
+
+	if _, err := r.Execute(context.Background(), Task{Type: TaskTypeReport}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(systemPrompt, "输出风格") {
+		t.Errorf("default report should not have a style instruction: %q", systemPrompt)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		configured, request, want string
+	}{
+		{"", "Compare Go and Rust", "中文"},
+		{"English", "比较 Go 和 Rust", "English"},
+		{LanguageAuto, "Compare Go and Rust", "English"},
+		{LanguageAuto, "比较 Go and Rust", "中文"},
+		{LanguageAuto, "123", "中文"},
+	}
+	for _, tt := range tests {
+		if got := resolveLanguage(tt.configured, tt.request); got != tt.want {
+			t.Errorf("resolveLanguage(%q, %q) = %q, want %q", tt.configured, tt.request, got, tt.want)
+		}
+	}
+
+	var tasks []Task
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", Language: LanguageAuto}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = recordingSubagent{TaskTypeSearch, &tasks}
+	a.AddUserMessage("Compare Go and Rust")
+	plan := &Plan{Tasks: []Task{
+		{Type: TaskTypeSearch},
+		{Type: TaskTypeSearch, Parameters: map[string]interface{}{"language": "Deutsch"}},
+	}}
+	if _, err := a.Execute(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	if got := taskLanguage(tasks[0]); got != "English" {
+		t.Errorf("expected the detected language, got %q", got)
+	}
+	if got := taskLanguage(tasks[1]); got != "Deutsch" {
+		t.Errorf("task language overridden, got %q", got)
+	}
+
+	prompt := withLanguage("prompt", tasks[0])
+	if !strings.Contains(prompt, "written in English") {
+		t.Errorf("language instruction missing from %q", prompt)
+	}
+	if got := withLanguage("prompt", Task{}); got != "prompt" {
+		t.Errorf("prompt changed without a language: %q", got)
+	}
+}
+
+// sourceSubagent is a stub SEARCH subagent that reports the results in its
+// task description as sources.
+type sourceSubagent struct{}
+
+func (sourceSubagent) Type() TaskType { return TaskTypeSearch }
+
+func (sourceSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	return Result{
+		TaskType: TaskTypeSearch,
+		Success:  true,
+		Output:   task.Description,
+		Metadata: map[string]interface{}{"sources": parseSources(task.Description)},
+	}, nil
+}
+
+func TestSources(t *testing.T) {
+	first := "Title: Go\nURL: https://go.dev\nContent: The Go language\n\nTitle: Go again\nURL: https://go.dev\nContent: dup\n\n" +
+		"Title: Rust\nURL: https://rust-lang.org\nContent: The Rust language\n\n- Image URL: https://img"
+	second := "Title: Go docs\nURL: https://go.dev\nContent: docs\n\nTitle: Zig\nURL: https://ziglang.org\nContent: Zig"
+
+	want := []tool.SearchResult{
+		{Title: "Go", URL: "https://go.dev", Content: "The Go language"},
+		{Title: "Rust", URL: "https://rust-lang.org", Content: "The Rust language"},
+	}
+	if got := parseSources(first); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSources = %+v, want %+v", got, want)
+	}
+
+	var tasks []Task
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = sourceSubagent{}
+	a.subagents[TaskTypeReport] = recordingSubagent{TaskTypeReport, &tasks}
+	plan := &Plan{Tasks: []Task{
+		{Type: TaskTypeSearch, Description: first},
+		{Type: TaskTypeSearch, Description: second},
+		{Type: TaskTypeReport},
+	}}
+	if _, err := a.Execute(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, _ := tasks[0].Parameters["sources"].([]tool.SearchResult)
+	var urls []string
+	for _, source := range sources {
+		urls = append(urls, source.URL)
+	}
+	if want := []string{"https://go.dev", "https://rust-lang.org", "https://ziglang.org"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("aggregated sources %v, want %v", urls, want)
+	}
+	if _, ok := plan.Tasks[0].Parameters["sources"]; ok {
+		t.Error("the first task should not receive sources")
+	}
+	if got := formatSources(sources[:1]); got != "[1] Go - https://go.dev\n" {
+		t.Errorf("formatSources = %q", got)
+	}
+}
+
+func TestSearchDomainFilter(t *testing.T) {
+	opts := tool.SearchOptions{
+		IncludeDomains: []string{"*.gov", "Wikipedia.org"},
+		ExcludeDomains: []string{"spam.wikipedia.org"},
+	}
+	tests := map[string]bool{
+		"https://www.nasa.gov/news":         true,
+		"https://gov/":                      true,
+		"https://en.wikipedia.org/wiki/Go":  true,
+		"https://wikipedia.org":             true,
+		"https://spam.wikipedia.org/x":      false,
+		"https://notwikipedia.org":          false,
+		"https://example.com/?ref=nasa.gov": false,
+		"not a url":                         false,
+	}
+	for u, want := range tests {
+		if got := opts.Allows(u); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", u, got, want)
+		}
+	}
+	if !(tool.SearchOptions{}).Allows("not a url") {
+		t.Error("options without filters should allow everything")
+	}
+}
+
+// countingSubagent counts its executions and echoes its context.
+type countingSubagent struct {
+	taskType TaskType
+	calls    *int
+}
+
+func (s countingSubagent) Type() TaskType { return s.taskType }
+
+func (s countingSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	*s.calls++
+	return Result{
+		TaskType: s.taskType,
+		Success:  true,
+		Output:   fmt.Sprintf("%s #%d from %s", s.taskType, *s.calls, contextText(task)),
+	}, nil
+}
+
+func TestExecuteCanceled(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	var searches int
+	a.subagents[TaskTypeSearch] = countingSubagent{TaskTypeSearch, &searches}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.Execute(ctx, &Plan{Tasks: []Task{{Type: TaskTypeSearch, Description: "search"}}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if searches != 0 {
+		t.Errorf("expected no task to run, got %d", searches)
+	}
+}
+
+// failingSubagent is a stub subagent that fails with err and result.
+type failingSubagent struct {
+	taskType TaskType
+	result   Result
+	err      error
+}
+
+func (s failingSubagent) Type() TaskType { return s.taskType }
+
+func (s failingSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	return s.result, s.err
+}
+
+func TestClassifyError(t *testing.T) {
+	var syntaxErr error
+	if err := json.Unmarshal([]byte("{"), &struct{}{}); err != nil {
+		syntaxErr = fmt.Errorf("parse plan: %w", err)
+	}
+	tests := []struct {
+		err  error
+		want ErrorKind
+	}{
+		{nil, ""},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), ErrTimeout},
+		{&openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, ErrRateLimit},
+		{&openai.APIError{HTTPStatusCode: http.StatusInternalServerError}, ErrAPI},
+		{&openai.RequestError{HTTPStatusCode: http.StatusTooManyRequests}, ErrRateLimit},
+		{&openai.RequestError{HTTPStatusCode: http.StatusBadGateway}, ErrAPI},
+		{syntaxErr, ErrParse},
+		{&json.UnmarshalTypeError{Value: "string"}, ErrParse},
+		{errors.New("boom"), ErrUnknown},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteErrorKind(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = stubSubagent{TaskTypeSearch, "results"}
+	a.subagents[TaskTypeAnalyze] = failingSubagent{TaskTypeAnalyze, Result{ErrorKind: ErrParse}, errors.New("bad JSON")}
+
+	plan := &Plan{Tasks: []Task{{Type: TaskTypeSearch, Description: "search"}, {Type: TaskTypeAnalyze, Description: "analyze"}}}
+	results, err := a.Execute(context.Background(), plan)
+	var taskErr *TaskError
+	if !errors.As(err, &taskErr) {
+		t.Fatalf("expected a TaskError, got %v", err)
+	}
+	if taskErr.Index != 2 || ErrorKindOf(err) != ErrParse {
+		t.Errorf("expected task 2 to fail with %q, got task %d with %q", ErrParse, taskErr.Index, ErrorKindOf(err))
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected the failed result after the search, got %d results", len(results))
+	}
+	if failed := results[1]; failed.Success || failed.TaskType != TaskTypeAnalyze || failed.ErrorKind != ErrParse || failed.Error != "bad JSON" {
+		t.Errorf("unexpected failed result %+v", failed)
+	}
+
+	// A kind the subagent did not set is classified from the error
+	a.subagents[TaskTypeAnalyze] = failingSubagent{TaskTypeAnalyze, Result{}, &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}}
+	if _, err := a.Execute(context.Background(), plan); ErrorKindOf(err) != ErrRateLimit {
+		t.Errorf("expected %q, got %q from %v", ErrRateLimit, ErrorKindOf(err), err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.Retry(context.Background(), TaskTypeReport); err == nil {
+		t.Error("expected an error without a previous plan")
+	}
+
+	var searches, analyses, reports int
+	a.subagents[TaskTypeSearch] = countingSubagent{TaskTypeSearch, &searches}
+	a.subagents[TaskTypeAnalyze] = countingSubagent{TaskTypeAnalyze, &analyses}
+	a.subagents[TaskTypeReport] = countingSubagent{TaskTypeReport, &reports}
+	plan := &Plan{Tasks: []Task{{Type: TaskTypeSearch}, {Type: TaskTypeAnalyze}, {Type: TaskTypeReport}}}
+	first, err := a.Execute(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := a.Retry(context.Background(), TaskTypeReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if searches != 1 || analyses != 1 || reports != 2 {
+		t.Errorf("expected only the report to run again, got %d/%d/%d calls", searches, analyses, reports)
+	}
+	if len(results) != 1 || !strings.Contains(results[0].Output, first[1].Output) {
+		t.Errorf("retried report did not get the cached analysis: %+v", results)
+	}
+
+	// A retried analysis feeds the next report retry
+	if _, err := a.Retry(context.Background(), TaskTypeAnalyze); err != nil {
+		t.Fatal(err)
+	}
+	results, err = a.Retry(context.Background(), TaskTypeReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(results[0].Output, "ANALYZE #2") {
+		t.Errorf("report retry used a stale analysis: %q", results[0].Output)
+	}
+}
+
+// validatingSubagent is a stub subagent that implements Validator.
+type validatingSubagent struct {
+	stubSubagent
+	err error
+}
+
+func (s validatingSubagent) Validate() error { return s.err }
+
+func TestPreflight(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = validatingSubagent{stubSubagent{TaskTypeSearch, "ok"}, errors.New("no key")}
+	a.subagents[TaskTypeAnalyze] = validatingSubagent{stubSubagent{TaskTypeAnalyze, "ok"}, nil}
+
+	unavailable := a.Preflight()
+	if len(unavailable) != 2 {
+		t.Fatalf("expected SEARCH and PPT to be unavailable, got %v", unavailable)
+	}
+	if err := unavailable[TaskTypePPT]; err == nil || !strings.Contains(err.Error(), "npm") {
+		t.Errorf("expected a missing npm error for PPT, got %v", err)
+	}
+	if err := unavailable[TaskTypeSearch]; err == nil || err.Error() != "no key" {
+		t.Errorf("unexpected SEARCH error %v", err)
+	}
+}
+
+func TestSupportedTasks(t *testing.T) {
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	supported := a.SupportedTasks()
+	if len(supported) != len(a.subagents) || supported[0] != TaskTypeSearch || slices.Contains(supported, TaskTypeRetrieve) {
+		t.Errorf("expected every registered subagent but RETRIEVE, got %v", supported)
+	}
+	for _, taskType := range supported {
+		if a.DescribeTask(taskType) == "" {
+			t.Errorf("no description for %s", taskType)
+		}
+	}
+
+	a, err = NewPlanningAgent(AgentConfig{APIKey: "test", AllowedTaskTypes: []TaskType{TaskTypeSearch, TaskTypeReport}, DisableWebSearch: true}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if supported := a.SupportedTasks(); !reflect.DeepEqual(supported, []TaskType{TaskTypeReport}) {
+		t.Errorf("expected only REPORT, got %v", supported)
+	}
+	if a.DescribeTask(TaskTypePPT) != "" {
+		t.Error("expected no description for a disallowed task type")
+	}
+}
+
+// llmSubagent makes one chat completion call per task.
+type llmSubagent struct {
+	client ChatCompleter
+}
+
+func (s llmSubagent) Type() TaskType { return TaskTypeAnalyze }
+
+func (s llmSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	_, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+	})
+	return Result{TaskType: TaskTypeAnalyze, Success: err == nil, Output: "ok"}, err
+}
+
+func TestExecuteBudget(t *testing.T) {
+	// Every call uses a million prompt tokens, $2.50 with gpt-4o
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object": "chat.completion", "model": "gpt-4o-2024-08-06",
+			"choices": [{"index": 0, "message": {"role": "assistant", "content": "ok"}}],
+			"usage": {"prompt_tokens": 1000000, "completion_tokens": 0}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, MaxCostUSD: 6}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeAnalyze] = llmSubagent{a.client}
+
+	plan := &Plan{Tasks: []Task{{Type: TaskTypeAnalyze}, {Type: TaskTypeAnalyze}, {Type: TaskTypeAnalyze}, {Type: TaskTypeAnalyze}}}
+	results, err := a.Execute(context.Background(), plan)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected ErrBudgetExceeded, got %v", err)
+	}
+	// The third task would bring the cost to $7.50
+	if len(results) != 2 {
+		t.Errorf("expected 2 partial results, got %d", len(results))
+	}
+	if usage := a.Usage(); usage.PromptTokens != 2000000 || usage.CostUSD != 5 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestUsageTrackerStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if opts, _ := req["stream_options"].(map[string]interface{}); opts["include_usage"] != true {
+			t.Error("expected include_usage in the streaming request")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"object": "chat.completion.chunk", "model": "gpt-4o-mini", "choices": [{"index": 0, "delta": {"content": "hi"}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"object": "chat.completion.chunk", "model": "gpt-4o-mini", "choices": [], "usage": {"prompt_tokens": 1000000, "completion_tokens": 1000000}}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Capabilities: Capabilities{Streaming: true}}, &streamHandler{})
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.subagents[TaskTypeReport].Execute(context.Background(), Task{Type: TaskTypeReport}); err != nil {
+		t.Fatal(err)
+	}
+	if usage := a.Usage(); usage.CompletionTokens != 1000000 || usage.CostUSD != 0.75 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+// reviewHandler answers plan reviews with modifications, then approves.
+type reviewHandler struct {
+	checkpointHandler
+	modifications []string
+}
+
+func (h *reviewHandler) ReviewPlan(plan *Plan) (string, error) {
+	if len(h.modifications) == 0 {
+		return "", nil
+	}
+	modification := h.modifications[0]
+	h.modifications = h.modifications[1:]
+	return modification, nil
+}
+
+func TestPlanWithReviewRevisesPlan(t *testing.T) {
+	var requests []string
+	var mu sync.Mutex
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		messages := req["messages"].([]interface{})
+		mu.Lock()
+		requests = append(requests, messages[len(messages)-1].(map[string]interface{})["content"].(string))
+		n := len(requests)
+		mu.Unlock()
+		if n == 1 {
+			return `{"description": "量子计算报告", "tasks": [{"type": "SEARCH", "description": "搜索量子计算"}, {"type": "REPORT", "description": "写报告"}]}`
+		}
+		return `{"description": "量子计算报告和幻灯片", "tasks": [{"type": "SEARCH", "description": "搜索量子计算"}, {"type": "REPORT", "description": "写报告"}, {"type": "PPT", "description": "生成幻灯片"}]}`
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, &reviewHandler{modifications: []string{"再加一个幻灯片"}})
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	plan, err := a.PlanWithReview(context.Background(), "研究量子计算")
+	if err != nil {
+		t.Fatalf("PlanWithReview failed: %v", err)
+	}
+	if len(plan.Tasks) != 3 {
+		t.Errorf("expected the revised plan, got %+v", plan)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected a plan and a revision request, got %d", len(requests))
+	}
+	for _, want := range []string{"研究量子计算", "搜索量子计算", "再加一个幻灯片"} {
+		if !strings.Contains(requests[1], want) {
+			t.Errorf("revision request does not contain %q: %s", want, requests[1])
+		}
+	}
+}
+
+func TestWikipediaOptions(t *testing.T) {
+	s := NewSearchSubagent(nil, "", false, nil, "", false, SearchConfig{})
+	tests := []struct {
+		name    string
+		config  SearchConfig
+		query   string
+		params  map[string]interface{}
+		lang    string
+		enabled bool
+	}{
+		{name: "chinese query", query: "量子计算", lang: "zh", enabled: true},
+		{name: "english query", query: "quantum computing", lang: "en", enabled: true},
+		{name: "output language", query: "2024", params: map[string]interface{}{"language": "English"}, lang: "en", enabled: true},
+		{name: "configured", config: SearchConfig{WikipediaLanguage: "ja"}, query: "量子计算", lang: "ja", enabled: true},
+		{name: "task overrides", config: SearchConfig{WikipediaLanguage: "ja"}, query: "go", params: map[string]interface{}{"wikipedia_language": "de"}, lang: "de", enabled: true},
+		{name: "disabled", config: SearchConfig{DisableWikipedia: true}, query: "go", lang: "en", enabled: false},
+		{name: "task enables", config: SearchConfig{DisableWikipedia: true}, query: "go", params: map[string]interface{}{"wikipedia": true}, lang: "en", enabled: true},
+		{name: "task disables", query: "go", params: map[string]interface{}{"wikipedia": false}, lang: "en", enabled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.config = tt.config
+			opts, enabled := s.wikipediaOptions(Task{Parameters: tt.params}, tt.query)
+			if opts.Language != tt.lang || enabled != tt.enabled {
+				t.Errorf("got %q, %v, want %q, %v", opts.Language, enabled, tt.lang, tt.enabled)
+			}
+		})
+	}
+
+	opts, _ := s.wikipediaOptions(Task{Parameters: map[string]interface{}{"wikipedia_section": "历史"}}, "量子计算")
+	if opts.Section != "历史" || opts.BaseURL() != "https://zh.wikipedia.org/" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
+
+func TestReportContinuation(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]interface{}
+	parts := []string{"# 报告\n\n第一部分", "，第二部分", "，第三部分"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		requests = append(requests, req["messages"].([]interface{}))
+		n := len(requests)
+		mu.Unlock()
+
+		finish := "length"
+		if n >= len(parts) {
+			finish = "stop"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "chat.completion",
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"finish_reason": finish,
+				"message":       map[string]interface{}{"role": "assistant", "content": parts[min(n, len(parts))-1]},
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	r := NewReportSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 3, false, 0)
+	result, err := r.Execute(context.Background(), Task{Type: TaskTypeReport, Description: "写报告"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(parts, ""); result.Output != want {
+		t.Errorf("got %q, want %q", result.Output, want)
+	}
+	if truncated, _ := result.Metadata["truncated"].(bool); truncated {
+		t.Error("completed report marked as truncated")
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+	last := requests[2]
+	if len(last) != 4 || last[2].(map[string]interface{})["content"] != parts[0]+parts[1] {
+		t.Errorf("continuation should carry the report so far: %v", last)
+	}
+
+	// The cap stops continuing and marks the report
+	mu.Lock()
+	requests = nil
+	mu.Unlock()
+	r = NewReportSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 1, false, 0)
+	result, err = r.Execute(context.Background(), Task{Type: TaskTypeReport, Description: "写报告"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || result.Output != parts[0]+parts[1] {
+		t.Errorf("expected one continuation, got %d requests and %q", len(requests), result.Output)
+	}
+	if truncated, _ := result.Metadata["truncated"].(bool); !truncated {
+		t.Error("capped report should be marked as truncated")
+	}
+}
+
+func TestReportCondense(t *testing.T) {
+	var mu sync.Mutex
+	var summaryPrompts []string
+	var reportPrompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		messages := req["messages"].([]interface{})
+		system := messages[0].(map[string]interface{})["content"].(string)
+		user := messages[1].(map[string]interface{})["content"].(string)
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(system, "资料整理助手") {
+			summaryPrompts = append(summaryPrompts, system)
+			return "- 要点 [1]"
+		}
+		reportPrompt = user
+		return "# 报告"
+	})
+
+	outputs := []TaskOutput{
+		{TaskType: TaskTypeAnalyze, Output: strings.Repeat("Go 的并发模型基于 goroutine。", 20)},
+		{TaskType: TaskTypeAnalyze, Output: strings.Repeat("Rust 通过所有权保证内存安全。", 20)},
+	}
+	task := Task{Type: TaskTypeReport, Description: "写报告", Parameters: map[string]interface{}{
+		OutputsKey: outputs,
+		"sources":  []tool.SearchResult{{Title: "Go", URL: "https://go.dev"}},
+	}}
+
+	r := NewReportSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 0, false, 1000)
+	result, err := r.Execute(context.Background(), task)
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if n, _ := result.Metadata["summarized_chunks"].(int); n < 2 || n != len(summaryPrompts) {
+		t.Errorf("expected every chunk to be summarized, got %d chunks and %d summaries", n, len(summaryPrompts))
+	}
+	if !strings.Contains(summaryPrompts[0], "[1] Go - https://go.dev") {
+		t.Errorf("summaries should cite the numbered sources:\n%s", summaryPrompts[0])
+	}
+	if !strings.Contains(reportPrompt, "资料摘要 1/") || strings.Contains(reportPrompt, "goroutine") {
+		t.Errorf("expected the report to be written from the summaries, got %q", reportPrompt)
+	}
+
+	// A context within the limit is used as is
+	summaryPrompts = nil
+	r = NewReportSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 0, false, 100000)
+	if result, err = r.Execute(context.Background(), task); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaryPrompts) != 0 || !strings.Contains(reportPrompt, "goroutine") || result.Metadata["summarized_chunks"] != nil {
+		t.Errorf("expected no summaries, got %d", len(summaryPrompts))
+	}
+}
+
+func TestMaxConcurrentAPICalls(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	srv := newFakeLLM(t, func(map[string]interface{}) string {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return `{"description": "test", "tasks": [{"type": "SEARCH", "description": "search"}]}`
+	})
+
+	// Agents with the same limit share it, like the sessions of the web server
+	config := AgentConfig{APIKey: "test", APIBase: srv.URL, MaxConcurrentAPICalls: 2}
+	var agents []*PlanningAgent
+	for i := 0; i < 2; i++ {
+		a, err := NewPlanningAgent(config, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		agents = append(agents, a)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(a *PlanningAgent) {
+			defer wg.Done()
+			if _, err := a.Plan(context.Background(), "go"); err != nil {
+				t.Errorf("Plan failed: %v", err)
+			}
+		}(agents[i%2])
+	}
+	wg.Wait()
+
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 concurrent API calls, got %d", maxInFlight)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	srv := newFakeLLM(t, func(map[string]interface{}) string { return "# 报告" })
+	dir := t.TempDir()
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "sk-secret", APIBase: srv.URL, OutputDir: dir, Trace: true}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	results, err := a.Execute(context.Background(), &Plan{Tasks: []Task{
+		{Type: TaskTypeReport, Description: "写报告 sk-secret"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, ok := results[0].Metadata["trace"].([]TraceEntry)
+	if !ok || len(entries) != 1 {
+		t.Fatalf("expected one traced call, got %v", results[0].Metadata["trace"])
+	}
+	entry := entries[0]
+	if !strings.Contains(entry.Request, "写报告") || !strings.Contains(entry.Response, "# 报告") || entry.StatusCode != http.StatusOK {
+		t.Errorf("unexpected trace entry %+v", entry)
+	}
+	if strings.Contains(entry.Request, "sk-secret") || !strings.Contains(entry.Request, "[REDACTED]") {
+		t.Errorf("API key not redacted: %s", entry.Request)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "traces", "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a trace file, got %v, %v", files, err)
+	}
+	data, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(data), `"task_type":"REPORT"`) {
+		t.Errorf("unexpected trace file %s", data)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	caps, err := ParseCapabilities("json, Streaming")
+	if err != nil {
+		t.Fatalf("ParseCapabilities failed: %v", err)
+	}
+	if caps != (Capabilities{JSONMode: true, Streaming: true}) || caps.String() != "json,streaming" {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+	if caps, _ := ParseCapabilities("none"); caps.String() != "none" {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+	if caps, _ := ParseCapabilities("vision,tools"); caps != (Capabilities{Tools: true, Vision: true}) || caps.String() != "tools,vision" {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+	if _, err := ParseCapabilities("audio"); err == nil {
+		t.Error("expected an error for an unknown capability")
+	}
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	// An endpoint that rejects response_format and streaming but calls tools
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["response_format"] != nil || req["stream"] == true {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"message": "unsupported parameter", "type": "invalid_request_error"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "chat.completion",
+			"choices": []map[string]interface{}{{
+				"index":         0,
+				"finish_reason": "tool_calls",
+				"message": map[string]interface{}{
+					"role": "assistant",
+					"tool_calls": []map[string]interface{}{{
+						"id":       "call_1",
+						"type":     "function",
+						"function": map[string]string{"name": "ping", "arguments": "{}"},
+					}},
+				},
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	caps, err := ProbeCapabilities(context.Background(), AgentConfig{APIKey: "test", APIBase: srv.URL})
+	if err != nil {
+		t.Fatalf("ProbeCapabilities failed: %v", err)
+	}
+	if caps != (Capabilities{Tools: true}) {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+
+	srv.Close()
+	if _, err := ProbeCapabilities(context.Background(), AgentConfig{APIKey: "test", APIBase: srv.URL}); err == nil {
+		t.Error("expected an error for an unreachable endpoint")
+	}
+}
+
+func TestPlanJSONMode(t *testing.T) {
+	var format interface{}
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		format = req["response_format"]
+		return `{"description": "plan", "tasks": [{"type": "SEARCH", "description": "search"}]}`
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.Plan(context.Background(), "go"); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if format != nil {
+		t.Errorf("expected no response_format by default, got %v", format)
+	}
+
+	a, err = NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Capabilities: Capabilities{JSONMode: true}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.Plan(context.Background(), "go"); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if f, _ := format.(map[string]interface{}); f["type"] != "json_object" {
+		t.Errorf("expected JSON mode, got %v", format)
+	}
+}
+
+func TestFinalFormat(t *testing.T) {
+	var prompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return `{"description": "plan", "tasks": [{"type": "REPORT", "description": "report"}, {"type": "RENDER", "description": "render"}]}`
+	})
+
+	for _, tc := range []struct {
+		config AgentConfig
+		tasks  int
+	}{
+		{AgentConfig{}, 2},
+		{AgentConfig{RenderHTML: true}, 2},
+		{AgentConfig{FinalFormat: FinalFormatMarkdown}, 1},
+		{AgentConfig{FinalFormat: FinalFormatNone, RenderHTML: true}, 1},
+	} {
+		config := tc.config
+		config.APIKey, config.APIBase = "test", srv.URL
+		a, err := NewPlanningAgent(config, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		plan, err := a.Plan(context.Background(), "go")
+		if err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+		if len(plan.Tasks) != tc.tasks {
+			t.Errorf("%+v: expected %d tasks, got %+v", tc.config, tc.tasks, plan.Tasks)
+		}
+		if rendered := strings.Contains(prompt, "始终包含 RENDER 任务"); rendered != (tc.tasks == 2) {
+			t.Errorf("%+v: unexpected RENDER rule in the planner prompt", tc.config)
+		}
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", FinalFormat: "pdf"}, nil); err == nil {
+		t.Error("expected an error for an unknown final format")
+	}
+
+	task := Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": "# Title"}}
+	result, err := NewRenderSubagent(false, FinalFormatMarkdown, false, 0, RenderConfig{}, nil).Execute(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Output != "# Title" {
+		t.Errorf("expected the markdown unchanged, got %q", result.Output)
+	}
+}
+
+func TestRenderBoth(t *testing.T) {
+	task := Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": "# Title\n\nSome **bold** text."}}
+	for _, format := range []FinalFormat{FinalFormatHTML, FinalFormatTerm} {
+		result, err := NewRenderSubagent(false, format, true, 0, RenderConfig{Both: true}, nil).Execute(context.Background(), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		htmlOut, _ := result.Metadata["html"].(string)
+		term, _ := result.Metadata["term"].(string)
+		if !strings.Contains(htmlOut, "<strong>bold</strong>") || !strings.Contains(term, "bold") || strings.Contains(term, "<") {
+			t.Errorf("%s: unexpected representations html=%q term=%q", format, htmlOut, term)
+		}
+		primary := map[FinalFormat]string{FinalFormatHTML: htmlOut, FinalFormatTerm: term}[format]
+		if result.Output != primary {
+			t.Errorf("%s: expected the output in the final format, got %q", format, result.Output)
+		}
+	}
+
+	result, err := NewRenderSubagent(false, FinalFormatHTML, true, 0, RenderConfig{}, nil).Execute(context.Background(), task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result.Metadata["term"]; ok {
+		t.Error("expected no terminal text without Both")
+	}
+
+	// Both alone keeps the default layout
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", Render: RenderConfig{Both: true}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	want := DefaultRenderConfig
+	want.Both = true
+	if a.config.Render != want {
+		t.Errorf("expected %+v, got %+v", want, a.config.Render)
+	}
+}
+
+// emptySearchSubagent is a SEARCH subagent that finds nothing.
+type emptySearchSubagent struct{}
+
+func (emptySearchSubagent) Type() TaskType { return TaskTypeSearch }
+
+func (emptySearchSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	return Result{TaskType: TaskTypeSearch, Success: true, Output: "未找到结果。", Metadata: map[string]interface{}{"empty": true}}, nil
+}
+
+func TestReportWithoutSources(t *testing.T) {
+	var mu sync.Mutex
+	var prompts []string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		mu.Lock()
+		defer mu.Unlock()
+		prompts = append(prompts, req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string))
+		return "# Report"
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypeSearch] = emptySearchSubagent{}
+
+	results, err := a.Execute(context.Background(), &Plan{Tasks: []Task{{Type: TaskTypeSearch}, {Type: TaskTypeReport}}})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if noSources, _ := results[1].Metadata["no_sources"].(bool); !noSources {
+		t.Error("expected the report to be marked as written without sources")
+	}
+
+	// Searches that found something
+	a.subagents[TaskTypeSearch] = stubSubagent{TaskTypeSearch, "Title: Go\nURL: https://go.dev\nContent: Go"}
+	results, err = a.Execute(context.Background(), &Plan{Tasks: []Task{{Type: TaskTypeSearch}, {Type: TaskTypeReport}}})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if _, ok := results[1].Metadata["no_sources"]; ok {
+		t.Error("report with sources marked as written without them")
+	}
+
+	if len(prompts) != 2 || !strings.Contains(prompts[0], noSourcesInstruction) || strings.Contains(prompts[1], noSourcesInstruction) {
+		t.Errorf("expected only the first report to be told there are no sources")
+	}
+}
+
+func TestPlanConfig(t *testing.T) {
+	short := `{"description": "short", "tasks": [{"type": "SEARCH", "description": "s"}, {"type": "REPORT", "description": "r"}]}`
+	long := `{"description": "long", "tasks": [{"type": "SEARCH", "description": "s1"}, {"type": "SEARCH", "description": "s2"}, {"type": "ANALYZE", "description": "a"}, {"type": "REPORT", "description": "r"}, {"type": "RENDER", "description": "render"}]}`
+	var prompt string
+	reply, calls := sequentialReplies(short, long)
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return reply(req)
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Planner: PlanConfig{MinTasks: 3, MaxTasks: 4, Guidance: "为每个子问题单独搜索。"}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	plan, err := a.Plan(context.Background(), "go")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("expected the short plan to be requested again, got %d calls", *calls)
+	}
+	if plan.Description != "long" || len(plan.Tasks) != 4 {
+		t.Errorf("expected the long plan truncated to 4 tasks, got %+v", plan)
+	}
+	if !strings.Contains(prompt, "3-4 个任务") || !strings.Contains(prompt, "为每个子问题单独搜索。") || strings.Contains(prompt, "3-5") {
+		t.Errorf("planner prompt does not reflect the plan config:\n%s", prompt)
+	}
+
+	// A plan that stays too short is still used
+	srv = newFakeLLM(t, func(map[string]interface{}) string { return short })
+	a, err = NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Planner: PlanConfig{MinTasks: 3}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if plan, err := a.Plan(context.Background(), "go"); err != nil || len(plan.Tasks) != 2 {
+		t.Errorf("expected the short plan, got %+v, %v", plan, err)
+	}
+
+	if got := (PlanConfig{}).prompt(); !strings.Contains(got, "3-5") {
+		t.Errorf("unexpected default prompt %q", got)
+	}
+}
+
+func TestFinalOutput(t *testing.T) {
+	results := []Result{
+		{TaskType: TaskTypeSearch, Success: true, Output: "results"},
+		{TaskType: TaskTypeReport, Success: true, Output: "# Report"},
+		{TaskType: TaskTypeRender, Success: true, Output: "<h1>Report</h1>"},
+		{TaskType: TaskTypePodcast, Success: false, Output: "failed podcast"},
+	}
+
+	for _, tc := range []struct {
+		strategy OutputStrategy
+		results  []Result
+		want     string
+	}{
+		{"", results, "<h1>Report</h1>"},
+		{OutputPreferReport, results, "# Report"},
+		{OutputConcatenateAll, results, "results\n\n# Report\n\n<h1>Report</h1>\n\n"},
+		{OutputPreferReport, results[2:], "<h1>Report</h1>"},
+		{OutputPreferRender, results[:2], "# Report"},
+		{OutputPreferRender, results[:1], "results\n\n"},
+	} {
+		a, err := NewPlanningAgent(AgentConfig{APIKey: "test", OutputStrategy: tc.strategy}, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		if got := a.FinalOutput(tc.results); got != tc.want {
+			t.Errorf("%q with %d results: expected %q, got %q", tc.strategy, len(tc.results), tc.want, got)
+		}
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", OutputStrategy: "first"}, nil); err == nil {
+		t.Error("expected an error for an unknown output strategy")
+	}
+}
+
+func TestAnalyzeImages(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "chart.png")
+	png, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(probeImage, "data:image/png;base64,"))
+	if err := os.WriteFile(image, png, 0644); err != nil {
+		t.Fatal(err)
+	}
+	images := []interface{}{"https://example.com/a.jpg", image, filepath.Join(t.TempDir(), "missing.png")}
+
+	// An endpoint that records the user messages and optionally rejects images
+	var contents []interface{}
+	rejectImages := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		content := req["messages"].([]interface{})[1].(map[string]interface{})["content"]
+		contents = append(contents, content)
+		if _, multi := content.([]interface{}); multi && rejectImages {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"message": "image input is not supported", "type": "invalid_request_error"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object":  "chat.completion",
+			"choices": []map[string]interface{}{{"index": 0, "finish_reason": "stop", "message": map[string]interface{}{"role": "assistant", "content": "analysis"}}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	task := Task{Type: TaskTypeAnalyze, Description: "analyze the chart", Parameters: map[string]interface{}{"images": images}}
+	run := func(vision bool) {
+		t.Helper()
+		contents = nil
+		result, err := NewAnalysisSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", 1, vision, EnsembleConfig{}).Execute(context.Background(), task)
+		if err != nil || result.Output != "analysis" {
+			t.Fatalf("Execute failed: %+v, %v", result, err)
+		}
+	}
+
+	run(true)
+	parts, ok := contents[0].([]interface{})
+	if !ok || len(parts) != 3 {
+		t.Fatalf("expected text and two images, got %v", contents[0])
+	}
+	if parts[0].(map[string]interface{})["text"] != "analyze the chart" {
+		t.Errorf("unexpected text part %v", parts[0])
+	}
+	urls := []string{"https://example.com/a.jpg", probeImage}
+	for i, url := range urls {
+		if got := parts[i+1].(map[string]interface{})["image_url"].(map[string]interface{})["url"]; got != url {
+			t.Errorf("image %d: expected %q, got %q", i, url, got)
+		}
+	}
+
+	run(false)
+	if text, ok := contents[0].(string); !ok || !strings.Contains(text, image) {
+		t.Errorf("expected a text-only prompt listing the images, got %v", contents[0])
+	}
+
+	rejectImages = true
+	run(true)
+	if _, ok := contents[len(contents)-1].(string); len(contents) != 2 || !ok {
+		t.Errorf("expected a text-only retry, got %v", contents)
+	}
+}
+
+func TestSearchCircuitBreaker(t *testing.T) {
+	// A provider that is down and one that works
+	var downCalls, upCalls int
+	searchProviders["test-down"] = searchProvider{name: "Down", search: func(string, tool.SearchOptions) (string, error) {
+		downCalls++
+		return "", errors.New("timeout")
+	}}
+	searchProviders["test-up"] = searchProvider{name: "Up", search: func(query string, _ tool.SearchOptions) (string, error) {
+		upCalls++
+		return "results for " + query, nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-down")
+		delete(searchProviders, "test-up")
+		delete(searchBreakers, "test-down")
+		delete(searchBreakers, "test-up")
+	})
+
+	config := SearchConfig{Providers: []string{"test-down", "test-up"}, BreakerThreshold: 2, BreakerCooldown: 100 * time.Millisecond}
+	s := NewSearchSubagent(nil, "", false, nil, "", false, config)
+	search := func() {
+		t.Helper()
+		if result, err := s.webSearch(context.Background(), "go", tool.SearchOptions{}); err != nil || result != "results for go" {
+			t.Fatalf("webSearch failed: %q, %v", result, err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		search()
+	}
+	if downCalls != 2 || upCalls != 4 {
+		t.Errorf("expected the failing provider to be skipped after 2 failures, got %d calls", downCalls)
+	}
+
+	// After the cooldown one trial call fails and opens the breaker again
+	time.Sleep(config.BreakerCooldown)
+	search()
+	search()
+	if downCalls != 3 {
+		t.Errorf("expected one trial call after the cooldown, got %d calls in total", downCalls)
+	}
+
+	// The last provider of the chain is never skipped
+	s = NewSearchSubagent(nil, "", false, nil, "", false, SearchConfig{Providers: []string{"test-down"}, BreakerThreshold: 1})
+	for i := 0; i < 2; i++ {
+		if _, err := s.webSearch(context.Background(), "go", tool.SearchOptions{}); err == nil {
+			t.Fatal("expected an error from the failing provider")
+		}
+	}
+	if downCalls != 5 {
+		t.Errorf("expected the only provider to be called every time, got %d calls in total", downCalls)
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", Search: SearchConfig{Providers: []string{"bing"}}}, nil); err == nil {
+		t.Error("expected an error for an unknown search provider")
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	content := "# Title\n\nSome **bold** text that is long enough to be wrapped over several lines of the output.\n"
+	task := Task{Type: TaskTypeRender, Parameters: map[string]interface{}{"content": content}}
+	render := func(config RenderConfig) string {
+		t.Helper()
+		result, err := NewRenderSubagent(false, FinalFormatTerm, false, 0, config, nil).Execute(context.Background(), task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Output
+	}
+
+	if colored := render(DefaultRenderConfig); !strings.Contains(colored, "\x1b[") {
+		t.Errorf("expected ANSI escapes with color, got %q", colored)
+	}
+
+	plain := render(RenderConfig{Width: 30, LeftPad: 2})
+	if strings.Contains(plain, "\x1b") {
+		t.Errorf("expected no ANSI escapes without color, got %q", plain)
+	}
+	for _, line := range strings.Split(strings.TrimRight(plain, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > 30 || !strings.HasPrefix(line, "  ") {
+			t.Errorf("line %q does not fit width 30 with a left pad of 2", line)
+		}
+	}
+	if !strings.Contains(plain, "bold") {
+		t.Errorf("text lost when removing colors: %q", plain)
+	}
+}
+
+type heartbeatHandler struct {
+	checkpointHandler
+	mu    sync.Mutex
+	beats []string
+}
+
+func (h *heartbeatHandler) Heartbeat(taskType TaskType, activity string, elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.beats = append(h.beats, string(taskType)+" "+activity)
+}
+
+func (h *heartbeatHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.beats)
+}
+
+func TestHeartbeat(t *testing.T) {
+	interval := heartbeatInterval
+	heartbeatInterval = 10 * time.Millisecond
+	t.Cleanup(func() { heartbeatInterval = interval })
+
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		time.Sleep(100 * time.Millisecond)
+		return "analysis"
+	})
+	h := &heartbeatHandler{}
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, h)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.Execute(context.Background(), &Plan{Tasks: []Task{{Type: TaskTypeAnalyze, Description: "analyze"}}}); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	n := h.count()
+	if n == 0 || h.beats[0] != "ANALYZE model" {
+		t.Fatalf("expected heartbeats of the model call, got %q", h.beats)
+	}
+	time.Sleep(5 * heartbeatInterval)
+	if h.count() != n {
+		t.Error("heartbeats continued after the call returned")
+	}
+
+	// Cancellation stops the heartbeats of a call that has not returned
+	ctx, cancel := context.WithCancel(withHeartbeatTarget(context.Background(), h, TaskTypeSearch))
+	stop := startHeartbeat(ctx, "search")
+	defer stop()
+	time.Sleep(5 * heartbeatInterval)
+	cancel()
+	time.Sleep(heartbeatInterval)
+	n = h.count()
+	time.Sleep(5 * heartbeatInterval)
+	if h.count() != n || h.beats[n-1] != "SEARCH search" {
+		t.Errorf("expected search heartbeats to stop on cancellation, got %q", h.beats)
+	}
+}
+
+func TestTaskParams(t *testing.T) {
+	var params map[string]interface{}
+	json.Unmarshal([]byte(`{"count": "3", "top_k": 2.7, "to": "a@example.com", "tags": ["x", 1, {"y": 2}], "full": "true", "year": 2024, "name": "go"}`), &params)
+	task := Task{Parameters: params}
+
+	if n := task.IntParam("count"); n != 3 {
+		t.Errorf("expected the numeric string to parse as 3, got %d", n)
+	}
+	if n := task.IntParam("top_k"); n != 2 {
+		t.Errorf("expected 2.7 to truncate to 2, got %d", n)
+	}
+	if n := task.IntParam("name"); n != 0 {
+		t.Errorf("expected 0 for a non-numeric string, got %d", n)
+	}
+	if s := task.StringParam("year"); s != "2024" {
+		t.Errorf("expected the number formatted as 2024, got %q", s)
+	}
+	if s := task.StringParam("tags"); s != "" {
+		t.Errorf("expected no string for a list, got %q", s)
+	}
+	if got := task.StringSliceParam("to"); !reflect.DeepEqual(got, []string{"a@example.com"}) {
+		t.Errorf("expected a single string as a list of one, got %q", got)
+	}
+	if got := task.StringSliceParam("tags"); !reflect.DeepEqual(got, []string{"x", "1"}) {
+		t.Errorf("expected the scalar list items, got %q", got)
+	}
+	if got := task.StringSliceParam("missing"); got != nil {
+		t.Errorf("expected nil for a missing key, got %q", got)
+	}
+	if !task.BoolParam("full", false) || !task.BoolParam("missing", true) || task.BoolParam("name", false) {
+		t.Error("unexpected boolean parameters")
+	}
+	if !task.HasParam("name") || task.HasParam("missing") {
+		t.Error("unexpected HasParam results")
+	}
+}
+
+func TestPlanExamples(t *testing.T) {
+	var messages []interface{}
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		messages = req["messages"].([]interface{})
+		return `{"description": "plan", "tasks": [{"type": "SEARCH", "description": "s"}]}`
+	})
+
+	example := PlanExample{
+		Request: "合同法中的违约责任",
+		Plan: Plan{Description: "法律研究", Tasks: []Task{
+			{Type: TaskTypeSearch, Description: "搜索法条", Parameters: map[string]interface{}{"query": "违约责任 法条"}},
+			{Type: TaskTypeSearch, Description: "搜索判例"},
+			{Type: TaskTypeReport, Description: "撰写备忘录"},
+		}},
+	}
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, PlanExamples: []PlanExample{example}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if _, err := a.Plan(context.Background(), "侵权责任"); err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+
+	if len(messages) != 4 {
+		t.Fatalf("expected the system prompt, the example pair and the request, got %d messages", len(messages))
+	}
+	content := func(i int) (string, string) {
+		m := messages[i].(map[string]interface{})
+		return m["role"].(string), m["content"].(string)
+	}
+	if role, text := content(1); role != "user" || !strings.Contains(text, example.Request) {
+		t.Errorf("unexpected example request %s: %q", role, text)
+	}
+	role, text := content(2)
+	var plan Plan
+	if err := json.Unmarshal([]byte(text), &plan); role != "assistant" || err != nil || len(plan.Tasks) != 3 || plan.Tasks[1].Description != "搜索判例" {
+		t.Errorf("unexpected example plan %s: %q", role, text)
+	}
+	if role, text := content(3); role != "user" || !strings.Contains(text, "侵权责任") {
+		t.Errorf("unexpected request %s: %q", role, text)
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", PlanExamples: []PlanExample{{Request: "x"}}}, nil); err == nil {
+		t.Error("expected an error for an example without tasks")
+	}
+}
+
+func TestSearchInvalidUTF8(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "invalid_utf8.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchProviders["test-binary"] = searchProvider{name: "Binary", search: func(string, tool.SearchOptions) (string, error) {
+		return string(fixture), nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-binary")
+		delete(searchBreakers, "test-binary")
+	})
+
+	var prompts []string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		for _, m := range req["messages"].([]interface{}) {
+			prompts = append(prompts, m.(map[string]interface{})["content"].(string))
+		}
+		return "SUFFICIENT"
+	})
+
+	s := NewSearchSubagent(newFakeClient(srv), "", false, nil, "", false, SearchConfig{Providers: []string{"test-binary"}, DisableWikipedia: true})
+	result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "go"})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+
+	clean := func(text string) bool {
+		return utf8.ValidString(text) && !strings.ContainsAny(text, "\x00\x01\x1b\r�")
+	}
+	if len(prompts) == 0 {
+		t.Fatal("expected a reflection prompt")
+	}
+	for _, prompt := range append(prompts, result.Output) {
+		if !clean(prompt) {
+			t.Errorf("search results not sanitized: %q", prompt)
+		}
+	}
+	if !strings.Contains(result.Output, "Go 语言") || !strings.Contains(result.Output, "Go is fast and (simple[31m. 中文 truncated") {
+		t.Errorf("expected the valid text to be kept, got %q", result.Output)
+	}
+}
+
+func TestSearchReflectionModel(t *testing.T) {
+	searchProviders["test-static"] = searchProvider{name: "Static", search: func(string, tool.SearchOptions) (string, error) {
+		return "Go is a programming language.", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-static")
+		delete(searchBreakers, "test-static")
+	})
+
+	for _, tc := range []struct{ reflectionModel, want string }{
+		{"", "main-model"},
+		{"small-model", "small-model"},
+	} {
+		var models []string
+		srv := newFakeLLM(t, func(req map[string]interface{}) string {
+			models = append(models, req["model"].(string))
+			return "SUFFICIENT"
+		})
+		s := NewSearchSubagent(newFakeClient(srv), "main-model", false, nil, "", false, SearchConfig{Providers: []string{"test-static"}, DisableWikipedia: true, ReflectionModel: tc.reflectionModel})
+		result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "go"})
+		if err != nil || !result.Success {
+			t.Fatalf("Execute failed: %+v, %v", result, err)
+		}
+		if len(models) == 0 {
+			t.Fatal("expected a reflection request")
+		}
+		for _, model := range models {
+			if model != tc.want {
+				t.Errorf("reflection model %q: expected requests to %q, got %q", tc.reflectionModel, tc.want, model)
+			}
+		}
+	}
+}
+
+func TestSearchNovelty(t *testing.T) {
+	var searches atomic.Int32
+	searchProviders["test-repeat"] = searchProvider{name: "Repeat", search: func(query string, _ tool.SearchOptions) (string, error) {
+		searches.Add(1)
+		if query == "fresh" {
+			return "Title: Rust\nURL: https://rust.example\nContent: Rust guarantees memory safety without a garbage collector.", nil
+		}
+		return "Title: Go\nURL: https://go.example\nContent: Go is a statically typed language with goroutines.", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-repeat")
+		delete(searchBreakers, "test-repeat")
+	})
+
+	for _, tc := range []struct {
+		name       string
+		followUp   string
+		minNovelty float64
+		want       int32
+	}{
+		{"duplicates stop the loop", "again", 0, 2},
+		{"disabled", "again", -1, 4},
+		{"new content continues", "fresh", 0, 3},
+	} {
+		searches.Store(0)
+		srv := newFakeLLM(t, func(map[string]interface{}) string { return tc.followUp })
+		s := NewSearchSubagent(newFakeClient(srv), "", false, nil, "", false, SearchConfig{Providers: []string{"test-repeat"}, DisableWikipedia: true, MinNovelty: tc.minNovelty})
+		if result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "go"}); err != nil || !result.Success {
+			t.Fatalf("%s: Execute failed: %+v, %v", tc.name, result, err)
+		}
+		if n := searches.Load(); n != tc.want {
+			t.Errorf("%s: expected %d searches, got %d", tc.name, tc.want, n)
+		}
+	}
+
+	if n := novelty(shingles("Go has goroutines."), shingles("Go has goroutines. Rust has ownership.")); n != 0 {
+		t.Errorf("expected no novelty for contained text, got %v", n)
+	}
+	if n := novelty(shingles("完全不同的中文内容在这里"), shingles("Go has goroutines.")); n != 1 {
+		t.Errorf("expected full novelty for new text, got %v", n)
+	}
+}
+
+func TestSearchRelevance(t *testing.T) {
+	var queries []string
+	searchProviders["test-relevance"] = searchProvider{name: "Relevance", search: func(query string, _ tool.SearchOptions) (string, error) {
+		queries = append(queries, query)
+		if query == "golang generics type parameters" {
+			return "Title: Type parameters\nURL: https://go.dev/params\nContent: Type parameters make golang generics possible.\n\n", nil
+		}
+		return "Title: Golang generics\nURL: https://go.dev/generics\nContent: A tutorial on golang generics.\n\n" +
+			"Title: Pasta\nURL: https://food.example/pasta\nContent: How to cook pasta.\n\n", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-relevance")
+		delete(searchBreakers, "test-relevance")
+	})
+
+	for _, tc := range []struct {
+		name      string
+		heuristic bool
+		refocus   string
+		want      []string
+		searches  int
+	}{
+		{"heuristic with refocused search", true, "golang generics type parameters", []string{"go.dev/generics", "go.dev/params"}, 2},
+		{"model scores", false, "golang generics", []string{"go.dev/generics"}, 1},
+	} {
+		queries = nil
+		srv := newFakeLLM(t, func(req map[string]interface{}) string {
+			system := req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+			switch {
+			case strings.Contains(system, "不相关结果"):
+				return tc.refocus
+			case strings.Contains(system, "评估助手"):
+				return `{"scores": [0.9, 0.1]}`
+			}
+			return "SUFFICIENT"
+		})
+		s := NewSearchSubagent(newFakeClient(srv), "", false, nil, "", false, SearchConfig{
+			Providers:          []string{"test-relevance"},
+			DisableWikipedia:   true,
+			MinRelevance:       0.5,
+			HeuristicRelevance: tc.heuristic,
+		})
+
+		result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "golang generics"})
+		if err != nil || !result.Success {
+			t.Fatalf("%s: Execute failed: %+v, %v", tc.name, result, err)
+		}
+		if strings.Contains(result.Output, "pasta") || result.Metadata["filtered"] != 1 {
+			t.Errorf("%s: expected the off-topic result to be dropped, got %v:\n%s", tc.name, result.Metadata["filtered"], result.Output)
+		}
+		for _, url := range tc.want {
+			if !strings.Contains(result.Output, url) {
+				t.Errorf("%s: expected %s in the output:\n%s", tc.name, url, result.Output)
+			}
+		}
+		if len(queries) != tc.searches {
+			t.Errorf("%s: expected %d searches, got %q", tc.name, tc.searches, queries)
+		}
+	}
+
+	if r := heuristicRelevance("Go 泛型", "Go 语言的泛型"); r != 1 {
+		t.Errorf("expected full relevance, got %v", r)
+	}
+	if r := heuristicRelevance("Go 泛型", "Python 教程"); r != 0 {
+		t.Errorf("expected no relevance, got %v", r)
+	}
+}
+
+func TestDisableWebSearch(t *testing.T) {
+	var searches atomic.Int32
+	searchProviders["test-offline"] = searchProvider{name: "Offline", search: func(string, tool.SearchOptions) (string, error) {
+		searches.Add(1)
+		return "Title: Go\nURL: https://go.dev\nContent: Go", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-offline")
+		delete(searchBreakers, "test-offline")
+	})
+
+	var prompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return `{"description": "plan", "tasks": [{"type": "SEARCH", "description": "s"}, {"type": "ANALYZE", "description": "a"}, {"type": "REPORT", "description": "r"}]}`
+	})
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, DisableWebSearch: true, Search: SearchConfig{Providers: []string{"test-offline"}}}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	plan, err := a.Plan(context.Background(), "go")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if !strings.Contains(prompt, "网络搜索已禁用") {
+		t.Error("planner not told that web search is disabled")
+	}
+	if len(plan.Tasks) != 2 || plan.Tasks[0].Type != TaskTypeAnalyze {
+		t.Errorf("expected the SEARCH task to be removed, got %+v", plan.Tasks)
+	}
+
+	// Searches queued while running do not reach any provider
+	result, err := a.subagents[TaskTypeSearch].Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "go"})
+	if err != nil || !result.Success || result.Metadata["disabled"] != true {
+		t.Fatalf("expected an empty disabled search, got %+v, %v", result, err)
+	}
+	if n := searches.Load(); n != 0 {
+		t.Errorf("expected no search requests, got %d", n)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "charts"), 0755)
+	os.MkdirAll(filepath.Join(dir, "ppt_1", "dist", "assets"), 0755)
+	os.WriteFile(filepath.Join(dir, "charts", "chart.svg"), []byte("<svg/>"), 0644)
+	os.WriteFile(filepath.Join(dir, "ppt_1", "dist", "index.html"), []byte("<html></html>"), 0644)
+	os.WriteFile(filepath.Join(dir, "ppt_1", "dist", "assets", "app.js"), []byte("app()"), 0644)
+
+	results := []Result{
+		{TaskType: TaskTypeChart, Success: true, Metadata: map[string]interface{}{"chart_url": "/generated/charts/chart.svg"}},
+		{TaskType: TaskTypeReport, Success: true, Output: "# Report"},
+		{TaskType: TaskTypePodcast, Success: true, Metadata: map[string]interface{}{"script": []DialogueLine{{Speaker: "A", Text: "hi"}}}},
+		{TaskType: TaskTypePPT, Success: true, Metadata: map[string]interface{}{"ppt_url": "/generated/ppt_1/dist/"}},
+		{TaskType: TaskTypeExport, Success: true, Metadata: map[string]interface{}{"pdf_url": "/generated/exports/deleted.pdf"}},
+		{TaskType: TaskTypeChart, Success: false, Metadata: map[string]interface{}{"chart_url": "/generated/charts/chart.svg"}},
+	}
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", OutputDir: dir}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	out := a.Output(results)
+	if err := a.SaveManifest(out); err != nil {
+		t.Fatalf("SaveManifest failed: %v", err)
+	}
+
+	data, err := os.ReadFile(out.Manifest.Path)
+	if err != nil {
+		t.Fatalf("manifest.json not written: %v", err)
+	}
+	var saved Manifest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("bad manifest.json: %v", err)
+	}
+
+	sizes := make(map[string]int64)
+	for _, artifact := range saved.Artifacts {
+		if _, err := os.Stat(artifact.Path); err != nil {
+			t.Errorf("%s artifact %s does not exist", artifact.Kind, artifact.Path)
+		}
+		sizes[artifact.Kind] = artifact.Size
+	}
+	want := map[string]int64{"chart": 6, "ppt": 18, "report": 8}
+	for kind, size := range want {
+		if sizes[kind] != size {
+			t.Errorf("expected %s of %d bytes, got %d", kind, size, sizes[kind])
+		}
+	}
+	if len(saved.Artifacts) != 4 || sizes["podcast_script"] == 0 {
+		t.Errorf("expected the chart, ppt, report and podcast script only, got %+v", saved.Artifacts)
+	}
+	report, _ := os.ReadFile(filepath.Join(filepath.Dir(out.Manifest.Path), "report.md"))
+	if string(report) != "# Report" {
+		t.Errorf("unexpected report.md %q", report)
+	}
+}
+
+func TestAnalyzeEnsemble(t *testing.T) {
+	var mu sync.Mutex
+	var synthesisPrompt string
+	calls := make(map[string]int)
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		model := req["model"].(string)
+		mu.Lock()
+		defer mu.Unlock()
+		calls[model]++
+		switch model {
+		case "judge":
+			synthesisPrompt = req["messages"].([]interface{})[1].(map[string]interface{})["content"].(string)
+			return "combined analysis\n\n## 分歧\n- growth"
+		case "cautious":
+			return "growth is 2%"
+		}
+		return "growth is 5%"
+	})
+
+	ensemble := EnsembleConfig{Models: []string{"bold", "cautious"}, Synthesizer: "judge"}
+	a := NewAnalysisSubagent(newFakeClient(srv), "main", false, nil, "", 1, false, ensemble)
+
+	// Only tasks asking for an ensemble get one
+	result, err := a.Execute(context.Background(), Task{Type: TaskTypeAnalyze, Description: "analyze growth"})
+	if err != nil || result.Output != "growth is 5%" || calls["main"] != 1 || result.Metadata != nil {
+		t.Fatalf("expected a single model analysis, got %+v, %v, calls %v", result, err, calls)
+	}
+
+	result, err = a.Execute(context.Background(), Task{Type: TaskTypeAnalyze, Description: "analyze growth", Parameters: map[string]interface{}{"ensemble": true}})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if calls["bold"] != 1 || calls["cautious"] != 1 || calls["judge"] != 1 || calls["main"] != 1 {
+		t.Errorf("expected one call per ensemble model and the synthesizer, got %v", calls)
+	}
+	if !strings.HasPrefix(result.Output, "combined analysis") {
+		t.Errorf("expected the synthesis, got %q", result.Output)
+	}
+	if !strings.Contains(synthesisPrompt, "growth is 5%") || !strings.Contains(synthesisPrompt, "growth is 2%") || !strings.Contains(synthesisPrompt, "cautious") {
+		t.Errorf("synthesizer did not get both analyses:\n%s", synthesisPrompt)
+	}
+	analyses, _ := result.Metadata["analyses"].([]ModelAnalysis)
+	if len(analyses) != 2 || analyses[0].Model != "bold" || analyses[1].Output != "growth is 2%" {
+		t.Errorf("unexpected individual analyses %+v", analyses)
+	}
+}
+
+func TestReportRule(t *testing.T) {
+	types := func(tasks []Task) string {
+		var names []string
+		for _, task := range tasks {
+			names = append(names, string(task.Type))
+		}
+		return strings.Join(names, ",")
+	}
+	plan := func(tasks ...Task) *Plan { return &Plan{Tasks: tasks} }
+	search := Task{Type: TaskTypeSearch, Description: "s"}
+	links := Task{Type: TaskTypeSearch, Description: "s", Parameters: map[string]interface{}{"mode": "links"}}
+	report := Task{Type: TaskTypeReport, Description: "r"}
+	ppt := Task{Type: TaskTypePPT, Description: "p"}
+	podcast := Task{Type: TaskTypePodcast, Description: "p"}
+	render := Task{Type: TaskTypeRender, Description: "render"}
+	given := Task{Type: TaskTypePodcast, Description: "p", Parameters: map[string]interface{}{"content": "report"}}
+
+	for _, tc := range []struct {
+		rule ReportRule
+		plan *Plan
+		want string
+	}{
+		{"", plan(search, ppt, render), "SEARCH,REPORT,PPT,RENDER"},
+		{"", plan(search, podcast, report), "SEARCH,REPORT,PODCAST"},
+		{"", plan(search, report, ppt), "SEARCH,REPORT,PPT"},
+		{"", plan(links, render), "SEARCH,RENDER"},
+		{"", plan(given), "PODCAST"},
+		{ReportRuleReorder, plan(search, podcast, report), "SEARCH,REPORT,PODCAST"},
+		{ReportRuleReorder, plan(search, ppt), "SEARCH,PPT"},
+		{ReportRuleOff, plan(search, podcast, report), "SEARCH,PODCAST,REPORT"},
+	} {
+		a, err := NewPlanningAgent(AgentConfig{APIKey: "test", FinalFormat: FinalFormatTerm, ReportRule: tc.rule}, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		before := types(tc.plan.Tasks)
+		a.validatePlan(tc.plan)
+		if got := types(tc.plan.Tasks); got != tc.want {
+			t.Errorf("%q rule on %s: expected %s, got %s", tc.rule, before, tc.want, got)
+		}
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{APIKey: "test", ReportRule: "always"}, nil); err == nil {
+		t.Error("expected an error for an unknown report rule")
+	}
+}
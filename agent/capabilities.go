@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Capabilities are the optional chat completion features of the model
+// endpoint. Smaller and local models (e.g. behind an Ollama style endpoint)
+// often lack them, so the zero value only sends plain text requests and
+// parses JSON out of the replies, which every endpoint supports.
+type Capabilities struct {
+	// JSONMode requests JSON objects with response_format, used by the
+	// planner and the CHART, EXTRACT, PODCAST and PPT tasks.
+	JSONMode bool `json:"json_mode"`
+	// Tools requests the plan through the create_plan function tool.
+	Tools bool `json:"tools"`
+	// Streaming streams the report to a StreamHandler as it is written,
+	// and the slides of PPT tasks as they are previewed.
+	Streaming bool `json:"streaming"`
+	// Vision sends the images attached to ANALYZE tasks to the model.
+	Vision bool `json:"vision"`
+}
+
+// String lists the enabled capabilities in the format accepted by
+// ParseCapabilities.
+func (c Capabilities) String() string {
+	var names []string
+	if c.JSONMode {
+		names = append(names, "json")
+	}
+	if c.Tools {
+		names = append(names, "tools")
+	}
+	if c.Streaming {
+		names = append(names, "streaming")
+	}
+	if c.Vision {
+		names = append(names, "vision")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseCapabilities parses a comma separated list of "json", "tools",
+// "streaming" and "vision". An empty string or "none" enables none of them.
+func ParseCapabilities(s string) (Capabilities, error) {
+	var c Capabilities
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "", "none":
+		case "json":
+			c.JSONMode = true
+		case "tools":
+			c.Tools = true
+		case "streaming", "stream":
+			c.Streaming = true
+		case "vision":
+			c.Vision = true
+		default:
+			return Capabilities{}, fmt.Errorf("unknown capability %q (want json, tools, streaming or vision)", name)
+		}
+	}
+	return c, nil
+}
+
+// probeTimeout bounds each request made by ProbeCapabilities.
+const probeTimeout = 30 * time.Second
+
+// probeImage is a 1x1 red PNG sent to probe vision support.
+const probeImage = "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAADElEQVR4nGP4z8AAAAMBAQDJ/pLvAAAAAElFTkSuQmCC"
+
+// ProbeCapabilities detects the capabilities of the model configured in
+// config with one small request per feature. A feature is supported if its
+// request succeeds and the reply uses it. It returns an error only if the
+// endpoint cannot be reached at all.
+func ProbeCapabilities(ctx context.Context, config AgentConfig) (Capabilities, error) {
+	if config.Model == "" {
+		config.Model = "gpt-4o"
+	}
+	openaiConfig := openai.DefaultConfig(config.APIKey)
+	if config.APIBase != "" {
+		openaiConfig.BaseURL = config.APIBase
+	}
+	client := openai.NewClientWithConfig(openaiConfig)
+
+	var caps Capabilities
+	var errs []error
+	probe := func(feature string, f func(ctx context.Context) (bool, error)) bool {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+		ok, err := f(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", feature, err))
+		}
+		return ok
+	}
+	messages := func(content string) []openai.ChatCompletionMessage {
+		return []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: content}}
+	}
+
+	caps.JSONMode = probe("json", func(ctx context.Context) (bool, error) {
+		resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model:          config.Model,
+			Messages:       messages(`Reply with the JSON object {"ok": true}.`),
+			ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+			MaxTokens:      20,
+		})
+		if err != nil || len(resp.Choices) == 0 {
+			return false, err
+		}
+		var v map[string]interface{}
+		return json.Unmarshal([]byte(resp.Choices[0].Message.Content), &v) == nil, nil
+	})
+
+	caps.Tools = probe("tools", func(ctx context.Context) (bool, error) {
+		resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model:    config.Model,
+			Messages: messages("Call the ping function."),
+			Tools: []openai.Tool{{
+				Type:     openai.ToolTypeFunction,
+				Function: &openai.FunctionDefinition{Name: "ping", Parameters: json.RawMessage(`{"type":"object","properties":{}}`)},
+			}},
+			ToolChoice: openai.ToolChoice{Type: openai.ToolTypeFunction, Function: openai.ToolFunction{Name: "ping"}},
+			MaxTokens:  20,
+		})
+		if err != nil || len(resp.Choices) == 0 {
+			return false, err
+		}
+		return len(resp.Choices[0].Message.ToolCalls) > 0, nil
+	})
+
+	caps.Streaming = probe("streaming", func(ctx context.Context) (bool, error) {
+		stream, err := client.CreateChatCompletionStream(ctx, openai.ChatCompletionRequest{
+			Model:     config.Model,
+			Messages:  messages("Say ok."),
+			MaxTokens: 5,
+		})
+		if err != nil {
+			return false, err
+		}
+		defer stream.Close()
+		_, err = stream.Recv()
+		return err == nil, err
+	})
+
+	caps.Vision = probe("vision", func(ctx context.Context) (bool, error) {
+		resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model: config.Model,
+			Messages: []openai.ChatCompletionMessage{{
+				Role: openai.ChatMessageRoleUser,
+				MultiContent: []openai.ChatMessagePart{
+					{Type: openai.ChatMessagePartTypeText, Text: "What color is this image? Reply with one word."},
+					{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: probeImage, Detail: openai.ImageURLDetailLow}},
+				},
+			}},
+			MaxTokens: 5,
+		})
+		if err != nil || len(resp.Choices) == 0 {
+			return false, err
+		}
+		return strings.TrimSpace(resp.Choices[0].Message.Content) != "", nil
+	})
+
+	// API errors mean the feature is unsupported; only fail if the
+	// endpoint never answered
+	unreachable := 0
+	for _, err := range errs {
+		var apiErr *openai.APIError
+		var reqErr *openai.RequestError
+		if !errors.As(err, &apiErr) && !errors.As(err, &reqErr) {
+			unreachable++
+		}
+	}
+	if unreachable == 4 {
+		return Capabilities{}, fmt.Errorf("probing model capabilities failed: %w", errors.Join(errs...))
+	}
+	return caps, nil
+}
@@ -0,0 +1,344 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChartSubagent turns data in the context into an embeddable SVG chart.
+type ChartSubagent struct {
+	client             ChatCompleter
+	model              string
+	verbose            bool
+	interactionHandler InteractionHandler
+	outputDir          string
+	systemPrompt       string
+	jsonMode           bool
+}
+
+// NewChartSubagent creates a new ChartSubagent. jsonMode requests the chart
+// data with response_format instead of parsing it out of free text.
+func NewChartSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, outputDir string, systemPrompt string, jsonMode bool) *ChartSubagent {
+	return &ChartSubagent{
+		client:             client,
+		model:              model,
+		verbose:            verbose,
+		interactionHandler: interactionHandler,
+		outputDir:          outputDir,
+		systemPrompt:       systemPrompt,
+		jsonMode:           jsonMode,
+	}
+}
+
+// Type returns the task type this subagent handles.
+func (c *ChartSubagent) Type() TaskType {
+	return TaskTypeChart
+}
+
+// ChartSeries is one named series of values in a chart.
+type ChartSeries struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+}
+
+// ChartSpec describes a chart produced by the LLM.
+type ChartSpec struct {
+	Title  string        `json:"title"`
+	Type   string        `json:"type"` // "bar", "line" or "pie"
+	Labels []string      `json:"labels"`
+	Series []ChartSeries `json:"series"`
+}
+
+// Execute generates a chart from the input content.
+func (c *ChartSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	if c.verbose {
+		fmt.Println("📈 图表 Subagent")
+	}
+	if c.interactionHandler != nil {
+		c.interactionHandler.Log(fmt.Sprintf("> 图表 Subagent: %s", task.Description))
+	}
+
+	content := task.Description
+	if contextData := contextText(task); contextData != "" {
+		content = fmt.Sprintf("%s\n\n%s", task.Description, contextData)
+	}
+	// Exact figures extracted earlier take precedence over the prose
+	if data := extractedData(task); data != nil {
+		if tables, err := json.Marshal(data); err == nil {
+			content = fmt.Sprintf("%s\n\n提取的数据表 (JSON，优先使用其中的精确数值):\n%s", content, tables)
+		}
+	}
+
+	chartType := task.StringParam("chart_type")
+
+	spec, err := c.generateSpec(ctx, content, chartType)
+	if err != nil {
+		return Result{
+			TaskType:  TaskTypeChart,
+			Success:   false,
+			Error:     fmt.Sprintf("生成图表数据失败: %v", err),
+			ErrorKind: classifyError(err),
+		}, err
+	}
+	if chartType != "" {
+		spec.Type = chartType
+	}
+
+	chartsDir := filepath.Join(c.outputDir, "charts")
+	if err := os.MkdirAll(chartsDir, 0755); err != nil {
+		return Result{
+			TaskType:  TaskTypeChart,
+			Success:   false,
+			Error:     fmt.Sprintf("创建输出目录失败: %v", err),
+			ErrorKind: ErrIO,
+		}, err
+	}
+
+	fileName := fmt.Sprintf("chart_%d.svg", time.Now().UnixNano())
+	if err := os.WriteFile(filepath.Join(chartsDir, fileName), []byte(renderChartSVG(spec)), 0644); err != nil {
+		return Result{
+			TaskType:  TaskTypeChart,
+			Success:   false,
+			Error:     fmt.Sprintf("写入图表失败: %v", err),
+			ErrorKind: ErrIO,
+		}, err
+	}
+
+	url := fmt.Sprintf("/generated/charts/%s", fileName)
+
+	if c.verbose {
+		fmt.Printf("  ✓ 图表已生成: %s\n", url)
+	}
+	if c.interactionHandler != nil {
+		c.interactionHandler.Log(fmt.Sprintf("✓ 图表已生成: %s", url))
+	}
+
+	return Result{
+		TaskType: TaskTypeChart,
+		Success:  true,
+		Output:   fmt.Sprintf("![%s](%s)", spec.Title, url),
+		Metadata: map[string]interface{}{
+			"chart_url": url,
+			"chart":     spec,
+		},
+	}, nil
+}
+
+func (c *ChartSubagent) generateSpec(ctx context.Context, content, chartType string) (*ChartSpec, error) {
+	typeHint := "根据数据选择最合适的类型 (\"bar\", \"line\", \"pie\")。"
+	if chartType != "" {
+		typeHint = fmt.Sprintf("图表类型必须为 %q。", chartType)
+	}
+
+	systemPrompt := fmt.Sprintf(`你是一位数据可视化专家。从提供的文本中提取最适合可视化的数值数据。
+%s
+
+仅输出一个 JSON 对象，包含：
+- "title": 图表标题。
+- "type": 图表类型。
+- "labels": 字符串数组（X 轴类别或饼图扇区）。
+- "series": 数组，每个元素包含 "name" 和 "values"（数值数组，长度与 labels 相同）。
+
+Example:
+{"title": "Revenue by Year", "type": "bar", "labels": ["2022", "2023"], "series": [{"name": "Revenue", "values": [10.5, 12.3]}]}`, typeHint)
+	if c.systemPrompt != "" {
+		systemPrompt = c.systemPrompt + "\n" + typeHint
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model: c.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: systemPrompt,
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: content,
+			},
+		},
+		Temperature: 0,
+	}
+	if c.jsonMode {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+	resp, err := c.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response")
+	}
+
+	jsonContent := resp.Choices[0].Message.Content
+
+	// Clean up markdown code blocks if present
+	if idx := strings.Index(jsonContent, "```json"); idx != -1 {
+		jsonContent = jsonContent[idx+7:]
+	} else if idx := strings.Index(jsonContent, "```"); idx != -1 {
+		jsonContent = jsonContent[idx+3:]
+	}
+	if idx := strings.LastIndex(jsonContent, "```"); idx != -1 {
+		jsonContent = jsonContent[:idx]
+	}
+	jsonContent = strings.TrimSpace(jsonContent)
+
+	var spec ChartSpec
+	if err := json.Unmarshal([]byte(jsonContent), &spec); err != nil {
+		return nil, fmt.Errorf("解析图表 JSON 失败: %w", err)
+	}
+	if len(spec.Labels) == 0 || len(spec.Series) == 0 {
+		return nil, fmt.Errorf("图表数据为空")
+	}
+
+	return &spec, nil
+}
+
+var chartPalette = []string{"#22d3ee", "#a855f7", "#f97316", "#22c55e", "#ef4444", "#eab308", "#3b82f6", "#ec4899"}
+
+const (
+	chartWidth  = 800
+	chartHeight = 480
+	chartMargin = 60
+)
+
+// renderChartSVG draws the spec as a standalone SVG document.
+func renderChartSVG(spec *ChartSpec) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`+"\n", chartWidth, chartHeight, chartWidth, chartHeight))
+	sb.WriteString(`<rect width="100%" height="100%" fill="white"/>` + "\n")
+	sb.WriteString(fmt.Sprintf(`<text x="%d" y="30" text-anchor="middle" font-size="20">%s</text>`+"\n", chartWidth/2, html.EscapeString(spec.Title)))
+
+	switch spec.Type {
+	case "pie":
+		renderPie(&sb, spec)
+	case "line":
+		renderAxes(&sb, spec, true)
+	default:
+		renderAxes(&sb, spec, false)
+	}
+
+	// Legend (pie charts label their slices instead)
+	if spec.Type != "pie" {
+		for i, series := range spec.Series {
+			y := chartMargin + i*20
+			sb.WriteString(fmt.Sprintf(`<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, chartWidth-150, y, chartPalette[i%len(chartPalette)]))
+			sb.WriteString(fmt.Sprintf(`<text x="%d" y="%d" font-size="12">%s</text>`+"\n", chartWidth-132, y+11, html.EscapeString(series.Name)))
+		}
+	}
+
+	sb.WriteString("</svg>\n")
+	return sb.String()
+}
+
+// renderAxes draws a bar chart, or a line chart if line is set. The value
+// axis always includes zero, so bars of negative values go down from it.
+func renderAxes(sb *strings.Builder, spec *ChartSpec, line bool) {
+	maxVal, minVal := 0.0, 0.0
+	for _, series := range spec.Series {
+		for _, v := range series.Values {
+			maxVal = math.Max(maxVal, v)
+			minVal = math.Min(minVal, v)
+		}
+	}
+	if maxVal == minVal {
+		maxVal = 1
+	}
+
+	plotW := float64(chartWidth - 2*chartMargin - 100)
+	plotH := float64(chartHeight - 2*chartMargin)
+	originX := float64(chartMargin)
+	originY := float64(chartHeight - chartMargin)
+	// y returns the position of value v
+	y := func(v float64) float64 {
+		return originY - (v-minVal)/(maxVal-minVal)*plotH
+	}
+	zeroY := y(0)
+
+	sb.WriteString(fmt.Sprintf(`<line x1="%.0f" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#333"/>`+"\n", originX, zeroY, originX+plotW, zeroY))
+	sb.WriteString(fmt.Sprintf(`<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="#333"/>`+"\n", originX, originY, originX, originY-plotH))
+	sb.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" text-anchor="end" font-size="11">%g</text>`+"\n", originX-4, originY-plotH+4, maxVal))
+	if minVal < 0 {
+		sb.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.1f" text-anchor="end" font-size="11">0</text>`+"\n", originX-4, zeroY+4))
+		sb.WriteString(fmt.Sprintf(`<text x="%.0f" y="%.0f" text-anchor="end" font-size="11">%g</text>`+"\n", originX-4, originY+4, minVal))
+	}
+
+	slot := plotW / float64(len(spec.Labels))
+	for i, label := range spec.Labels {
+		x := originX + slot*(float64(i)+0.5)
+		sb.WriteString(fmt.Sprintf(`<text x="%.1f" y="%.0f" text-anchor="middle" font-size="11">%s</text>`+"\n", x, originY+16, html.EscapeString(label)))
+	}
+
+	barW := slot * 0.8 / float64(len(spec.Series))
+	for si, series := range spec.Series {
+		color := chartPalette[si%len(chartPalette)]
+		var points []string
+		for i, v := range series.Values {
+			if i >= len(spec.Labels) {
+				break
+			}
+			if line {
+				x := originX + slot*(float64(i)+0.5)
+				points = append(points, fmt.Sprintf("%.1f,%.1f", x, y(v)))
+				sb.WriteString(fmt.Sprintf(`<circle cx="%.1f" cy="%.1f" r="3" fill="%s"/>`+"\n", x, y(v), color))
+			} else {
+				x := originX + slot*float64(i) + slot*0.1 + barW*float64(si)
+				top, bottom := y(v), zeroY
+				if v < 0 {
+					top, bottom = zeroY, y(v)
+				}
+				sb.WriteString(fmt.Sprintf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, top, barW, bottom-top, color))
+			}
+		}
+		if line && len(points) > 0 {
+			sb.WriteString(fmt.Sprintf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n", strings.Join(points, " "), color))
+		}
+	}
+}
+
+func renderPie(sb *strings.Builder, spec *ChartSpec) {
+	values := spec.Series[0].Values
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	if total == 0 {
+		return
+	}
+
+	cx, cy, r := 300.0, 260.0, 180.0
+	angle := -math.Pi / 2
+	for i, v := range values {
+		if i >= len(spec.Labels) {
+			break
+		}
+		color := chartPalette[i%len(chartPalette)]
+		sweep := v / total * 2 * math.Pi
+		if v == total {
+			// An arc cannot end where it starts, so a whole pie is a circle
+			sb.WriteString(fmt.Sprintf(`<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"/>`+"\n", cx, cy, r, color))
+		} else {
+			x1, y1 := cx+r*math.Cos(angle), cy+r*math.Sin(angle)
+			x2, y2 := cx+r*math.Cos(angle+sweep), cy+r*math.Sin(angle+sweep)
+			largeArc := 0
+			if sweep > math.Pi {
+				largeArc = 1
+			}
+			sb.WriteString(fmt.Sprintf(`<path d="M%.1f,%.1f L%.1f,%.1f A%.1f,%.1f 0 %d 1 %.1f,%.1f Z" fill="%s"/>`+"\n", cx, cy, x1, y1, r, r, largeArc, x2, y2, color))
+		}
+		angle += sweep
+
+		y := chartMargin + i*20
+		sb.WriteString(fmt.Sprintf(`<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, 540, y, color))
+		sb.WriteString(fmt.Sprintf(`<text x="%d" y="%d" font-size="12">%s (%.1f%%)</text>`+"\n", 558, y+11, html.EscapeString(spec.Labels[i]), v/total*100))
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"encoding/xml"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderChartSVG(t *testing.T) {
+	rectHeight := regexp.MustCompile(`<rect x="[^"]*" y="[^"]*" width="[^"]*" height="(-?[0-9.]+)" fill="#`)
+	tests := []struct {
+		name string
+		spec ChartSpec
+		// want are fragments the SVG must contain
+		want []string
+		// bars is the number of bars, not counting legend entries
+		bars int
+	}{
+		{
+			name: "bar",
+			spec: ChartSpec{Title: "Sales", Type: "bar", Labels: []string{"Q1", "Q2"}, Series: []ChartSeries{{Name: "2024", Values: []float64{10, 20}}}},
+			want: []string{">Sales</text>", ">Q1</text>", ">2024</text>", ">20</text>"},
+			bars: 2,
+		},
+		{
+			name: "negative bar",
+			spec: ChartSpec{Title: "Profit", Type: "bar", Labels: []string{"A", "B"}, Series: []ChartSeries{{Name: "profit", Values: []float64{30, -10}}}},
+			// The baseline is at zero, a quarter of the plot above the bottom,
+			// and the negative bar goes down from it
+			want: []string{`y1="330.0" x2="640" y2="330.0"`, `y="330.0" width="232.0" height="90.0"`, ">-10</text>", ">0</text>"},
+			bars: 2,
+		},
+		{
+			name: "all zero",
+			spec: ChartSpec{Type: "bar", Labels: []string{"A"}, Series: []ChartSeries{{Name: "none", Values: []float64{0}}}},
+			want: []string{`height="0.0"`},
+			bars: 1,
+		},
+		{
+			name: "line",
+			spec: ChartSpec{Type: "line", Labels: []string{"Jan", "Feb", "Mar"}, Series: []ChartSeries{{Name: "users", Values: []float64{1, -2, 3}}}},
+			want: []string{"<polyline", `r="3"`},
+		},
+		{
+			name: "pie",
+			spec: ChartSpec{Type: "pie", Labels: []string{"Go", "Rust"}, Series: []ChartSeries{{Values: []float64{3, 1}}}},
+			want: []string{"<path", "Go (75.0%)", "Rust (25.0%)"},
+		},
+		{
+			name: "whole pie",
+			spec: ChartSpec{Type: "pie", Labels: []string{"Go", "Rust"}, Series: []ChartSeries{{Values: []float64{5, 0}}}},
+			want: []string{`<circle cx="300.0" cy="260.0" r="180.0"`, "Go (100.0%)"},
+		},
+		{
+			name: "escaped",
+			spec: ChartSpec{Title: "<b>&", Type: "bar", Labels: []string{"a<b"}, Series: []ChartSeries{{Name: "x", Values: []float64{1}}}},
+			want: []string{"&lt;b&gt;&amp;", "a&lt;b"},
+			bars: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svg := renderChartSVG(&tt.spec)
+			if err := xml.Unmarshal([]byte(svg), new(struct{})); err != nil {
+				t.Fatalf("invalid SVG: %v\n%s", err, svg)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(svg, want) {
+					t.Errorf("expected %q in\n%s", want, svg)
+				}
+			}
+
+			// Legend entries are 12 high; bars are the other filled rects
+			bars := 0
+			for _, m := range rectHeight.FindAllStringSubmatch(svg, -1) {
+				h, _ := strconv.ParseFloat(m[1], 64)
+				if h < 0 {
+					t.Errorf("negative rect height %g", h)
+				}
+				if m[1] != "12" {
+					bars++
+				}
+			}
+			if tt.spec.Type != "pie" && bars != tt.bars {
+				t.Errorf("expected %d bars, got %d", tt.bars, bars)
+			}
+			if tt.spec.Type == "pie" && strings.Contains(svg, "NaN") {
+				t.Errorf("invalid pie geometry:\n%s", svg)
+			}
+		})
+	}
+}
+
+func TestChartNoChoices(t *testing.T) {
+	m := filteredClient{&MockClient{Replies: []string{"{}"}}, 0}
+	c := NewChartSubagent(m, "gpt-4o", false, nil, t.TempDir(), "", false)
+	result, err := c.Execute(context.Background(), Task{Type: TaskTypeChart, Description: "sales", Parameters: map[string]interface{}{"content": "Q1 10, Q2 20"}})
+	if err == nil || result.Success || !strings.Contains(result.Error, "no choices") {
+		t.Errorf("expected an error, got %+v, %v", result, err)
+	}
+}
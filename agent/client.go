@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatCompleter sends chat completion requests. The planner and the
+// subagents depend on it rather than on *openai.Client, which implements it,
+// so they can be tested with a MockClient.
+type ChatCompleter interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+}
+
+// ChatStreamer is optionally implemented by a ChatCompleter to stream
+// completions. Subagents that stream fall back to plain requests without
+// it.
+type ChatStreamer interface {
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (*openai.ChatCompletionStream, error)
+}
+
+// Embedder creates embeddings, used by RETRIEVE tasks to index and search
+// the knowledge base.
+type Embedder interface {
+	CreateEmbeddings(ctx context.Context, conv openai.EmbeddingRequestConverter) (openai.EmbeddingResponse, error)
+}
+
+// ImageCreator is optionally implemented by a ChatCompleter to generate the
+// images of PPT slides.
+type ImageCreator interface {
+	CreateImage(ctx context.Context, req openai.ImageRequest) (openai.ImageResponse, error)
+}
+
+// MockClient is a ChatCompleter returning canned replies without network
+// calls, for testing the planner and the subagents. It is safe for
+// concurrent use.
+type MockClient struct {
+	// Replies are returned in order, one per request. The last reply is
+	// repeated once they run out.
+	Replies []string
+	// Respond, if set, computes the reply to each request instead.
+	Respond func(req openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error)
+
+	mu       sync.Mutex
+	requests []openai.ChatCompletionRequest
+}
+
+// CreateChatCompletion records req and returns the next canned reply.
+func (m *MockClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	m.mu.Lock()
+	n := len(m.requests)
+	m.requests = append(m.requests, req)
+	m.mu.Unlock()
+
+	var message openai.ChatCompletionMessage
+	switch {
+	case m.Respond != nil:
+		var err error
+		if message, err = m.Respond(req); err != nil {
+			return openai.ChatCompletionResponse{}, err
+		}
+	case len(m.Replies) > 0:
+		message = openai.ChatCompletionMessage{Content: m.Replies[min(n, len(m.Replies)-1)]}
+	default:
+		return openai.ChatCompletionResponse{}, fmt.Errorf("mock client has no reply for request %d", n+1)
+	}
+	if message.Role == "" {
+		message.Role = openai.ChatMessageRoleAssistant
+	}
+
+	finish := openai.FinishReasonStop
+	if len(message.ToolCalls) > 0 {
+		finish = openai.FinishReasonToolCalls
+	}
+	return openai.ChatCompletionResponse{
+		Model:   req.Model,
+		Choices: []openai.ChatCompletionChoice{{Message: message, FinishReason: finish}},
+	}, nil
+}
+
+// Requests returns the requests received so far.
+func (m *MockClient) Requests() []openai.ChatCompletionRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]openai.ChatCompletionRequest(nil), m.requests...)
+}
@@ -0,0 +1,340 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/smallnest/aiagents/tool"
+)
+
+func TestMockClient(t *testing.T) {
+	m := &MockClient{Replies: []string{"first", "second"}}
+	for _, want := range []string{"first", "second", "second"} {
+		resp, err := m.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{Model: "gpt-4o"})
+		if err != nil || resp.Choices[0].Message.Content != want || resp.Choices[0].Message.Role != openai.ChatMessageRoleAssistant {
+			t.Fatalf("expected %q, got %+v, %v", want, resp, err)
+		}
+	}
+	if len(m.Requests()) != 3 {
+		t.Errorf("expected 3 recorded requests, got %d", len(m.Requests()))
+	}
+
+	failing := &MockClient{Respond: func(openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error) {
+		return openai.ChatCompletionMessage{}, errors.New("boom")
+	}}
+	if _, err := failing.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err == nil {
+		t.Error("expected the error of Respond")
+	}
+	if _, err := (&MockClient{}).CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{}); err == nil {
+		t.Error("expected an error without replies")
+	}
+}
+
+func TestMockClientPlan(t *testing.T) {
+	m := &MockClient{Replies: []string{"```json\n" + `{"description": "go vs rust", "tasks": [{"type": "SEARCH", "description": "search"}, {"type": "REPORT", "description": "report"}]}` + "\n```"}}
+	a, err := NewPlanningAgent(AgentConfig{Client: m}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	plan, err := a.Plan(context.Background(), "go vs rust")
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if len(plan.Tasks) != 2 || plan.Tasks[0].Type != TaskTypeSearch || plan.Tasks[1].Type != TaskTypeReport {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if len(m.Requests()) != 1 {
+		t.Errorf("expected one planner request, got %d", len(m.Requests()))
+	}
+
+	if _, err := NewPlanningAgent(AgentConfig{Client: m, Knowledge: KnowledgeConfig{Paths: []string{"docs"}}}, nil); err == nil {
+		t.Error("expected an error for a knowledge base without an Embedder")
+	}
+}
+
+// filteredClient answers like its MockClient for the first replies requests
+// and without any choices afterwards, like a provider filtering the content.
+type filteredClient struct {
+	*MockClient
+	replies int
+}
+
+func (c filteredClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := c.MockClient.CreateChatCompletion(ctx, req)
+	if err == nil && len(c.Requests()) > c.replies {
+		resp.Choices = nil
+	}
+	return resp, err
+}
+
+// pptSubagent is a stub PPT subagent that returns the URL of a deck built
+// from the last report, without running npm.
+type pptSubagent struct{}
+
+func (pptSubagent) Type() TaskType { return TaskTypePPT }
+
+func (pptSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	report, ok := latestOutput(task, TaskTypeReport)
+	if !ok {
+		return Result{TaskType: TaskTypePPT, Success: false, Error: "no report"}, errors.New("no report")
+	}
+	return Result{
+		TaskType: TaskTypePPT,
+		Success:  true,
+		Output:   "slides for " + report,
+		Metadata: map[string]interface{}{"ppt_url": "/generated/slides/index.html"},
+	}, nil
+}
+
+func TestMockClientRunFull(t *testing.T) {
+	plan := `{"description": "go vs rust", "tasks": [{"type": "REPORT", "description": "write a report"}, {"type": "PODCAST", "description": "make a podcast"}, {"type": "PPT", "description": "make slides"}]}`
+	m := &MockClient{Respond: func(req openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error) {
+		system := req.Messages[0].Content
+		switch {
+		case strings.Contains(system, "报告写作助手"):
+			return openai.ChatCompletionMessage{Content: "# Go vs Rust\n\nBoth are fast."}, nil
+		case strings.Contains(system, "播客制作人"):
+			return openai.ChatCompletionMessage{Content: `[{"speaker": "Host 1", "text": "Go or Rust?"}, {"speaker": "Host 2", "text": "Both are fast."}]`}, nil
+		}
+		return openai.ChatCompletionMessage{Content: plan}, nil
+	}}
+	a, err := NewPlanningAgent(AgentConfig{Client: m}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	a.subagents[TaskTypePPT] = pptSubagent{}
+
+	out, err := a.RunFull(context.Background(), "compare go and rust with a podcast and slides")
+	if err != nil {
+		t.Fatalf("RunFull failed: %v", err)
+	}
+	if out.Report != "# Go vs Rust\n\nBoth are fast." {
+		t.Errorf("unexpected report %q", out.Report)
+	}
+	if len(out.PodcastScript) != 2 || out.PodcastScript[0].Speaker != "Host 1" || out.PodcastScript[1].Text != "Both are fast." {
+		t.Errorf("unexpected podcast script %+v", out.PodcastScript)
+	}
+	if out.PPTUrl != "/generated/slides/index.html" {
+		t.Errorf("unexpected PPT URL %q", out.PPTUrl)
+	}
+	if len(out.Results) != 3 || out.Results[2].Output != "slides for "+out.Report {
+		t.Errorf("expected the results of the three tasks, got %+v", out.Results)
+	}
+
+	// Run returns the same report
+	report, err := a.Run(context.Background(), "compare go and rust with a podcast and slides")
+	if err != nil || report != out.Report {
+		t.Errorf("Run() = %q, %v, want %q", report, err, out.Report)
+	}
+}
+
+func TestMockClientMissingInfo(t *testing.T) {
+	m := &MockClient{Replies: []string{"MISSING_INFO: go 1.22 release notes"}}
+	a := NewAnalysisSubagent(m, "gpt-4o", false, nil, "", 1, false, EnsembleConfig{})
+
+	result, err := a.Execute(context.Background(), Task{Type: TaskTypeAnalyze, Description: "analyze go"})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if len(result.NewTasks) != 2 || result.NewTasks[0].StringParam("query") != "go 1.22 release notes" || result.NewTasks[1].Type != TaskTypeAnalyze {
+		t.Fatalf("expected a search and the re-queued analysis, got %+v", result.NewTasks)
+	}
+
+	// The re-queued analysis has used up its attempts and must answer; a
+	// request for more information is asked once more
+	retry := result.NewTasks[1]
+	m.Replies = []string{"", "MISSING_INFO: more", "analysis of go"}
+	result, err = a.Execute(context.Background(), retry)
+	if err != nil || len(result.NewTasks) != 0 || result.Output != "analysis of go" {
+		t.Fatalf("expected the analysis without more searches, got %+v, %v", result, err)
+	}
+	requests := m.Requests()
+	if prompt := requests[1].Messages[0].Content; !strings.Contains(prompt, "已达到补充搜索上限") || strings.Contains(prompt, "请仅回复 'MISSING_INFO") {
+		t.Errorf("expected the attempt limit instead of the MISSING_INFO option in the prompt:\n%s", prompt)
+	}
+	if len(requests) != 3 || len(requests[2].Messages) != 4 {
+		t.Fatalf("expected the analysis to be asked again, got %d requests", len(requests))
+	}
+
+	// An analysis that still requests more information fails
+	m = &MockClient{Replies: []string{"MISSING_INFO: more"}}
+	a = NewAnalysisSubagent(m, "gpt-4o", false, nil, "", 1, false, EnsembleConfig{})
+	result, err = a.Execute(context.Background(), retry)
+	if err == nil || result.Success || result.ErrorKind != ErrParse || strings.HasPrefix(result.Output, "MISSING_INFO:") {
+		t.Errorf("expected a failed analysis, got %+v, %v", result, err)
+	}
+	if len(m.Requests()) != 2 {
+		t.Errorf("expected two requests, got %d", len(m.Requests()))
+	}
+}
+
+func TestMockClientSearchReflection(t *testing.T) {
+	var queries []string
+	searchProviders["test-mock"] = searchProvider{name: "Mock", search: func(query string, _ tool.SearchOptions) (string, error) {
+		queries = append(queries, query)
+		return "Title: " + query + "\nURL: https://example.com/" + query + "\nContent: Something new about " + query + " every time.", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-mock")
+		delete(searchBreakers, "test-mock")
+	})
+
+	var reflections atomic.Int32
+	m := &MockClient{Respond: func(openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error) {
+		if reflections.Add(1) == 1 {
+			return openai.ChatCompletionMessage{Content: "rust ownership"}, nil
+		}
+		return openai.ChatCompletionMessage{Content: "SUFFICIENT"}, nil
+	}}
+	s := NewSearchSubagent(m, "gpt-4o", false, nil, "", false, SearchConfig{Providers: []string{"test-mock"}, DisableWikipedia: true})
+
+	result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "go"})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if len(queries) != 2 || queries[1] != "rust ownership" {
+		t.Errorf("expected the follow-up query of the reflection, got %q", queries)
+	}
+	if n := reflections.Load(); n != 2 {
+		t.Errorf("expected 2 reflection requests, got %d", n)
+	}
+}
+
+// guidanceHandler answers the first request for guidance with guidance.
+type guidanceHandler struct {
+	checkpointHandler
+	guidance string
+	asked    []string
+}
+
+func (h *guidanceHandler) RequestGuidance(context string) (string, bool) {
+	h.asked = append(h.asked, context)
+	if len(h.asked) > 1 {
+		return "", false
+	}
+	return h.guidance, true
+}
+
+func TestMockClientSearchGuidance(t *testing.T) {
+	var queries []string
+	searchProviders["test-mock"] = searchProvider{name: "Mock", search: func(query string, _ tool.SearchOptions) (string, error) {
+		queries = append(queries, query)
+		return "Title: " + query + "\nURL: https://example.com/" + query + "\nContent: Something new about " + query + " every time.", nil
+	}}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-mock")
+		delete(searchBreakers, "test-mock")
+	})
+
+	var reflections atomic.Int32
+	m := &MockClient{Respond: func(req openai.ChatCompletionRequest) (openai.ChatCompletionMessage, error) {
+		prompt := req.Messages[len(req.Messages)-1].Content
+		switch reflections.Add(1) {
+		case 1:
+			return openai.ChatCompletionMessage{Content: "rust ownership"}, nil
+		case 2:
+			// The follow-up query depends on the guidance in the prompt
+			if strings.Contains(prompt, "用户的搜索指导") && strings.Contains(prompt, "- focus on the borrow checker") {
+				return openai.ChatCompletionMessage{Content: "rust borrow checker"}, nil
+			}
+			return openai.ChatCompletionMessage{Content: "rust lifetimes"}, nil
+		}
+		return openai.ChatCompletionMessage{Content: "SUFFICIENT"}, nil
+	}}
+	h := &guidanceHandler{guidance: "focus on the borrow checker"}
+	s := NewSearchSubagent(m, "gpt-4o", false, h, "", true, SearchConfig{Providers: []string{"test-mock"}, DisableWikipedia: true})
+
+	result, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "rust"})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if len(queries) != 3 || queries[1] != "rust ownership" || queries[2] != "rust borrow checker" {
+		t.Errorf("expected the guidance to change the second follow-up query, got %q", queries)
+	}
+	if len(h.asked) != 2 || !strings.Contains(h.asked[0], "rust ownership") {
+		t.Errorf("expected guidance to be requested after each of the first two iterations, got %q", h.asked)
+	}
+
+	// Without guidance the reflection chooses on its own
+	queries = nil
+	reflections.Store(0)
+	s = NewSearchSubagent(m, "gpt-4o", false, h, "", false, SearchConfig{Providers: []string{"test-mock"}, DisableWikipedia: true})
+	if _, err := s.Execute(context.Background(), Task{Type: TaskTypeSearch, Description: "rust"}); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(queries) != 3 || queries[2] != "rust lifetimes" {
+		t.Errorf("expected the unguided follow-up query, got %q", queries)
+	}
+}
+
+func TestMockClientSearchLinks(t *testing.T) {
+	var opts tool.SearchOptions
+	searchProviders["test-links"] = searchProvider{
+		name: "Links",
+		search: func(string, tool.SearchOptions) (string, error) {
+			t.Error("links mode ran a full search")
+			return "", nil
+		},
+		results: func(_ string, o tool.SearchOptions) ([]tool.SearchResult, error) {
+			opts = o
+			return []tool.SearchResult{
+				{Title: "The Go Programming Language", URL: "https://go.dev"},
+				{URL: "https://www.rust-lang.org"},
+			}, nil
+		},
+	}
+	t.Cleanup(func() {
+		delete(searchProviders, "test-links")
+		delete(searchBreakers, "test-links")
+	})
+
+	m := &MockClient{Replies: []string{"SUFFICIENT"}}
+	s := NewSearchSubagent(m, "gpt-4o", false, nil, "", false, SearchConfig{Providers: []string{"test-links"}})
+	result, err := s.Execute(context.Background(), Task{
+		Type:        TaskTypeSearch,
+		Description: "go vs rust",
+		Parameters:  map[string]interface{}{"mode": "links"},
+	})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if n := len(m.Requests()); n != 0 {
+		t.Errorf("expected no model calls in links mode, got %d", n)
+	}
+	want := "- [The Go Programming Language](https://go.dev)\n- [https://www.rust-lang.org](https://www.rust-lang.org)\n"
+	if result.Output != want {
+		t.Errorf("Output = %q, want %q", result.Output, want)
+	}
+	if links, _ := result.Metadata["links"].([]tool.SearchResult); len(links) != 2 || result.Metadata["mode"] != "links" {
+		t.Errorf("expected the links in the metadata, got %v", result.Metadata)
+	}
+	if opts.MaxResults != defaultLinkResults {
+		t.Errorf("expected %d results by default, got %d", defaultLinkResults, opts.MaxResults)
+	}
+}
+
+func TestMockClientJSONRepair(t *testing.T) {
+	m := &MockClient{Replies: []string{
+		`{"tables": [{"title": "T", "columns": ["A", "B"], "rows": [[1]]}]}`,
+		`{"tables": [{"title": "T", "columns": ["A", "B"], "rows": [[1, 2]]}]}`,
+	}}
+	e := NewExtractSubagent(m, "gpt-4o", false, nil, "", false)
+
+	result, err := e.Execute(context.Background(), Task{Type: TaskTypeExtract, Description: "numbers"})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	requests := m.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected a repair request, got %d requests", len(requests))
+	}
+	repair := requests[1].Messages
+	if last := repair[len(repair)-1]; !strings.Contains(last.Content, "你的输出无效") || repair[len(repair)-2].Role != openai.ChatMessageRoleAssistant {
+		t.Errorf("expected the invalid reply and a correction request, got %+v", repair)
+	}
+}
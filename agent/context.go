@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/smallnest/aiagents/tool"
+)
+
+// DefaultContextRules lists, for each task type, the task types whose
+// outputs are injected into its OutputsKey parameter. Downstream tasks only
+// see the refined outputs they need, e.g. REPORT gets the analysis rather
+// than the raw search results. REPORT and CHART read the tables of EXTRACT
+// from the scratchpad (see ExtractedDataKey).
+var DefaultContextRules = map[TaskType][]TaskType{
+	TaskTypeAnalyze: {TaskTypeSearch, TaskTypeRetrieve},
+	TaskTypeReport:  {TaskTypeAnalyze, TaskTypeChart},
+	TaskTypeChart:   {TaskTypeSearch, TaskTypeRetrieve, TaskTypeAnalyze},
+	TaskTypeExtract: {TaskTypeSearch, TaskTypeRetrieve, TaskTypeAnalyze},
+	TaskTypeRender:  {TaskTypeReport},
+	TaskTypeExport:  {TaskTypeReport},
+	TaskTypePodcast: {TaskTypeReport},
+	TaskTypePPT:     {TaskTypeReport},
+	TaskTypeEmail:   {TaskTypeReport},
+}
+
+// OutputsKey is the task parameter that holds the []TaskOutput of the prior
+// tasks relevant to a task, in execution order.
+const OutputsKey = "outputs"
+
+// FilesKey is the task parameter that holds the paths of the files, such
+// as exported documents, produced by earlier tasks.
+const FilesKey = "files"
+
+// noSourcesKey is the task parameter set to true when every SEARCH task of
+// the plan so far found nothing.
+const noSourcesKey = "_no_sources"
+
+// TaskOutput is the output of a completed task kept for later tasks.
+type TaskOutput struct {
+	TaskType TaskType `json:"task_type"`
+	Output   string   `json:"output"`
+	// TaskID is the ID of the task, if it has one.
+	TaskID string `json:"task_id,omitempty"`
+}
+
+// String formats the output for inclusion in a prompt.
+func (o TaskOutput) String() string {
+	if o.TaskID != "" {
+		return fmt.Sprintf("Output from %s task %s:\n%s", o.TaskType, o.TaskID, o.Output)
+	}
+	return fmt.Sprintf("Output from %s task:\n%s", o.TaskType, o.Output)
+}
+
+// taskOutputs returns the prior outputs injected into task.
+func taskOutputs(task Task) []TaskOutput {
+	outputs, _ := task.Parameters[OutputsKey].([]TaskOutput)
+	return outputs
+}
+
+// contextText joins the prior outputs injected into task for a prompt. It
+// returns "" if there are none.
+func contextText(task Task) string {
+	outputs := taskOutputs(task)
+	parts := make([]string, len(outputs))
+	for i, o := range outputs {
+		parts[i] = o.String()
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// latestOutput returns the most recent prior output of type taskType
+// injected into task, or else the most recent prior output of any type.
+func latestOutput(task Task, taskType TaskType) (string, bool) {
+	outputs := taskOutputs(task)
+	for i := len(outputs) - 1; i >= 0; i-- {
+		if outputs[i].TaskType == taskType {
+			return strings.TrimSpace(outputs[i].Output), true
+		}
+	}
+	if len(outputs) > 0 {
+		return strings.TrimSpace(outputs[len(outputs)-1].Output), true
+	}
+	return "", false
+}
+
+// runState is what a plan run has produced so far for later tasks.
+type runState struct {
+	outputs []TaskOutput
+	sources []tool.SearchResult // from SEARCH tasks, in order without duplicates
+	files   []string            // from Result.Metadata["path"]
+	// scratchpad is shared by the tasks of the run; nil if the run has none
+	scratchpad *Scratchpad
+
+	searches      int // successful SEARCH tasks
+	emptySearches int // SEARCH tasks that found nothing
+}
+
+// noSources reports whether SEARCH tasks ran, all of them found nothing and
+// no other task, such as RETRIEVE, provided sources.
+func (s *runState) noSources() bool {
+	return s.searches > 0 && s.emptySearches == s.searches && len(s.sources) == 0
+}
+
+// add records the successful result of task.
+func (s *runState) add(task Task, result Result) {
+	taskType := task.Type
+	s.outputs = append(s.outputs, TaskOutput{TaskType: taskType, TaskID: task.ID, Output: result.Output})
+	if found, ok := result.Metadata["sources"].([]tool.SearchResult); ok {
+		s.sources = mergeSources(s.sources, found)
+	}
+	if path, ok := result.Metadata["path"].(string); ok && path != "" {
+		s.files = append(s.files, path)
+	}
+	if taskType == TaskTypeSearch {
+		s.searches++
+		if empty, _ := result.Metadata["empty"].(bool); empty {
+			s.emptySearches++
+		}
+	}
+}
+
+// selectContext returns the prior outputs relevant to a task of type
+// taskType according to rules, dropping duplicate outputs. Task types
+// without a rule, and tasks whose relevant types produced nothing yet,
+// receive every prior output.
+func selectContext(outputs []TaskOutput, taskType TaskType, rules map[TaskType][]TaskType) []TaskOutput {
+	relevant := func(TaskType) bool { return true }
+	if types, ok := rules[taskType]; ok {
+		allowed := make(map[TaskType]bool, len(types))
+		for _, t := range types {
+			allowed[t] = true
+		}
+		matched := false
+		for _, o := range outputs {
+			if allowed[o.TaskType] {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			relevant = func(t TaskType) bool { return allowed[t] }
+		}
+	}
+
+	var selected []TaskOutput
+	seen := make(map[string]bool)
+	for _, o := range outputs {
+		if !relevant(o.TaskType) || seen[o.Output] {
+			continue
+		}
+		seen[o.Output] = true
+		selected = append(selected, o)
+	}
+	return selected
+}
+
+// selectInputs returns the prior outputs of the tasks with the given IDs,
+// in execution order and without duplicate outputs.
+func selectInputs(outputs []TaskOutput, inputs []string) []TaskOutput {
+	wanted := make(map[string]bool, len(inputs))
+	for _, id := range inputs {
+		wanted[id] = true
+	}
+
+	var selected []TaskOutput
+	seen := make(map[string]bool)
+	for _, o := range outputs {
+		if o.TaskID == "" || !wanted[o.TaskID] || seen[o.Output] {
+			continue
+		}
+		seen[o.Output] = true
+		selected = append(selected, o)
+	}
+	return selected
+}
+
+// nextTaskID returns an ID for a new task of type taskType that is not in
+// used, such as "search3", and adds it to used.
+func nextTaskID(used map[string]bool, taskType TaskType) string {
+	prefix := strings.ToLower(string(taskType))
+	for n := 1; ; n++ {
+		if id := fmt.Sprintf("%s%d", prefix, n); !used[id] {
+			used[id] = true
+			return id
+		}
+	}
+}
+
+// linkNewTasks prepares the tasks inserted by a task with declared inputs.
+// New tasks get IDs, and those with inputs, such as a re-queued ANALYZE
+// task, also receive the outputs of the new tasks before them; otherwise
+// the searches an analysis asked for would not reach it.
+func linkNewTasks(tasks []Task, parent Task, newTasks []Task) []Task {
+	if len(parent.Inputs) == 0 {
+		return newTasks
+	}
+	used := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		used[task.ID] = true
+	}
+
+	linked := make([]Task, len(newTasks))
+	var added []string
+	for i, task := range newTasks {
+		if task.ID == "" {
+			task.ID = nextTaskID(used, task.Type)
+		}
+		if len(task.Inputs) > 0 {
+			task.Inputs = append(append([]string(nil), task.Inputs...), added...)
+		}
+		added = append(added, task.ID)
+		linked[i] = task
+	}
+	return linked
+}
@@ -0,0 +1,7 @@
+// Package agent implements the planning agent and its subagents.
+//
+// It was moved here from the agent package of github.com/smallnest/goskills
+// and has since grown beyond it, e.g. InteractionHandler.ConfirmAction, so
+// the commands under cmd/ import this package rather than the upstream one.
+// Only the config package of goskills is still used.
+package agent
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailConfig configures the SMTP server used by EMAIL tasks.
+type EmailConfig struct {
+	// Host is the SMTP server host. Empty disables sending.
+	Host string
+	// Port is the SMTP server port. Zero uses 587.
+	Port     int
+	Username string
+	Password string
+	// From is the sender address. Empty uses Username.
+	From string
+}
+
+// sendMailFunc matches smtp.SendMail.
+type sendMailFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+// EmailSubagent sends the report, and the files produced by earlier tasks,
+// by email. A PPT task only produces a file to attach, its source zip, with
+// PPTConfig.SourceZip.
+type EmailSubagent struct {
+	verbose            bool
+	interactionHandler InteractionHandler
+	outputDir          string
+	config             EmailConfig
+	sendMail           sendMailFunc
+}
+
+// NewEmailSubagent creates a new EmailSubagent.
+func NewEmailSubagent(verbose bool, interactionHandler InteractionHandler, outputDir string, config EmailConfig) *EmailSubagent {
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	if config.From == "" {
+		config.From = config.Username
+	}
+	return &EmailSubagent{
+		verbose:            verbose,
+		interactionHandler: interactionHandler,
+		outputDir:          outputDir,
+		config:             config,
+		sendMail:           smtp.SendMail,
+	}
+}
+
+// Type returns the task type this subagent handles.
+func (e *EmailSubagent) Type() TaskType {
+	return TaskTypeEmail
+}
+
+// Execute sends the report as an HTML email to the recipients in the "to"
+// parameter. The optional "subject" and "body" parameters set the subject
+// and a note above the report. Files exported by earlier tasks and paths in
+// the "attachments" parameter are attached if they are in the output
+// directory. Sending failures are returned as a failed Result without an
+// error, so the rest of the plan still runs.
+func (e *EmailSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	if e.verbose {
+		fmt.Println("📧 邮件 Subagent")
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(fmt.Sprintf("> 邮件 Subagent: %s", task.Description))
+	}
+
+	if e.config.Host == "" {
+		return e.failed("未配置 SMTP 服务器，无法发送邮件", ErrTool), nil
+	}
+	recipients, err := emailRecipients(task)
+	if err != nil {
+		return e.failed(err.Error(), ErrTool), nil
+	}
+
+	subject := task.StringParam("subject")
+	if subject == "" {
+		subject = task.Description
+	}
+	body := renderMarkdownHTML(reportContent(task))
+	if note := task.StringParam("body"); note != "" {
+		body = strings.Replace(body, "<body>", "<body>\n"+renderMarkdownHTMLFragment(note), 1)
+	}
+
+	var attachments []string
+	for _, path := range append(task.StringSliceParam(FilesKey), task.StringSliceParam("attachments")...) {
+		if !e.inOutputDir(path) {
+			e.warn(fmt.Sprintf("⚠️ 已跳过输出目录之外的附件: %s", path))
+			continue
+		}
+		attachments = append(attachments, path)
+	}
+
+	msg, err := buildEmail(e.config.From, recipients, subject, body, attachments)
+	if err != nil {
+		return e.failed(fmt.Sprintf("生成邮件失败: %v", err), ErrIO), nil
+	}
+
+	var auth smtp.Auth
+	if e.config.Username != "" {
+		auth = smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host)
+	}
+	addr := net.JoinHostPort(e.config.Host, strconv.Itoa(e.config.Port))
+	if err := e.sendMail(addr, auth, e.config.From, recipients, msg); err != nil {
+		return e.failed(fmt.Sprintf("发送邮件失败: %v", err), ErrTool), nil
+	}
+
+	if e.verbose {
+		fmt.Printf("  ✓ 邮件已发送至 %s\n", strings.Join(recipients, ", "))
+	}
+	return Result{
+		TaskType: TaskTypeEmail,
+		Success:  true,
+		Output:   fmt.Sprintf("邮件已发送至 %s (附件 %d 个)", strings.Join(recipients, ", "), len(attachments)),
+		Metadata: map[string]interface{}{
+			"recipients":  recipients,
+			"attachments": attachments,
+		},
+	}, nil
+}
+
+func (e *EmailSubagent) failed(message string, kind ErrorKind) Result {
+	e.warn("❌ " + message)
+	return Result{
+		TaskType:  TaskTypeEmail,
+		Success:   false,
+		Error:     message,
+		ErrorKind: kind,
+	}
+}
+
+// warn reports a warning to the terminal (in verbose mode) and the user interface.
+func (e *EmailSubagent) warn(message string) {
+	if e.verbose {
+		fmt.Println(message)
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(message)
+	}
+}
+
+// inOutputDir reports whether path is inside the output directory, so a
+// plan cannot attach arbitrary local files.
+func (e *EmailSubagent) inOutputDir(path string) bool {
+	dir, err := filepath.Abs(e.outputDir)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, abs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// emailRecipients returns the addresses in the "to" parameter, which may be
+// a list or a comma separated string.
+func emailRecipients(task Task) ([]string, error) {
+	var to []string
+	for _, s := range task.StringSliceParam("to") {
+		to = append(to, strings.Split(s, ",")...)
+	}
+
+	var recipients []string
+	for _, s := range to {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("无效的收件人地址 %q: %v", s, err)
+		}
+		recipients = append(recipients, addr.Address)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("未指定收件人")
+	}
+	return recipients, nil
+}
+
+// buildEmail returns a MIME message with an HTML body and the attachments.
+func buildEmail(from string, to []string, subject, htmlBody string, attachments []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64(part, []byte(htmlBody))
+
+	for _, path := range attachments {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		name := mime.QEncoding.Encode("utf-8", filepath.Base(path))
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("%s; name=%q", contentType, name)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", name)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(part, data)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
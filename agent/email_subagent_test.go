@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmailSubagent(t *testing.T) {
+	dir := t.TempDir()
+	exported := filepath.Join(dir, "exports", "report.pdf")
+	if err := os.MkdirAll(filepath.Dir(exported), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(exported, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	task := Task{Type: TaskTypeEmail, Description: "发送报告", Parameters: map[string]interface{}{
+		"to":          "a@example.com, Bob <b@example.com>",
+		"subject":     "周报",
+		"attachments": []interface{}{outside},
+		FilesKey:      []string{exported},
+		OutputsKey:    []TaskOutput{{TaskType: TaskTypeReport, Output: "# Title\n\nreport body"}},
+	}}
+
+	if result, err := NewEmailSubagent(false, nil, dir, EmailConfig{}).Execute(context.Background(), task); err != nil || result.Success {
+		t.Errorf("expected a failed result without SMTP, got %+v, %v", result, err)
+	}
+
+	e := NewEmailSubagent(false, nil, dir, EmailConfig{Host: "smtp.example.com", Username: "me@example.com"})
+	var addr, from string
+	var to []string
+	var msg []byte
+	e.sendMail = func(a string, _ smtp.Auth, f string, t []string, m []byte) error {
+		addr, from, to, msg = a, f, t, m
+		return nil
+	}
+	result, err := e.Execute(context.Background(), task)
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if addr != "smtp.example.com:587" || from != "me@example.com" {
+		t.Errorf("unexpected addr %q or from %q", addr, from)
+	}
+	if want := []string{"a@example.com", "b@example.com"}; !reflect.DeepEqual(to, want) {
+		t.Errorf("got recipients %v, want %v", to, want)
+	}
+	if attachments := result.Metadata["attachments"].([]string); !reflect.DeepEqual(attachments, []string{exported}) {
+		t.Errorf("expected only the exported file to be attached, got %v", attachments)
+	}
+	for _, want := range []string{"Subject: =?utf-8?q?", "text/html", `filename="report.pdf"`} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("message does not contain %q", want)
+		}
+	}
+
+	e.sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+		return errors.New("connection refused")
+	}
+	result, err = e.Execute(context.Background(), task)
+	if err != nil {
+		t.Errorf("SMTP errors should not stop the plan: %v", err)
+	}
+	if result.Success || !strings.Contains(result.Error, "connection refused") {
+		t.Errorf("expected a failed result, got %+v", result)
+	}
+
+	delete(task.Parameters, "to")
+	if result, _ := e.Execute(context.Background(), task); result.Success {
+		t.Error("expected a failure without recipients")
+	}
+}
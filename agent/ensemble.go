@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// EnsembleConfig runs ANALYZE tasks on several models concurrently and has
+// a synthesizer model reconcile their analyses, reducing the bias of a
+// single model.
+type EnsembleConfig struct {
+	// Models are asked for independent analyses. Fewer than two disables
+	// ensembles.
+	Models []string
+	// Synthesizer merges the analyses. Empty means AgentConfig.Model.
+	Synthesizer string
+	// Enabled makes every ANALYZE task an ensemble; otherwise only tasks
+	// with the "ensemble" parameter set are.
+	Enabled bool
+}
+
+// ModelAnalysis is the analysis of one model of an ensemble, returned in
+// Result.Metadata["analyses"].
+type ModelAnalysis struct {
+	Model  string `json:"model"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ensembleModels returns the models that analyze task, or nil for a single
+// model analysis.
+func (a *AnalysisSubagent) ensembleModels(task Task) []string {
+	if len(a.ensemble.Models) < 2 || !task.BoolParam("ensemble", a.ensemble.Enabled) {
+		return nil
+	}
+	return a.ensemble.Models
+}
+
+// runEnsemble runs analyze on every model concurrently and synthesizes the
+// successful analyses. Models that fail are left out; if all but one fail
+// its analysis is used as is. If every model asks for more information the
+// first request is returned so the task can re-queue itself.
+func (a *AnalysisSubagent) runEnsemble(ctx context.Context, task Task, prompt string, models []string, analyze func(ctx context.Context, model string) (string, error)) (string, []ModelAnalysis, error) {
+	a.warn(fmt.Sprintf("🧩 集成分析: %d 个模型 (%s)", len(models), strings.Join(models, ", ")))
+
+	analyses := make([]ModelAnalysis, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			analyses[i].Model = model
+			output, err := analyze(ctx, model)
+			if err != nil {
+				analyses[i].Error = err.Error()
+				return
+			}
+			analyses[i].Output = output
+		}(i, model)
+	}
+	wg.Wait()
+
+	var succeeded []ModelAnalysis
+	var missing string
+	var errs []error
+	for _, analysis := range analyses {
+		switch {
+		case analysis.Error != "":
+			a.warn(fmt.Sprintf("⚠️ 模型 %s 分析失败: %s", analysis.Model, analysis.Error))
+			errs = append(errs, fmt.Errorf("%s: %s", analysis.Model, analysis.Error))
+		case strings.HasPrefix(strings.TrimSpace(analysis.Output), "MISSING_INFO:"):
+			if missing == "" {
+				missing = analysis.Output
+			}
+		default:
+			succeeded = append(succeeded, analysis)
+		}
+	}
+
+	switch len(succeeded) {
+	case 0:
+		if missing != "" {
+			return missing, analyses, nil
+		}
+		return "", analyses, fmt.Errorf("every model of the ensemble failed: %w", errors.Join(errs...))
+	case 1:
+		return succeeded[0].Output, analyses, nil
+	}
+
+	synthesis, err := a.synthesize(ctx, task, prompt, succeeded)
+	if err != nil {
+		// The individual analyses are still better than nothing
+		a.warn(fmt.Sprintf("⚠️ 综合分析失败，使用 %s 的分析: %v", succeeded[0].Model, err))
+		return succeeded[0].Output, analyses, nil
+	}
+	a.warn(fmt.Sprintf("✓ 已综合 %d 个模型的分析", len(succeeded)))
+	return synthesis, analyses, nil
+}
+
+// synthesize asks the synthesizer model to reconcile the analyses of the
+// ensemble into one, flagging where they disagree.
+func (a *AnalysisSubagent) synthesize(ctx context.Context, task Task, prompt string, analyses []ModelAnalysis) (string, error) {
+	model := a.ensemble.Synthesizer
+	if model == "" {
+		model = a.model
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "分析任务:\n%s\n\n", prompt)
+	for i, analysis := range analyses {
+		fmt.Fprintf(&sb, "=== 分析 %d (模型 %s) ===\n%s\n\n", i+1, analysis.Model, analysis.Output)
+	}
+
+	resp, err := a.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role: openai.ChatMessageRoleSystem,
+				Content: withLanguage("你是一个综合分析专家。以下是多个模型针对同一任务独立完成的分析。"+
+					"请将它们整合为一份清晰、结构化的分析：保留各分析的共识，补充只有部分分析提到的有价值的内容。"+
+					"最后添加一个 \"## 分歧\" 小节，逐条列出各分析之间相互矛盾的结论或数据，并注明来自哪个分析；若没有分歧，请说明。", task),
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: sb.String(),
+			},
+		},
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("empty response from %s", model)
+	}
+	return resp.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ErrorKind classifies why a subagent failed, so callers can decide whether
+// to retry, prompt the user, or just report the error.
+type ErrorKind string
+
+const (
+	ErrAPI       ErrorKind = "api"        // LLM API call failed
+	ErrRateLimit ErrorKind = "rate_limit" // LLM API rejected the call with 429
+	ErrParse     ErrorKind = "parse"      // model output could not be parsed
+	ErrTool      ErrorKind = "tool"       // external tool (search, etc.) failed
+	ErrBuild     ErrorKind = "build"      // artifact build (npm, slidev) failed
+	ErrTimeout   ErrorKind = "timeout"    // deadline exceeded
+	ErrIO        ErrorKind = "io"         // local file system error
+	ErrUnknown   ErrorKind = "unknown"
+)
+
+// ErrBudgetExceeded is returned by Execute, together with the results so
+// far, when continuing would exceed AgentConfig.MaxCostUSD.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// TaskError is returned by Execute when a subagent fails with an error. It
+// carries the failed Result, whose ErrorKind tells callers whether to retry,
+// prompt the user, or just report the error.
+type TaskError struct {
+	// Index is the 1-based position of the task in the plan.
+	Index  int
+	Result Result
+	Err    error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("task %d failed: %v", e.Index, e.Err)
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorKindOf returns the ErrorKind of the failed task of a TaskError in
+// the chain of err, or else classifies err. It returns "" for a nil err.
+func ErrorKindOf(err error) ErrorKind {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) && taskErr.Result.ErrorKind != "" {
+		return taskErr.Result.ErrorKind
+	}
+	return classifyError(err)
+}
+
+// failedResult completes the result of a task that failed with err, so
+// that it carries the task type, the error and its kind.
+func failedResult(task Task, result Result, err error) Result {
+	result.Success = false
+	if result.TaskType == "" {
+		result.TaskType = task.Type
+	}
+	if result.Error == "" {
+		result.Error = err.Error()
+	}
+	if result.ErrorKind == "" {
+		result.ErrorKind = classifyError(err)
+	}
+	return result
+}
+
+// classifyError maps an error returned from an LLM call or its parsing to an ErrorKind.
+func classifyError(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.HTTPStatusCode == http.StatusTooManyRequests {
+			return ErrRateLimit
+		}
+		return ErrAPI
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		if reqErr.HTTPStatusCode == http.StatusTooManyRequests {
+			return ErrRateLimit
+		}
+		return ErrAPI
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrParse
+	}
+
+	return ErrUnknown
+}
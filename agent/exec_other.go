@@ -0,0 +1,9 @@
+//go:build !unix
+
+package agent
+
+import "os/exec"
+
+// setProcessGroup is a no-op on platforms without process groups; context
+// cancellation only kills the command itself.
+func setProcessGroup(cmd *exec.Cmd) {}
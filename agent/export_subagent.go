@@ -0,0 +1,432 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fumiama/go-docx"
+	"github.com/gomarkdown/markdown/ast"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// ExportSubagent writes the report to a document file such as DOCX or PDF.
+type ExportSubagent struct {
+	verbose            bool
+	interactionHandler InteractionHandler
+	outputDir          string
+}
+
+// NewExportSubagent creates a new ExportSubagent.
+func NewExportSubagent(verbose bool, interactionHandler InteractionHandler, outputDir string) *ExportSubagent {
+	return &ExportSubagent{
+		verbose:            verbose,
+		interactionHandler: interactionHandler,
+		outputDir:          outputDir,
+	}
+}
+
+// Type returns the task type this subagent handles.
+func (e *ExportSubagent) Type() TaskType {
+	return TaskTypeExport
+}
+
+// Execute exports markdown content in the format given by the "format"
+// parameter: "docx" (the default) or "pdf". The URL of the document is in
+// the "docx_url" or "pdf_url" metadata. A PDF export that cannot print the
+// PDF still succeeds with the HTML version: "pdf_url" is then missing,
+// "fallback" is "html" and "error" tells why.
+func (e *ExportSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	if e.verbose {
+		fmt.Println("📄 导出 Subagent")
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(fmt.Sprintf("> 导出 Subagent: %s", task.Description))
+	}
+
+	format := task.StringParam("format")
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = "docx"
+	}
+	if format != "docx" && format != "pdf" {
+		err := fmt.Errorf("不支持的导出格式: %s", format)
+		return Result{
+			TaskType:  TaskTypeExport,
+			Success:   false,
+			Error:     err.Error(),
+			ErrorKind: ErrTool,
+		}, err
+	}
+
+	content := reportContent(task)
+
+	exportDir := filepath.Join(e.outputDir, "exports")
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return Result{
+			TaskType:  TaskTypeExport,
+			Success:   false,
+			Error:     fmt.Sprintf("创建输出目录失败: %v", err),
+			ErrorKind: ErrIO,
+		}, err
+	}
+
+	if format == "pdf" {
+		return e.exportPDF(ctx, exportDir, content)
+	}
+
+	fileName := fmt.Sprintf("report_%d.docx", time.Now().UnixNano())
+	filePath := filepath.Join(exportDir, fileName)
+	if err := writeDocx(filePath, content); err != nil {
+		return Result{
+			TaskType:  TaskTypeExport,
+			Success:   false,
+			Error:     fmt.Sprintf("写入 DOCX 失败: %v", err),
+			ErrorKind: ErrIO,
+		}, err
+	}
+
+	url := fmt.Sprintf("/generated/exports/%s", fileName)
+	e.logExported(filePath, url)
+
+	return Result{
+		TaskType: TaskTypeExport,
+		Success:  true,
+		Output:   fmt.Sprintf("[下载 Word 文档](%s)", url),
+		Metadata: map[string]interface{}{
+			"format":   format,
+			"path":     filePath,
+			"docx_url": url,
+		},
+	}, nil
+}
+
+// exportPDF renders the content to HTML and prints it to PDF with headless
+// Chrome. If Chrome is missing or fails, the HTML file is returned instead.
+// Generated images are inlined, since neither Chrome nor a downloaded HTML
+// file can load them from the web server.
+func (e *ExportSubagent) exportPDF(ctx context.Context, exportDir, content string) (Result, error) {
+	base := fmt.Sprintf("report_%d", time.Now().UnixNano())
+	htmlPath := filepath.Join(exportDir, base+".html")
+	page := inlineGeneratedImages(renderMarkdownHTML(content), e.outputDir)
+	if err := os.WriteFile(htmlPath, []byte(page), 0644); err != nil {
+		return Result{
+			TaskType:  TaskTypeExport,
+			Success:   false,
+			Error:     fmt.Sprintf("写入 HTML 失败: %v", err),
+			ErrorKind: ErrIO,
+		}, err
+	}
+	htmlURL := fmt.Sprintf("/generated/exports/%s.html", base)
+
+	pdfPath := filepath.Join(exportDir, base+".pdf")
+	if err := printPDF(ctx, htmlPath, pdfPath); err != nil {
+		if e.verbose {
+			fmt.Printf("❌ PDF 生成失败: %v\n", err)
+		}
+		if e.interactionHandler != nil {
+			e.interactionHandler.Log("❌ PDF 生成失败。已改为导出 HTML。")
+		}
+
+		// Return success with the HTML version, marked as a fallback
+		return Result{
+			TaskType: TaskTypeExport,
+			Success:  true,
+			Output:   fmt.Sprintf("PDF 生成失败 (需要 Chrome/Chromium)，已导出 HTML 版本: [下载 HTML](%s)", htmlURL),
+			Metadata: map[string]interface{}{
+				"format":   "html",
+				"fallback": "html",
+				"path":     htmlPath,
+				"html_url": htmlURL,
+				"error":    err.Error(),
+			},
+		}, nil
+	}
+
+	url := fmt.Sprintf("/generated/exports/%s.pdf", base)
+	e.logExported(pdfPath, url)
+
+	return Result{
+		TaskType: TaskTypeExport,
+		Success:  true,
+		Output:   fmt.Sprintf("[下载 PDF](%s)", url),
+		Metadata: map[string]interface{}{
+			"format":   "pdf",
+			"path":     pdfPath,
+			"pdf_url":  url,
+			"html_url": htmlURL,
+		},
+	}, nil
+}
+
+func (e *ExportSubagent) logExported(path, url string) {
+	if e.verbose {
+		fmt.Printf("  ✓ 文档已导出: %s\n", path)
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(fmt.Sprintf("✓ 文档已导出: [%s](%s)", filepath.Base(path), url))
+	}
+}
+
+// generatedImage matches the source of an image served from /generated/.
+var generatedImage = regexp.MustCompile(`src="/generated/([^"]+)"`)
+
+// inlineGeneratedImages replaces the sources of images served from
+// /generated/ in page with data URLs of their files under outputDir.
+// Sources whose file cannot be read are kept.
+func inlineGeneratedImages(page, outputDir string) string {
+	return generatedImage.ReplaceAllStringFunc(page, func(src string) string {
+		rel := html.UnescapeString(generatedImage.FindStringSubmatch(src)[1])
+		file := filepath.Join(outputDir, filepath.FromSlash(path.Clean("/"+rel)))
+		info, err := os.Stat(file)
+		if err != nil || info.Size() > maxImageBytes {
+			return src
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return src
+		}
+		// SVG charts are detected as XML, so the extension comes first
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if !strings.HasPrefix(contentType, "image/") {
+			contentType = http.DetectContentType(data)
+		}
+		if !strings.HasPrefix(contentType, "image/") {
+			return src
+		}
+		return `src="data:` + contentType + ";base64," + base64.StdEncoding.EncodeToString(data) + `"`
+	})
+}
+
+// chromeCandidates are the executables tried when CHROME_PATH is not set.
+var chromeCandidates = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "chrome"}
+
+// printPDF converts an HTML file to PDF using headless Chrome.
+func printPDF(ctx context.Context, htmlPath, pdfPath string) error {
+	chrome := os.Getenv("CHROME_PATH")
+	if chrome == "" {
+		for _, name := range chromeCandidates {
+			if path, err := exec.LookPath(name); err == nil {
+				chrome = path
+				break
+			}
+		}
+	}
+	if chrome == "" {
+		return fmt.Errorf("未找到 Chrome/Chromium，可通过 CHROME_PATH 指定")
+	}
+
+	absHTML, err := filepath.Abs(htmlPath)
+	if err != nil {
+		return err
+	}
+	absPDF, err := filepath.Abs(pdfPath)
+	if err != nil {
+		return err
+	}
+
+	printCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(printCtx, chrome,
+		"--headless", "--disable-gpu", "--no-sandbox", "--no-pdf-header-footer",
+		"--print-to-pdf="+absPDF, "file://"+filepath.ToSlash(absHTML))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("chrome 打印 PDF 失败: %v\n输出: %s", err, string(output))
+	}
+	if _, err := os.Stat(absPDF); err != nil {
+		return fmt.Errorf("chrome 未生成 PDF: %v", err)
+	}
+	return nil
+}
+
+// writeDocx converts markdown to a Word document and saves it to path.
+func writeDocx(path, content string) error {
+	// OrderedListStart keeps the numbers of a list that does not start at 1
+	p := parser.NewWithExtensions(parser.CommonExtensions | parser.OrderedListStart)
+	doc := p.Parse([]byte(content))
+
+	w := docx.New().WithDefaultTheme()
+	for _, block := range doc.GetChildren() {
+		writeDocxBlock(w, block, 0)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Font sizes in half-points for heading levels 1-4; deeper levels use the last one.
+var docxHeadingSizes = []string{"36", "32", "28", "24"}
+
+func writeDocxBlock(w *docx.Docx, node ast.Node, depth int) {
+	switch n := node.(type) {
+	case *ast.Heading:
+		size := docxHeadingSizes[min(n.Level, len(docxHeadingSizes))-1]
+		para := w.AddParagraph()
+		for _, r := range docxInline(para, n) {
+			r.Bold().Size(size)
+		}
+	case *ast.Paragraph:
+		docxInline(w.AddParagraph(), n)
+	case *ast.List:
+		start := n.Start
+		if start == 0 {
+			start = 1
+		}
+		for i, item := range n.GetChildren() {
+			marker := "• "
+			if n.ListFlags&ast.ListTypeOrdered != 0 {
+				marker = fmt.Sprintf("%d. ", start+i)
+			}
+			for j, child := range item.GetChildren() {
+				if _, ok := child.(*ast.List); ok {
+					writeDocxBlock(w, child, depth+1)
+					continue
+				}
+				para := w.AddParagraph()
+				prefix := strings.Repeat("    ", depth)
+				if j == 0 {
+					prefix += marker
+				}
+				para.AddText(prefix)
+				docxInline(para, child)
+			}
+		}
+	case *ast.CodeBlock:
+		for _, line := range strings.Split(strings.TrimRight(string(n.Literal), "\n"), "\n") {
+			w.AddParagraph().AddText(line).Font("Courier New", "Courier New", "Courier New", "")
+		}
+	case *ast.BlockQuote:
+		for _, child := range n.GetChildren() {
+			for _, r := range docxInline(w.AddParagraph(), child) {
+				r.Italic()
+			}
+		}
+	case *ast.Table:
+		writeDocxTable(w, n)
+	case *ast.HorizontalRule:
+		w.AddParagraph()
+	default:
+		for _, child := range node.GetChildren() {
+			writeDocxBlock(w, child, depth)
+		}
+	}
+}
+
+// docxInline appends the inline content of node to para and returns the runs it created.
+func docxInline(para *docx.Paragraph, node ast.Node) []*docx.Run {
+	var runs []*docx.Run
+	var walk func(n ast.Node, bold, italic bool)
+	walk = func(n ast.Node, bold, italic bool) {
+		switch n := n.(type) {
+		case *ast.Text:
+			if len(n.Literal) == 0 {
+				return
+			}
+			r := para.AddText(string(n.Literal))
+			if bold {
+				r.Bold()
+			}
+			if italic {
+				r.Italic()
+			}
+			runs = append(runs, r)
+		case *ast.Code:
+			runs = append(runs, para.AddText(string(n.Literal)).Font("Courier New", "Courier New", "Courier New", ""))
+		case *ast.Softbreak, *ast.Hardbreak:
+			runs = append(runs, para.AddText(" "))
+		case *ast.Strong:
+			for _, c := range n.GetChildren() {
+				walk(c, true, italic)
+			}
+		case *ast.Emph:
+			for _, c := range n.GetChildren() {
+				walk(c, bold, true)
+			}
+		case *ast.Link:
+			para.AddLink(inlineText(n), string(n.Destination))
+		case *ast.Image:
+			runs = append(runs, para.AddText(inlineText(n)))
+		default:
+			for _, c := range n.GetChildren() {
+				walk(c, bold, italic)
+			}
+		}
+	}
+	for _, c := range node.GetChildren() {
+		walk(c, false, false)
+	}
+	return runs
+}
+
+func writeDocxTable(w *docx.Docx, table *ast.Table) {
+	var rows [][]string
+	ast.WalkFunc(table, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch n := node.(type) {
+		case *ast.TableRow:
+			if entering {
+				rows = append(rows, nil)
+			}
+		case *ast.TableCell:
+			if entering {
+				rows[len(rows)-1] = append(rows[len(rows)-1], inlineText(n))
+				return ast.SkipChildren
+			}
+		}
+		return ast.GoToNext
+	})
+	if len(rows) == 0 {
+		return
+	}
+
+	cols := 0
+	for _, row := range rows {
+		cols = max(cols, len(row))
+	}
+	t := w.AddTable(len(rows), cols, 0, nil)
+	for i, row := range rows {
+		for j, cell := range row {
+			r := t.TableRows[i].TableCells[j].AddParagraph().AddText(cell)
+			if i == 0 {
+				r.Bold()
+			}
+		}
+	}
+}
+
+// inlineText returns the plain text of node's descendants.
+func inlineText(node ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(node, func(n ast.Node, entering bool) ast.WalkStatus {
+		if !entering {
+			return ast.GoToNext
+		}
+		switch n := n.(type) {
+		case *ast.Text:
+			sb.Write(n.Literal)
+		case *ast.Code:
+			sb.Write(n.Literal)
+		case *ast.Softbreak, *ast.Hardbreak:
+			sb.WriteString(" ")
+		}
+		return ast.GoToNext
+	})
+	return sb.String()
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportPDFFallback(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CHROME_PATH", filepath.Join(dir, "no-chrome"))
+	if err := os.MkdirAll(filepath.Join(dir, "charts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	chart := `<svg xmlns="http://www.w3.org/2000/svg"><rect width="1" height="1"/></svg>`
+	if err := os.WriteFile(filepath.Join(dir, "charts", "sales.svg"), []byte(chart), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewExportSubagent(false, nil, dir)
+	result, err := e.Execute(context.Background(), Task{
+		Type:       TaskTypeExport,
+		Parameters: map[string]interface{}{"format": "pdf", "content": "# Sales\n\n![sales](/generated/charts/sales.svg)\n\n![gone](/generated/charts/gone.svg)"},
+	})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if !result.Success || result.ErrorKind != "" {
+		t.Errorf("expected a successful fallback without an error kind, got %+v", result)
+	}
+	if result.Metadata["fallback"] != "html" || result.Metadata["error"] == nil {
+		t.Errorf("expected the fallback and its reason in the metadata, got %v", result.Metadata)
+	}
+	if _, ok := result.Metadata["pdf_url"]; ok {
+		t.Errorf("expected no pdf_url for the fallback, got %v", result.Metadata)
+	}
+
+	page, err := os.ReadFile(result.Metadata["path"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), `src="data:image/svg+xml;base64,`) {
+		t.Errorf("expected the chart to be inlined:\n%s", page)
+	}
+	if !strings.Contains(string(page), `src="/generated/charts/gone.svg"`) {
+		t.Errorf("expected a missing image to keep its source:\n%s", page)
+	}
+}
+
+func TestInlineGeneratedImages(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.png"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		// Not an image
+		`<img src="/generated/notes.txt">`: `<img src="/generated/notes.txt">`,
+		// Not served from /generated/
+		`<img src="https://example.com/a.png">`: `<img src="https://example.com/a.png">`,
+		// Escapes outside the output directory stay inside it
+		`<img src="/generated/../` + filepath.Base(dir) + `/secret.png">`: `<img src="/generated/../` + filepath.Base(dir) + `/secret.png">`,
+	}
+	for page, want := range tests {
+		if got := inlineGeneratedImages(page, dir); got != want {
+			t.Errorf("inlineGeneratedImages(%q) = %q, want %q", page, got, want)
+		}
+	}
+}
+
+// docxParagraphs returns the text of each paragraph of the Word document at
+// path, and the text of the cells of its tables.
+func docxParagraphs(t *testing.T, path string) (paragraphs []string, cells []string) {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("not a zip file: %v", err)
+	}
+	defer r.Close()
+	f, err := r.Open("word/document.xml")
+	if err != nil {
+		t.Fatalf("no document: %v", err)
+	}
+	defer f.Close()
+
+	var text strings.Builder
+	inTable := 0
+	d := xml.NewDecoder(f)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid document XML: %v", err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "tbl":
+				inTable++
+			case "p":
+				text.Reset()
+			case "t":
+				var s string
+				if err := d.DecodeElement(&s, &tok); err != nil {
+					t.Fatal(err)
+				}
+				text.WriteString(s)
+			}
+		case xml.EndElement:
+			switch tok.Name.Local {
+			case "tbl":
+				inTable--
+			case "p":
+				if inTable > 0 {
+					cells = append(cells, text.String())
+				} else {
+					paragraphs = append(paragraphs, text.String())
+				}
+			}
+		}
+	}
+	return paragraphs, cells
+}
+
+func TestWriteDocx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.docx")
+	content := `# Go vs Rust
+
+Go is **simple** and *fast*.
+
+- memory safety
+  - ownership
+- concurrency
+
+3. first
+4. second
+
+| Language | Year |
+| --- | --- |
+| Go | 2009 |
+| Rust | 2015 |
+`
+	if err := writeDocx(path, content); err != nil {
+		t.Fatalf("writeDocx failed: %v", err)
+	}
+
+	paragraphs, cells := docxParagraphs(t, path)
+	want := []string{
+		"Go vs Rust",
+		"Go is simple and fast.",
+		"• memory safety",
+		"    • ownership",
+		"• concurrency",
+		"3. first",
+		"4. second",
+	}
+	var got []string
+	for _, p := range paragraphs {
+		if p != "" {
+			got = append(got, p)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("paragraphs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if strings.Join(cells, ",") != "Language,Year,Go,2009,Rust,2015" {
+		t.Errorf("unexpected table cells %q", cells)
+	}
+}
@@ -0,0 +1,279 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ExtractSubagent pulls numeric and tabular data out of the context into
+// structured tables, so reports and charts use exact figures instead of
+// numbers paraphrased from prose.
+type ExtractSubagent struct {
+	client             ChatCompleter
+	model              string
+	verbose            bool
+	interactionHandler InteractionHandler
+	systemPrompt       string
+	jsonMode           bool
+}
+
+// NewExtractSubagent creates a new ExtractSubagent. jsonMode requests the
+// tables with response_format instead of parsing them out of free text.
+func NewExtractSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, systemPrompt string, jsonMode bool) *ExtractSubagent {
+	return &ExtractSubagent{
+		client:             client,
+		model:              model,
+		verbose:            verbose,
+		interactionHandler: interactionHandler,
+		systemPrompt:       systemPrompt,
+		jsonMode:           jsonMode,
+	}
+}
+
+// Type returns the task type this subagent handles.
+func (e *ExtractSubagent) Type() TaskType {
+	return TaskTypeExtract
+}
+
+// DataTable is a table of data extracted from the context. Cells are
+// numbers or strings.
+type DataTable struct {
+	Title   string          `json:"title"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// Source is the URL or name of the source the data comes from.
+	Source string `json:"source,omitempty"`
+}
+
+// ExtractedData is the structured data of an EXTRACT task, returned in
+// Result.Metadata["data"].
+type ExtractedData struct {
+	Tables []DataTable `json:"tables"`
+}
+
+// Markdown renders the tables as markdown, each under its title.
+func (d ExtractedData) Markdown() string {
+	var sb strings.Builder
+	for i, table := range d.Tables {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if table.Title != "" {
+			fmt.Fprintf(&sb, "### %s\n\n", table.Title)
+		}
+		sb.WriteString(markdownRow(table.Columns))
+		sb.WriteString("|" + strings.Repeat(" --- |", len(table.Columns)) + "\n")
+		for _, row := range table.Rows {
+			cells := make([]string, len(row))
+			for j, cell := range row {
+				cells[j], _ = scalarString(cell)
+			}
+			sb.WriteString(markdownRow(cells))
+		}
+		if table.Source != "" {
+			fmt.Fprintf(&sb, "\n来源: %s\n", table.Source)
+		}
+	}
+	return sb.String()
+}
+
+// merge returns the tables of d followed by those of other, without
+// modifying either. A table of other replaces a table of d with the same
+// title, so a retried EXTRACT task does not duplicate its tables.
+func (d *ExtractedData) merge(other *ExtractedData) *ExtractedData {
+	merged := &ExtractedData{}
+	replaced := make(map[string]bool, len(other.Tables))
+	for _, table := range other.Tables {
+		replaced[table.Title] = true
+	}
+	if d != nil {
+		for _, table := range d.Tables {
+			if !replaced[table.Title] {
+				merged.Tables = append(merged.Tables, table)
+			}
+		}
+	}
+	merged.Tables = append(merged.Tables, other.Tables...)
+	return merged
+}
+
+// markdownRow formats cells as a markdown table row, escaping pipes.
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = strings.ReplaceAll(strings.ReplaceAll(cell, "|", `\|`), "\n", " ")
+	}
+	return "| " + strings.Join(escaped, " | ") + " |\n"
+}
+
+// Execute extracts the tables from the context of the task.
+func (e *ExtractSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	if e.verbose {
+		fmt.Println("🔢 数据提取 Subagent")
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(fmt.Sprintf("> 数据提取 Subagent: %s", task.Description))
+	}
+
+	content := task.Description
+	if contextData := contextText(task); contextData != "" {
+		content = fmt.Sprintf("%s\n\n%s", task.Description, contextData)
+	}
+
+	// The schema hint is a description such as "year, revenue (USD bn)" or
+	// a list of column names
+	schema := task.StringParam("schema")
+	if schema == "" {
+		schema = strings.Join(task.StringSliceParam("schema"), ", ")
+	}
+
+	data, err := e.extract(ctx, task, content, schema)
+	if err != nil {
+		return Result{
+			TaskType:  TaskTypeExtract,
+			Success:   false,
+			Error:     fmt.Sprintf("提取数据失败: %v", err),
+			ErrorKind: classifyError(err),
+		}, err
+	}
+
+	// Later tasks read the tables of every EXTRACT task of the run by key
+	taskScratchpad(task).Update(ExtractedDataKey, func(old interface{}) interface{} {
+		prev, _ := old.(*ExtractedData)
+		return prev.merge(data)
+	})
+
+	rows := 0
+	for _, table := range data.Tables {
+		rows += len(table.Rows)
+	}
+	if e.verbose {
+		fmt.Printf("  ✓ 已提取 %d 个表格 (%d 行)\n", len(data.Tables), rows)
+	}
+	if e.interactionHandler != nil {
+		e.interactionHandler.Log(fmt.Sprintf("✓ 已提取 %d 个表格 (%d 行)", len(data.Tables), rows))
+	}
+
+	return Result{
+		TaskType: TaskTypeExtract,
+		Success:  true,
+		Output:   data.Markdown(),
+		Metadata: map[string]interface{}{
+			"data": data,
+		},
+	}, nil
+}
+
+// extract asks the model for the tables, and once more to correct them if
+// they are invalid.
+func (e *ExtractSubagent) extract(ctx context.Context, task Task, content, schema string) (*ExtractedData, error) {
+	schemaHint := "根据数据自行确定表格和列。"
+	if schema != "" {
+		schemaHint = fmt.Sprintf("表格的列应为: %s。", schema)
+	}
+
+	systemPrompt := fmt.Sprintf(`你是一位数据提取专家。从提供的文本中提取所有数值和表格数据，整理为结构化表格。
+%s
+
+规则：
+- 只提取文本中明确出现的数据，不要估算、推断或编造数字。
+- 数值单元格使用 JSON 数字，不含千位分隔符；单位写在列名中 (例如 "营收 (亿元)")。
+- 缺失的值使用 null。
+- 相同主题的数据放在同一个表格中，不同主题使用不同的表格。
+
+仅输出一个 JSON 对象，包含 "tables" 数组，每个表格包含：
+- "title": 表格标题。
+- "columns": 列名数组。
+- "rows": 行数组，每行是与 columns 等长的数组。
+- "source": 可选，数据来源的 URL 或名称。
+
+Example:
+{"tables": [{"title": "Revenue by Year", "columns": ["Year", "Revenue (USD bn)"], "rows": [["2022", 10.5], ["2023", 12.3]], "source": "https://example.com/report"}]}`, schemaHint)
+	if e.systemPrompt != "" {
+		systemPrompt = e.systemPrompt + "\n" + schemaHint
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model: e.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: withLanguage(systemPrompt, task),
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: content,
+			},
+		},
+		Temperature: 0,
+	}
+	if e.jsonMode {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+
+	resp, err := e.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response")
+	}
+	data, err := parseExtractedData(resp.Choices[0].Message.Content)
+	if err != nil {
+		if e.interactionHandler != nil {
+			e.interactionHandler.Log(fmt.Sprintf("⚠️ 提取的数据无效: %v，正在请求修正", err))
+		}
+		req.Messages = append(req.Messages, resp.Choices[0].Message, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: fmt.Sprintf("你的输出无效: %v。请修正并仅输出包含 \"tables\" 的 JSON 对象，每行的长度必须与 columns 相同。", err),
+		})
+		resp, err = e.client.CreateChatCompletion(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("no choices in response")
+		}
+		data, err = parseExtractedData(resp.Choices[0].Message.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// parseExtractedData parses and validates the tables returned by the model.
+// Tables without columns or rows are dropped.
+func parseExtractedData(content string) (*ExtractedData, error) {
+	var data ExtractedData
+	if err := json.Unmarshal([]byte(stripCodeFence(content)), &data); err != nil {
+		return nil, fmt.Errorf("解析数据 JSON 失败: %w", err)
+	}
+
+	tables := data.Tables[:0]
+	for _, table := range data.Tables {
+		if len(table.Columns) == 0 || len(table.Rows) == 0 {
+			continue
+		}
+		for i, row := range table.Rows {
+			if len(row) != len(table.Columns) {
+				return nil, fmt.Errorf("表格 %q 第 %d 行有 %d 个单元格，应为 %d 个", table.Title, i+1, len(row), len(table.Columns))
+			}
+			for j, cell := range row {
+				if _, ok := scalarString(cell); !ok && cell != nil {
+					return nil, fmt.Errorf("表格 %q 第 %d 行第 %d 列不是数字或字符串", table.Title, i+1, j+1)
+				}
+			}
+		}
+		tables = append(tables, table)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("未提取到数据")
+	}
+	data.Tables = tables
+	return &data, nil
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExtractSubagent(t *testing.T) {
+	var prompts []string
+	reply, calls := sequentialReplies(
+		`{"tables": [{"title": "Revenue", "columns": ["Year", "Revenue (USD bn)"], "rows": [["2022", 10.5], ["2023"]]}]}`,
+		"```json\n"+`{"tables": [{"title": "Revenue", "columns": ["Year", "Revenue (USD bn)"], "rows": [["2022", 10.5], ["2023", 1200000]], "source": "https://example.com"}, {"title": "Empty", "columns": ["A"], "rows": []}]}`+"\n```",
+	)
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompts = append(prompts, req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string))
+		return reply(req)
+	})
+
+	e := NewExtractSubagent(newFakeClient(srv), "gpt-4o", false, nil, "", false)
+	task := Task{Type: TaskTypeExtract, Description: "revenue", Parameters: map[string]interface{}{
+		"schema":   []interface{}{"Year", "Revenue (USD bn)"},
+		OutputsKey: []TaskOutput{{TaskType: TaskTypeSearch, Output: "Revenue was 10.5bn in 2022 and 1.2 million bn in 2023."}},
+	}}
+	result, err := e.Execute(context.Background(), task)
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if *calls != 2 {
+		t.Errorf("expected the short row to be repaired, got %d calls", *calls)
+	}
+	if !strings.Contains(prompts[0], "表格的列应为: Year, Revenue (USD bn)。") {
+		t.Errorf("schema hint missing from prompt:\n%s", prompts[0])
+	}
+
+	data, ok := result.Metadata["data"].(*ExtractedData)
+	if !ok || len(data.Tables) != 1 || len(data.Tables[0].Rows) != 2 {
+		t.Fatalf("expected one table with two rows, got %+v", result.Metadata["data"])
+	}
+	want := "### Revenue\n\n| Year | Revenue (USD bn) |\n| --- | --- |\n| 2022 | 10.5 |\n| 2023 | 1200000 |\n\n来源: https://example.com\n"
+	if result.Output != want {
+		t.Errorf("unexpected markdown:\n%s", result.Output)
+	}
+
+	if _, err := parseExtractedData(`{"tables": [{"title": "T", "columns": ["A"], "rows": [[{"x": 1}]]}]}`); err == nil {
+		t.Error("expected an error for an object cell")
+	}
+	if _, err := parseExtractedData(`{"tables": []}`); err == nil {
+		t.Error("expected an error for no tables")
+	}
+}
+
+func TestExtractNoChoices(t *testing.T) {
+	// The first reply and its correction
+	for replies := 0; replies < 2; replies++ {
+		m := filteredClient{&MockClient{Replies: []string{"not json"}}, replies}
+		e := NewExtractSubagent(m, "gpt-4o", false, nil, "", false)
+		result, err := e.Execute(context.Background(), Task{Type: TaskTypeExtract, Description: "revenue"})
+		if err == nil || result.Success || !strings.Contains(result.Error, "no choices") {
+			t.Errorf("after %d replies: expected an error, got %+v, %v", replies, result, err)
+		}
+	}
+}
+
+func TestExtractScratchpad(t *testing.T) {
+	var reportPrompt string
+	reply, _ := sequentialReplies(
+		`{"tables": [{"title": "Revenue", "columns": ["Year", "USD bn"], "rows": [["2022", 1]]}]}`,
+		`{"tables": [{"title": "Revenue", "columns": ["Year", "USD bn"], "rows": [["2022", 10.5]]}, {"title": "Users", "columns": ["Year", "Users (m)"], "rows": [["2022", 3]]}]}`,
+	)
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		messages := req["messages"].([]interface{})
+		if strings.Contains(messages[0].(map[string]interface{})["content"].(string), "数据提取专家") {
+			return reply(req)
+		}
+		reportPrompt = messages[1].(map[string]interface{})["content"].(string)
+		return "# 报告"
+	})
+
+	a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	if a.Scratchpad() != nil {
+		t.Error("expected no scratchpad before a run")
+	}
+	_, err = a.Execute(context.Background(), &Plan{Tasks: []Task{
+		{Type: TaskTypeExtract, Description: "revenue"},
+		{Type: TaskTypeExtract, Description: "revenue and users"},
+		{Type: TaskTypeReport, Description: "report"},
+	}})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	// The second EXTRACT replaces the Revenue table and adds Users
+	value, _ := a.Scratchpad().Get(ExtractedDataKey)
+	data, ok := value.(*ExtractedData)
+	if !ok || len(data.Tables) != 2 || data.Tables[0].Rows[0][1] != 10.5 || data.Tables[1].Title != "Users" {
+		t.Fatalf("unexpected scratchpad data %+v", value)
+	}
+	// Without ANALYZE outputs the report falls back to every output, so only
+	// the tables after the marker come from the scratchpad
+	_, tables, _ := strings.Cut(reportPrompt, "提取的数据表:\n")
+	if tables != strings.TrimSpace(data.Markdown()) {
+		t.Errorf("report prompt lacks the extracted tables:\n%s", reportPrompt)
+	}
+}
+
+func TestScratchpadConcurrent(t *testing.T) {
+	s := NewScratchpad()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Set(fmt.Sprintf("key%d", i%5), i)
+			s.Update("count", func(old interface{}) interface{} {
+				n, _ := old.(int)
+				return n + 1
+			})
+			s.Snapshot()
+		}(i)
+	}
+	wg.Wait()
+
+	if count, _ := s.Get("count"); count != 50 {
+		t.Errorf("expected 50 updates, got %v", count)
+	}
+	if keys := s.Keys(); len(keys) != 6 || keys[0] != "count" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	// A nil scratchpad ignores writes
+	var none *Scratchpad
+	none.Set("a", 1)
+	if _, ok := none.Get("a"); ok || len(none.Snapshot()) != 0 {
+		t.Error("expected a nil scratchpad to stay empty")
+	}
+}
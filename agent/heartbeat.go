@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is how often a HeartbeatHandler is called while a call
+// is in flight.
+var heartbeatInterval = 3 * time.Second
+
+type heartbeatKey struct{}
+
+// heartbeatTarget is the handler and task that heartbeats are sent for.
+type heartbeatTarget struct {
+	handler  HeartbeatHandler
+	taskType TaskType
+}
+
+// withHeartbeatTarget returns a context whose calls send heartbeats of the
+// task to ih, if ih implements HeartbeatHandler.
+func withHeartbeatTarget(ctx context.Context, ih InteractionHandler, taskType TaskType) context.Context {
+	handler, ok := ih.(HeartbeatHandler)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, heartbeatKey{}, heartbeatTarget{handler, taskType})
+}
+
+// startHeartbeat sends heartbeats for activity to the target of ctx until
+// the returned function is called or ctx is done. It does nothing if ctx
+// has no target.
+func startHeartbeat(ctx context.Context, activity string) (stop func()) {
+	target, ok := ctx.Value(heartbeatKey{}).(heartbeatTarget)
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				target.handler.Heartbeat(target.taskType, activity, time.Since(start))
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// withHeartbeat runs call, a call that does not go through the model client
+// such as a web search, sending heartbeats while it is in flight.
+func withHeartbeat[T any](ctx context.Context, activity string, call func() (T, error)) (T, error) {
+	stop := startHeartbeat(ctx, activity)
+	defer stop()
+	return call()
+}
+
+// heartbeatTransport sends heartbeats while a model request is in flight,
+// until its response body has been fully read or closed, so streamed
+// responses keep the heartbeat going.
+type heartbeatTransport struct {
+	base http.RoundTripper
+}
+
+func (t *heartbeatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stop := startHeartbeat(req.Context(), "model")
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: stop}
+	return resp, nil
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// summaryPrefix marks the developer message that replaces compacted turns.
+const summaryPrefix = "以下是之前对话的摘要：\n"
+
+// estimateTokens roughly estimates the token count of messages: about four
+// bytes per token for ASCII text and one token per other character.
+func estimateTokens(messages []openai.ChatCompletionMessage) int {
+	tokens := 0
+	for _, msg := range messages {
+		ascii := 0
+		for _, r := range msg.Content {
+			if r < utf8.RuneSelf {
+				ascii++
+			} else {
+				tokens++
+			}
+		}
+		tokens += ascii/4 + 4 // per-message overhead
+	}
+	return tokens
+}
+
+// truncateTokens cuts content to about tokens estimated tokens, counted like
+// estimateTokens, and marks the cut with an ellipsis.
+func truncateTokens(content string, tokens int) string {
+	budget := (tokens - 4) * 4 // in quarter tokens, after the per-message overhead
+	for i, r := range content {
+		if r < utf8.RuneSelf {
+			budget--
+		} else {
+			budget -= 4
+		}
+		if budget < 0 {
+			return content[:i] + "..."
+		}
+	}
+	return content
+}
+
+// CompactHistory replaces all but the most recent turns of the conversation
+// with an LLM-generated summary. A turn starts at each user or developer
+// message; AgentConfig.KeepRecentTurns of them are kept verbatim. The
+// history is left unchanged if the summary is empty.
+func (a *PlanningAgent) CompactHistory(ctx context.Context) error {
+	history := a.history()
+
+	// Find where the turns to keep begin
+	keep := a.config.KeepRecentTurns
+	split := len(history)
+	for i := len(history) - 1; i >= 0 && keep > 0; i-- {
+		if role := history[i].Role; role == openai.ChatMessageRoleUser || role == openai.ChatMessageRoleDeveloper {
+			split = i
+			keep--
+		}
+	}
+	if split == 0 || (split == 1 && strings.HasPrefix(history[0].Content, summaryPrefix)) {
+		return nil // nothing old enough to compact
+	}
+	older := history[:split]
+
+	if a.config.Verbose {
+		fmt.Printf("🗜️  正在压缩对话历史 (%d 条消息)...\n", len(older))
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(fmt.Sprintf("🗜️ 正在压缩对话历史 (%d 条消息)...", len(older)))
+	}
+
+	var transcript strings.Builder
+	for _, msg := range older {
+		transcript.WriteString(fmt.Sprintf("[%s]: %s\n\n", msg.Role, msg.Content))
+	}
+
+	resp, err := a.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: a.config.Model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "你是一个对话摘要助手。请简洁地总结以下对话，保留用户的目标、偏好、指令以及已得出的关键结论和数据，供后续对话使用。仅输出摘要。",
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: transcript.String(),
+			},
+		},
+		Temperature: 0,
+	})
+	if err != nil {
+		return fmt.Errorf("summarize history: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return fmt.Errorf("summarize history: no choices in response")
+	}
+	summary := strings.TrimSpace(resp.Choices[0].Message.Content)
+	if summary == "" {
+		// Keep the turns rather than replace them with nothing
+		return fmt.Errorf("summarize history: empty summary")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.messages) < split {
+		return nil // history was cleared while summarizing
+	}
+	compacted := []openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleDeveloper,
+		Content: summaryPrefix + summary,
+	}}
+	a.messages = append(compacted, a.messages[split:]...)
+
+	if a.config.Verbose {
+		fmt.Printf("  ✓ 已将 %d 条消息压缩为摘要\n", len(older))
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(fmt.Sprintf("✓ 已将 %d 条消息压缩为摘要", len(older)))
+	}
+	return nil
+}
+
+// maybeCompactHistory compacts the history when it exceeds
+// AgentConfig.CompactThreshold. Failures are logged and otherwise ignored.
+func (a *PlanningAgent) maybeCompactHistory(ctx context.Context) {
+	if a.config.CompactThreshold <= 0 || estimateTokens(a.history()) <= a.config.CompactThreshold {
+		return
+	}
+	if err := a.CompactHistory(ctx); err != nil {
+		a.warn(fmt.Sprintf("⚠️ 压缩对话历史失败: %v", err))
+	}
+}
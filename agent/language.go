@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// LanguageAuto makes the agent answer in the language of the user's request.
+const LanguageAuto = "auto"
+
+// defaultLanguage is the output language when none is configured.
+const defaultLanguage = "中文"
+
+// detectLanguage guesses the language of text: Chinese if it contains Han
+// characters, English if it contains other letters, and "" otherwise.
+func detectLanguage(text string) string {
+	letters := 0
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			return "中文"
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if letters > 0 {
+		return "English"
+	}
+	return ""
+}
+
+// resolveLanguage returns the output language for a request given the
+// configured language, which may be empty, LanguageAuto or a language name.
+func resolveLanguage(configured, request string) string {
+	switch configured {
+	case "":
+		return defaultLanguage
+	case LanguageAuto:
+		if lang := detectLanguage(request); lang != "" {
+			return lang
+		}
+		return defaultLanguage
+	default:
+		return configured
+	}
+}
+
+// taskLanguage returns the output language set on a task by Execute, or the
+// default language.
+func taskLanguage(task Task) string {
+	if lang := task.StringParam("language"); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// withLanguage appends the language instruction for the task's language to a
+// system prompt. Prompts are left unchanged when no language was set.
+func withLanguage(systemPrompt string, task Task) string {
+	if lang := task.StringParam("language"); lang != "" {
+		return systemPrompt + "\n\n" + languageInstruction(lang)
+	}
+	return systemPrompt
+}
+
+// languageInstruction is appended to system prompts to fix the output language.
+func languageInstruction(lang string) string {
+	if lang == defaultLanguage {
+		return "所有输出必须使用中文。"
+	}
+	return fmt.Sprintf("All output must be written in %s, regardless of the language of these instructions or of the source material.", lang)
+}
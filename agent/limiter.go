@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	apiSemaphoresMu sync.Mutex
+	// apiSemaphores holds one semaphore per AgentConfig.MaxConcurrentAPICalls
+	// value, shared by every agent in the process configured with it.
+	apiSemaphores = make(map[int]chan struct{})
+)
+
+// apiSemaphore returns the process-wide semaphore allowing limit concurrent
+// API calls.
+func apiSemaphore(limit int) chan struct{} {
+	apiSemaphoresMu.Lock()
+	defer apiSemaphoresMu.Unlock()
+	sem, ok := apiSemaphores[limit]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		apiSemaphores[limit] = sem
+	}
+	return sem
+}
+
+// limitTransport caps the number of API requests in flight. A request
+// holds its slot until the response body is read or closed, so streamed
+// responses count for their whole duration.
+type limitTransport struct {
+	base http.RoundTripper
+	sem  chan struct{}
+}
+
+func (l *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	var once sync.Once
+	release := func() { once.Do(func() { <-l.sem }) }
+
+	resp, err := l.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody releases a limitTransport slot once the body has been fully
+// read or closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
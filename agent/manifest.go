@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Artifact is a file produced by a plan run.
+type Artifact struct {
+	// Kind is what the file is: report, podcast_script, chart, docx, pdf,
+	// html, ppt or ppt_source.
+	Kind     string   `json:"kind"`
+	TaskType TaskType `json:"task_type,omitempty"`
+	// Path is the file on disk; for a ppt it is the built site directory.
+	Path string `json:"path"`
+	// URL is where the web server serves the file under /generated/.
+	URL  string `json:"url,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// Manifest lists the artifacts of a plan run, so callers find them without
+// knowing which task produced what.
+type Manifest struct {
+	CreatedAt time.Time  `json:"created_at"`
+	Artifacts []Artifact `json:"artifacts"`
+	// Path is the manifest.json written by SaveManifest, if any.
+	Path string `json:"-"`
+}
+
+// artifactURLKeys maps the result metadata keys holding artifact URLs to
+// the artifact kinds.
+var artifactURLKeys = []struct{ key, kind string }{
+	{"chart_url", "chart"},
+	{"docx_url", "docx"},
+	{"pdf_url", "pdf"},
+	{"html_url", "html"},
+	{"ppt_url", "ppt"},
+	{"source_zip", "ppt_source"},
+}
+
+// newManifest collects the files referenced by the metadata of the
+// successful results. Files that no longer exist are left out.
+func newManifest(results []Result, outputDir string) *Manifest {
+	m := &Manifest{CreatedAt: time.Now(), Artifacts: []Artifact{}}
+	for _, result := range results {
+		if !result.Success {
+			continue
+		}
+		for _, k := range artifactURLKeys {
+			url, _ := result.Metadata[k.key].(string)
+			rel, ok := strings.CutPrefix(url, "/generated/")
+			if !ok {
+				continue
+			}
+			m.add(Artifact{Kind: k.kind, TaskType: result.TaskType, Path: filepath.Join(outputDir, filepath.FromSlash(rel)), URL: url})
+		}
+	}
+	return m
+}
+
+// add appends the artifact with its size if its file exists.
+func (m *Manifest) add(artifact Artifact) {
+	size, err := fileSize(artifact.Path)
+	if err != nil {
+		return
+	}
+	artifact.Size = size
+	m.Artifacts = append(m.Artifacts, artifact)
+}
+
+// fileSize returns the size of a file, or the total size of the files in a
+// directory.
+func fileSize(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+	var size int64
+	err = filepath.WalkDir(name, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// SaveManifest writes the markdown report and the podcast script of out,
+// which are not files yet, and a manifest.json listing every artifact to a
+// new directory under OutputDir/runs. It updates out.Manifest.
+func (a *PlanningAgent) SaveManifest(out *RunOutput) error {
+	if out.Manifest == nil {
+		out.Manifest = newManifest(out.Results, a.config.OutputDir)
+	}
+	m := out.Manifest
+
+	name := fmt.Sprintf("run_%d", m.CreatedAt.UnixNano())
+	dir := filepath.Join(a.config.OutputDir, "runs", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create manifest directory: %w", err)
+	}
+	write := func(kind string, taskType TaskType, file string, data []byte) error {
+		p := filepath.Join(dir, file)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		m.add(Artifact{Kind: kind, TaskType: taskType, Path: p, URL: path.Join("/generated/runs", name, file)})
+		return nil
+	}
+
+	if report, ok := lastResult(out.Results, TaskTypeReport); ok {
+		if err := write("report", TaskTypeReport, "report.md", []byte(report.Output)); err != nil {
+			return err
+		}
+	}
+	if out.PodcastScript != nil {
+		data, err := json.MarshalIndent(out.PodcastScript, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode podcast script: %w", err)
+		}
+		if err := write("podcast_script", TaskTypePodcast, "podcast_script.json", data); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	m.Path = filepath.Join(dir, "manifest.json")
+	if err := os.WriteFile(m.Path, data, 0644); err != nil {
+		m.Path = ""
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
@@ -11,19 +11,80 @@ import (
 
 // PodcastSubagent generates a podcast from a report.
 type PodcastSubagent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	model              string
 	verbose            bool
 	interactionHandler InteractionHandler
+	config             PodcastConfig
+	systemPrompt       string
+	jsonMode           bool
 }
 
-// NewPodcastSubagent creates a new PodcastSubagent.
-func NewPodcastSubagent(client *openai.Client, model string, verbose bool, interactionHandler InteractionHandler) *PodcastSubagent {
+// SpeakerPersona describes one speaker of the podcast.
+type SpeakerPersona struct {
+	// Name is used as DialogueLine.Speaker, e.g. "Host 1" or "Alice".
+	Name string
+	// Persona describes the speaker's role and style for the script writer.
+	Persona string
+}
+
+// PodcastConfig holds options for podcast script generation.
+type PodcastConfig struct {
+	// Speakers are the people in the podcast: one for a solo narration,
+	// two or more for a conversation. Default: two Chinese co-hosts.
+	Speakers []SpeakerPersona
+	// Language of the script. Default: the agent's output language
+	// (AgentConfig.Language), which is 中文 unless configured.
+	Language string
+	// WordsPerMinute is the speaking rate used to estimate the runtime of
+	// the script. Zero means 150.
+	WordsPerMinute int
+	// MaxRepairs is how many times an invalid script is sent back to the
+	// model with the error for correction. Zero means 2; negative disables
+	// corrections.
+	MaxRepairs int
+}
+
+// defaultSpeakers are the two hosts used when PodcastConfig.Speakers is empty.
+var defaultSpeakers = []SpeakerPersona{
+	{Name: "Host 1", Persona: "男，热情、好奇，负责提问和引入话题。"},
+	{Name: "Host 2", Persona: "女，知识渊博、冷静，负责解释细节和提供见解。"},
+}
+
+// speakers returns the configured speakers with empty names dropped, or the
+// default hosts if none are left.
+func (c PodcastConfig) speakers() []SpeakerPersona {
+	var speakers []SpeakerPersona
+	for _, sp := range c.Speakers {
+		if sp.Name = strings.TrimSpace(sp.Name); sp.Name != "" {
+			speakers = append(speakers, sp)
+		}
+	}
+	if len(speakers) == 0 {
+		return defaultSpeakers
+	}
+	return speakers
+}
+
+// language returns the configured script language, or fallback if none.
+func (c PodcastConfig) language(fallback string) string {
+	if c.Language == "" {
+		return fallback
+	}
+	return c.Language
+}
+
+// NewPodcastSubagent creates a new PodcastSubagent. jsonMode requests the
+// script with response_format, wrapped in an object under "script".
+func NewPodcastSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, config PodcastConfig, systemPrompt string, jsonMode bool) *PodcastSubagent {
 	return &PodcastSubagent{
 		client:             client,
 		model:              model,
 		verbose:            verbose,
 		interactionHandler: interactionHandler,
+		config:             config,
+		systemPrompt:       systemPrompt,
+		jsonMode:           jsonMode,
 	}
 }
 
@@ -36,6 +97,9 @@ func (p *PodcastSubagent) Type() TaskType {
 type DialogueLine struct {
 	Speaker string `json:"speaker"`
 	Text    string `json:"text"`
+	// Section names the segment of the podcast starting at this line, such
+	// as the introduction; empty continues the current segment.
+	Section string `json:"section,omitempty"`
 }
 
 // Execute generates a podcast from the input content.
@@ -48,35 +112,11 @@ func (p *PodcastSubagent) Execute(ctx context.Context, task Task) (Result, error
 	}
 
 	// Get content from parameters or description
-	content, ok := task.Parameters["content"].(string)
+	content, ok := task.StringParam("content"), task.HasParam("content")
 	if !ok || content == "Use the content from the previous REPORT task." {
-		// Try to get from context (passed from previous task)
-		if ctxContent, ok := task.Parameters["context"].([]string); ok && len(ctxContent) > 0 {
-			// Try to find the output from the REPORT task
-			var foundReport bool
-			for i := len(ctxContent) - 1; i >= 0; i-- {
-				if strings.Contains(ctxContent[i], "Output from REPORT task:") {
-					content = ctxContent[i]
-					// Extract the content after the header
-					if idx := strings.Index(content, "\n"); idx != -1 {
-						content = content[idx+1:]
-					}
-					foundReport = true
-					break
-				}
-			}
-
-			if !foundReport {
-				// If no REPORT output found, use the last task's output
-				content = ctxContent[len(ctxContent)-1]
-				// Extract the content after the header if present
-				if idx := strings.Index(content, "Output from "); idx != -1 {
-					if newlineIdx := strings.Index(content[idx:], "\n"); newlineIdx != -1 {
-						content = content[idx+newlineIdx+1:]
-					}
-				}
-			}
-			content = strings.TrimSpace(content)
+		// Use the REPORT output passed from a previous task, or the last output
+		if output, found := latestOutput(task, TaskTypeReport); found {
+			content = output
 		} else if !ok {
 			content = task.Description
 		}
@@ -87,33 +127,36 @@ func (p *PodcastSubagent) Execute(ctx context.Context, task Task) (Result, error
 	}
 
 	// 1. Generate Dialogue Script
-	script, err := p.generateScript(ctx, content)
+	script, err := p.generateScript(ctx, content, p.config.language(taskLanguage(task)))
 	if err != nil {
 		return Result{
-			TaskType: TaskTypePodcast,
-			Success:  false,
-			Error:    fmt.Sprintf("生成脚本失败: %v", err),
+			TaskType:  TaskTypePodcast,
+			Success:   false,
+			Error:     fmt.Sprintf("生成脚本失败: %v", err),
+			ErrorKind: classifyError(err),
 		}, err
 	}
 
+	timing := estimateTiming(script, p.config.WordsPerMinute)
 	if p.verbose {
-		fmt.Printf("  ✓ 脚本已生成 (%d 行)\n", len(script))
+		fmt.Printf("  ✓ 脚本已生成 (%d 行，预计时长 %s)\n", len(script), formatRuntime(timing.Total))
 	}
 	if p.interactionHandler != nil {
-		p.interactionHandler.Log(fmt.Sprintf("✓ 脚本已生成 (%d 行)", len(script)))
+		p.interactionHandler.Log(fmt.Sprintf("✓ 脚本已生成 (%d 行，预计时长 %s)", len(script), formatRuntime(timing.Total)))
 	}
 
 	// Convert script to JSON string for output
 	scriptJSON, err := json.MarshalIndent(script, "", "  ")
 	if err != nil {
 		return Result{
-			TaskType: TaskTypePodcast,
-			Success:  false,
-			Error:    fmt.Sprintf("序列化脚本失败: %v", err),
+			TaskType:  TaskTypePodcast,
+			Success:   false,
+			Error:     fmt.Sprintf("序列化脚本失败: %v", err),
+			ErrorKind: ErrParse,
 		}, err
 	}
 
-	outputMsg := fmt.Sprintf("播客脚本生成成功！\n\n请将以下脚本提交到 https://listenhub.ai/zh 以生成音频：\n\n%s", string(scriptJSON))
+	outputMsg := fmt.Sprintf("播客脚本生成成功！预计时长 %s。\n\n请将以下脚本提交到 https://listenhub.ai/zh 以生成音频：\n\n%s", formatRuntime(timing.Total), string(scriptJSON))
 
 	return Result{
 		TaskType: TaskTypePodcast,
@@ -121,22 +164,21 @@ func (p *PodcastSubagent) Execute(ctx context.Context, task Task) (Result, error
 		Output:   outputMsg,
 		Metadata: map[string]interface{}{
 			"script": script,
+			"timing": timing,
 		},
 	}, nil
 }
 
-func (p *PodcastSubagent) generateScript(ctx context.Context, content string) ([]DialogueLine, error) {
-	systemPrompt := `你是一位播客制作人。你的目标是将提供的输入文本（报告或文章）转换为两位主持人之间引人入胜的对话：
-- 主持人 1 (男): 热情、好奇，负责提问和引入话题。
-- 主持人 2 (女): 知识渊博、冷静，负责解释细节和提供见解。
+func (p *PodcastSubagent) generateScript(ctx context.Context, content, language string) ([]DialogueLine, error) {
+	speakers := p.config.speakers()
 
-对话应自然、口语化且易于收听。它应涵盖输入文本的要点。
-仅输出一个 JSON 对象数组，其中每个对象包含 "speaker" ("Host 1" 或 "Host 2") 和 "text" (口语台词)。
-Example:
-[
-  {"speaker": "Host 1", "text": "Welcome back to the show! Today we're discussing..."},
-  {"speaker": "Host 2", "text": "That's right. It's a fascinating topic..."}
-]`
+	systemPrompt := podcastSystemPrompt(speakers, language)
+	if p.systemPrompt != "" {
+		systemPrompt = p.systemPrompt
+	}
+	if p.jsonMode {
+		systemPrompt += jsonArrayHint("script")
+	}
 
 	messages := []openai.ChatCompletionMessage{
 		{
@@ -145,7 +187,7 @@ Example:
 		},
 		{
 			Role:    openai.ChatMessageRoleUser,
-			Content: fmt.Sprintf("将此文本转换为播客对话 (输出中文):\n\n%s", content),
+			Content: fmt.Sprintf("将此文本转换为播客脚本 (输出%s):\n\n%s", language, content),
 		},
 	}
 
@@ -154,29 +196,116 @@ Example:
 		Messages:    messages,
 		Temperature: 0.7,
 	}
+	if p.jsonMode {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
 
 	resp, err := p.client.CreateChatCompletion(ctx, req)
 	if err != nil {
 		return nil, err
 	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response")
+	}
 
-	scriptContent := resp.Choices[0].Message.Content
+	script, err := parseScript(resp.Choices[0].Message.Content, speakers)
+	// Feed the error back to the model until the script is valid
+	repairs := jsonRepairs(p.config.MaxRepairs)
+	for attempt := 1; err != nil && attempt <= repairs; attempt++ {
+		if p.verbose {
+			fmt.Printf("  ⚠️ 播客脚本无效: %v，正在请求修正 (%d/%d)\n", err, attempt, repairs)
+		}
+		if p.interactionHandler != nil {
+			p.interactionHandler.Log(fmt.Sprintf("⚠️ 播客脚本无效: %v，正在请求修正 (%d/%d)", err, attempt, repairs))
+		}
 
-	// Clean up markdown code blocks if present
-	if idx := strings.Index(scriptContent, "```json"); idx != -1 {
-		scriptContent = scriptContent[idx+7:]
-	} else if idx := strings.Index(scriptContent, "```"); idx != -1 {
-		scriptContent = scriptContent[idx+3:]
+		req.Messages = append(req.Messages, resp.Choices[0].Message, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: fmt.Sprintf("你的输出无效: %v。请修正并仅输出有效的 JSON 数组，每行的 \"speaker\" 必须是 %s 之一，\"text\" 不能为空。", err, quotedNames(speakers)),
+		})
+		var reqErr error
+		resp, reqErr = p.client.CreateChatCompletion(ctx, req)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("no choices in response")
+		}
+		script, err = parseScript(resp.Choices[0].Message.Content, speakers)
 	}
-	if idx := strings.LastIndex(scriptContent, "```"); idx != -1 {
-		scriptContent = scriptContent[:idx]
+	if err != nil {
+		return nil, err
+	}
+
+	return script, nil
+}
+
+// podcastSystemPrompt builds the script writer prompt for the speakers.
+func podcastSystemPrompt(speakers []SpeakerPersona, language string) string {
+	var sb strings.Builder
+	if len(speakers) == 1 {
+		sb.WriteString("你是一位播客制作人。你的目标是将提供的输入文本（报告或文章）转换为一位主持人引人入胜的单人讲述：\n")
+	} else {
+		sb.WriteString(fmt.Sprintf("你是一位播客制作人。你的目标是将提供的输入文本（报告或文章）转换为 %d 位主持人之间引人入胜的对话：\n", len(speakers)))
+	}
+	for _, sp := range speakers {
+		sb.WriteString(fmt.Sprintf("- %s: %s\n", sp.Name, sp.Persona))
+	}
+	sb.WriteString(fmt.Sprintf(`
+内容应自然、口语化且易于收听，使用%s。它应涵盖输入文本的要点。
+仅输出一个 JSON 对象数组，其中每个对象包含 "speaker" (%s 之一) 和 "text" (口语台词)。
+在每个段落（如开场、各个话题、结尾）的第一行添加 "section" 字段标注段落名称，其余行省略该字段。
+Example:
+[
+`, language, quotedNames(speakers)))
+	examples := []string{"Welcome back to the show! Today we're discussing...", "That's right. It's a fascinating topic..."}
+	for i, text := range examples {
+		sep := ","
+		if i == len(examples)-1 {
+			sep = ""
+		}
+		section := ""
+		if i == 0 {
+			section = `, "section": "Intro"`
+		}
+		sb.WriteString(fmt.Sprintf("  {\"speaker\": %q, \"text\": %q%s}%s\n", speakers[i%len(speakers)].Name, text, section, sep))
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// quotedNames returns the speaker names quoted and separated by commas.
+func quotedNames(speakers []SpeakerPersona) string {
+	names := make([]string, len(speakers))
+	for i, sp := range speakers {
+		names[i] = fmt.Sprintf("%q", sp.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// parseScript parses and validates the podcast script JSON returned by the
+// LLM, either an array or an object with the array under "script". Every
+// line must belong to one of speakers.
+func parseScript(content string, speakers []SpeakerPersona) ([]DialogueLine, error) {
+	allowed := make(map[string]bool, len(speakers))
+	for _, sp := range speakers {
+		allowed[sp.Name] = true
 	}
-	scriptContent = strings.TrimSpace(scriptContent)
 
 	var script []DialogueLine
-	if err := json.Unmarshal([]byte(scriptContent), &script); err != nil {
+	if err := json.Unmarshal([]byte(unwrapJSONArray(content, "script")), &script); err != nil {
 		return nil, fmt.Errorf("解析脚本 JSON 失败: %w", err)
 	}
-
+	if len(script) == 0 {
+		return nil, fmt.Errorf("脚本为空")
+	}
+	for i, line := range script {
+		if !allowed[line.Speaker] {
+			return nil, fmt.Errorf("第 %d 行的说话人 %q 无效", i+1, line.Speaker)
+		}
+		if strings.TrimSpace(line.Text) == "" {
+			return nil, fmt.Errorf("第 %d 行没有台词", i+1)
+		}
+	}
 	return script, nil
 }
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGenerateScriptRepair(t *testing.T) {
+	roundtable := PodcastConfig{
+		Speakers: []SpeakerPersona{{Name: "Alice"}, {Name: "Bob"}, {Name: "Carol"}},
+		Language: "English",
+	}
+
+	tests := []struct {
+		name    string
+		config  PodcastConfig
+		replies []string
+		calls   int
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			replies: []string{`[{"speaker": "Host 1", "text": "Hi"}, {"speaker": "Host 2", "text": "Hello"}]`},
+			calls:   1,
+		},
+		{
+			name:    "malformed json repaired",
+			replies: []string{`[{"speaker": "Host 1", "text": "Hi"`, `[{"speaker": "Host 1", "text": "Hi"}]`},
+			calls:   2,
+		},
+		{
+			name:    "unknown speaker repaired",
+			replies: []string{`[{"speaker": "Narrator", "text": "Hi"}]`, `[{"speaker": "Host 2", "text": "Hi"}]`},
+			calls:   2,
+		},
+		{
+			name:    "empty text still invalid",
+			replies: []string{`[{"speaker": "Host 1", "text": ""}]`, `[{"speaker": "Host 1", "text": "  "}]`},
+			calls:   3,
+			wantErr: true,
+		},
+		{
+			name:    "repaired on the second correction",
+			replies: []string{`not json`, `[{"speaker": "Host 1"`, `[{"speaker": "Host 1", "text": "Hi"}]`},
+			calls:   3,
+		},
+		{
+			name:    "more corrections configured",
+			config:  PodcastConfig{MaxRepairs: 3},
+			replies: []string{`not json`, `not json`, `not json`, `[{"speaker": "Host 2", "text": "Hi"}]`},
+			calls:   4,
+		},
+		{
+			name:    "corrections disabled",
+			config:  PodcastConfig{MaxRepairs: -1},
+			replies: []string{`not json`, `[{"speaker": "Host 1", "text": "Hi"}]`},
+			calls:   1,
+			wantErr: true,
+		},
+		{
+			name:    "custom speakers",
+			config:  roundtable,
+			replies: []string{`[{"speaker": "Host 1", "text": "Hi"}]`, `[{"speaker": "Alice", "text": "Hi"}, {"speaker": "Carol", "text": "Hey"}]`},
+			calls:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, calls := sequentialReplies(tt.replies...)
+			srv := newFakeLLM(t, reply)
+			p := NewPodcastSubagent(newFakeClient(srv), "gpt-4o", false, nil, tt.config, "", false)
+
+			script, err := p.generateScript(context.Background(), "content", "中文")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *calls != tt.calls {
+				t.Errorf("expected %d LLM calls, got %d", tt.calls, *calls)
+			}
+			allowed := make(map[string]bool)
+			for _, sp := range tt.config.speakers() {
+				allowed[sp.Name] = true
+			}
+			for _, line := range script {
+				if !allowed[line.Speaker] || line.Text == "" {
+					t.Errorf("invalid line in script: %+v", line)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateScriptNoChoices(t *testing.T) {
+	// The first reply and its correction
+	for replies := 0; replies < 2; replies++ {
+		m := filteredClient{&MockClient{Replies: []string{"not json"}}, replies}
+		p := NewPodcastSubagent(m, "gpt-4o", false, nil, PodcastConfig{}, "", false)
+		if _, err := p.generateScript(context.Background(), "content", "中文"); err == nil || !strings.Contains(err.Error(), "no choices") {
+			t.Errorf("after %d replies: expected an error, got %v", replies, err)
+		}
+	}
+}
+
+func TestPodcastSystemPrompt(t *testing.T) {
+	prompt := podcastSystemPrompt(PodcastConfig{}.speakers(), PodcastConfig{}.language(defaultLanguage))
+	for _, want := range []string{"2 位主持人", `"Host 1", "Host 2"`, "使用中文"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("default prompt missing %q:\n%s", want, prompt)
+		}
+	}
+
+	solo := PodcastConfig{Speakers: []SpeakerPersona{{Name: "Narrator", Persona: "calm storyteller"}}, Language: "English"}
+	prompt = podcastSystemPrompt(solo.speakers(), solo.language(defaultLanguage))
+	for _, want := range []string{"单人讲述", "- Narrator: calm storyteller", `{"speaker": "Narrator"`, "使用English"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("solo prompt missing %q:\n%s", want, prompt)
+		}
+	}
+
+	if got := (PodcastConfig{Speakers: []SpeakerPersona{{Name: " "}}}).speakers(); len(got) != 2 {
+		t.Errorf("expected default speakers for blank names, got %+v", got)
+	}
+}
+
+func TestPodcastTiming(t *testing.T) {
+	srv := newFakeLLM(t, func(map[string]interface{}) string {
+		return `[{"speaker": "Host 1", "text": "one two three four five six", "section": "Intro"},
+			{"speaker": "Host 2", "text": "one two three"},
+			{"speaker": "Host 1", "text": "今天我们聊聊人工智能的发展", "section": "主题"}]`
+	})
+	p := NewPodcastSubagent(newFakeClient(srv), "gpt-4o", false, nil, PodcastConfig{WordsPerMinute: 120}, "", false)
+	result, err := p.Execute(context.Background(), Task{Type: TaskTypePodcast, Parameters: map[string]interface{}{"content": "report"}})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+
+	timing, ok := result.Metadata["timing"].(PodcastTiming)
+	if !ok {
+		t.Fatalf("expected timing metadata, got %+v", result.Metadata)
+	}
+	// 6 and 3 words at 2 words per second; 13 characters are 8.125 words
+	want := []LineTiming{{0, 3}, {3, 1.5}, {4.5, 4.1}}
+	for i, line := range timing.Lines {
+		if line != want[i] {
+			t.Errorf("line %d: expected %+v, got %+v", i, want[i], line)
+		}
+	}
+	if timing.Total != 8.6 || timing.WordsPerMinute != 120 {
+		t.Errorf("unexpected total %v at %d wpm", timing.Total, timing.WordsPerMinute)
+	}
+	wantSegments := []PodcastSegment{{Section: "Intro", Line: 0, Start: 0, Duration: 4.5}, {Section: "主题", Line: 2, Start: 4.5, Duration: 4.1}}
+	if len(timing.Segments) != 2 || timing.Segments[0] != wantSegments[0] || timing.Segments[1] != wantSegments[1] {
+		t.Errorf("expected segments %+v, got %+v", wantSegments, timing.Segments)
+	}
+	if !strings.Contains(result.Output, "预计时长 0:09") || !strings.Contains(result.Output, `"section": "Intro"`) {
+		t.Errorf("unexpected output %q", result.Output)
+	}
+}
+
+func TestGenerateScriptJSONMode(t *testing.T) {
+	for _, jsonMode := range []bool{false, true} {
+		var format interface{}
+		var prompt string
+		srv := newFakeLLM(t, func(req map[string]interface{}) string {
+			format = req["response_format"]
+			prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+			if jsonMode {
+				return `{"script": [{"speaker": "Host 1", "text": "Hi"}]}`
+			}
+			return "```json\n[{\"speaker\": \"Host 1\", \"text\": \"Hi\"}]\n```"
+		})
+		p := NewPodcastSubagent(newFakeClient(srv), "gpt-4o", false, nil, PodcastConfig{}, "", jsonMode)
+
+		script, err := p.generateScript(context.Background(), "content", "中文")
+		if err != nil {
+			t.Fatalf("jsonMode=%v: generateScript failed: %v", jsonMode, err)
+		}
+		if len(script) != 1 || script[0].Text != "Hi" {
+			t.Errorf("jsonMode=%v: unexpected script %+v", jsonMode, script)
+		}
+		if (format != nil) != jsonMode || strings.Contains(prompt, `"script"`) != jsonMode {
+			t.Errorf("jsonMode=%v: got response_format %v, prompt %q", jsonMode, format, prompt)
+		}
+	}
+}
+
+func TestGenerateScriptRepairFeedback(t *testing.T) {
+	m := &MockClient{Replies: []string{`[{"speaker": "Host 1", "text": "Hi"`, `[{"speaker": "Host 1", "text": "Hi"}]`}}
+	p := NewPodcastSubagent(m, "gpt-4o", false, nil, PodcastConfig{}, "", false)
+	if _, err := p.generateScript(context.Background(), "content", "中文"); err != nil {
+		t.Fatalf("generateScript failed: %v", err)
+	}
+
+	// The correction request carries the invalid reply and its parse error
+	messages := m.Requests()[1].Messages
+	invalid, feedback := messages[len(messages)-2], messages[len(messages)-1]
+	if invalid.Content != `[{"speaker": "Host 1", "text": "Hi"` || !strings.Contains(feedback.Content, "解析脚本 JSON 失败: unexpected end of JSON input") {
+		t.Errorf("unexpected correction messages %+v", messages[len(messages)-2:])
+	}
+}
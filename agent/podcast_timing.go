@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"unicode"
+)
+
+// defaultWordsPerMinute is the speaking rate used when
+// PodcastConfig.WordsPerMinute is not set.
+const defaultWordsPerMinute = 150
+
+// charsPerWord is the average number of Chinese, Japanese or Korean
+// characters per spoken word, so one rate fits every script language.
+const charsPerWord = 1.6
+
+// LineTiming is the estimated position of a script line in the audio, in
+// seconds.
+type LineTiming struct {
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+}
+
+// PodcastSegment is a section of the script, starting at the line that
+// names it.
+type PodcastSegment struct {
+	Section string `json:"section"`
+	// Line is the index of the first line of the segment.
+	Line     int     `json:"line"`
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+}
+
+// PodcastTiming estimates the runtime of a script from its word counts,
+// returned in Result.Metadata["timing"].
+type PodcastTiming struct {
+	WordsPerMinute int              `json:"words_per_minute"`
+	Lines          []LineTiming     `json:"lines"`
+	Segments       []PodcastSegment `json:"segments,omitempty"`
+	// Total is the estimated runtime in seconds.
+	Total float64 `json:"total"`
+}
+
+// spokenWords counts the words of text, counting charsPerWord Chinese,
+// Japanese or Korean characters as one word.
+func spokenWords(text string) float64 {
+	words, chars := 0, 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			chars++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if !inWord {
+				words++
+			}
+			inWord = true
+		default:
+			inWord = false
+		}
+	}
+	return float64(words) + float64(chars)/charsPerWord
+}
+
+// estimateTiming estimates the duration of every line of script at
+// wordsPerMinute, and groups the lines into segments starting at lines
+// with a section. Lines before the first section belong to no segment.
+func estimateTiming(script []DialogueLine, wordsPerMinute int) PodcastTiming {
+	if wordsPerMinute <= 0 {
+		wordsPerMinute = defaultWordsPerMinute
+	}
+	timing := PodcastTiming{WordsPerMinute: wordsPerMinute, Lines: make([]LineTiming, len(script))}
+	for i, line := range script {
+		duration := math.Round(spokenWords(line.Text)*60/float64(wordsPerMinute)*10) / 10
+		timing.Lines[i] = LineTiming{Start: timing.Total, Duration: duration}
+		timing.Total = math.Round((timing.Total+duration)*10) / 10
+
+		if line.Section != "" {
+			timing.Segments = append(timing.Segments, PodcastSegment{Section: line.Section, Line: i, Start: timing.Lines[i].Start})
+		}
+		if n := len(timing.Segments); n > 0 {
+			timing.Segments[n-1].Duration = math.Round((timing.Total-timing.Segments[n-1].Start)*10) / 10
+		}
+	}
+	return timing
+}
+
+// formatRuntime formats seconds as minutes and seconds, e.g. "12:05".
+func formatRuntime(seconds float64) string {
+	s := int(math.Round(seconds))
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
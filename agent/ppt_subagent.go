@@ -1,13 +1,21 @@
 package agent
 
 import (
+	"archive/zip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,21 +24,75 @@ import (
 
 // PPTSubagent generates a modern HTML presentation from content.
 type PPTSubagent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	model              string
 	verbose            bool
 	interactionHandler InteractionHandler
 	outputDir          string
+	config             PPTConfig
+	systemPrompt       string
+	caps               Capabilities
 }
 
-// NewPPTSubagent creates a new PPTSubagent.
-func NewPPTSubagent(client *openai.Client, model string, verbose bool, interactionHandler InteractionHandler, outputDir string) *PPTSubagent {
+// PPTConfig holds options for presentation generation.
+type PPTConfig struct {
+	// ConfirmBuild asks the user via ConfirmAction before running npm.
+	ConfirmBuild bool
+	// ImageGen generates an image for each slide's image description
+	// instead of using random placeholder pictures.
+	ImageGen bool
+	// ImageModel is the image generation model (default: dall-e-3).
+	ImageModel string
+	// MinSlides and MaxSlides bound the number of slides (default: 5-20).
+	MinSlides int
+	MaxSlides int
+	// SourceZip packs the editable project source (slides.md and
+	// package.json) into source.zip, returned in Result.Metadata["source_zip"].
+	// Its file is also returned in Result.Metadata["path"], so a later EMAIL
+	// task attaches it. The built deck is a web page and is never attached.
+	SourceZip bool
+	// KeepProjects is how many of the newest ppt_<ts> project directories
+	// are kept in the output directory; older ones are removed after each
+	// build. Zero keeps all.
+	KeepProjects int
+	// PreviewSlides sends each slide to the SlideHandler of the interaction
+	// handler before the presentation is built. If the model supports
+	// streaming, the slides are streamed and sent as they are generated.
+	PreviewSlides bool
+	// MaxRepairs is how many times invalid slides are sent back to the
+	// model with the error for correction. Zero means 2; negative disables
+	// corrections.
+	MaxRepairs int
+}
+
+// slideBounds returns the configured slide count range with defaults applied.
+func (c PPTConfig) slideBounds() (int, int) {
+	minSlides, maxSlides := c.MinSlides, c.MaxSlides
+	if minSlides <= 0 {
+		minSlides = 5
+	}
+	if maxSlides <= 0 {
+		maxSlides = 20
+	}
+	if minSlides > maxSlides {
+		minSlides = maxSlides
+	}
+	return minSlides, maxSlides
+}
+
+// NewPPTSubagent creates a new PPTSubagent. With caps.JSONMode the slides
+// are requested with response_format, wrapped in an object under "slides";
+// with caps.Streaming they are streamed when they are previewed.
+func NewPPTSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, outputDir string, config PPTConfig, systemPrompt string, caps Capabilities) *PPTSubagent {
 	return &PPTSubagent{
 		client:             client,
 		model:              model,
 		verbose:            verbose,
 		interactionHandler: interactionHandler,
 		outputDir:          outputDir,
+		config:             config,
+		systemPrompt:       systemPrompt,
+		caps:               caps,
 	}
 }
 
@@ -59,42 +121,19 @@ func (p *PPTSubagent) Execute(ctx context.Context, task Task) (Result, error) {
 	// Ensure output directory exists
 	if err := os.MkdirAll(p.outputDir, 0755); err != nil {
 		return Result{
-			TaskType: TaskTypePPT,
-			Success:  false,
-			Error:    fmt.Sprintf("创建输出目录失败: %v", err),
+			TaskType:  TaskTypePPT,
+			Success:   false,
+			Error:     fmt.Sprintf("创建输出目录失败: %v", err),
+			ErrorKind: ErrIO,
 		}, err
 	}
 
 	// Get content from parameters or description
-	content, ok := task.Parameters["content"].(string)
+	content, ok := task.StringParam("content"), task.HasParam("content")
 	if !ok || content == "Use the content from the previous REPORT task." {
-		// Try to get from context (passed from previous task)
-		if ctxContent, ok := task.Parameters["context"].([]string); ok && len(ctxContent) > 0 {
-			// Try to find the output from the REPORT task
-			var foundReport bool
-			for i := len(ctxContent) - 1; i >= 0; i-- {
-				if strings.Contains(ctxContent[i], "Output from REPORT task:") {
-					content = ctxContent[i]
-					// Extract the content after the header
-					if idx := strings.Index(content, "\n"); idx != -1 {
-						content = content[idx+1:]
-					}
-					foundReport = true
-					break
-				}
-			}
-
-			if !foundReport {
-				// If no REPORT output found, use the last task's output
-				content = ctxContent[len(ctxContent)-1]
-				// Extract the content after the header if present
-				if idx := strings.Index(content, "Output from "); idx != -1 {
-					if newlineIdx := strings.Index(content[idx:], "\n"); newlineIdx != -1 {
-						content = content[idx+newlineIdx+1:]
-					}
-				}
-			}
-			content = strings.TrimSpace(content)
+		// Use the REPORT output passed from a previous task, or the last output
+		if output, found := latestOutput(task, TaskTypeReport); found {
+			content = output
 		} else if !ok {
 			content = task.Description
 		}
@@ -118,12 +157,13 @@ func (p *PPTSubagent) Execute(ctx context.Context, task Task) (Result, error) {
 	}
 
 	// 1. Generate Slide Structure
-	slides, err := p.generateSlides(ctx, content, images)
+	slides, err := p.generateSlides(ctx, content, images, taskLanguage(task))
 	if err != nil {
 		return Result{
-			TaskType: TaskTypePPT,
-			Success:  false,
-			Error:    fmt.Sprintf("生成幻灯片失败: %v", err),
+			TaskType:  TaskTypePPT,
+			Success:   false,
+			Error:     fmt.Sprintf("生成幻灯片失败: %v", err),
+			ErrorKind: classifyError(err),
 		}, err
 	}
 
@@ -132,7 +172,26 @@ func (p *PPTSubagent) Execute(ctx context.Context, task Task) (Result, error) {
 	}
 
 	// 2. Generate and Build
-	url, err := p.GenerateAndBuild(ctx, slides)
+	dirName, err := p.generateProject(ctx, slides)
+	var url, sourceZip string
+	if err == nil {
+		if p.config.SourceZip {
+			if sourceZip, err = p.zipProject(dirName); err != nil {
+				p.warn(fmt.Sprintf("⚠️ 打包演示文稿源码失败: %v", err))
+			}
+		}
+		url, err = p.buildProject(ctx, dirName)
+		p.cleanupProjects(dirName)
+	}
+	if err != nil && ctx.Err() != nil {
+		// The run was stopped; don't fall back to the unbuilt sources
+		return Result{
+			TaskType:  TaskTypePPT,
+			Success:   false,
+			Error:     fmt.Sprintf("构建演示文稿已取消: %v", ctx.Err()),
+			ErrorKind: classifyError(err),
+		}, err
+	}
 	if err != nil {
 		// Log detailed error to terminal/logs
 		if p.verbose {
@@ -143,37 +202,168 @@ func (p *PPTSubagent) Execute(ctx context.Context, task Task) (Result, error) {
 		}
 
 		// Return success but with a warning message
+		metadata := map[string]interface{}{
+			"slides": slides,
+			"error":  err.Error(),
+		}
+		if sourceZip != "" {
+			metadata["source_zip"] = sourceZip
+			metadata["path"] = filepath.Join(p.outputDir, dirName, "source.zip")
+		}
 		return Result{
-			TaskType: TaskTypePPT,
-			Success:  true,
-			Output:   "PPT 内容已生成，但构建演示文稿失败 (可能是内存不足)。已跳过构建步骤，您可以查看生成的源文件。",
-			Metadata: map[string]interface{}{
-				"slides": slides,
-				"error":  err.Error(),
-			},
+			TaskType:  TaskTypePPT,
+			Success:   true,
+			ErrorKind: ErrBuild,
+			Output:    "PPT 内容已生成，但构建演示文稿失败 (可能是内存不足)。已跳过构建步骤，您可以查看生成的源文件。",
+			Metadata:  metadata,
 		}, nil
 	}
 
+	output := fmt.Sprintf("演示文稿生成成功。请访问: %s", url)
+	metadata := map[string]interface{}{
+		"ppt_url": url,
+		"slides":  slides,
+	}
+	if sourceZip != "" {
+		output += fmt.Sprintf("\n源码下载: %s", sourceZip)
+		metadata["source_zip"] = sourceZip
+		metadata["path"] = filepath.Join(p.outputDir, dirName, "source.zip")
+	}
 	return Result{
 		TaskType: TaskTypePPT,
 		Success:  true,
-		Output:   fmt.Sprintf("演示文稿生成成功。请访问: %s", url),
-		Metadata: map[string]interface{}{
-			"ppt_url": url,
-			"slides":  slides,
-		},
+		Output:   output,
+		Metadata: metadata,
 	}, nil
 }
 
+// sourceFiles are the files of a generated project packed by zipProject.
+var sourceFiles = []string{"slides.md", "package.json"}
+
+// zipProject packs the source files of a generated project into source.zip
+// in the project directory and returns its URL.
+func (p *PPTSubagent) zipProject(dirName string) (string, error) {
+	projectDir := filepath.Join(p.outputDir, dirName)
+	f, err := os.Create(filepath.Join(projectDir, "source.zip"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, name := range sourceFiles {
+		data, err := os.ReadFile(filepath.Join(projectDir, name))
+		if err != nil {
+			return "", err
+		}
+		w, err := zw.Create(path.Join(dirName, name))
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/generated/%s/source.zip", dirName), nil
+}
+
+// cleanupProjects removes the oldest ppt_<ts>[_<random>] project
+// directories beyond KeepProjects, never the current one.
+func (p *PPTSubagent) cleanupProjects(current string) {
+	if p.config.KeepProjects <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(p.outputDir)
+	if err != nil {
+		return
+	}
+
+	type project struct {
+		name      string
+		timestamp int64
+	}
+	var projects []project
+	for _, entry := range entries {
+		ts, ok := strings.CutPrefix(entry.Name(), "ppt_")
+		if !entry.IsDir() || !ok {
+			continue
+		}
+		ts, _, _ = strings.Cut(ts, "_")
+		if timestamp, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			projects = append(projects, project{entry.Name(), timestamp})
+		}
+	}
+	// Newest first
+	sort.Slice(projects, func(i, j int) bool { return projects[i].timestamp > projects[j].timestamp })
+
+	kept := 0
+	for _, proj := range projects {
+		if proj.name == current || kept < p.config.KeepProjects-1 {
+			if proj.name != current {
+				kept++
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(p.outputDir, proj.name)); err != nil {
+			p.warn(fmt.Sprintf("⚠️ 清理旧演示文稿 %s 失败: %v", proj.name, err))
+		}
+	}
+}
+
+// warn reports a non-fatal problem to the terminal and the interaction handler.
+func (p *PPTSubagent) warn(message string) {
+	if p.verbose {
+		fmt.Println("  " + message)
+	}
+	if p.interactionHandler != nil {
+		p.interactionHandler.Log(message)
+	}
+}
+
+// Validate checks that npm is available to build presentations.
+func (p *PPTSubagent) Validate() error {
+	if _, err := exec.LookPath("npm"); err != nil {
+		return fmt.Errorf("未找到 npm，无法构建演示文稿: %w", err)
+	}
+	return nil
+}
+
 // GenerateAndBuild generates the markdown and builds the Slidev project.
 func (p *PPTSubagent) GenerateAndBuild(ctx context.Context, slides []Slide) (string, error) {
-	timestamp := time.Now().Unix()
-	dirName := fmt.Sprintf("ppt_%d", timestamp)
-	projectDir := filepath.Join(p.outputDir, dirName)
+	dirName, err := p.generateProject(ctx, slides)
+	if err != nil {
+		return "", err
+	}
+	return p.buildProject(ctx, dirName)
+}
 
-	if err := os.MkdirAll(projectDir, 0755); err != nil {
+// generateProject writes the Slidev project for slides to a new
+// ppt_<ts>_<random> directory of the output directory and returns the
+// directory name. The random part keeps projects generated in the same
+// second by concurrent sessions apart.
+func (p *PPTSubagent) generateProject(ctx context.Context, slides []Slide) (string, error) {
+	if err := os.MkdirAll(p.outputDir, 0755); err != nil {
+		return "", fmt.Errorf("创建输出目录失败: %v", err)
+	}
+	projectDir, err := os.MkdirTemp(p.outputDir, fmt.Sprintf("ppt_%d_*", time.Now().Unix()))
+	if err != nil {
 		return "", fmt.Errorf("创建项目目录失败: %v", err)
 	}
+	// MkdirTemp creates private directories, but the deck is served as is
+	if err := os.Chmod(projectDir, 0755); err != nil {
+		return "", fmt.Errorf("创建项目目录失败: %v", err)
+	}
+	dirName := filepath.Base(projectDir)
+
+	if p.config.ImageGen {
+		p.generateImages(ctx, slides)
+	}
 
 	markdown := p.generateSlidevMarkdown(slides)
 	if err := os.WriteFile(filepath.Join(projectDir, "slides.md"), []byte(markdown), 0644); err != nil {
@@ -206,6 +396,29 @@ func (p *PPTSubagent) GenerateAndBuild(ctx context.Context, slides []Slide) (str
 		return "", fmt.Errorf("写入 package.json 失败: %v", err)
 	}
 
+	return dirName, nil
+}
+
+// buildProject installs the dependencies of a generated project and builds
+// it with Slidev. It returns the URL of the built presentation.
+func (p *PPTSubagent) buildProject(ctx context.Context, dirName string) (string, error) {
+	projectDir := filepath.Join(p.outputDir, dirName)
+	basePath := fmt.Sprintf("/generated/%s/dist/", dirName)
+
+	// Ask before running npm if configured
+	if p.config.ConfirmBuild && p.interactionHandler != nil {
+		approved, err := p.interactionHandler.ConfirmAction("运行 npm install 和 npm run build 构建演示文稿", map[string]interface{}{
+			"dir":      projectDir,
+			"commands": []string{"npm install", "npm run build"},
+		})
+		if err != nil {
+			return "", fmt.Errorf("确认构建失败: %v", err)
+		}
+		if !approved {
+			return "", fmt.Errorf("用户取消了构建")
+		}
+	}
+
 	// Run npm install
 	if p.verbose {
 		fmt.Println("  正在安装依赖 (npm install)...")
@@ -218,10 +431,16 @@ func (p *PPTSubagent) GenerateAndBuild(ctx context.Context, slides []Slide) (str
 	installCtx, installCancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer installCancel()
 
-	installCmd := exec.CommandContext(installCtx, "npm", "install")
-	installCmd.Dir = projectDir
-	if output, err := installCmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("npm install 失败: %v\n输出: %s", err, string(output))
+	// Concurrent installs can corrupt the shared npm cache
+	select {
+	case npmInstallSem <- struct{}{}:
+	case <-installCtx.Done():
+		return "", fmt.Errorf("等待 npm install 失败: %w", installCtx.Err())
+	}
+	output, err := runCommand(installCtx, projectDir, "npm", "install")
+	<-npmInstallSem
+	if err != nil {
+		return "", fmt.Errorf("npm install 失败: %w\n输出: %s", err, string(output))
 	}
 
 	// Run npm run build
@@ -236,10 +455,8 @@ func (p *PPTSubagent) GenerateAndBuild(ctx context.Context, slides []Slide) (str
 	buildCtx, buildCancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer buildCancel()
 
-	buildCmd := exec.CommandContext(buildCtx, "npm", "run", "build")
-	buildCmd.Dir = projectDir
-	if output, err := buildCmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("slidev build 失败: %v\n输出: %s", err, string(output))
+	if output, err := runCommand(buildCtx, projectDir, "npm", "run", "build"); err != nil {
+		return "", fmt.Errorf("slidev build 失败: %w\n输出: %s", err, string(output))
 	}
 
 	if p.verbose {
@@ -252,13 +469,38 @@ func (p *PPTSubagent) GenerateAndBuild(ctx context.Context, slides []Slide) (str
 	return fmt.Sprintf("%sindex.html", basePath), nil
 }
 
-func (p *PPTSubagent) generateSlides(ctx context.Context, content string, images []string) ([]Slide, error) {
+// npmInstallSem serializes npm install across the agents of the process, e.g.
+// web sessions building presentations at the same time. Builds still run
+// concurrently.
+var npmInstallSem = make(chan struct{}, 1)
+
+// commandWaitDelay bounds how long runCommand waits for output pipes held
+// open by leftover child processes after the command exits or is killed.
+const commandWaitDelay = 5 * time.Second
+
+// runCommand runs name with args in dir and returns its combined output.
+// Cancelling ctx kills the command together with every process it spawned.
+func runCommand(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.WaitDelay = commandWaitDelay
+	setProcessGroup(cmd)
+	output, err := cmd.CombinedOutput()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return output, fmt.Errorf("%w (%v)", ctxErr, err)
+	}
+	return output, err
+}
+
+func (p *PPTSubagent) generateSlides(ctx context.Context, content string, images []string, language string) ([]Slide, error) {
 	imagesContext := ""
 	if len(images) > 0 {
 		imagesContext = fmt.Sprintf("\n你可以使用以下来自源材料的图片：\n- %s\n\n在适当的时候，在幻灯片的 'image' 字段中使用这些确切的 URL。如果列表中没有相关的图片，请使用占位符或描述。", strings.Join(images, "\n- "))
 	}
 
-	systemPrompt := fmt.Sprintf(`你是一位专业的演示文稿设计师。你的目标是将提供的文本转换为结构化的幻灯片（5-20 张）。
+	minSlides, maxSlides := p.config.slideBounds()
+
+	systemPrompt := fmt.Sprintf(`你是一位专业的演示文稿设计师。你的目标是将提供的文本转换为结构化的幻灯片（%d-%d 张）。
 设计应现代、简洁且引人入胜。
 %s
 
@@ -275,7 +517,13 @@ Example:
 [
   {"title": "The Future of AI", "content": ["AI is evolving rapidly", "Impact on all industries"], "layout": "title-center"},
   {"title": "Key Trends", "content": ["Generative Models", "Agentic Workflows"], "layout": "bullets"}
-]`, imagesContext)
+]`, minSlides, maxSlides, imagesContext)
+	if p.systemPrompt != "" {
+		systemPrompt = p.systemPrompt + fmt.Sprintf("\n幻灯片数量: %d-%d 张。\n", minSlides, maxSlides) + imagesContext
+	}
+	if p.caps.JSONMode {
+		systemPrompt += jsonArrayHint("slides")
+	}
 
 	messages := []openai.ChatCompletionMessage{
 		{
@@ -284,7 +532,7 @@ Example:
 		},
 		{
 			Role:    openai.ChatMessageRoleUser,
-			Content: fmt.Sprintf("根据此内容创建幻灯片（语言：中文）：\n\n%s", content),
+			Content: fmt.Sprintf("根据此内容创建幻灯片（语言：%s）：\n\n%s", language, content),
 		},
 	}
 
@@ -293,33 +541,246 @@ Example:
 		Messages:    messages,
 		Temperature: 0.7,
 	}
+	if p.caps.JSONMode {
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
 
-	resp, err := p.client.CreateChatCompletion(ctx, req)
+	reply, previewed, err := p.completeSlides(ctx, req)
 	if err != nil {
 		return nil, err
 	}
 
-	jsonContent := resp.Choices[0].Message.Content
+	slides, err := parseSlides(reply)
+	if err != nil && len(slides) >= minSlides {
+		// Enough valid slides survived, skip the broken ones
+		p.warn(fmt.Sprintf("⚠️ 幻灯片输出部分无效: %v，保留 %d 张有效幻灯片", err, len(slides)))
+	}
+	// Feed the error back to the model until enough slides are valid
+	repairs := jsonRepairs(p.config.MaxRepairs)
+	for attempt := 1; err != nil && len(slides) < minSlides && attempt <= repairs; attempt++ {
+		p.warn(fmt.Sprintf("⚠️ 幻灯片输出无效: %v，正在请求修正 (%d/%d)", err, attempt, repairs))
+
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: reply,
+		}, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: fmt.Sprintf("你的输出无效: %v。请修正并仅输出符合要求的完整有效 JSON 数组，每张幻灯片都必须有非空的 \"title\"。", err),
+		})
+		resp, reqErr := p.client.CreateChatCompletion(ctx, req)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("no choices in response")
+		}
+		reply = resp.Choices[0].Message.Content
+		// Keep the partial slides if the correction is no better
+		var repaired []Slide
+		repaired, err = parseSlides(reply)
+		if len(repaired) >= len(slides) {
+			slides = repaired
+		}
+	}
+	if len(slides) == 0 {
+		return nil, err
+	}
 
-	// Clean up markdown code blocks if present
-	if idx := strings.Index(jsonContent, "```json"); idx != -1 {
-		jsonContent = jsonContent[idx+7:]
-	} else if idx := strings.Index(jsonContent, "```"); idx != -1 {
-		jsonContent = jsonContent[idx+3:]
+	if len(slides) < minSlides {
+		if p.verbose {
+			fmt.Printf("  ⚠️ 仅生成了 %d 张幻灯片，少于最少 %d 张\n", len(slides), minSlides)
+		}
+		if p.interactionHandler != nil {
+			p.interactionHandler.Log(fmt.Sprintf("⚠️ 仅生成了 %d 张幻灯片，少于最少 %d 张", len(slides), minSlides))
+		}
 	}
-	if idx := strings.LastIndex(jsonContent, "```"); idx != -1 {
-		jsonContent = jsonContent[:idx]
+	if len(slides) > maxSlides {
+		if p.verbose {
+			fmt.Printf("  ⚠️ 生成了 %d 张幻灯片，合并为 %d 张\n", len(slides), maxSlides)
+		}
+		if p.interactionHandler != nil {
+			p.interactionHandler.Log(fmt.Sprintf("⚠️ 生成了 %d 张幻灯片，合并为 %d 张", len(slides), maxSlides))
+		}
+		slides = fitSlides(slides, maxSlides)
 	}
-	jsonContent = strings.TrimSpace(jsonContent)
 
-	var slides []Slide
-	if err := json.Unmarshal([]byte(jsonContent), &slides); err != nil {
-		return nil, fmt.Errorf("解析幻灯片 JSON 失败: %w", err)
+	// Replace the streamed preview if the slides changed since
+	if p.config.PreviewSlides && !reflect.DeepEqual(slides, previewed) {
+		if sh, ok := p.interactionHandler.(SlideHandler); ok {
+			for i, slide := range slides {
+				sh.PreviewSlide(i+1, slide)
+			}
+		}
+	}
+
+	return slides, nil
+}
+
+// completeSlides sends req and returns the reply. If slides are previewed
+// and the model supports streaming, the reply is streamed and every valid
+// slide is sent to the SlideHandler as soon as it is complete; the slides
+// sent are returned too.
+func (p *PPTSubagent) completeSlides(ctx context.Context, req openai.ChatCompletionRequest) (string, []Slide, error) {
+	sh, ok := p.interactionHandler.(SlideHandler)
+	streamer, canStream := p.client.(ChatStreamer)
+	if !ok || !p.config.PreviewSlides || !p.caps.Streaming || !canStream {
+		resp, err := p.client.CreateChatCompletion(ctx, req)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(resp.Choices) == 0 {
+			return "", nil, fmt.Errorf("no choices in response")
+		}
+		return resp.Choices[0].Message.Content, nil, nil
+	}
+
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // for cost tracking
+	stream, err := streamer.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer stream.Close()
+
+	var sb strings.Builder
+	var previewed []Slide
+	parsed := 0 // objects of the reply looked at so far
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), previewed, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(resp.Choices) == 0 || resp.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := resp.Choices[0].Delta.Content
+		sb.WriteString(delta)
+		if !strings.Contains(delta, "}") {
+			continue
+		}
+
+		objects := jsonObjects(sb.String())
+		for ; parsed < len(objects); parsed++ {
+			var slide Slide
+			if json.Unmarshal([]byte(objects[parsed]), &slide) != nil || strings.TrimSpace(slide.Title) == "" {
+				continue
+			}
+			previewed = append(previewed, slide)
+			sh.PreviewSlide(len(previewed), slide)
+		}
+	}
+}
+
+// parseSlides parses and validates the slides JSON returned by the LLM,
+// either an array or an object with the array under "slides". If
+// the array is malformed or truncated, or some slides are invalid, it
+// returns the valid slides together with an error describing the problems.
+func parseSlides(content string) ([]Slide, error) {
+	content = unwrapJSONArray(content, "slides")
+	var all []Slide
+	var errs []string
+	if err := json.Unmarshal([]byte(content), &all); err != nil {
+		errs = append(errs, fmt.Sprintf("解析幻灯片 JSON 失败: %v", err))
+		all = nil
+		for i, obj := range jsonObjects(content) {
+			var slide Slide
+			if err := json.Unmarshal([]byte(obj), &slide); err != nil {
+				errs = append(errs, fmt.Sprintf("第 %d 张幻灯片无法解析", i+1))
+				continue
+			}
+			all = append(all, slide)
+		}
 	}
 
+	var slides []Slide
+	for i, slide := range all {
+		if strings.TrimSpace(slide.Title) == "" {
+			errs = append(errs, fmt.Sprintf("第 %d 张幻灯片缺少标题", i+1))
+			continue
+		}
+		slides = append(slides, slide)
+	}
+	if len(slides) == 0 && len(errs) == 0 {
+		errs = append(errs, "没有生成任何幻灯片")
+	}
+	if len(errs) > 0 {
+		return slides, errors.New(strings.Join(errs, "; "))
+	}
 	return slides, nil
 }
 
+// jsonObjects returns the complete top-level objects of the JSON array in
+// content, even if the array is truncated or some objects are malformed. An
+// object whose braces are never closed is dropped.
+func jsonObjects(content string) []string {
+	start := strings.Index(content, "[")
+	if start == -1 {
+		return nil
+	}
+
+	var objects []string
+	depth, objStart := 0, 0
+	inString, escaped := false, false
+	for i := start + 1; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{':
+			if depth == 0 {
+				objStart = i
+			}
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+			if depth == 0 {
+				objects = append(objects, content[objStart:i+1])
+			}
+		}
+	}
+	return objects
+}
+
+// fitSlides reduces slides to at most maxSlides. The title and closing slides
+// are kept; the adjacent pair of middle slides with the least content is
+// merged repeatedly, and slides are dropped only when no middle pair is left.
+func fitSlides(slides []Slide, maxSlides int) []Slide {
+	slides = append([]Slide(nil), slides...)
+	for len(slides) > maxSlides {
+		// Middle slides are slides[1 : len-1]
+		best := -1
+		for i := 1; i+1 < len(slides)-1; i++ {
+			if best == -1 || len(slides[i].Content)+len(slides[i+1].Content) < len(slides[best].Content)+len(slides[best+1].Content) {
+				best = i
+			}
+		}
+		if best == -1 {
+			// Too few slides to merge, keep the first ones
+			return slides[:maxSlides]
+		}
+
+		merged := slides[best]
+		merged.Content = append(append([]string(nil), merged.Content...), slides[best+1].Content...)
+		if merged.Image == "" {
+			merged.Image = slides[best+1].Image
+		}
+		slides[best] = merged
+		slides = append(slides[:best+1], slides[best+2:]...)
+	}
+	return slides
+}
+
 func (p *PPTSubagent) generateSlidevMarkdown(slides []Slide) string {
 	var sb strings.Builder
 
@@ -344,7 +805,7 @@ func (p *PPTSubagent) generateSlidevMarkdown(slides []Slide) string {
 		if s0.Layout == "split-image-right" {
 			sb.WriteString("layout: image-right\n")
 			img := s0.Image
-			if img == "" || !strings.HasPrefix(img, "http") || strings.Contains(img, "source.unsplash.com") {
+			if !isUsableImage(img) {
 				img = "https://picsum.photos/800/600?random=0"
 			}
 			sb.WriteString(fmt.Sprintf("image: %s\n", img))
@@ -373,7 +834,7 @@ func (p *PPTSubagent) generateSlidevMarkdown(slides []Slide) string {
 			if slide.Layout == "split-image-right" {
 				sb.WriteString("layout: image-right\n")
 				img := slide.Image
-				if img == "" || !strings.HasPrefix(img, "http") || strings.Contains(img, "source.unsplash.com") {
+				if !isUsableImage(img) {
 					img = fmt.Sprintf("https://picsum.photos/800/600?random=%d", i)
 				}
 				sb.WriteString(fmt.Sprintf("image: %s\n", img))
@@ -436,6 +897,73 @@ func (p *PPTSubagent) generateSlidevMarkdown(slides []Slide) string {
 	return sb.String()
 }
 
+// isUsableImage reports whether img is a real image URL rather than a description.
+func isUsableImage(img string) bool {
+	if strings.HasPrefix(img, "/generated/") {
+		return true
+	}
+	return strings.HasPrefix(img, "http") && !strings.Contains(img, "source.unsplash.com")
+}
+
+// generateImages replaces slide image descriptions with generated images saved
+// under the output directory. Slides whose generation fails keep their
+// description, so the placeholder fallback applies.
+func (p *PPTSubagent) generateImages(ctx context.Context, slides []Slide) {
+	creator, ok := p.client.(ImageCreator)
+	if !ok {
+		p.warn("⚠️ 模型客户端不支持生成图片，使用占位图片")
+		return
+	}
+	model := p.config.ImageModel
+	if model == "" {
+		model = openai.CreateImageModelDallE3
+	}
+
+	imagesDir := filepath.Join(p.outputDir, "images")
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		p.warn(fmt.Sprintf("⚠️ 无法创建图片目录，使用占位图片: %v", err))
+		return
+	}
+
+	for i := range slides {
+		if slides[i].Layout != "split-image-right" {
+			continue // Only image layouts display the image
+		}
+		if slides[i].Image == "" || isUsableImage(slides[i].Image) {
+			continue
+		}
+
+		if p.interactionHandler != nil {
+			p.interactionHandler.Log(fmt.Sprintf("正在为幻灯片 %d 生成图片...", i+1))
+		}
+
+		resp, err := creator.CreateImage(ctx, openai.ImageRequest{
+			Prompt:         slides[i].Image,
+			Model:          model,
+			N:              1,
+			Size:           openai.CreateImageSize1024x1024,
+			ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+		})
+		if err == nil && len(resp.Data) == 0 {
+			err = fmt.Errorf("未返回图片")
+		}
+		var data []byte
+		if err == nil {
+			data, err = base64.StdEncoding.DecodeString(resp.Data[0].B64JSON)
+		}
+		fileName := fmt.Sprintf("slide_%d_%d.png", time.Now().UnixNano(), i)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(imagesDir, fileName), data, 0644)
+		}
+		if err != nil {
+			p.warn(fmt.Sprintf("⚠️ 幻灯片 %d 图片生成失败，使用占位图: %v", i+1, err))
+			continue
+		}
+
+		slides[i].Image = "/generated/images/" + fileName
+	}
+}
+
 // Unused but kept for interface compatibility if needed
 func (p *PPTSubagent) generateHTML(slides []Slide, filepath string) error {
 	return nil
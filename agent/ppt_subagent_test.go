@@ -1,11 +1,21 @@
 package agent
 
 import (
+	"archive/zip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
 )
 
 func TestGenerateAndBuild(t *testing.T) {
@@ -17,7 +27,7 @@ func TestGenerateAndBuild(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Initialize PPTSubagent with the temp directory
-	agent := NewPPTSubagent(nil, "gpt-4o", true, nil, tempDir)
+	agent := NewPPTSubagent(nil, "gpt-4o", true, nil, tempDir, PPTConfig{}, "", Capabilities{})
 
 	// Create sample slides
 	slides := []Slide{
@@ -78,3 +88,396 @@ func TestGenerateAndBuild(t *testing.T) {
 		fmt.Printf("Found index.html at %s\n", indexPath)
 	}
 }
+
+func TestFitSlides(t *testing.T) {
+	slides := []Slide{
+		{Title: "Title"},
+		{Title: "A", Content: []string{"a1", "a2", "a3"}},
+		{Title: "B", Content: []string{"b1"}},
+		{Title: "C", Content: []string{"c1"}},
+		{Title: "D", Content: []string{"d1", "d2", "d3"}},
+		{Title: "Thanks"},
+	}
+
+	got := fitSlides(slides, 5)
+	if len(got) != 5 {
+		t.Fatalf("expected 5 slides, got %d", len(got))
+	}
+	if got[0].Title != "Title" || got[4].Title != "Thanks" {
+		t.Errorf("title and closing slides must be kept: %+v", got)
+	}
+	if got[2].Title != "B" || len(got[2].Content) != 2 {
+		t.Errorf("expected B and C to be merged, got %+v", got[2])
+	}
+	if len(slides) != 6 {
+		t.Errorf("input slice was modified")
+	}
+
+	if got := fitSlides(slides, 2); len(got) != 2 || got[0].Title != "Title" {
+		t.Errorf("unexpected result for max 2: %+v", got)
+	}
+}
+
+func TestSlideBounds(t *testing.T) {
+	if lo, hi := (PPTConfig{}).slideBounds(); lo != 5 || hi != 20 {
+		t.Errorf("expected default bounds 5-20, got %d-%d", lo, hi)
+	}
+	if lo, hi := (PPTConfig{MaxSlides: 3}).slideBounds(); lo != 3 || hi != 3 {
+		t.Errorf("expected min clamped to max, got %d-%d", lo, hi)
+	}
+}
+
+func TestGenerateSlidesRepair(t *testing.T) {
+	tests := []struct {
+		name       string
+		replies    []string
+		maxRepairs int
+		calls      int
+		wantErr    bool
+	}{
+		{
+			name:    "valid",
+			replies: []string{`[{"title": "Intro", "content": ["a"]}]`},
+			calls:   1,
+		},
+		{
+			name:    "malformed json repaired",
+			replies: []string{`[{"title": "Intro", "content": [}`, "```json\n[{\"title\": \"Intro\"}]\n```"},
+			calls:   2,
+		},
+		{
+			name:    "missing title skipped",
+			replies: []string{`[{"title": "Intro"}, {"content": ["no title"]}]`},
+			calls:   1,
+		},
+		{
+			name:    "missing title repaired",
+			replies: []string{`[{"content": ["no title"]}]`, `[{"title": "Intro"}, {"title": "Body"}]`},
+			calls:   2,
+		},
+		{
+			name:    "truncated array recovered",
+			replies: []string{`[{"title": "Intro", "content": ["a {b}"]}, {"title": "Body", "content": ["c`},
+			calls:   1,
+		},
+		{
+			name:    "repaired on the second correction",
+			replies: []string{`not json`, `[{"title": ""}]`, `[{"title": "Intro"}]`},
+			calls:   3,
+		},
+		{
+			name:    "still invalid",
+			replies: []string{`not json`, `[{"title": ""}]`},
+			calls:   3,
+			wantErr: true,
+		},
+		{
+			name:       "corrections disabled",
+			replies:    []string{`not json`, `[{"title": "Intro"}]`},
+			maxRepairs: -1,
+			calls:      1,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, calls := sequentialReplies(tt.replies...)
+			srv := newFakeLLM(t, reply)
+			p := NewPPTSubagent(newFakeClient(srv), "gpt-4o", false, nil, t.TempDir(), PPTConfig{MinSlides: 1, MaxRepairs: tt.maxRepairs}, "", Capabilities{})
+
+			slides, err := p.generateSlides(context.Background(), "content", nil, "中文")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *calls != tt.calls {
+				t.Errorf("expected %d LLM calls, got %d", tt.calls, *calls)
+			}
+			for _, slide := range slides {
+				if slide.Title == "" {
+					t.Errorf("slide without title: %+v", slides)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSlidesNoChoices(t *testing.T) {
+	// The first reply and its correction
+	for replies := 0; replies < 2; replies++ {
+		m := filteredClient{&MockClient{Replies: []string{"not json"}}, replies}
+		p := NewPPTSubagent(m, "gpt-4o", false, nil, t.TempDir(), PPTConfig{MinSlides: 1}, "", Capabilities{})
+		if _, err := p.generateSlides(context.Background(), "content", nil, "中文"); err == nil || !strings.Contains(err.Error(), "no choices") {
+			t.Errorf("after %d replies: expected an error, got %v", replies, err)
+		}
+	}
+}
+
+func TestParseSlidesPartial(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		titles  []string
+	}{
+		{"truncated", `[{"title": "A"}, {"title": "B", "content": ["x", "y"]}, {"title": "C", "con`, []string{"A", "B"}},
+		{"invalid slide", "```json\n[{\"title\": \"A\"}, {\"title\": \"B\" \"content\": []}, {\"title\": \"C \\\"}\\\"\"}]\n```", []string{"A", `C "}"`}},
+		{"wrong type", `[{"title": "A", "content": "not a list"}, {"title": "B"},]`, []string{"B"}},
+		{"not json", `no slides here`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slides, err := parseSlides(tt.content)
+			if err == nil {
+				t.Error("expected an error describing the skipped slides")
+			}
+			var titles []string
+			for _, slide := range slides {
+				titles = append(titles, slide.Title)
+			}
+			if !reflect.DeepEqual(titles, tt.titles) {
+				t.Errorf("got slides %q, want %q", titles, tt.titles)
+			}
+		})
+	}
+}
+
+func TestGenerateSlidesKeepsPartial(t *testing.T) {
+	// Too few slides survive, and the corrections are worse than the original
+	reply, calls := sequentialReplies(`[{"title": "Intro"}, {"title": "Body"}, {"title": "Thanks", "con`, `not json`)
+	srv := newFakeLLM(t, reply)
+	p := NewPPTSubagent(newFakeClient(srv), "gpt-4o", false, nil, t.TempDir(), PPTConfig{MinSlides: 3}, "", Capabilities{})
+
+	slides, err := p.generateSlides(context.Background(), "content", nil, "中文")
+	if err != nil {
+		t.Fatalf("generateSlides failed: %v", err)
+	}
+	if *calls != 3 || len(slides) != 2 {
+		t.Errorf("expected 2 repair requests and the 2 partial slides, got %d calls and %+v", *calls, slides)
+	}
+}
+
+func TestPPTProjectSource(t *testing.T) {
+	dir := t.TempDir()
+	p := NewPPTSubagent(nil, "gpt-4o", false, nil, dir, PPTConfig{SourceZip: true, KeepProjects: 2}, "", Capabilities{})
+
+	dirName, err := p.generateProject(context.Background(), []Slide{{Title: "Test", Content: []string{"point"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := p.zipProject(dirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/generated/" + dirName + "/source.zip"; url != want {
+		t.Errorf("got URL %q, want %q", url, want)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(dir, dirName, "source.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{dirName + "/slides.md", dirName + "/package.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("zip contains %v, want %v", names, want)
+	}
+
+	// Only the current project and the newest other one are kept
+	for _, name := range []string{"ppt_100", "ppt_200", "ppt_300", "images"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.cleanupProjects("ppt_100")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if want := []string{"images", "ppt_100", dirName}; !reflect.DeepEqual(left, want) {
+		t.Errorf("after cleanup %v, want %v", left, want)
+	}
+}
+
+// declineHandler declines every action.
+type declineHandler struct {
+	checkpointHandler
+}
+
+func (declineHandler) ConfirmAction(string, map[string]interface{}) (bool, error) {
+	return false, nil
+}
+
+func TestPPTSourceZipAttachment(t *testing.T) {
+	dir := t.TempDir()
+	m := &MockClient{Replies: []string{`[{"title": "Go", "content": ["simple"]}]`}}
+	// The declined build falls back to the project sources without npm
+	p := NewPPTSubagent(m, "gpt-4o", false, &declineHandler{}, dir, PPTConfig{MinSlides: 1, SourceZip: true, ConfirmBuild: true}, "", Capabilities{})
+	task := Task{Type: TaskTypePPT, Description: "slides", Parameters: map[string]interface{}{"content": "# Go"}}
+	result, err := p.Execute(context.Background(), task)
+	if err != nil || !result.Success || result.ErrorKind != ErrBuild {
+		t.Fatalf("expected the unbuilt sources, got %+v, %v", result, err)
+	}
+	zipPath, _ := result.Metadata["path"].(string)
+	if rel, _ := filepath.Rel(dir, zipPath); filepath.Base(zipPath) != "source.zip" || strings.HasPrefix(rel, "..") {
+		t.Fatalf("expected the source zip in the output directory, got %q", zipPath)
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The zip reaches the files a later EMAIL task attaches
+	var state runState
+	state.add(task, result)
+	if !reflect.DeepEqual(state.files, []string{zipPath}) {
+		t.Errorf("expected the zip to be attached, got %v", state.files)
+	}
+
+	// Without SourceZip there is nothing to attach
+	p = NewPPTSubagent(m, "gpt-4o", false, &declineHandler{}, dir, PPTConfig{MinSlides: 1, ConfirmBuild: true}, "", Capabilities{})
+	if result, _ := p.Execute(context.Background(), task); result.Metadata["path"] != nil {
+		t.Errorf("expected no file without SourceZip, got %v", result.Metadata)
+	}
+}
+
+func TestGenerateSlidesJSONMode(t *testing.T) {
+	var format interface{}
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		format = req["response_format"]
+		return `{"slides": [{"title": "Intro"}, {"title": "Thanks"}]}`
+	})
+	p := NewPPTSubagent(newFakeClient(srv), "gpt-4o", false, nil, t.TempDir(), PPTConfig{MinSlides: 2}, "", Capabilities{JSONMode: true})
+
+	slides, err := p.generateSlides(context.Background(), "content", nil, "中文")
+	if err != nil {
+		t.Fatalf("generateSlides failed: %v", err)
+	}
+	if len(slides) != 2 || format == nil {
+		t.Errorf("expected 2 slides with response_format set, got %+v and %v", slides, format)
+	}
+
+	// A truncated object still yields the complete slides
+	slides, _ = parseSlides(`{"slides": [{"title": "A"}, {"title": "B"}, {"title": "C", "con`)
+	if len(slides) != 2 {
+		t.Errorf("expected 2 slides from the truncated object, got %+v", slides)
+	}
+}
+
+// slideHandler records previewed slides.
+type slideHandler struct {
+	checkpointHandler
+	numbers []int
+	titles  []string
+}
+
+func (h *slideHandler) PreviewSlide(number int, slide Slide) {
+	h.numbers = append(h.numbers, number)
+	h.titles = append(h.titles, slide.Title)
+}
+
+func TestGenerateSlidesPreview(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		deltas := []string{`[{"title": "Intro"}, {"ti`, `tle": ""}, {"title": "Body", "content": ["a"]}`, `, {"title": "Thanks"}]`}
+		for _, delta := range deltas {
+			data, _ := json.Marshal(map[string]interface{}{
+				"object":  "chat.completion.chunk",
+				"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{"content": delta}}},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	// The untitled slide is skipped while streaming
+	h := &slideHandler{}
+	p := NewPPTSubagent(newFakeClient(srv), "gpt-4o", false, h, t.TempDir(), PPTConfig{MinSlides: 1, PreviewSlides: true}, "", Capabilities{Streaming: true})
+	slides, err := p.generateSlides(context.Background(), "content", nil, "中文")
+	if err != nil || len(slides) != 3 {
+		t.Fatalf("generateSlides failed: %+v, %v", slides, err)
+	}
+	if !reflect.DeepEqual(h.numbers, []int{1, 2, 3}) || !reflect.DeepEqual(h.titles, []string{"Intro", "Body", "Thanks"}) {
+		t.Errorf("unexpected previews %v %q", h.numbers, h.titles)
+	}
+
+	// Slides merged after streaming are previewed again
+	h = &slideHandler{}
+	p = NewPPTSubagent(newFakeClient(srv), "gpt-4o", false, h, t.TempDir(), PPTConfig{MinSlides: 1, MaxSlides: 2, PreviewSlides: true}, "", Capabilities{Streaming: true})
+	if _, err := p.generateSlides(context.Background(), "content", nil, "中文"); err != nil {
+		t.Fatalf("generateSlides failed: %v", err)
+	}
+	if !reflect.DeepEqual(h.numbers, []int{1, 2, 3, 1, 2}) {
+		t.Errorf("expected the merged slides to replace the preview, got %v %q", h.numbers, h.titles)
+	}
+}
+
+// imageMockClient is a MockClient that also creates images, failing for
+// prompts containing "fail".
+type imageMockClient struct {
+	*MockClient
+}
+
+func (imageMockClient) CreateImage(ctx context.Context, req openai.ImageRequest) (openai.ImageResponse, error) {
+	if strings.Contains(req.Prompt, "fail") {
+		return openai.ImageResponse{}, errors.New("content policy violation")
+	}
+	return openai.ImageResponse{Data: []openai.ImageResponseDataInner{{B64JSON: base64.StdEncoding.EncodeToString([]byte("png"))}}}, nil
+}
+
+// logHandler records logged messages.
+type logHandler struct {
+	checkpointHandler
+	logs []string
+}
+
+func (h *logHandler) Log(message string) { h.logs = append(h.logs, message) }
+
+func TestGenerateImages(t *testing.T) {
+	h := &logHandler{}
+	dir := t.TempDir()
+	p := NewPPTSubagent(imageMockClient{&MockClient{}}, "gpt-4o", false, h, dir, PPTConfig{}, "", Capabilities{})
+	slides := []Slide{
+		{Title: "Cover", Layout: "cover", Image: "a sunrise"},
+		{Title: "Growth", Layout: "split-image-right", Image: "a rising chart"},
+		{Title: "Risks", Layout: "split-image-right", Image: "please fail"},
+	}
+	p.generateImages(context.Background(), slides)
+
+	if slides[0].Image != "a sunrise" {
+		t.Errorf("expected no image for a layout that does not show it, got %q", slides[0].Image)
+	}
+	if !strings.HasPrefix(slides[1].Image, "/generated/images/") {
+		t.Errorf("expected a generated image, got %q", slides[1].Image)
+	} else if _, err := os.Stat(filepath.Join(dir, "images", filepath.Base(slides[1].Image))); err != nil {
+		t.Errorf("generated image not saved: %v", err)
+	}
+	if slides[2].Image != "please fail" {
+		t.Errorf("expected the failed slide to keep its description, got %q", slides[2].Image)
+	}
+
+	// The failure reaches the user without verbose output
+	var failures []string
+	for _, log := range h.logs {
+		if strings.Contains(log, "图片生成失败") {
+			failures = append(failures, log)
+		}
+	}
+	if len(failures) != 1 || !strings.Contains(failures[0], "幻灯片 3") || !strings.Contains(failures[0], "content policy violation") {
+		t.Errorf("expected the failure of slide 3 to be logged, got %q", h.logs)
+	}
+
+	// A client that cannot create images is reported too
+	h = &logHandler{}
+	p = NewPPTSubagent(&MockClient{}, "gpt-4o", false, h, dir, PPTConfig{}, "", Capabilities{})
+	p.generateImages(context.Background(), slides)
+	if len(h.logs) != 1 || !strings.Contains(h.logs[0], "不支持生成图片") {
+		t.Errorf("expected a warning about the client, got %q", h.logs)
+	}
+}
@@ -0,0 +1,141 @@
+//go:build unix
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone reports whether pid has exited. Zombies count as gone since
+// they no longer run and only wait for their new parent to reap them.
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestGenerateAndBuildCancel(t *testing.T) {
+	binDir := t.TempDir()
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+
+	// A fake npm that spawns a long-running child, like node does, and waits
+	script := "#!/bin/sh\nsleep 60 &\necho $! > " + pidFile + "\nwait\n"
+	if err := os.WriteFile(filepath.Join(binDir, "npm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := NewPPTSubagent(nil, "gpt-4o", false, nil, t.TempDir(), PPTConfig{}, "", Capabilities{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.GenerateAndBuild(ctx, []Slide{{Title: "Test"}})
+		done <- err
+	}()
+
+	// Wait for the child to start, then stop the run
+	var pid int
+	deadline := time.Now().Add(10 * time.Second)
+	for pid == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("fake npm did not start")
+		}
+		if data, err := os.ReadFile(pidFile); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected a cancellation error, got %v", err)
+		}
+	case <-time.After(commandWaitDelay + 5*time.Second):
+		t.Fatal("GenerateAndBuild did not return after cancellation")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for !processGone(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child process %d outlived the cancelled build", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGenerateAndBuildConcurrent(t *testing.T) {
+	binDir := t.TempDir()
+	lockDir := filepath.Join(t.TempDir(), "npm.lock")
+
+	// A fake npm whose install fails if another install is running and whose
+	// build publishes the slides as the deck
+	script := `#!/bin/sh
+case "$1" in
+install)
+	mkdir ` + lockDir + ` || { echo "concurrent npm install" >&2; exit 1; }
+	sleep 0.2
+	rmdir ` + lockDir + `
+	;;
+run)
+	mkdir -p dist && cp slides.md dist/index.html
+	;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(binDir, "npm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	outputDir := t.TempDir()
+	titles := []string{"First Deck", "Second Deck"}
+	urls := make([]string, len(titles))
+	errs := make([]error, len(titles))
+	var wg sync.WaitGroup
+	for i, title := range titles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := NewPPTSubagent(nil, "gpt-4o", false, nil, outputDir, PPTConfig{}, "", Capabilities{})
+			urls[i], errs[i] = p.GenerateAndBuild(context.Background(), []Slide{{Title: title}})
+		}()
+	}
+	wg.Wait()
+
+	for i, title := range titles {
+		if errs[i] != nil {
+			t.Fatalf("GenerateAndBuild %d failed: %v", i, errs[i])
+		}
+		path := filepath.Join(outputDir, strings.TrimPrefix(urls[i], "/generated/"))
+		deck, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("deck %d not built: %v", i, err)
+		}
+		if !strings.Contains(string(deck), title) || strings.Contains(string(deck), titles[1-i]) {
+			t.Errorf("deck %d does not hold its own slides: %q", i, deck)
+		}
+	}
+	if urls[0] == urls[1] {
+		t.Errorf("both builds wrote to %s", urls[0])
+	}
+}
@@ -0,0 +1,269 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/smallnest/aiagents/tool"
+)
+
+// minRelevantResults is the number of relevant results below which a
+// search is retried once with a refocused query, and a warning is logged if
+// that does not help.
+const minRelevantResults = 2
+
+// relevanceSnippet is the number of runes of each result shown to the model
+// for scoring.
+const relevanceSnippet = 300
+
+// filterRelevance drops the results of text scored below
+// SearchConfig.MinRelevance for query. If fewer than minRelevantResults
+// pass, it searches once more with a refocused query. It returns the
+// filtered text, the number of dropped results and whether any result is
+// left. Paragraphs of text that are not results, such as image lists, are
+// kept.
+func (s *SearchSubagent) filterRelevance(ctx context.Context, query, text string, opts tool.SearchOptions) (string, int, bool) {
+	filtered, kept, dropped := s.dropIrrelevant(ctx, query, text)
+
+	if kept < minRelevantResults && !s.config.DisableRephrase {
+		if refocused := s.refocusQuery(ctx, query); refocused != "" {
+			if s.verbose {
+				fmt.Printf("  🎯 相关结果不足，重新搜索: %q\n", refocused)
+			}
+			if s.interactionHandler != nil {
+				s.interactionHandler.Log(fmt.Sprintf("🎯 相关结果不足，重新搜索: %s", refocused))
+			}
+			if more, err := s.webSearch(ctx, refocused, opts); err == nil && !tool.IsEmptyResult(more) {
+				more, moreKept, moreDropped := s.dropIrrelevant(ctx, query, more)
+				if moreKept > 0 {
+					filtered += "\n\n--- Additional Search Results ---\n" + more
+				}
+				kept += moreKept
+				dropped += moreDropped
+			}
+		}
+	}
+
+	if kept < minRelevantResults {
+		message := fmt.Sprintf("仅 %d 条搜索结果与 %q 相关 (相关度阈值 %.2f)，报告可能缺乏依据", kept, query, s.config.MinRelevance)
+		if s.verbose {
+			fmt.Printf("  ⚠️ %s\n", message)
+		}
+		if s.interactionHandler != nil {
+			s.interactionHandler.Log("⚠️ " + message)
+		}
+	}
+	return filtered, dropped, kept > 0
+}
+
+// dropIrrelevant scores the results of text and removes those below the
+// threshold. It returns the remaining text and the number of kept and
+// dropped results.
+func (s *SearchSubagent) dropIrrelevant(ctx context.Context, query, text string) (string, int, int) {
+	sources := parseSources(text)
+	if len(sources) == 0 {
+		return text, 0, 0
+	}
+	scores := s.scoreRelevance(ctx, query, sources)
+	relevant := make(map[string]bool, len(sources))
+	for i, source := range sources {
+		relevant[source.URL] = scores[i] >= s.config.MinRelevance
+	}
+
+	var kept []string
+	counted := make(map[string]bool)
+	dropped := 0
+	for _, entry := range strings.Split(text, "\n\n") {
+		source := parseSources(entry)
+		if len(source) == 0 {
+			kept = append(kept, entry)
+			continue
+		}
+		if !relevant[source[0].URL] {
+			dropped++
+			continue
+		}
+		// A URL repeated by a follow-up search is counted once
+		counted[source[0].URL] = true
+		kept = append(kept, entry)
+	}
+	keptResults := len(counted)
+
+	if dropped > 0 {
+		if s.verbose {
+			fmt.Printf("  🧹 已过滤 %d 条不相关的搜索结果\n", dropped)
+		}
+		if s.interactionHandler != nil {
+			s.interactionHandler.Log(fmt.Sprintf("🧹 已过滤 %d 条不相关的搜索结果", dropped))
+		}
+	}
+	return strings.Join(kept, "\n\n"), keptResults, dropped
+}
+
+// scoreRelevance returns the relevance of each source to query, from 0 to
+// 1. It asks the reflection model unless SearchConfig.HeuristicRelevance is
+// set, and falls back to heuristicRelevance if the model fails.
+func (s *SearchSubagent) scoreRelevance(ctx context.Context, query string, sources []tool.SearchResult) []float64 {
+	if !s.config.HeuristicRelevance {
+		scores, err := s.modelRelevance(ctx, query, sources)
+		if err == nil {
+			return scores
+		}
+		if s.interactionHandler != nil {
+			s.interactionHandler.Log(fmt.Sprintf("⚠️ 相关度评分失败: %v，改用关键词匹配", err))
+		}
+	}
+
+	scores := make([]float64, len(sources))
+	for i, source := range sources {
+		scores[i] = heuristicRelevance(query, source.Title+"\n"+source.Content)
+	}
+	return scores
+}
+
+// modelRelevance asks the reflection model to score the sources in one
+// request.
+func (s *SearchSubagent) modelRelevance(ctx context.Context, query string, sources []tool.SearchResult) ([]float64, error) {
+	var sb strings.Builder
+	for i, source := range sources {
+		content := []rune(source.Content)
+		if len(content) > relevanceSnippet {
+			content = append(content[:relevanceSnippet], []rune("...")...)
+		}
+		fmt.Fprintf(&sb, "[%d] %s\n%s\n\n", i+1, source.Title, string(content))
+	}
+
+	resp, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: s.reflectionModel(),
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "你是一个搜索结果评估助手。你评估每条搜索结果与用户查询的相关度。",
+			},
+			{
+				Role: openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf(`用户查询: %s
+
+搜索结果:
+%s
+为每条搜索结果给出 0 到 1 之间的相关度分数：1 表示直接回答查询，0 表示与查询无关。
+仅输出一个 JSON 对象，"scores" 数组按顺序包含 %d 个分数，例如 {"scores": [0.9, 0.2]}。`, query, sb.String(), len(sources)),
+			},
+		},
+		Temperature: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no response")
+	}
+
+	var reply struct {
+		Scores []float64 `json:"scores"`
+	}
+	if err := json.Unmarshal([]byte(stripCodeFence(resp.Choices[0].Message.Content)), &reply); err != nil {
+		return nil, fmt.Errorf("解析相关度 JSON 失败: %w", err)
+	}
+	if len(reply.Scores) != len(sources) {
+		return nil, fmt.Errorf("收到 %d 个分数，应为 %d 个", len(reply.Scores), len(sources))
+	}
+	return reply.Scores, nil
+}
+
+// refocusQuery asks the model for a more precise wording of a query whose
+// results were mostly off-topic. It returns "" if the model fails or
+// repeats the query.
+func (s *SearchSubagent) refocusQuery(ctx context.Context, query string) string {
+	resp, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: s.reflectionModel(),
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "你是一个搜索优化助手。你改写返回了不相关结果的搜索查询。",
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf("搜索查询 %q 的结果大多与查询无关。请改写该查询，使其更明确，例如加入关键的专有名词或限定词，避免歧义。仅回复新的查询，不要添加任何其他文本。", query),
+			},
+		},
+		Temperature: 0.3,
+	})
+	if err != nil || len(resp.Choices) == 0 {
+		return ""
+	}
+	refocused := strings.Trim(strings.TrimSpace(resp.Choices[0].Message.Content), "\"'")
+	if strings.EqualFold(refocused, query) {
+		return ""
+	}
+	return refocused
+}
+
+// heuristicRelevance returns the fraction of the terms of query that occur
+// in text, ignoring case. Terms are words, and character pairs of Chinese,
+// Japanese and Korean text, which has no spaces.
+func heuristicRelevance(query, text string) float64 {
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return 1
+	}
+	text = strings.ToLower(text)
+	found := 0
+	for _, term := range terms {
+		if strings.Contains(text, term) {
+			found++
+		}
+	}
+	return float64(found) / float64(len(terms))
+}
+
+// queryTerms splits query into lower case terms for heuristicRelevance,
+// without duplicates. Single letters are skipped.
+func queryTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	var word, wide []rune
+	flush := func() {
+		if len(word) > 1 && !seen[string(word)] {
+			seen[string(word)] = true
+			terms = append(terms, string(word))
+		}
+		pairs := []string{string(wide)}
+		if len(wide) > 1 {
+			pairs = pairs[:0]
+			for i := 0; i+1 < len(wide); i++ {
+				pairs = append(pairs, string(wide[i:i+2]))
+			}
+		}
+		for _, pair := range pairs {
+			if pair != "" && !seen[pair] {
+				seen[pair] = true
+				terms = append(terms, pair)
+			}
+		}
+		word, wide = word[:0], wide[:0]
+	}
+
+	for _, r := range strings.ToLower(query) {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			if len(word) > 0 {
+				flush()
+			}
+			wide = append(wide, r)
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			if len(wide) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
@@ -0,0 +1,385 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/smallnest/aiagents/tool"
+)
+
+// KnowledgeConfig configures the knowledge base searched by RETRIEVE tasks.
+type KnowledgeConfig struct {
+	// Paths are the files and directories indexed into the knowledge base.
+	// Directories are walked for knowledgeExtensions files. Empty disables
+	// RETRIEVE tasks.
+	Paths []string
+	// EmbeddingModel is the model of the embeddings endpoint. Empty uses
+	// text-embedding-3-small.
+	EmbeddingModel string
+	// ChunkSize is the approximate size in bytes of the indexed chunks.
+	// Zero uses 1000.
+	ChunkSize int
+	// TopK is the number of chunks returned by default. Zero uses 4.
+	TopK int
+	// Store holds the indexed chunks. Nil uses a MemoryVectorStore shared
+	// by every agent in the process configured with the same paths, e.g.
+	// all web sessions, so the files are indexed once.
+	Store VectorStore
+}
+
+// knowledgeExtensions are the file types indexed from directories.
+var knowledgeExtensions = map[string]bool{".md": true, ".markdown": true, ".txt": true}
+
+// embeddingBatchSize is the number of chunks embedded per request.
+const embeddingBatchSize = 64
+
+// Chunk is a piece of an indexed document.
+type Chunk struct {
+	Source string    `json:"source"` // file path
+	Text   string    `json:"text"`
+	Vector []float32 `json:"-"`
+}
+
+// ScoredChunk is a chunk found by a VectorStore with its similarity score.
+type ScoredChunk struct {
+	Chunk
+	Score float64 `json:"score"`
+}
+
+// VectorStore stores embedded chunks and finds the ones nearest to a query.
+type VectorStore interface {
+	Add(chunks ...Chunk) error
+	Search(vector []float32, k int) ([]ScoredChunk, error)
+}
+
+// MemoryVectorStore is an in-memory VectorStore ranking chunks by cosine
+// similarity.
+type MemoryVectorStore struct {
+	mu     sync.RWMutex
+	chunks []Chunk
+}
+
+// Add stores chunks.
+func (s *MemoryVectorStore) Add(chunks ...Chunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chunks = append(s.chunks, chunks...)
+	return nil
+}
+
+// Search returns the k chunks most similar to vector, best first.
+func (s *MemoryVectorStore) Search(vector []float32, k int) ([]ScoredChunk, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scored := make([]ScoredChunk, 0, len(s.chunks))
+	for _, chunk := range s.chunks {
+		scored = append(scored, ScoredChunk{Chunk: chunk, Score: cosineSimilarity(vector, chunk.Vector)})
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+	if len(scored) > k {
+		scored = scored[:k]
+	}
+	return scored, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, or 0 if
+// their lengths differ or either is zero.
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// knowledgeIndex is a vector store and whether the knowledge base files
+// have been added to it.
+type knowledgeIndex struct {
+	mu      sync.Mutex
+	indexed bool
+	store   VectorStore
+}
+
+var (
+	knowledgeIndexesMu sync.Mutex
+	// knowledgeIndexes holds the in-memory indexes shared by the agents
+	// configured with the same knowledge base.
+	knowledgeIndexes = make(map[string]*knowledgeIndex)
+)
+
+// sharedKnowledgeIndex returns the process-wide in-memory index for config.
+func sharedKnowledgeIndex(config KnowledgeConfig) *knowledgeIndex {
+	key := fmt.Sprintf("%q %s %d", config.Paths, config.EmbeddingModel, config.ChunkSize)
+	knowledgeIndexesMu.Lock()
+	defer knowledgeIndexesMu.Unlock()
+	index, ok := knowledgeIndexes[key]
+	if !ok {
+		index = &knowledgeIndex{store: &MemoryVectorStore{}}
+		knowledgeIndexes[key] = index
+	}
+	return index
+}
+
+// RetrieveSubagent searches the knowledge base for the chunks relevant to a
+// query. The documents are indexed on the first RETRIEVE task.
+type RetrieveSubagent struct {
+	client             Embedder
+	verbose            bool
+	interactionHandler InteractionHandler
+	config             KnowledgeConfig
+	index              *knowledgeIndex
+}
+
+// NewRetrieveSubagent creates a new RetrieveSubagent.
+func NewRetrieveSubagent(client Embedder, verbose bool, interactionHandler InteractionHandler, config KnowledgeConfig) *RetrieveSubagent {
+	if config.EmbeddingModel == "" {
+		config.EmbeddingModel = string(openai.SmallEmbedding3)
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = 1000
+	}
+	if config.TopK == 0 {
+		config.TopK = 4
+	}
+	index := &knowledgeIndex{store: config.Store}
+	if config.Store == nil {
+		index = sharedKnowledgeIndex(config)
+	}
+	return &RetrieveSubagent{
+		client:             client,
+		verbose:            verbose,
+		interactionHandler: interactionHandler,
+		config:             config,
+		index:              index,
+	}
+}
+
+// Type returns the task type this subagent handles.
+func (r *RetrieveSubagent) Type() TaskType {
+	return TaskTypeRetrieve
+}
+
+// Validate checks that the knowledge base paths exist.
+func (r *RetrieveSubagent) Validate() error {
+	for _, path := range r.config.Paths {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("knowledge base path: %w", err)
+		}
+	}
+	return nil
+}
+
+// Execute returns the chunks most relevant to the "query" parameter, or the
+// task description. The optional "top_k" parameter sets how many.
+func (r *RetrieveSubagent) Execute(ctx context.Context, task Task) (Result, error) {
+	if r.verbose {
+		fmt.Println("📚 知识库检索 Subagent")
+	}
+	if r.interactionHandler != nil {
+		r.interactionHandler.Log(fmt.Sprintf("> 知识库检索 Subagent: %s", task.Description))
+	}
+
+	// Failures are not the end of the plan, which may still search the web
+	if err := r.ensureIndexed(ctx); err != nil {
+		return r.failed(fmt.Sprintf("索引知识库失败: %v", err), classifyError(err)), nil
+	}
+
+	query := task.StringParam("query")
+	if query == "" {
+		query = task.Description
+	}
+	k := task.IntParam("top_k")
+	if k <= 0 {
+		k = r.config.TopK
+	}
+
+	vectors, err := r.embed(ctx, []string{query})
+	if err != nil {
+		return r.failed(fmt.Sprintf("生成查询向量失败: %v", err), classifyError(err)), nil
+	}
+	hits, err := r.index.store.Search(vectors[0], k)
+	if err != nil {
+		return r.failed(fmt.Sprintf("检索知识库失败: %v", err), ErrTool), nil
+	}
+
+	var sb strings.Builder
+	var sources []tool.SearchResult
+	for _, hit := range hits {
+		sb.WriteString(fmt.Sprintf("Source: %s\nContent: %s\n\n", hit.Source, hit.Text))
+		sources = mergeSources(sources, []tool.SearchResult{{Title: filepath.Base(hit.Source), URL: hit.Source}})
+	}
+	output := sb.String()
+	if output == "" {
+		output = fmt.Sprintf("知识库中未找到与 %q 相关的内容。", query)
+	}
+	r.log(fmt.Sprintf("✓ 从知识库检索到 %d 个片段", len(hits)))
+
+	return Result{
+		TaskType: TaskTypeRetrieve,
+		Success:  true,
+		Output:   output,
+		Metadata: map[string]interface{}{
+			"query":   query,
+			"chunks":  hits,
+			"sources": sources,
+		},
+	}, nil
+}
+
+// ensureIndexed indexes the knowledge base unless that already succeeded.
+func (r *RetrieveSubagent) ensureIndexed(ctx context.Context) error {
+	r.index.mu.Lock()
+	defer r.index.mu.Unlock()
+	if r.index.indexed {
+		return nil
+	}
+	if err := r.indexFiles(ctx); err != nil {
+		return err
+	}
+	r.index.indexed = true
+	return nil
+}
+
+// indexFiles chunks and embeds the knowledge base files and adds them to
+// the store, all or nothing.
+func (r *RetrieveSubagent) indexFiles(ctx context.Context) error {
+	var files []string
+	for _, root := range r.config.Paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && (path == root || knowledgeExtensions[strings.ToLower(filepath.Ext(path))]) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var chunks []Chunk
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, text := range chunkText(string(data), r.config.ChunkSize) {
+			chunks = append(chunks, Chunk{Source: file, Text: text})
+		}
+	}
+
+	for start := 0; start < len(chunks); start += embeddingBatchSize {
+		batch := chunks[start:min(start+embeddingBatchSize, len(chunks))]
+		texts := make([]string, len(batch))
+		for i, chunk := range batch {
+			texts[i] = chunk.Text
+		}
+		vectors, err := r.embed(ctx, texts)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			batch[i].Vector = vectors[i]
+		}
+	}
+	if err := r.index.store.Add(chunks...); err != nil {
+		return err
+	}
+
+	r.log(fmt.Sprintf("📚 已索引 %d 个文件，共 %d 个片段", len(files), len(chunks)))
+	return nil
+}
+
+// embed returns the embeddings of texts, in order.
+func (r *RetrieveSubagent) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := r.client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: texts,
+		Model: openai.EmbeddingModel(r.config.EmbeddingModel),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(resp.Data))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, e := range resp.Data {
+		if e.Index < 0 || e.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", e.Index)
+		}
+		vectors[e.Index] = e.Embedding
+	}
+	return vectors, nil
+}
+
+// chunkText splits text into chunks of about size bytes at blank lines. A
+// paragraph longer than size is split at line breaks, or at size bytes.
+func chunkText(text string, size int) []string {
+	var chunks []string
+	var chunk strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(chunk.String()); s != "" {
+			chunks = append(chunks, s)
+		}
+		chunk.Reset()
+	}
+	for _, para := range strings.Split(text, "\n\n") {
+		if chunk.Len() > 0 && chunk.Len()+len(para) > size {
+			flush()
+		}
+		for len(para) > size {
+			cut := strings.LastIndex(para[:size], "\n")
+			if cut <= 0 {
+				cut = size
+				for cut > 0 && !utf8.RuneStart(para[cut]) {
+					cut--
+				}
+			}
+			chunk.WriteString(para[:cut])
+			flush()
+			para = para[cut:]
+		}
+		chunk.WriteString(para + "\n\n")
+	}
+	flush()
+	return chunks
+}
+
+func (r *RetrieveSubagent) failed(message string, kind ErrorKind) Result {
+	r.log("❌ " + message)
+	return Result{
+		TaskType:  TaskTypeRetrieve,
+		Success:   false,
+		Error:     message,
+		ErrorKind: kind,
+	}
+}
+
+// log reports a message to the terminal (in verbose mode) and the user interface.
+func (r *RetrieveSubagent) log(message string) {
+	if r.verbose {
+		fmt.Println("  " + message)
+	}
+	if r.interactionHandler != nil {
+		r.interactionHandler.Log(message)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/smallnest/aiagents/tool"
+)
+
+// newFakeEmbeddings starts a server answering embeddings requests with
+// vectors counting the words "go" and "rust", and counts the texts embedded.
+func newFakeEmbeddings(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var embedded atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		embedded.Add(int32(len(req.Input)))
+
+		data := make([]map[string]interface{}, len(req.Input))
+		for i, text := range req.Input {
+			text = strings.ToLower(text)
+			data[i] = map[string]interface{}{
+				"object":    "embedding",
+				"index":     i,
+				"embedding": []float32{float32(strings.Count(text, "go")), float32(strings.Count(text, "rust")), 0.1},
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "list", "data": data})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &embedded
+}
+
+func TestRetrieveSubagent(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "go.md"), []byte("# Go\n\nGo is a language from Google. Go has goroutines."), 0644)
+	os.WriteFile(filepath.Join(dir, "rust.txt"), []byte("Rust has ownership. Rust has no garbage collector."), 0644)
+	os.WriteFile(filepath.Join(dir, "image.png"), []byte("go go go"), 0644)
+
+	srv, embedded := newFakeEmbeddings(t)
+	config := KnowledgeConfig{Paths: []string{dir}, TopK: 1}
+	r := NewRetrieveSubagent(newFakeClient(srv), false, nil, config)
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	result, err := r.Execute(context.Background(), Task{Type: TaskTypeRetrieve, Parameters: map[string]interface{}{"query": "rust memory"}})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if !strings.Contains(result.Output, "Rust has ownership") || strings.Contains(result.Output, "Google") {
+		t.Errorf("expected the rust chunk only, got %q", result.Output)
+	}
+	sources, _ := result.Metadata["sources"].([]tool.SearchResult)
+	if len(sources) != 1 || sources[0].URL != filepath.Join(dir, "rust.txt") {
+		t.Errorf("unexpected sources %+v", sources)
+	}
+	// Two chunks and the query; the image is not indexed
+	if n := embedded.Load(); n != 3 {
+		t.Errorf("expected 3 embedded texts, got %d", n)
+	}
+
+	// Another agent with the same knowledge base reuses the index
+	r = NewRetrieveSubagent(newFakeClient(srv), false, nil, config)
+	result, err = r.Execute(context.Background(), Task{Type: TaskTypeRetrieve, Description: "go concurrency", Parameters: map[string]interface{}{"top_k": 2}})
+	if err != nil || !result.Success {
+		t.Fatalf("Execute failed: %+v, %v", result, err)
+	}
+	if !strings.HasPrefix(result.Output, "Source: "+filepath.Join(dir, "go.md")) || strings.Count(result.Output, "Source: ") != 2 {
+		t.Errorf("expected both chunks, go first, got %q", result.Output)
+	}
+	if n := embedded.Load(); n != 4 {
+		t.Errorf("expected only the query to be embedded, got %d texts in total", n)
+	}
+
+	if err := NewRetrieveSubagent(newFakeClient(srv), false, nil, KnowledgeConfig{Paths: []string{filepath.Join(dir, "missing")}}).Validate(); err == nil {
+		t.Error("expected an error for a missing path")
+	}
+}
+
+func TestRetrieveRegistration(t *testing.T) {
+	var prompt string
+	srv := newFakeLLM(t, func(req map[string]interface{}) string {
+		prompt = req["messages"].([]interface{})[0].(map[string]interface{})["content"].(string)
+		return `{"description": "plan", "tasks": [{"type": "RETRIEVE", "description": "r"}, {"type": "SEARCH", "description": "s"}]}`
+	})
+
+	for _, paths := range [][]string{nil, {t.TempDir()}} {
+		a, err := NewPlanningAgent(AgentConfig{APIKey: "test", APIBase: srv.URL, Knowledge: KnowledgeConfig{Paths: paths}}, nil)
+		if err != nil {
+			t.Fatalf("NewPlanningAgent failed: %v", err)
+		}
+		plan, err := a.Plan(context.Background(), "go")
+		if err != nil {
+			t.Fatalf("Plan failed: %v", err)
+		}
+		configured := len(paths) > 0
+		if strings.Contains(prompt, "- RETRIEVE:") != configured {
+			t.Errorf("knowledge base configured: %v, but RETRIEVE in prompt: %v", configured, !configured)
+		}
+		if want := map[bool]int{false: 1, true: 2}[configured]; len(plan.Tasks) != want {
+			t.Errorf("knowledge base configured: %v, expected %d tasks, got %+v", configured, want, plan.Tasks)
+		}
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	long := strings.Repeat("长", 50)
+	chunks := chunkText("para one\n\npara two\n\n"+long, 30)
+	if len(chunks) < 3 || chunks[0] != "para one\n\npara two" {
+		t.Fatalf("unexpected chunks %q", chunks)
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 30 || !utf8.ValidString(chunk) {
+			t.Errorf("bad chunk %q", chunk)
+		}
+	}
+	if strings.Join(chunks[1:], "") != long {
+		t.Errorf("long paragraph not split losslessly: %q", chunks[1:])
+	}
+}
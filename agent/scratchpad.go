@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// ScratchpadKey is the task parameter that holds the *Scratchpad shared by
+// the tasks of a plan run.
+const ScratchpadKey = "scratchpad"
+
+// ExtractedDataKey is the scratchpad key under which EXTRACT tasks store
+// the *ExtractedData of the run. CHART and REPORT tasks read the tables
+// from it instead of from the markdown output of EXTRACT.
+const ExtractedDataKey = "extracted_data"
+
+// Scratchpad is typed state shared by the tasks of a plan run, in addition
+// to the text outputs passed on by the context rules. A task stores a value
+// under a key and any later task reads it by key.
+//
+// A scratchpad is safe for concurrent use, e.g. by the goroutines of a
+// subagent or a caller inspecting a run. Values are shared, not copied:
+// writers store a new value instead of modifying the one stored, and
+// readers must not modify the values they get. Use Update to read and
+// write a key atomically, such as when appending to a stored value.
+//
+// The methods of a nil *Scratchpad are no-ops, so subagents executed
+// outside a plan run need no checks.
+type Scratchpad struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// NewScratchpad returns an empty scratchpad.
+func NewScratchpad() *Scratchpad {
+	return &Scratchpad{values: make(map[string]interface{})}
+}
+
+// Get returns the value stored under key.
+func (s *Scratchpad) Get(key string) (interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Set stores value under key, replacing any previous value.
+func (s *Scratchpad) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// Update stores the value returned by fn for the value stored under key,
+// which is nil if there is none. Other writers wait until fn returns.
+func (s *Scratchpad) Update(key string, fn func(old interface{}) interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = fn(s.values[key])
+}
+
+// Keys returns the keys of the stored values in sorted order.
+func (s *Scratchpad) Keys() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns a copy of the map of stored values. The values
+// themselves are shared.
+func (s *Scratchpad) Snapshot() map[string]interface{} {
+	snapshot := make(map[string]interface{})
+	if s == nil {
+		return snapshot
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, value := range s.values {
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+// MarshalJSON encodes the stored values as a JSON object.
+func (s *Scratchpad) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
+
+// taskScratchpad returns the scratchpad injected into task, or nil.
+func taskScratchpad(task Task) *Scratchpad {
+	scratchpad, _ := task.Parameters[ScratchpadKey].(*Scratchpad)
+	return scratchpad
+}
+
+// extractedData returns the tables stored by EXTRACT tasks in the
+// scratchpad of task, or nil if there are none.
+func extractedData(task Task) *ExtractedData {
+	data, _ := taskScratchpad(task).Get(ExtractedDataKey)
+	extracted, _ := data.(*ExtractedData)
+	if extracted == nil || len(extracted.Tables) == 0 {
+		return nil
+	}
+	return extracted
+}
@@ -0,0 +1,167 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/smallnest/aiagents/tool"
+)
+
+// searchProvider is a web search backend of the fallback chain.
+type searchProvider struct {
+	name    string // display name
+	search  func(query string, opts tool.SearchOptions) (string, error)
+	results func(query string, opts tool.SearchOptions) ([]tool.SearchResult, error)
+}
+
+// searchProviders are the providers accepted in SearchConfig.Providers.
+var searchProviders = map[string]searchProvider{
+	"tavily":     {"Tavily", tool.TavilySearchWithOptions, tool.TavilySearchResults},
+	"duckduckgo": {"DuckDuckGo", tool.DuckDuckGoSearchWithOptions, tool.DuckDuckGoSearchResults},
+}
+
+// defaultSearchProviders is the fallback chain used when
+// SearchConfig.Providers is empty.
+var defaultSearchProviders = []string{"tavily", "duckduckgo"}
+
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = time.Minute
+)
+
+// providers returns the fallback chain of c.
+func (c SearchConfig) providers() []string {
+	if len(c.Providers) == 0 {
+		return defaultSearchProviders
+	}
+	return c.Providers
+}
+
+// validate checks that every provider of the chain exists.
+func (c SearchConfig) validate() error {
+	for _, name := range c.Providers {
+		if _, ok := searchProviders[name]; !ok {
+			return fmt.Errorf("unknown search provider %q (want tavily or duckduckgo)", name)
+		}
+	}
+	return nil
+}
+
+// breaker returns the failure threshold and cooldown of the circuit
+// breakers, with a zero threshold if circuit breaking is disabled.
+func (c SearchConfig) breaker() (int, time.Duration) {
+	threshold, cooldown := c.BreakerThreshold, c.BreakerCooldown
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	} else if threshold < 0 {
+		threshold = 0
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return threshold, cooldown
+}
+
+// circuitBreaker tracks the consecutive failures of a search provider. It
+// opens after a threshold of failures, skipping the provider for a cooldown.
+// Once the cooldown ends the next call is a trial: a success closes the
+// breaker, a failure opens it again right away.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether the provider may be called.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// record counts the outcome of a call and reports whether it opened the
+// breaker.
+func (b *circuitBreaker) record(ok bool, threshold int, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+var (
+	searchBreakersMu sync.Mutex
+	// searchBreakers holds one circuit breaker per search provider, shared
+	// by every agent in the process since they share the outages too.
+	searchBreakers = make(map[string]*circuitBreaker)
+)
+
+// searchBreaker returns the process-wide circuit breaker of a provider.
+func searchBreaker(name string) *circuitBreaker {
+	searchBreakersMu.Lock()
+	defer searchBreakersMu.Unlock()
+	b, ok := searchBreakers[name]
+	if !ok {
+		b = &circuitBreaker{}
+		searchBreakers[name] = b
+	}
+	return b
+}
+
+// searchWithFallback calls each provider of the chain of s in turn until
+// one succeeds. Providers with an open circuit breaker are skipped, except
+// the last one, which is always tried.
+func searchWithFallback[T any](ctx context.Context, s *SearchSubagent, call func(searchProvider) (T, error)) (T, error) {
+	var zero T
+	var errs []error
+	threshold, cooldown := s.config.breaker()
+	names := s.config.providers()
+	for i, name := range names {
+		provider := searchProviders[name]
+		breaker := searchBreaker(name)
+		last := i == len(names)-1
+		if threshold > 0 && !last && !breaker.allow() {
+			s.log(fmt.Sprintf("  ⏭️ %s 近期连续失败，暂时跳过", provider.name))
+			continue
+		}
+
+		result, err := withHeartbeat(ctx, "search", func() (T, error) {
+			return call(provider)
+		})
+		if threshold > 0 && breaker.record(err == nil, threshold, cooldown) {
+			s.log(fmt.Sprintf("  🔌 %s 连续失败 %d 次，%s 内将跳过", provider.name, threshold, cooldown))
+		}
+		if err == nil {
+			return result, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", provider.name, err))
+		if !last {
+			next := searchProviders[names[i+1]].name
+			s.log(fmt.Sprintf("  ⚠️ %s 搜索失败: %v。回退到 %s。", provider.name, err, next))
+		}
+	}
+	if len(errs) == 1 {
+		return zero, errs[0]
+	}
+	return zero, errors.Join(errs...)
+}
+
+// log reports progress of the search.
+func (s *SearchSubagent) log(msg string) {
+	if s.verbose {
+		fmt.Println(msg)
+	}
+	if s.interactionHandler != nil {
+		s.interactionHandler.Log(msg)
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/smallnest/aiagents/tool"
+)
+
+// parseSources extracts the results from the text format returned by
+// tool.TavilySearch ("Title: ...\nURL: ...\nContent: ...", one entry per
+// paragraph), in order and without duplicate URLs.
+func parseSources(text string) []tool.SearchResult {
+	var sources []tool.SearchResult
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(text, "\n\n") {
+		var source tool.SearchResult
+		for _, line := range strings.Split(entry, "\n") {
+			if title, ok := strings.CutPrefix(line, "Title: "); ok {
+				source.Title = title
+			} else if url, ok := strings.CutPrefix(line, "URL: "); ok {
+				source.URL = url
+			} else if content, ok := strings.CutPrefix(line, "Content: "); ok {
+				source.Content = content
+			}
+		}
+		if source.Title != "" && source.URL != "" && !seen[source.URL] {
+			seen[source.URL] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// mergeSources appends the sources whose URLs are not yet in sources.
+func mergeSources(sources, add []tool.SearchResult) []tool.SearchResult {
+	seen := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		seen[source.URL] = true
+	}
+	for _, source := range add {
+		if source.URL != "" && !seen[source.URL] {
+			seen[source.URL] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// formatSources renders sources as a numbered list for citation.
+func formatSources(sources []tool.SearchResult) string {
+	var sb strings.Builder
+	for i, source := range sources {
+		title := source.Title
+		if title == "" {
+			title = source.URL
+		}
+		sb.WriteString(fmt.Sprintf("[%d] %s - %s\n", i+1, title, source.URL))
+	}
+	return sb.String()
+}
+
+// shingleSize is the length in runes of the shingles compared by novelty.
+const shingleSize = 8
+
+// shingles returns the set of overlapping rune sequences of text, lower
+// cased with runs of whitespace collapsed. Rune shingles need no word
+// segmentation, so they work for Chinese as well.
+func shingles(text string) map[string]bool {
+	runes := []rune(strings.ToLower(strings.Join(strings.Fields(text), " ")))
+	set := make(map[string]bool)
+	if len(runes) < shingleSize {
+		if len(runes) > 0 {
+			set[string(runes)] = true
+		}
+		return set
+	}
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		set[string(runes[i:i+shingleSize])] = true
+	}
+	return set
+}
+
+// novelty returns the fraction of the shingles in set that do not occur in
+// seen: 1 for entirely new content, 0 for content seen before or no content.
+func novelty(set, seen map[string]bool) float64 {
+	if len(set) == 0 {
+		return 0
+	}
+	novel := 0
+	for shingle := range set {
+		if !seen[shingle] {
+			novel++
+		}
+	}
+	return float64(novel) / float64(len(set))
+}
@@ -2,10 +2,16 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/smallnest/goskills/tool"
+	"github.com/smallnest/aiagents/tool"
 
 	markdown "github.com/MichaelMure/go-term-markdown"
 	gomarkdown "github.com/gomarkdown/markdown"
@@ -16,19 +22,116 @@ import (
 
 // SearchSubagent performs web searches.
 type SearchSubagent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	model              string
 	verbose            bool
 	interactionHandler InteractionHandler
+	systemPrompt       string
+	guidance           bool
+	config             SearchConfig
 }
 
-// NewSearchSubagent creates a new SearchSubagent.
-func NewSearchSubagent(client *openai.Client, model string, verbose bool, interactionHandler InteractionHandler) *SearchSubagent {
+// SearchConfig restricts the sources of web searches.
+type SearchConfig struct {
+	// IncludeDomains limits results to these domains and their subdomains,
+	// e.g. "wikipedia.org" or "*.gov". Empty allows all domains, and lets
+	// the "include_domains" task parameter choose them instead.
+	IncludeDomains []string
+	// ExcludeDomains drops results from these domains, in addition to
+	// those in the "exclude_domains" task parameter.
+	ExcludeDomains []string
+	// DisableWikipedia skips the Wikipedia lookup of searches unless a task
+	// sets the "wikipedia" parameter to true.
+	DisableWikipedia bool
+	// WikipediaLanguage is the Wikipedia edition searched, such as "zh".
+	// Empty picks the edition matching the language of the query.
+	WikipediaLanguage string
+	// DisableRephrase stops a search that found nothing from being retried
+	// once with a query rephrased by the model.
+	DisableRephrase bool
+	// Providers is the fallback chain of search providers, tried in order:
+	// "tavily" and "duckduckgo". Empty means tavily, then duckduckgo.
+	Providers []string
+	// BreakerThreshold is the number of consecutive failures after which a
+	// provider other than the last one is skipped for BreakerCooldown. Zero
+	// means 3, negative disables circuit breaking.
+	BreakerThreshold int
+	// BreakerCooldown is how long a failing provider is skipped. Zero means
+	// one minute.
+	BreakerCooldown time.Duration
+	// ReflectionModel decides whether the results suffice and rephrases
+	// queries that found nothing, simple steps a small fast model handles
+	// well. Empty means the main model.
+	ReflectionModel string
+	// MinNovelty ends the reflection loop early when a follow-up search
+	// adds less than this fraction of content not found before, as the
+	// topic is already covered. Zero means 0.2, negative disables it.
+	MinNovelty float64
+	// MinRelevance drops search results whose relevance to the query,
+	// scored from 0 to 1 by ReflectionModel, is below it, so REPORT is not
+	// fed off-topic pages. If fewer than two results pass, the search is
+	// retried once with a refocused query, then a warning is logged. Zero
+	// disables the scoring.
+	MinRelevance float64
+	// HeuristicRelevance scores relevance by the query terms found in each
+	// result instead of asking the model. The model is only asked for a
+	// refocused query.
+	HeuristicRelevance bool
+	// Disabled makes every search return no results without contacting
+	// any provider, see AgentConfig.DisableWebSearch.
+	Disabled bool
+}
+
+// wikipediaLanguages maps output language names to Wikipedia language codes.
+var wikipediaLanguages = map[string]string{
+	"中文":       "zh",
+	"chinese":  "zh",
+	"english":  "en",
+	"日本語":      "ja",
+	"japanese": "ja",
+	"korean":   "ko",
+	"french":   "fr",
+	"german":   "de",
+	"spanish":  "es",
+}
+
+// wikipediaOptions returns the Wikipedia edition and detail for a search
+// task, and whether to look up Wikipedia at all. The "wikipedia",
+// "wikipedia_language", "wikipedia_section" and "wikipedia_full" task
+// parameters override the configuration. Without a configured language the
+// edition follows the language of the query, then the task's output language.
+func (s *SearchSubagent) wikipediaOptions(task Task, query string) (tool.WikipediaOptions, bool) {
+	enabled := task.BoolParam("wikipedia", !s.config.DisableWikipedia)
+
+	var opts tool.WikipediaOptions
+	opts.Language = task.StringParam("wikipedia_language")
+	if opts.Language == "" {
+		opts.Language = s.config.WikipediaLanguage
+	}
+	if opts.Language == "" {
+		lang := detectLanguage(query)
+		if lang == "" {
+			lang = taskLanguage(task)
+		}
+		opts.Language = wikipediaLanguages[strings.ToLower(lang)]
+	}
+	opts.Section = task.StringParam("wikipedia_section")
+	opts.FullArticle = task.BoolParam("wikipedia_full", false)
+	return opts, enabled
+}
+
+// NewSearchSubagent creates a new SearchSubagent. If guidance is set and the
+// interaction handler implements GuidanceHandler, the user is asked for
+// guidance between reflection iterations.
+func NewSearchSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, systemPrompt string, guidance bool, config SearchConfig) *SearchSubagent {
 	return &SearchSubagent{
 		client:             client,
 		model:              model,
 		verbose:            verbose,
 		interactionHandler: interactionHandler,
+		systemPrompt:       systemPrompt,
+		guidance:           guidance,
+		config:             config,
 	}
 }
 
@@ -47,8 +150,8 @@ func (s *SearchSubagent) Execute(ctx context.Context, task Task) (Result, error)
 	}
 
 	// Extract query from parameters
-	query, ok := task.Parameters["query"].(string)
-	if !ok {
+	query := task.StringParam("query")
+	if query == "" {
 		query = task.Description
 	}
 
@@ -59,29 +162,80 @@ func (s *SearchSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		s.interactionHandler.Log(fmt.Sprintf("  查询: %q", query))
 	}
 
-	// Perform Tavily search
-	searchResult, err := tool.TavilySearch(query)
-	if err != nil {
-		// Fallback to DuckDuckGo if Tavily fails (e.g. missing key)
+	if s.config.Disabled {
+		message := fmt.Sprintf("网络搜索已禁用，未搜索 %q。", query)
 		if s.verbose {
-			fmt.Printf("  ⚠️ Tavily 搜索失败: %v。回退到 DuckDuckGo。\n", err)
+			fmt.Printf("  🔌 %s\n", message)
 		}
 		if s.interactionHandler != nil {
-			s.interactionHandler.Log(fmt.Sprintf("  ⚠️ Tavily 搜索失败: %v。回退到 DuckDuckGo。", err))
+			s.interactionHandler.Log("🔌 " + message)
 		}
-		searchResult, err = tool.DuckDuckGoSearch(query)
-		if err != nil {
-			return Result{
-				TaskType: TaskTypeSearch,
-				Success:  false,
-				Error:    err.Error(),
-			}, err
+		return Result{
+			TaskType: TaskTypeSearch,
+			Success:  true,
+			Output:   message,
+			Metadata: map[string]interface{}{
+				"query":    query,
+				"empty":    true,
+				"disabled": true,
+			},
+		}, nil
+	}
+
+	var opts tool.SearchOptions
+	opts.MaxResults = task.IntParam("max_results")
+	opts.Region = task.StringParam("region")
+	opts.IncludeDomains = s.config.IncludeDomains
+	if len(opts.IncludeDomains) == 0 {
+		opts.IncludeDomains = task.StringSliceParam("include_domains")
+	}
+	opts.ExcludeDomains = append(append([]string(nil), s.config.ExcludeDomains...), task.StringSliceParam("exclude_domains")...)
+
+	if task.StringParam("mode") == "links" {
+		return s.searchLinks(ctx, query, opts)
+	}
+
+	searchResult, err := s.webSearch(ctx, query, opts)
+	if err != nil {
+		return Result{
+			TaskType:  TaskTypeSearch,
+			Success:   false,
+			Error:     err.Error(),
+			ErrorKind: ErrTool,
+		}, err
+	}
+
+	// Retry a search that found nothing once with different wording
+	if tool.IsEmptyResult(searchResult) && !s.config.DisableRephrase {
+		if rephrased := s.rephraseQuery(ctx, query); rephrased != "" {
+			if s.interactionHandler != nil {
+				s.interactionHandler.Log(fmt.Sprintf("🔄 未找到结果，改写查询: %s", rephrased))
+			}
+			if s.verbose {
+				fmt.Printf("  🔄 未找到结果，改写查询: %q\n", rephrased)
+			}
+			if result, err := s.webSearch(ctx, rephrased, opts); err == nil {
+				searchResult = result
+			}
 		}
 	}
+	found := !tool.IsEmptyResult(searchResult)
+
+	reflectionSystemPrompt := "你是一个搜索优化助手。你评估搜索结果并决定是否需要更多信息。"
+	if s.systemPrompt != "" {
+		reflectionSystemPrompt = s.systemPrompt
+	}
+	reflectionSystemPrompt = withLanguage(reflectionSystemPrompt, task)
 
 	// Reflection Loop
 	maxIterations := 3
 	accumulatedResults := searchResult
+	seen := shingles(searchResult)
+	minNovelty := s.config.MinNovelty
+	if minNovelty == 0 {
+		minNovelty = 0.2
+	}
+	var userGuidance []string
 
 	for i := 0; i < maxIterations; i++ {
 		// Prepare prompt for reflection
@@ -92,18 +246,21 @@ func (s *SearchSubagent) Execute(ctx context.Context, task Task) (Result, error)
 信息是否足以回答用户的查询？
 如果是，请仅回复 "SUFFICIENT"。
 如果否，请回复一个新的、更精细的搜索查询以查找缺失的信息。不要添加任何其他文本。`, query, accumulatedResults)
+		if len(userGuidance) > 0 {
+			reflectionPrompt += "\n\n用户的搜索指导 (生成新查询时必须遵循):\n- " + strings.Join(userGuidance, "\n- ")
+		}
 
 		// Truncate if too long to avoid context limit issues
 		if len(reflectionPrompt) > 80000 {
-			reflectionPrompt = reflectionPrompt[:80000] + "\n...(truncated)"
+			reflectionPrompt = strings.ToValidUTF8(reflectionPrompt[:80000], "") + "\n...(truncated)"
 		}
 
 		resp, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-			Model: s.model,
+			Model: s.reflectionModel(),
 			Messages: []openai.ChatCompletionMessage{
 				{
 					Role:    openai.ChatMessageRoleSystem,
-					Content: "你是一个搜索优化助手。你评估搜索结果并决定是否需要更多信息。",
+					Content: reflectionSystemPrompt,
 				},
 				{
 					Role:    openai.ChatMessageRoleUser,
@@ -152,46 +309,86 @@ func (s *SearchSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		}
 
 		// Execute new search
-		newResults, err := tool.TavilySearch(newQuery)
-		if err != nil {
-			// Try DDG fallback
-			newResults, err = tool.DuckDuckGoSearch(newQuery)
-		}
+		newResults, err := s.webSearch(ctx, newQuery, opts)
 
 		if err == nil {
 			accumulatedResults += "\n\n--- Additional Search Results ---\n" + newResults
+			found = found || !tool.IsEmptyResult(newResults)
+		}
+
+		// Stop once follow-up searches only repeat what was found
+		if minNovelty > 0 && i < maxIterations-1 {
+			fresh := 0.0
+			if err == nil && !tool.IsEmptyResult(newResults) {
+				set := shingles(newResults)
+				fresh = novelty(set, seen)
+				for shingle := range set {
+					seen[shingle] = true
+				}
+			}
+			if fresh < minNovelty {
+				if s.verbose {
+					fmt.Printf("  ✓ 补充搜索的新内容仅占 %.0f%%，停止反思。\n", fresh*100)
+				}
+				if s.interactionHandler != nil {
+					s.interactionHandler.Log(fmt.Sprintf("  ✓ 补充搜索的新内容仅占 %.0f%%，停止反思。", fresh*100))
+				}
+				break
+			}
 		}
-	}
 
-	// Also try Wikipedia if results are sparse (optional, keeping existing logic)
-	wikiResult, wikiErr := tool.WikipediaSearch(query)
-	if wikiErr == nil && wikiResult != "" {
-		accumulatedResults = fmt.Sprintf("网络搜索结果:\n%s\n\n维基百科结果:\n%s", accumulatedResults, wikiResult)
+		// Let the user steer the next iteration
+		if i < maxIterations-1 {
+			if text, ok := s.requestGuidance(query, newQuery, i+1); ok {
+				userGuidance = append(userGuidance, text)
+			}
+		}
 	}
 
-	// Parse and log simplified results
-	var resultLog strings.Builder
-	resultLog.WriteString("已检索信息:\n")
+	// Keep off-topic results out of the context of later tasks
+	dropped := 0
+	if s.config.MinRelevance > 0 && found {
+		accumulatedResults, dropped, found = s.filterRelevance(ctx, query, accumulatedResults, opts)
+	}
 
-	// Simple parsing of the text format returned by TavilySearch
-	// Format: Title: ...\nURL: ...\nContent: ...\n\n
-	entries := strings.Split(accumulatedResults, "\n\n")
-	for _, entry := range entries {
-		if strings.TrimSpace(entry) == "" {
-			continue
+	// Also try Wikipedia in the edition matching the request
+	if wikiOpts, ok := s.wikipediaOptions(task, query); ok && opts.Allows(wikiOpts.BaseURL()) {
+		wikiResult, wikiErr := withHeartbeat(ctx, "search", func() (string, error) {
+			return tool.WikipediaSearchWithOptions(query, wikiOpts)
+		})
+		if wikiErr == nil && wikiResult != "" {
+			accumulatedResults = fmt.Sprintf("网络搜索结果:\n%s\n\n维基百科结果:\n%s", accumulatedResults, wikiResult)
+			found = true
 		}
-		lines := strings.Split(entry, "\n")
-		var title, url string
-		for _, line := range lines {
-			if strings.HasPrefix(line, "Title: ") {
-				title = strings.TrimPrefix(line, "Title: ")
-			} else if strings.HasPrefix(line, "URL: ") {
-				url = strings.TrimPrefix(line, "URL: ")
-			}
+	}
+
+	// Nothing found: report it instead of passing on the placeholder texts,
+	// so later tasks do not write about sources that do not exist
+	if !found {
+		message := fmt.Sprintf("未找到与 %q 相关的搜索结果。", query)
+		if s.verbose {
+			fmt.Printf("  ⚠️ %s\n", message)
 		}
-		if title != "" && url != "" {
-			resultLog.WriteString(fmt.Sprintf("- [%s](%s)\n", title, url))
+		if s.interactionHandler != nil {
+			s.interactionHandler.Log("⚠️ " + message)
 		}
+		return Result{
+			TaskType: TaskTypeSearch,
+			Success:  true,
+			Output:   message,
+			Metadata: map[string]interface{}{
+				"query": query,
+				"empty": true,
+			},
+		}, nil
+	}
+
+	// Parse and log simplified results
+	sources := parseSources(accumulatedResults)
+	var resultLog strings.Builder
+	resultLog.WriteString("已检索信息:\n")
+	for _, source := range sources {
+		resultLog.WriteString(fmt.Sprintf("- [%s](%s)\n", source.Title, source.URL))
 	}
 
 	logContent := resultLog.String()
@@ -211,26 +408,180 @@ func (s *SearchSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		Success:  true,
 		Output:   accumulatedResults,
 		Metadata: map[string]interface{}{
-			"query": query,
+			"query":    query,
+			"sources":  sources,
+			"filtered": dropped,
+		},
+	}, nil
+}
+
+// webSearch searches with the provider chain of the configuration, by
+// default Tavily falling back to DuckDuckGo if Tavily fails (e.g. missing
+// key).
+func (s *SearchSubagent) webSearch(ctx context.Context, query string, opts tool.SearchOptions) (string, error) {
+	result, err := searchWithFallback(ctx, s, func(p searchProvider) (string, error) {
+		return p.search(query, opts)
+	})
+	// Keep page bytes that are not valid UTF-8 out of the prompts
+	return tool.SanitizeText(result), err
+}
+
+// reflectionModel returns the model of the reflection and rephrasing steps.
+func (s *SearchSubagent) reflectionModel() string {
+	if s.config.ReflectionModel != "" {
+		return s.config.ReflectionModel
+	}
+	return s.model
+}
+
+// rephraseQuery asks the model for a different wording of a query that
+// found nothing. It returns "" if the model fails or repeats the query.
+func (s *SearchSubagent) rephraseQuery(ctx context.Context, query string) string {
+	resp, err := s.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: s.reflectionModel(),
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: "你是一个搜索优化助手。你改写没有返回结果的搜索查询。",
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf("搜索查询 %q 没有返回任何结果。请改写该查询，例如使用更通用的词语、同义词或去掉过于具体的限定。仅回复新的查询，不要添加任何其他文本。", query),
+			},
+		},
+		Temperature: 0.3,
+	})
+	if err != nil || len(resp.Choices) == 0 {
+		return ""
+	}
+	rephrased := strings.Trim(strings.TrimSpace(resp.Choices[0].Message.Content), "\"'")
+	if strings.EqualFold(rephrased, query) {
+		return ""
+	}
+	return rephrased
+}
+
+// defaultLinkResults is the number of links returned in links mode when
+// max_results is not set.
+const defaultLinkResults = 8
+
+// searchLinks returns a markdown list of result titles and URLs, skipping the
+// reflection loop and Wikipedia lookup. The structured results are returned
+// in the "links" metadata.
+func (s *SearchSubagent) searchLinks(ctx context.Context, query string, opts tool.SearchOptions) (Result, error) {
+	if opts.MaxResults == 0 {
+		opts.MaxResults = defaultLinkResults
+	}
+
+	links, err := searchWithFallback(ctx, s, func(p searchProvider) ([]tool.SearchResult, error) {
+		return p.results(query, opts)
+	})
+	if err != nil {
+		return Result{
+			TaskType:  TaskTypeSearch,
+			Success:   false,
+			Error:     err.Error(),
+			ErrorKind: ErrTool,
+		}, err
+	}
+
+	var sb strings.Builder
+	for _, link := range links {
+		title := link.Title
+		if title == "" {
+			title = link.URL
+		}
+		sb.WriteString(fmt.Sprintf("- [%s](%s)\n", title, link.URL))
+	}
+	output := sb.String()
+	if output == "" {
+		output = fmt.Sprintf("未找到与 %q 相关的链接。", query)
+	}
+
+	if s.verbose {
+		fmt.Printf("  ✓ 找到 %d 个链接\n", len(links))
+	}
+	if s.interactionHandler != nil {
+		s.interactionHandler.Log(fmt.Sprintf("✓ 找到 %d 个链接", len(links)))
+	}
+
+	return Result{
+		TaskType: TaskTypeSearch,
+		Success:  true,
+		Output:   output,
+		Metadata: map[string]interface{}{
+			"query":   query,
+			"mode":    "links",
+			"links":   links,
+			"sources": links,
 		},
 	}, nil
 }
 
+// analyzeAttemptsKey is the task parameter counting MISSING_INFO re-queues.
+const analyzeAttemptsKey = "_analyze_attempts"
+
+// compareExpandedKey marks a compare analysis whose per-entity searches were queued.
+const compareExpandedKey = "_compare_expanded"
+
+// requestGuidance asks the user for guidance after a reflection iteration,
+// if enabled and supported by the interaction handler.
+func (s *SearchSubagent) requestGuidance(query, lastQuery string, iteration int) (string, bool) {
+	gh, ok := s.interactionHandler.(GuidanceHandler)
+	if !s.guidance || !ok {
+		return "", false
+	}
+
+	text, ok := gh.RequestGuidance(fmt.Sprintf("搜索 %q 已完成第 %d 轮补充搜索 (最近查询: %q)。可以输入指导以调整后续搜索方向。", query, iteration, lastQuery))
+	text = strings.TrimSpace(text)
+	if !ok || text == "" {
+		return "", false
+	}
+
+	if s.verbose {
+		fmt.Printf("  🧭 用户指导: %s\n", text)
+	}
+	s.interactionHandler.Log(fmt.Sprintf("🧭 用户指导: %s", text))
+	return text, true
+}
+
 // AnalysisSubagent analyzes and synthesizes information.
 type AnalysisSubagent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	model              string
 	verbose            bool
 	interactionHandler InteractionHandler
+	systemPrompt       string
+	maxAttempts        int
+	vision             bool
+	ensemble           EnsembleConfig
 }
 
-// NewAnalysisSubagent creates a new AnalysisSubagent.
-func NewAnalysisSubagent(client *openai.Client, model string, verbose bool, interactionHandler InteractionHandler) *AnalysisSubagent {
+// NewAnalysisSubagent creates a new AnalysisSubagent. maxAttempts limits how
+// many times an analysis may re-queue itself to request more information.
+// With vision the images in the "images" parameter are sent to the model;
+// otherwise the analysis is text-only. ensemble configures the analyses run
+// on several models.
+func NewAnalysisSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, systemPrompt string, maxAttempts int, vision bool, ensemble EnsembleConfig) *AnalysisSubagent {
 	return &AnalysisSubagent{
 		client:             client,
 		model:              model,
 		verbose:            verbose,
 		interactionHandler: interactionHandler,
+		systemPrompt:       systemPrompt,
+		maxAttempts:        maxAttempts,
+		vision:             vision,
+		ensemble:           ensemble,
+	}
+}
+
+// warn reports a problem that does not stop the analysis.
+func (a *AnalysisSubagent) warn(msg string) {
+	if a.verbose {
+		fmt.Println("  " + msg)
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(msg)
 	}
 }
 
@@ -249,56 +600,174 @@ func (a *AnalysisSubagent) Execute(ctx context.Context, task Task) (Result, erro
 	}
 
 	// Get context from parameters if available
-	contextData, hasContext := task.Parameters["context"].([]string)
+	contextData := contextText(task)
 
 	var prompt string
-	if hasContext && len(contextData) > 0 {
-		prompt = fmt.Sprintf("分析以下信息并 %s:\n\n%s", task.Description, strings.Join(contextData, "\n\n"))
+	if contextData != "" {
+		prompt = fmt.Sprintf("分析以下信息并 %s:\n\n%s", task.Description, contextData)
 	} else {
 		prompt = task.Description
 	}
 
+	// In compare mode, first fan out one search per entity and run again afterwards
+	compare := task.StringParam("mode") == "compare"
+	entities := task.StringSliceParam("entities")
+	if compare && len(entities) > 1 {
+		if !task.BoolParam(compareExpandedKey, false) {
+			if a.verbose {
+				fmt.Printf("  🔀 对比模式: 分别搜索 %d 个对象\n", len(entities))
+			}
+			if a.interactionHandler != nil {
+				a.interactionHandler.Log(fmt.Sprintf("🔀 对比模式: 分别搜索 %d 个对象", len(entities)))
+			}
+
+			var newTasks []Task
+			for _, entity := range entities {
+				newTasks = append(newTasks, Task{
+					Type:        TaskTypeSearch,
+					Description: entity,
+					Parameters: map[string]interface{}{
+						"query": entity,
+					},
+				})
+			}
+			retry := requeuedTask(task)
+			retry.Parameters[compareExpandedKey] = true
+			newTasks = append(newTasks, retry)
+
+			return Result{
+				TaskType: TaskTypeAnalyze,
+				Success:  true,
+				Output:   fmt.Sprintf("正在分别搜索对比对象: %s", strings.Join(entities, ", ")),
+				NewTasks: newTasks,
+			}, nil
+		}
+	}
+
+	// Number of times this analysis has already been re-queued for more information
+	attempts := task.IntParam(analyzeAttemptsKey)
+	canRequestInfo := attempts < a.maxAttempts
+
 	// Check for global context
-	globalContext, _ := task.Parameters["global_context"].(string)
-	systemPrompt := "你是一个分析助手，负责综合和分析信息。请提供清晰、结构化的分析。\n" +
-		"如果提供的信息不足以完成分析，你可以请求更多信息。\n" +
-		"如果需要更多信息，请仅回复 'MISSING_INFO: <具体的搜索查询>'。\n" +
-		"例如: 'MISSING_INFO: 2024年Q3特斯拉财报数据'"
+	globalContext := task.StringParam("global_context")
+	systemPrompt := "你是一个分析助手，负责综合和分析信息。请提供清晰、结构化的分析。"
+	if canRequestInfo {
+		systemPrompt += "\n如果提供的信息不足以完成分析，你可以请求更多信息。\n" +
+			"如果需要更多信息，请仅回复 'MISSING_INFO: <具体的搜索查询>'。\n" +
+			"例如: 'MISSING_INFO: 2024年Q3特斯拉财报数据'"
+	}
+	if a.systemPrompt != "" {
+		systemPrompt = a.systemPrompt
+	}
+	if compare {
+		systemPrompt += "\n\n这是一个对比分析。请先确定关键的对比维度，然后输出一个 Markdown 对比表格（每行一个维度，每列一个对比对象），最后总结主要的异同点和结论。"
+		if len(entities) > 0 {
+			systemPrompt += "\n对比对象: " + strings.Join(entities, ", ")
+		}
+	}
+	if !canRequestInfo {
+		systemPrompt += "\n\n已达到补充搜索上限。请基于已有信息完成分析，不要再回复 MISSING_INFO；如有信息不足之处，请在分析中注明。"
+	}
 
+	systemPrompt = withLanguage(systemPrompt, task)
 	if globalContext != "" {
 		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContext
 	}
 
+	// Attached images go to vision models; other models get the references
+	images := task.StringSliceParam("images")
+	userMessage := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt}
+	withImages := false
+	if len(images) > 0 && !a.vision {
+		a.warn("⚠️ 模型不支持图像输入，仅基于文本分析")
+	} else if len(images) > 0 {
+		userMessage, withImages = imageMessage(prompt, images, a.warn)
+	}
+	if len(images) > 0 && !withImages {
+		userMessage = openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt + textOnlyImages(images)}
+	}
+
 	messages := []openai.ChatCompletionMessage{
 		{
 			Role:    openai.ChatMessageRoleSystem,
 			Content: systemPrompt,
 		},
-		{
-			Role:    openai.ChatMessageRoleUser,
-			Content: prompt,
-		},
+		userMessage,
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model:       a.model,
-		Messages:    messages,
-		Temperature: 0.3,
+	analyze := func(ctx context.Context, model string) (string, error) {
+		req := openai.ChatCompletionRequest{
+			Model:       model,
+			Messages:    append([]openai.ChatCompletionMessage(nil), messages...),
+			Temperature: 0.3,
+		}
+		resp, err := a.client.CreateChatCompletion(ctx, req)
+		var apiErr *openai.APIError
+		if withImages && errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusBadRequest {
+			// The endpoint rejected the images after all
+			a.warn("⚠️ 模型拒绝了图像输入，改为仅基于文本分析")
+			req.Messages[1] = openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: prompt + textOnlyImages(images)}
+			resp, err = a.client.CreateChatCompletion(ctx, req)
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Choices) == 0 {
+			return "", fmt.Errorf("empty response from %s", model)
+		}
+		return resp.Choices[0].Message.Content, nil
 	}
 
-	resp, err := a.client.CreateChatCompletion(ctx, req)
+	var analysis string
+	var analyses []ModelAnalysis
+	var err error
+	if models := a.ensembleModels(task); len(models) > 1 {
+		analysis, analyses, err = a.runEnsemble(ctx, task, prompt, models, analyze)
+	} else {
+		analysis, err = analyze(ctx, a.model)
+	}
 	if err != nil {
 		return Result{
-			TaskType: TaskTypeAnalyze,
-			Success:  false,
-			Error:    err.Error(),
+			TaskType:  TaskTypeAnalyze,
+			Success:   false,
+			Error:     err.Error(),
+			ErrorKind: classifyError(err),
 		}, err
 	}
 
-	analysis := resp.Choices[0].Message.Content
-
 	// Check for MISSING_INFO signal
-	if strings.HasPrefix(strings.TrimSpace(analysis), "MISSING_INFO:") {
+	if strings.HasPrefix(strings.TrimSpace(analysis), "MISSING_INFO:") && !canRequestInfo {
+		if a.verbose {
+			fmt.Printf("  ⚠️ 已达到补充搜索上限 (%d 次)，基于现有信息继续\n", a.maxAttempts)
+		}
+		if a.interactionHandler != nil {
+			a.interactionHandler.Log(fmt.Sprintf("⚠️ 已达到补充搜索上限 (%d 次)，基于现有信息继续", a.maxAttempts))
+		}
+
+		// Ask once more, answering the request instead of passing it on
+		// as the analysis
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: analysis},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "无法再进行补充搜索。请基于已有信息直接完成分析，不要回复 MISSING_INFO；如有信息不足之处，请在分析中注明。"},
+		)
+		if analysis, err = analyze(ctx, a.model); err != nil {
+			return Result{
+				TaskType:  TaskTypeAnalyze,
+				Success:   false,
+				Error:     err.Error(),
+				ErrorKind: classifyError(err),
+			}, err
+		}
+		if strings.HasPrefix(strings.TrimSpace(analysis), "MISSING_INFO:") {
+			err := fmt.Errorf("analysis still requests more information after %d searches: %s", a.maxAttempts, strings.TrimSpace(analysis))
+			return Result{
+				TaskType:  TaskTypeAnalyze,
+				Success:   false,
+				Error:     err.Error(),
+				ErrorKind: ErrParse,
+			}, err
+		}
+	} else if strings.HasPrefix(strings.TrimSpace(analysis), "MISSING_INFO:") {
 		newQuery := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(analysis), "MISSING_INFO:"))
 
 		if a.verbose {
@@ -308,6 +777,10 @@ func (a *AnalysisSubagent) Execute(ctx context.Context, task Task) (Result, erro
 			a.interactionHandler.Log(fmt.Sprintf("🔄 分析发现信息缺失，请求新搜索: %q", newQuery))
 		}
 
+		// Re-queue the current analysis task to run after the search
+		retry := requeuedTask(task)
+		retry.Parameters[analyzeAttemptsKey] = attempts + 1
+
 		// Create new tasks
 		newTasks := []Task{
 			{
@@ -317,8 +790,7 @@ func (a *AnalysisSubagent) Execute(ctx context.Context, task Task) (Result, erro
 					"query": newQuery,
 				},
 			},
-			// Re-queue the current analysis task to run after the search
-			task,
+			retry,
 		}
 
 		return Result{
@@ -336,28 +808,82 @@ func (a *AnalysisSubagent) Execute(ctx context.Context, task Task) (Result, erro
 		a.interactionHandler.Log(fmt.Sprintf("✓ 信息这已足够，分析完成 (%d 字节)", len(analysis)))
 	}
 
-	return Result{
+	result := Result{
 		TaskType: TaskTypeAnalyze,
 		Success:  true,
 		Output:   analysis,
-	}, nil
+	}
+	if analyses != nil {
+		result.Metadata = map[string]interface{}{"analyses": analyses}
+	}
+	return result, nil
+}
+
+// requeuedTask returns a copy of task to be inserted again via NewTasks.
+// Injected context is dropped since Execute adds it again.
+func requeuedTask(task Task) Task {
+	retry := task
+	retry.Parameters = make(map[string]interface{}, len(task.Parameters))
+	for k, v := range task.Parameters {
+		if k != OutputsKey && k != FilesKey && k != ScratchpadKey && k != "global_context" && k != "sources" {
+			retry.Parameters[k] = v
+		}
+	}
+	return retry
+}
+
+// Report styles accepted in the "style" parameter of REPORT tasks. An unset
+// or unknown style produces the default comprehensive report.
+const (
+	ReportStyleBrief     = "brief"     // a one or two sentence summary
+	ReportStyleExecutive = "executive" // a short summary with key findings and recommendations
+	ReportStyleDeep      = "deep"      // an in-depth multi-section report
+	ReportStyleBullet    = "bullet"    // a bullet list of key points
+)
+
+// reportStyleInstructions are appended to the report system prompt per style.
+var reportStyleInstructions = map[string]string{
+	ReportStyleBrief:     "输出风格: 简要。只用一到两句话总结核心结论，不要使用标题、列表或多个段落。",
+	ReportStyleExecutive: "输出风格: 执行摘要。先给出一段简短的概述，然后列出 3-5 条关键发现和可行建议，总篇幅控制在 300 字以内。",
+	ReportStyleDeep:      "输出风格: 深度报告。撰写包含背景、详细分析、数据与证据、风险和结论等多个章节的深入报告，尽可能全面。",
+	ReportStyleBullet:    "输出风格: 要点列表。只输出一个简洁的要点列表，每条一句话，不要写段落。",
 }
 
 // ReportSubagent generates formatted reports.
 type ReportSubagent struct {
-	client             *openai.Client
+	client             ChatCompleter
 	model              string
 	verbose            bool
 	interactionHandler InteractionHandler
+	systemPrompt       string
+	maxContinuations   int
+	streaming          bool
+	maxContextBytes    int
 }
 
-// NewReportSubagent creates a new ReportSubagent.
-func NewReportSubagent(client *openai.Client, model string, verbose bool, interactionHandler InteractionHandler) *ReportSubagent {
+// noSourcesInstruction keeps a report from inventing facts when every search
+// of the plan came back empty.
+const noSourcesInstruction = "注意：本次搜索没有找到任何资料。请在报告开头明确说明未找到可靠来源，仅给出谨慎的概述，不要编造事实、数据、引用或参考文献。"
+
+// reportContinuePrompt asks the model to continue a report that was cut off
+// at the output token limit.
+const reportContinuePrompt = "报告在上一条回复中因长度限制被截断。请从中断处继续输出剩余内容，不要重复已输出的内容，也不要添加任何说明。"
+
+// NewReportSubagent creates a new ReportSubagent. maxContinuations limits how
+// many times a report cut off at the output token limit is continued. If
+// streaming is set and the interaction handler implements StreamHandler, the
+// report is streamed to it. A context larger than maxContextBytes is
+// summarized chunk by chunk first; zero or less never summarizes.
+func NewReportSubagent(client ChatCompleter, model string, verbose bool, interactionHandler InteractionHandler, systemPrompt string, maxContinuations int, streaming bool, maxContextBytes int) *ReportSubagent {
 	return &ReportSubagent{
 		client:             client,
 		model:              model,
 		verbose:            verbose,
 		interactionHandler: interactionHandler,
+		systemPrompt:       systemPrompt,
+		maxContinuations:   maxContinuations,
+		streaming:          streaming,
+		maxContextBytes:    maxContextBytes,
 	}
 }
 
@@ -376,18 +902,52 @@ func (r *ReportSubagent) Execute(ctx context.Context, task Task) (Result, error)
 	}
 
 	// Get context from parameters if available
-	contextData, hasContext := task.Parameters["context"].([]string)
+	contextData := contextText(task)
+	if data := extractedData(task); data != nil {
+		contextData = strings.TrimSpace(contextData + "\n\n提取的数据表:\n" + data.Markdown())
+	}
+	sources, _ := task.Parameters["sources"].([]tool.SearchResult)
+
+	// Summarize a context too large for one prompt (map-reduce)
+	summarized := 0
+	if r.maxContextBytes > 0 && len(contextData) > r.maxContextBytes {
+		var err error
+		contextData, summarized, err = r.condense(ctx, task, contextData, sources)
+		if err != nil {
+			return Result{
+				TaskType:  TaskTypeReport,
+				Success:   false,
+				Error:     fmt.Sprintf("摘要资料失败: %v", err),
+				ErrorKind: classifyError(err),
+			}, err
+		}
+	}
 
 	var prompt string
-	if hasContext && len(contextData) > 0 {
-		prompt = fmt.Sprintf("基于以下信息，%s:\n\n%s", task.Description, strings.Join(contextData, "\n\n"))
+	if contextData != "" {
+		prompt = fmt.Sprintf("基于以下信息，%s:\n\n%s", task.Description, contextData)
 	} else {
 		prompt = task.Description
 	}
 
 	// Check for global context
-	globalContext, _ := task.Parameters["global_context"].(string)
-	systemPrompt := "你是一个报告写作助手，负责创建格式良好、清晰且全面的 Markdown 格式报告。使用适当的标题、列表和格式使报告易于阅读。如果提供的信息包含带有 URL 和描述的图片，请选择最相关的图片，并使用标准 Markdown 图片语法 `![描述](URL)` 将其嵌入报告中。将图片放置在相关文本部分附近。"
+	globalContext := task.StringParam("global_context")
+	systemPrompt := "你是一个报告写作助手，负责创建格式良好、清晰且全面的 Markdown 格式报告。使用适当的标题、列表和格式使报告易于阅读。如果提供的信息包含带有 URL 和描述的图片，请选择最相关的图片，并使用标准 Markdown 图片语法 `![描述](URL)` 将其嵌入报告中。将图片放置在相关文本部分附近。如果分析中包含对比表格，请在报告中保留并完善该表格。"
+	if r.systemPrompt != "" {
+		systemPrompt = r.systemPrompt
+	}
+	style := task.StringParam("style")
+	if instruction, ok := reportStyleInstructions[strings.ToLower(strings.TrimSpace(style))]; ok {
+		systemPrompt += "\n\n" + instruction
+	}
+	if len(sources) > 0 {
+		systemPrompt += "\n\n可引用的来源如下。引用时请在正文中使用对应的编号（如 [1]），并在报告末尾列出参考文献：\n" + formatSources(sources)
+	}
+	noSources := task.BoolParam(noSourcesKey, false)
+	if noSources {
+		systemPrompt += "\n\n" + noSourcesInstruction
+	}
+	systemPrompt = withLanguage(systemPrompt, task)
 	if globalContext != "" {
 		systemPrompt += "\n\n来自用户的重要上下文/指令：\n" + globalContext
 	}
@@ -409,17 +969,31 @@ func (r *ReportSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		Temperature: 0.5,
 	}
 
-	resp, err := r.client.CreateChatCompletion(ctx, req)
+	report, finish, err := r.complete(ctx, req)
+
+	// Continue a report cut off at the output token limit
+	continuations := 0
+	for err == nil && finish == openai.FinishReasonLength && continuations < r.maxContinuations {
+		continuations++
+		r.log(fmt.Sprintf("⏩ 报告因长度限制被截断，继续生成 (%d/%d)", continuations, r.maxContinuations))
+
+		req.Messages = append(messages[:len(messages):len(messages)],
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: report},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: reportContinuePrompt},
+		)
+		var more string
+		more, finish, err = r.complete(ctx, req)
+		report += more
+	}
 	if err != nil {
 		return Result{
-			TaskType: TaskTypeReport,
-			Success:  false,
-			Error:    err.Error(),
+			TaskType:  TaskTypeReport,
+			Success:   false,
+			Error:     err.Error(),
+			ErrorKind: classifyError(err),
 		}, err
 	}
 
-	report := resp.Choices[0].Message.Content
-
 	if r.verbose {
 		fmt.Printf("  ✓ 报告已生成 (%d 字节)\n", len(report))
 	}
@@ -427,25 +1001,212 @@ func (r *ReportSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		r.interactionHandler.Log(fmt.Sprintf("✓ 报告已生成 (%d 字节)", len(report)))
 	}
 
-	return Result{
+	result := Result{
 		TaskType: TaskTypeReport,
 		Success:  true,
 		Output:   report,
-	}, nil
+	}
+	result.Metadata = map[string]interface{}{}
+	if finish == openai.FinishReasonLength {
+		r.log("⚠️ 报告因长度限制被截断，可能不完整")
+		result.Metadata["truncated"] = true
+	}
+	if noSources {
+		result.Metadata["no_sources"] = true
+	}
+	if summarized > 0 {
+		result.Metadata["summarized_chunks"] = summarized
+	}
+	return result, nil
+}
+
+// maxCondenseRounds limits how often summaries that are still too large are
+// summarized again.
+const maxCondenseRounds = 3
+
+// condense summarizes contextData in chunks of at most maxContextBytes
+// concurrently and joins the summaries, repeating while they are still too
+// large. Citations are kept as the numbers of sources. It returns the
+// condensed context and the number of chunks summarized in the first round.
+func (r *ReportSubagent) condense(ctx context.Context, task Task, contextData string, sources []tool.SearchResult) (string, int, error) {
+	first := 0
+	for round := 0; round < maxCondenseRounds && len(contextData) > r.maxContextBytes; round++ {
+		chunks := chunkText(contextData, r.maxContextBytes)
+		if first == 0 {
+			first = len(chunks)
+		}
+		r.log(fmt.Sprintf("📚 资料过长 (%d 字节)，分 %d 块先行摘要", len(contextData), len(chunks)))
+
+		summaries := make([]string, len(chunks))
+		errs := make([]error, len(chunks))
+		var wg sync.WaitGroup
+		for i, chunk := range chunks {
+			wg.Add(1)
+			go func(i int, chunk string) {
+				defer wg.Done()
+				summaries[i], errs[i] = r.summarizeChunk(ctx, task, chunk, sources)
+			}(i, chunk)
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return "", 0, err
+		}
+
+		for i, summary := range summaries {
+			summaries[i] = fmt.Sprintf("资料摘要 %d/%d:\n%s", i+1, len(summaries), summary)
+		}
+		condensed := strings.Join(summaries, "\n\n")
+		if len(condensed) >= len(contextData) {
+			// Summarizing no longer shrinks the context
+			return condensed, first, nil
+		}
+		contextData = condensed
+	}
+	return contextData, first, nil
+}
+
+// summarizeChunk condenses one chunk of the report context, keeping the
+// facts, figures and their citations.
+func (r *ReportSubagent) summarizeChunk(ctx context.Context, task Task, chunk string, sources []tool.SearchResult) (string, error) {
+	systemPrompt := "你是一个研究资料整理助手。请将提供的资料压缩为详尽的要点摘要，供之后撰写报告使用：保留所有关键事实、数据、日期、名称、对比表格和图片链接，删除重复和无关内容，不要添加资料中没有的信息。" +
+		"每个要点都必须保留出处：使用下方来源列表中的编号标注 (如 [1])；来源不在列表中时保留其 URL。"
+	if len(sources) > 0 {
+		systemPrompt += "\n\n来源列表：\n" + formatSources(sources)
+	}
+	resp, err := r.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: r.model,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: withLanguage(systemPrompt, task),
+			},
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf("报告主题: %s\n\n资料:\n%s", task.Description, chunk),
+			},
+		},
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || strings.TrimSpace(resp.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return resp.Choices[0].Message.Content, nil
+}
+
+// log reports a message to the terminal (in verbose mode) and the user interface.
+func (r *ReportSubagent) log(message string) {
+	if r.verbose {
+		fmt.Println("  " + message)
+	}
+	if r.interactionHandler != nil {
+		r.interactionHandler.Log(message)
+	}
+}
+
+// complete sends req, streaming the text if the interaction handler
+// supports it, and returns the generated text and why generation stopped.
+func (r *ReportSubagent) complete(ctx context.Context, req openai.ChatCompletionRequest) (string, openai.FinishReason, error) {
+	if sh, ok := r.interactionHandler.(StreamHandler); ok && r.streaming {
+		if streamer, ok := r.client.(ChatStreamer); ok {
+			return r.streamReport(ctx, req, streamer, sh)
+		}
+	}
+	resp, err := r.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", "", fmt.Errorf("no choices in response")
+	}
+	return resp.Choices[0].Message.Content, resp.Choices[0].FinishReason, nil
+}
+
+// streamReport generates the report with a streaming request, forwarding
+// each delta to sh, and returns the complete text and the finish reason.
+func (r *ReportSubagent) streamReport(ctx context.Context, req openai.ChatCompletionRequest, streamer ChatStreamer, sh StreamHandler) (string, openai.FinishReason, error) {
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true} // for cost tracking
+	stream, err := streamer.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", "", err
+	}
+	defer stream.Close()
+
+	var sb strings.Builder
+	var finish openai.FinishReason
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return sb.String(), finish, nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		if resp.Choices[0].FinishReason != "" {
+			finish = resp.Choices[0].FinishReason
+		}
+		delta := resp.Choices[0].Delta.Content
+		if delta != "" {
+			sb.WriteString(delta)
+			sh.StreamDelta(TaskTypeReport, delta)
+		}
+	}
+}
+
+// RenderConfig controls the terminal text rendered with FinalFormatTerm.
+type RenderConfig struct {
+	// Width is the line width of the rendered text. Zero means 80.
+	Width int
+	// LeftPad is the number of spaces the text is indented by.
+	LeftPad int
+	// Color keeps the ANSI colors and styles. Without it the text is plain,
+	// e.g. for piping to a file.
+	Color bool
+	// Both renders the report as HTML and as terminal text in one pass,
+	// returned in Result.Metadata["html"] and ["term"]; the Output is still
+	// in the final format. For a client that shows the text and can open
+	// the HTML in a browser.
+	Both bool
 }
 
+// DefaultRenderConfig is used when AgentConfig.Render sets nothing but Both.
+var DefaultRenderConfig = RenderConfig{Width: 80, LeftPad: 6, Color: true}
+
+// ansiEscape matches the ANSI escape sequences of rendered terminal text.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
 // RenderSubagent renders markdown to terminal-friendly format.
 type RenderSubagent struct {
 	verbose            bool
-	renderHTML         bool
+	format             FinalFormat
+	htmlFragment       bool
+	maxBytes           int
+	render             RenderConfig
 	interactionHandler InteractionHandler
 }
 
-// NewRenderSubagent creates a new RenderSubagent.
-func NewRenderSubagent(verbose bool, renderHTML bool, interactionHandler InteractionHandler) *RenderSubagent {
+// NewRenderSubagent creates a new RenderSubagent. With FinalFormatHTML the
+// output is a complete HTML page, or a fragment if htmlFragment is also set;
+// with FinalFormatMarkdown or FinalFormatNone the markdown is returned as is;
+// with FinalFormatTerm it is terminal text laid out by render.
+// Markdown longer than maxBytes is rendered as several HTML pages; zero
+// disables pagination.
+func NewRenderSubagent(verbose bool, format FinalFormat, htmlFragment bool, maxBytes int, render RenderConfig, interactionHandler InteractionHandler) *RenderSubagent {
+	if render.Width <= 0 {
+		render.Width = DefaultRenderConfig.Width
+	}
 	return &RenderSubagent{
 		verbose:            verbose,
-		renderHTML:         renderHTML,
+		format:             format,
+		htmlFragment:       htmlFragment,
+		maxBytes:           maxBytes,
+		render:             render,
 		interactionHandler: interactionHandler,
 	}
 }
@@ -464,40 +1225,7 @@ func (r *RenderSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		r.interactionHandler.Log(fmt.Sprintf("> 渲染 Subagent: %s", task.Description))
 	}
 
-	// Get content from parameters or description
-	content, ok := task.Parameters["content"].(string)
-	if !ok {
-		// Try to get from context (passed from previous task)
-		if ctxContent, ok := task.Parameters["context"].([]string); ok && len(ctxContent) > 0 {
-			// Try to find the output from the REPORT task
-			var foundReport bool
-			for i := len(ctxContent) - 1; i >= 0; i-- {
-				if strings.Contains(ctxContent[i], "Output from REPORT task:") {
-					content = ctxContent[i]
-					// Extract the content after the header
-					if idx := strings.Index(content, "\n"); idx != -1 {
-						content = content[idx+1:]
-					}
-					foundReport = true
-					break
-				}
-			}
-
-			if !foundReport {
-				// If no REPORT output found, use the last task's output
-				content = ctxContent[len(ctxContent)-1]
-				// Extract the content after the header if present
-				if idx := strings.Index(content, "Output from "); idx != -1 {
-					if newlineIdx := strings.Index(content[idx:], "\n"); newlineIdx != -1 {
-						content = content[idx+newlineIdx+1:]
-					}
-				}
-			}
-			content = strings.TrimSpace(content)
-		} else {
-			content = task.Description
-		}
-	}
+	content := reportContent(task)
 
 	if r.verbose {
 		fmt.Printf("  正在渲染 %d 字节的内容\n", len(content))
@@ -506,25 +1234,153 @@ func (r *RenderSubagent) Execute(ctx context.Context, task Task) (Result, error)
 		r.interactionHandler.Log(fmt.Sprintf("正在渲染 %d 字节的内容", len(content)))
 	}
 
+	metadata := map[string]interface{}{
+		"markdown": content,
+	}
+
 	// Render markdown
+	render := renderMarkdownHTML
+	if r.htmlFragment {
+		render = renderMarkdownHTMLFragment
+	}
 	var output string
-	if r.renderHTML {
-		extensions := parser.CommonExtensions | parser.AutoHeadingIDs
-		p := parser.NewWithExtensions(extensions)
-		doc := p.Parse([]byte(content))
+	switch r.format {
+	case FinalFormatHTML:
+		if r.maxBytes > 0 && len(content) > r.maxBytes {
+			chunks := splitMarkdown(content, r.maxBytes)
+			pages := make([]string, len(chunks))
+			for i, chunk := range chunks {
+				pages[i] = render(chunk)
+			}
+			output = pages[0]
+			metadata["pages"] = pages
 
-		htmlFlags := html.CommonFlags | html.HrefTargetBlank | html.CompletePage
-		opts := html.RendererOptions{Flags: htmlFlags, Title: "Agent Report"}
-		renderer := html.NewRenderer(opts)
+			msg := fmt.Sprintf("⚠️ 内容 %d 字节超过 %d 字节上限，已分为 %d 页", len(content), r.maxBytes, len(pages))
+			if r.verbose {
+				fmt.Printf("  %s\n", msg)
+			}
+			if r.interactionHandler != nil {
+				r.interactionHandler.Log(msg)
+			}
+		} else {
+			output = render(content)
+		}
+	case FinalFormatMarkdown, FinalFormatNone:
+		output = content
+	default:
+		output = r.renderTerm(content)
+	}
 
-		output = string(gomarkdown.Render(doc, renderer))
-	} else {
-		output = string(markdown.Render(content, 80, 6))
+	// Add the other representation without rendering the primary again
+	if r.render.Both {
+		switch r.format {
+		case FinalFormatHTML:
+			metadata["html"] = output
+			metadata["term"] = r.renderTerm(content)
+		case FinalFormatMarkdown, FinalFormatNone:
+			metadata["html"] = render(content)
+			metadata["term"] = r.renderTerm(content)
+		default:
+			metadata["html"] = render(content)
+			metadata["term"] = output
+		}
 	}
 
 	return Result{
 		TaskType: TaskTypeRender,
 		Success:  true,
 		Output:   output,
+		Metadata: metadata,
 	}, nil
 }
+
+// renderTerm renders markdown as terminal text with the RenderConfig.
+func (r *RenderSubagent) renderTerm(content string) string {
+	output := string(markdown.Render(content, r.render.Width, r.render.LeftPad))
+	if !r.render.Color {
+		output = ansiEscape.ReplaceAllString(output, "")
+	}
+	return output
+}
+
+// splitMarkdown splits markdown into chunks of about maxBytes at blank lines
+// outside code fences, so no block is cut in half. A single block larger
+// than maxBytes becomes a chunk of its own.
+func splitMarkdown(content string, maxBytes int) []string {
+	var blocks []string
+	var block strings.Builder
+	inFence := false
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		block.WriteString(line)
+		if !inFence && strings.TrimSpace(line) == "" {
+			blocks = append(blocks, block.String())
+			block.Reset()
+		}
+	}
+	if block.Len() > 0 {
+		blocks = append(blocks, block.String())
+	}
+
+	var chunks []string
+	var chunk strings.Builder
+	for _, b := range blocks {
+		if chunk.Len() > 0 && chunk.Len()+len(b) > maxBytes {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+		}
+		chunk.WriteString(b)
+	}
+	if chunk.Len() > 0 {
+		chunks = append(chunks, chunk.String())
+	}
+	return chunks
+}
+
+// renderMarkdownHTML renders markdown as a complete HTML page.
+func renderMarkdownHTML(content string) string {
+	return renderMarkdownToHTML(content, html.CompletePage)
+}
+
+// renderMarkdownHTMLFragment renders markdown as an HTML fragment without
+// <html>, <head> or <body>, suitable for embedding in another page.
+func renderMarkdownHTMLFragment(content string) string {
+	return renderMarkdownToHTML(content, 0)
+}
+
+// RenderMarkdownSafeHTML renders markdown as an HTML fragment that is safe
+// to insert into a page: raw HTML in the markdown is dropped and only links
+// to trusted protocols are kept.
+func RenderMarkdownSafeHTML(content string) string {
+	return renderMarkdownToHTML(content, html.SkipHTML|html.Safelink)
+}
+
+func renderMarkdownToHTML(content string, extraFlags html.Flags) string {
+	extensions := parser.CommonExtensions | parser.AutoHeadingIDs
+	p := parser.NewWithExtensions(extensions)
+	doc := p.Parse([]byte(content))
+
+	htmlFlags := html.CommonFlags | html.HrefTargetBlank | extraFlags
+	opts := html.RendererOptions{Flags: htmlFlags, Title: "Agent Report"}
+	renderer := html.NewRenderer(opts)
+
+	return string(gomarkdown.Render(doc, renderer))
+}
+
+// reportContent returns the markdown a render or export task should work on:
+// the "content" parameter, the prior REPORT output, the last prior output,
+// or the task description, in that order.
+func reportContent(task Task) string {
+	content := task.StringParam("content")
+	if !task.HasParam("content") {
+		// Use the REPORT output passed from a previous task, or the last output
+		if output, found := latestOutput(task, TaskTypeReport); found {
+			content = output
+		} else {
+			content = task.Description
+		}
+	}
+	return content
+}
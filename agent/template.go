@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TopicVar is the template variable that ToTemplate substitutes for the
+// plan's topic.
+const TopicVar = "topic"
+
+// templateVarPattern matches {{name}} placeholders in a PlanTemplate.
+var templateVarPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// PlanTemplate is a reusable plan whose descriptions and string parameters
+// may contain {{name}} placeholders. It serializes to JSON like a Plan.
+type PlanTemplate struct {
+	Description string `json:"description"`
+	Tasks       []Task `json:"tasks"`
+}
+
+// ToTemplate turns the plan into a template by replacing every occurrence
+// of its topic with the {{topic}} placeholder. Call it on a reviewed plan
+// before executing it, since execution inserts dynamic tasks into the plan.
+func (p *Plan) ToTemplate() (*PlanTemplate, error) {
+	topic := strings.TrimSpace(p.Topic)
+	if topic == "" {
+		return nil, fmt.Errorf("plan has no topic to parameterize")
+	}
+	placeholder := "{{" + TopicVar + "}}"
+	replace := func(s string) string {
+		return strings.ReplaceAll(s, topic, placeholder)
+	}
+
+	tmpl := &PlanTemplate{
+		Description: replace(p.Description),
+		Tasks:       make([]Task, 0, len(p.Tasks)),
+	}
+	for _, task := range p.Tasks {
+		task = templateTask(task, replace)
+		// Drop context injected by a previous execution and internal markers
+		for k := range task.Parameters {
+			if k == OutputsKey || k == FilesKey || k == ScratchpadKey || k == "global_context" || strings.HasPrefix(k, "_") {
+				delete(task.Parameters, k)
+			}
+		}
+		tmpl.Tasks = append(tmpl.Tasks, task)
+	}
+	return tmpl, nil
+}
+
+// Instantiate returns a plan with the template's placeholders replaced by
+// vars. It fails if a placeholder has no value.
+func (t *PlanTemplate) Instantiate(vars map[string]string) (*Plan, error) {
+	var missing []string
+	replace := func(s string) string {
+		return templateVarPattern.ReplaceAllStringFunc(s, func(m string) string {
+			name := templateVarPattern.FindStringSubmatch(m)[1]
+			value, ok := vars[name]
+			if !ok {
+				missing = append(missing, name)
+				return m
+			}
+			return value
+		})
+	}
+
+	plan := &Plan{
+		Description: replace(t.Description),
+		Topic:       vars[TopicVar],
+		Tasks:       make([]Task, 0, len(t.Tasks)),
+	}
+	for _, task := range t.Tasks {
+		plan.Tasks = append(plan.Tasks, templateTask(task, replace))
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing template variables: %s", strings.Join(missing, ", "))
+	}
+	return plan, nil
+}
+
+// templateTask returns a copy of task with replace applied to its
+// description and to every string in its parameters.
+func templateTask(task Task, replace func(string) string) Task {
+	task.Description = replace(task.Description)
+	if task.Parameters != nil {
+		task.Parameters = templateValue(task.Parameters, replace).(map[string]interface{})
+	}
+	return task
+}
+
+// templateValue deep-copies v, applying replace to every string it contains.
+func templateValue(v interface{}, replace func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return replace(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = replace(s)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = templateValue(e, replace)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = templateValue(e, replace)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// ExecuteTemplate instantiates the template with vars and executes the
+// resulting plan without calling the planner.
+func (a *PlanningAgent) ExecuteTemplate(ctx context.Context, tmpl *PlanTemplate, vars map[string]string) ([]Result, error) {
+	plan, err := tmpl.Instantiate(vars)
+	if err != nil {
+		return nil, err
+	}
+	a.validatePlan(plan)
+
+	if a.config.Verbose {
+		fmt.Printf("📋 模板计划: %s\n", plan.Description)
+		for i, task := range plan.Tasks {
+			fmt.Printf("  %d. [%s] %s\n", i+1, task.Type, task.Description)
+		}
+		fmt.Println()
+	}
+	if a.interactionHandler != nil {
+		a.interactionHandler.Log(fmt.Sprintf("📋 使用模板计划: %s", plan.Description))
+	}
+
+	return a.Execute(ctx, plan)
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceEntry is one API call recorded when AgentConfig.Trace is set.
+type TraceEntry struct {
+	URL        string        `json:"url"`
+	Request    string        `json:"request"`  // request body, e.g. the messages sent
+	Response   string        `json:"response"` // raw response body, or the stream events
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// taskTrace collects the API calls made while executing a task.
+type taskTrace struct {
+	mu      sync.Mutex
+	entries []TraceEntry
+}
+
+func (t *taskTrace) add(entry TraceEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, entry)
+}
+
+// list returns the calls recorded so far.
+func (t *taskTrace) list() []TraceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEntry(nil), t.entries...)
+}
+
+type traceKey struct{}
+
+// withTrace returns a context whose API calls are recorded in the returned
+// trace.
+func withTrace(ctx context.Context) (context.Context, *taskTrace) {
+	trace := &taskTrace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// traceTransport records the requests made with a trace in their context,
+// with the API key redacted.
+type traceTransport struct {
+	base   http.RoundTripper
+	secret string
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace, ok := req.Context().Value(traceKey{}).(*taskTrace)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	entry := TraceEntry{URL: req.URL.String()}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		entry.Request = t.redact(string(body))
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		entry.Error = t.redact(err.Error())
+		entry.Duration = time.Since(start)
+		trace.add(entry)
+		return nil, err
+	}
+	entry.StatusCode = resp.StatusCode
+	resp.Body = &traceBody{ReadCloser: resp.Body, done: func(body []byte) {
+		entry.Response = t.redact(string(body))
+		entry.Duration = time.Since(start)
+		trace.add(entry)
+	}}
+	return resp, nil
+}
+
+func (t *traceTransport) redact(s string) string {
+	if t.secret == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, t.secret, "[REDACTED]")
+}
+
+// traceBody copies the response body as it is read and passes it to done
+// once the body has been fully read or closed.
+type traceBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	once sync.Once
+	done func(body []byte)
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.buf.Bytes()) })
+	}
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
+
+// writeTrace appends the trace of a task to the JSON lines file at path.
+func writeTrace(path string, task Task, entries []TraceEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(struct {
+		TaskType    TaskType     `json:"task_type"`
+		Description string       `json:"description"`
+		Calls       []TraceEntry `json:"calls"`
+	}{task.Type, task.Description, entries})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -1,40 +1,70 @@
 package agent
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // TaskType represents the type of task to be executed by a subagent.
 type TaskType string
 
 const (
-	TaskTypeSearch  TaskType = "SEARCH"
-	TaskTypeAnalyze TaskType = "ANALYZE"
-	TaskTypeReport  TaskType = "REPORT"
-	TaskTypeRender  TaskType = "RENDER"
-	TaskTypePodcast TaskType = "PODCAST"
-	TaskTypePPT     TaskType = "PPT"
+	TaskTypeSearch   TaskType = "SEARCH"
+	TaskTypeAnalyze  TaskType = "ANALYZE"
+	TaskTypeReport   TaskType = "REPORT"
+	TaskTypeRender   TaskType = "RENDER"
+	TaskTypePodcast  TaskType = "PODCAST"
+	TaskTypePPT      TaskType = "PPT"
+	TaskTypeChart    TaskType = "CHART"
+	TaskTypeExport   TaskType = "EXPORT"
+	TaskTypeEmail    TaskType = "EMAIL"
+	TaskTypeExtract  TaskType = "EXTRACT"
+	TaskTypeRetrieve TaskType = "RETRIEVE"
 )
 
 // Task represents a subtask to be executed by a subagent.
 type Task struct {
+	// ID names the task within its plan, e.g. "search1", so later tasks
+	// can list it in Inputs. Optional.
+	ID          string                 `json:"id,omitempty"`
 	Type        TaskType               `json:"type"`
 	Description string                 `json:"description"`
 	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	// Inputs are the IDs of the earlier tasks whose outputs the task
+	// receives in OutputsKey. Empty, or naming tasks that produced
+	// nothing, selects the outputs by the context rules instead.
+	Inputs []string `json:"inputs,omitempty"`
+	// Checkpoint pauses execution before this task until the user confirms.
+	Checkpoint bool `json:"checkpoint,omitempty"`
 }
 
 // Result contains the output from a subagent execution.
 type Result struct {
-	TaskType TaskType               `json:"task_type"`
-	Success  bool                   `json:"success"`
-	Output   string                 `json:"output"`
-	Error    string                 `json:"error,omitempty"`
-	Metadata map[string]interface{} `json:"metadata,omitempty"`
-	NewTasks []Task                 `json:"new_tasks,omitempty"`
+	TaskType  TaskType               `json:"task_type"`
+	Success   bool                   `json:"success"`
+	Output    string                 `json:"output"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorKind ErrorKind              `json:"error_kind,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	NewTasks  []Task                 `json:"new_tasks,omitempty"`
 }
 
 // Plan represents a collection of tasks with dependencies.
 type Plan struct {
 	Tasks       []Task `json:"tasks"`
 	Description string `json:"description"`
+	// Topic is the main subject of the request, used by ToTemplate.
+	Topic string `json:"topic,omitempty"`
+}
+
+// PlanExample is a request and the plan the planner should have made for
+// it, used as a few-shot example by AgentConfig.PlanExamples.
+type PlanExample struct {
+	Request string `json:"request"`
+	Plan    Plan   `json:"plan"`
 }
 
 // Subagent interface for all subagent implementations.
@@ -43,6 +73,13 @@ type Subagent interface {
 	Type() TaskType
 }
 
+// Validator is optionally implemented by a Subagent to check its external
+// dependencies, such as executables or API keys, before a plan runs.
+// Validate returns an error describing what is missing.
+type Validator interface {
+	Validate() error
+}
+
 // InteractionHandler defines methods for human-in-the-loop interaction.
 type InteractionHandler interface {
 	// ReviewPlan asks the user to review and potentially modify the plan.
@@ -53,6 +90,148 @@ type InteractionHandler interface {
 	// Returns true if confirmed.
 	ConfirmPodcastGeneration(report string) (bool, error)
 
+	// ConfirmAction asks the user to approve a potentially dangerous action,
+	// such as running generated code or installing npm packages.
+	// Returns true if approved.
+	ConfirmAction(description string, details map[string]interface{}) (bool, error)
+
 	// Log sends a log message to the user interface.
 	Log(message string)
 }
+
+// StreamHandler is optionally implemented by an InteractionHandler to
+// receive generated text as it streams in, e.g. the report being written.
+type StreamHandler interface {
+	StreamDelta(taskType TaskType, delta string)
+}
+
+// HeartbeatHandler is optionally implemented by an InteractionHandler to
+// show that a task is alive, e.g. with a spinner, and to detect stalls.
+// While a model or search call of a task is in flight, Heartbeat is called
+// every few seconds with the time since the call started. Heartbeats stop
+// when the call returns or its context is cancelled.
+type HeartbeatHandler interface {
+	Heartbeat(taskType TaskType, activity string, elapsed time.Duration)
+}
+
+// SlideHandler is optionally implemented by an InteractionHandler to preview
+// the slides of a PPT task before the presentation is built. PreviewSlide is
+// called for every slide, numbered from 1, as soon as it is generated.
+// Number 1 starts a new preview that replaces the slides previewed so far,
+// e.g. when the slides were corrected after streaming.
+type SlideHandler interface {
+	PreviewSlide(number int, slide Slide)
+}
+
+// GuidanceHandler is optionally implemented by an InteractionHandler to let
+// the user steer a running search. RequestGuidance describes the progress so
+// far and returns the user's guidance, or false to let the search continue
+// on its own.
+type GuidanceHandler interface {
+	RequestGuidance(context string) (string, bool)
+}
+
+// Task parameters come from the planner's JSON as well as from Go code, so
+// the accessors below accept both the decoded JSON types (float64,
+// []interface{}) and the Go ones (int, []string), and convert between
+// scalars where the planner is known to be loose, e.g. a number where a
+// string is expected.
+
+// HasParam reports whether the task has the parameter key.
+func (t Task) HasParam(key string) bool {
+	_, ok := t.Parameters[key]
+	return ok
+}
+
+// StringParam returns the parameter key as a string. Numbers and booleans
+// are formatted; missing keys and other types return "".
+func (t Task) StringParam(key string) string {
+	s, _ := scalarString(t.Parameters[key])
+	return s
+}
+
+// StringSliceParam returns the parameter key as a list of strings. A single
+// value becomes a list of one, and list items that are not scalars are
+// skipped. Missing keys return nil.
+func (t Task) StringSliceParam(key string) []string {
+	switch v := t.Parameters[key].(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			if s, ok := scalarString(item); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		if s, ok := scalarString(v); ok {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+// IntParam returns the parameter key as an integer, truncating fractions.
+// Numeric strings are parsed; missing keys and other values return zero.
+func (t Task) IntParam(key string) int {
+	return int(t.FloatParam(key))
+}
+
+// FloatParam returns the parameter key as a float64. Numeric strings are
+// parsed; missing keys and other values return zero.
+func (t Task) FloatParam(key string) float64 {
+	switch v := t.Parameters[key].(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f
+	}
+	return 0
+}
+
+// BoolParam returns the parameter key as a boolean, accepting strings such
+// as "true" and "false". Missing keys and other values return def.
+func (t Task) BoolParam(key string, def bool) bool {
+	switch v := t.Parameters[key].(type) {
+	case bool:
+		return v
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+// scalarString formats a string, number or boolean parameter value.
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
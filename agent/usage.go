@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Usage is the token usage and estimated cost of the LLM calls made by an agent.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	Images           int
+	CostUSD          float64
+}
+
+// ModelPrice is the price of a model in US dollars.
+type ModelPrice struct {
+	InputPerMTok  float64 // per million prompt tokens
+	OutputPerMTok float64 // per million completion tokens
+	PerImage      float64 // per generated image
+}
+
+// DefaultModelPrices are the prices used to estimate costs, keyed by model
+// name prefix. The longest matching prefix wins, so dated snapshots such as
+// "gpt-4o-2024-08-06" use the "gpt-4o" price. Unknown models are priced as
+// defaultPriceModel.
+var DefaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":       {InputPerMTok: 2.5, OutputPerMTok: 10},
+	"gpt-4o-mini":  {InputPerMTok: 0.15, OutputPerMTok: 0.6},
+	"gpt-4.1":      {InputPerMTok: 2, OutputPerMTok: 8},
+	"gpt-4.1-mini": {InputPerMTok: 0.4, OutputPerMTok: 1.6},
+	"gpt-4.1-nano": {InputPerMTok: 0.1, OutputPerMTok: 0.4},
+	"o4-mini":      {InputPerMTok: 1.1, OutputPerMTok: 4.4},
+	"dall-e-3":     {PerImage: 0.04},
+}
+
+// defaultPriceModel is the entry of DefaultModelPrices used for unknown models.
+const defaultPriceModel = "gpt-4o"
+
+// usageTracker accumulates the usage reported in API responses.
+type usageTracker struct {
+	mu     sync.Mutex
+	usage  Usage
+	prices map[string]ModelPrice
+}
+
+func newUsageTracker(prices map[string]ModelPrice) *usageTracker {
+	if prices == nil {
+		prices = DefaultModelPrices
+	}
+	return &usageTracker{prices: prices}
+}
+
+// price returns the price of model by longest prefix match.
+func (t *usageTracker) price(model string) ModelPrice {
+	best := -1
+	var price ModelPrice
+	for prefix, p := range t.prices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > best {
+			best, price = len(prefix), p
+		}
+	}
+	if best < 0 {
+		return t.prices[defaultPriceModel]
+	}
+	return price
+}
+
+func (t *usageTracker) add(model string, promptTokens, completionTokens, images int) {
+	price := t.price(model)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage.PromptTokens += promptTokens
+	t.usage.CompletionTokens += completionTokens
+	t.usage.Images += images
+	t.usage.CostUSD += float64(promptTokens)*price.InputPerMTok/1e6 +
+		float64(completionTokens)*price.OutputPerMTok/1e6 +
+		float64(images)*price.PerImage
+}
+
+func (t *usageTracker) snapshot() Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.usage
+}
+
+// usageTransport records the usage of every successful API response.
+type usageTransport struct {
+	base    http.RoundTripper
+	tracker *usageTracker
+}
+
+func (u *usageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	resp.Body = &usageBody{
+		ReadCloser: resp.Body,
+		tracker:    u.tracker,
+		stream:     strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"),
+		images:     strings.HasSuffix(req.URL.Path, "/images/generations"),
+	}
+	return resp, nil
+}
+
+// usageBody copies the response body as it is read and records its usage
+// once the body has been fully read or closed.
+type usageBody struct {
+	io.ReadCloser
+	tracker  *usageTracker
+	stream   bool
+	images   bool
+	buf      bytes.Buffer
+	recorded bool
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.record()
+	}
+	return n, err
+}
+
+func (b *usageBody) Close() error {
+	b.record()
+	return b.ReadCloser.Close()
+}
+
+// usageResponse holds the fields of a response that carry usage.
+type usageResponse struct {
+	Model string `json:"model"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Data []json.RawMessage `json:"data"` // generated images
+}
+
+func (b *usageBody) record() {
+	if b.recorded {
+		return
+	}
+	b.recorded = true
+
+	if !b.stream {
+		var resp usageResponse
+		if json.Unmarshal(b.buf.Bytes(), &resp) != nil {
+			return
+		}
+		if b.images {
+			// Image responses carry no model; they are priced as DALL-E 3
+			b.tracker.add("dall-e-3", 0, 0, len(resp.Data))
+		} else if resp.Usage != nil {
+			b.tracker.add(resp.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, 0)
+		}
+		return
+	}
+
+	// Streams report usage in a final chunk when include_usage is requested
+	scanner := bufio.NewScanner(&b.buf)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk usageResponse
+		if json.Unmarshal([]byte(data), &chunk) == nil && chunk.Usage != nil {
+			b.tracker.add(chunk.Model, chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens, 0)
+		}
+	}
+}
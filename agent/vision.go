@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// maxImageBytes caps the size of a local image attached to a task.
+const maxImageBytes = 20 << 20
+
+// imageURL returns the URL passing the image ref to the model: http(s) and
+// data URLs are used as is, local files are inlined as base64 data URLs.
+func imageURL(ref string) (string, error) {
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "data:image/") {
+		return ref, nil
+	}
+	info, err := os.Stat(ref)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > maxImageBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", maxImageBytes)
+	}
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("not an image (%s)", contentType)
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// imageMessage returns a user message with text followed by images as
+// image_url parts. It returns false if none of the images could be loaded.
+func imageMessage(text string, images []string, warn func(string)) (openai.ChatCompletionMessage, bool) {
+	parts := []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: text}}
+	for _, image := range images {
+		url, err := imageURL(image)
+		if err != nil {
+			warn(fmt.Sprintf("⚠️ 无法加载图像 %s: %v", image, err))
+			continue
+		}
+		parts = append(parts, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: url, Detail: openai.ImageURLDetailAuto},
+		})
+	}
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: parts}, len(parts) > 1
+}
+
+// textOnlyImages describes images the model cannot see for a text-only
+// prompt.
+func textOnlyImages(images []string) string {
+	return "\n\n附带的图像 (无法查看，请仅基于文字信息分析): " + strings.Join(images, ", ")
+}
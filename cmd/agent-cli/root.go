@@ -3,11 +3,22 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
-
-	"github.com/smallnest/goskills/agent"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/term"
+	"github.com/mattn/go-isatty"
+	"github.com/smallnest/aiagents/agent"
+	"github.com/smallnest/aiagents/configfile"
+	"github.com/smallnest/aiagents/tool"
 	"github.com/smallnest/goskills/config"
 	"github.com/spf13/cobra"
 )
@@ -15,17 +26,76 @@ import (
 // CLIInteractionHandler implements agent.InteractionHandler for the CLI.
 type CLIInteractionHandler struct {
 	scanner *bufio.Scanner
+
+	mu      sync.Mutex
+	program *tea.Program // live output view, if one is running
+	outputs *outputQueue // forwards logs and report deltas to program
 }
 
 func NewCLIInteractionHandler(scanner *bufio.Scanner) *CLIInteractionHandler {
 	return &CLIInteractionHandler{scanner: scanner}
 }
 
+// attach sends subsequent output to the live view p.
+func (h *CLIInteractionHandler) attach(p *tea.Program) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.program = p
+	h.outputs = newOutputQueue(p.Send)
+}
+
+// detach restores plain terminal output once the queued output has been
+// sent to the view.
+func (h *CLIInteractionHandler) detach() {
+	h.mu.Lock()
+	outputs := h.outputs
+	h.program, h.outputs = nil, nil
+	h.mu.Unlock()
+
+	if outputs != nil {
+		outputs.close()
+	}
+}
+
+func (h *CLIInteractionHandler) view() *tea.Program {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.program
+}
+
+// queue returns the output queue of the live view, or nil without one.
+func (h *CLIInteractionHandler) queue() *outputQueue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.outputs
+}
+
+// pause releases the terminal from the live view while the user is prompted,
+// returning a function that restores it.
+func (h *CLIInteractionHandler) pause() func() {
+	p := h.view()
+	if p == nil {
+		return func() {}
+	}
+	p.ReleaseTerminal()
+	return func() { p.RestoreTerminal() }
+}
+
 func (h *CLIInteractionHandler) ReviewPlan(plan *agent.Plan) (string, error) {
+	defer h.pause()()
+
 	fmt.Println("\n📋 Proposed Plan:")
 	fmt.Printf("Description: %s\n", plan.Description)
 	for i, task := range plan.Tasks {
-		fmt.Printf("  %d. [%s] %s\n", i+1, task.Type, task.Description)
+		id := ""
+		if task.ID != "" {
+			id = task.ID + ": "
+		}
+		fmt.Printf("  %d. [%s] %s%s", i+1, task.Type, id, task.Description)
+		if len(task.Inputs) > 0 {
+			fmt.Printf(" ← %s", strings.Join(task.Inputs, ", "))
+		}
+		fmt.Println()
 	}
 	fmt.Println()
 
@@ -48,6 +118,8 @@ func (h *CLIInteractionHandler) ReviewPlan(plan *agent.Plan) (string, error) {
 }
 
 func (h *CLIInteractionHandler) ConfirmPodcastGeneration(report string) (bool, error) {
+	defer h.pause()()
+
 	fmt.Print("\n\033[1;33mDo you want to generate a podcast from this report? (y/N):\033[0m ")
 	if !h.scanner.Scan() {
 		return false, h.scanner.Err()
@@ -57,10 +129,58 @@ func (h *CLIInteractionHandler) ConfirmPodcastGeneration(report string) (bool, e
 	return strings.EqualFold(input, "y") || strings.EqualFold(input, "yes"), nil
 }
 
+func (h *CLIInteractionHandler) ConfirmAction(description string, details map[string]interface{}) (bool, error) {
+	defer h.pause()()
+
+	fmt.Printf("\n⚠️  %s\n", description)
+	fmt.Print(formatDetails(details))
+	fmt.Print("\033[1;33mDo you want to proceed? (y/N):\033[0m ")
+	if !h.scanner.Scan() {
+		return false, h.scanner.Err()
+	}
+	input := strings.TrimSpace(h.scanner.Text())
+
+	return strings.EqualFold(input, "y") || strings.EqualFold(input, "yes"), nil
+}
+
+// formatDetails lists the details of an action, one per line, sorted by key
+// so that the prompt reads the same every time.
+func formatDetails(details map[string]interface{}) string {
+	var sb strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(details)) {
+		fmt.Fprintf(&sb, "  %s: %v\n", key, details[key])
+	}
+	return sb.String()
+}
+
+func (h *CLIInteractionHandler) RequestGuidance(context string) (string, bool) {
+	defer h.pause()()
+
+	fmt.Printf("\n🧭 %s\n", context)
+	fmt.Print("\033[1;33mGuidance (Enter to continue):\033[0m ")
+	if !h.scanner.Scan() {
+		return "", false
+	}
+	input := strings.TrimSpace(h.scanner.Text())
+	return input, input != ""
+}
+
 func (h *CLIInteractionHandler) Log(message string) {
+	if q := h.queue(); q != nil {
+		q.push(outputLogMsg(message))
+		return
+	}
 	fmt.Println(message)
 }
 
+// StreamDelta forwards report tokens to the live view. Without a view the
+// report is printed once complete, so deltas are dropped.
+func (h *CLIInteractionHandler) StreamDelta(taskType agent.TaskType, delta string) {
+	if q := h.queue(); q != nil {
+		q.push(outputDeltaMsg(delta))
+	}
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "agent-cli",
 	Short: "A deep agents CLI tool with planning and specialized subagents.",
@@ -76,23 +196,349 @@ The agent maintains conversation history across messages.
 
 Special commands:
   /help   - Show available commands
-  /clear  - Clear conversation history
+  /clear  - Clear conversation history ("/clear context" only drops added context)
+  /compact - Summarize older turns to shrink the history
   /exit   - Exit the chat session
   /quit   - Exit the chat session`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		var prompts map[string]string
+		if path, _ := cmd.Flags().GetString("config"); path != "" {
+			file, err := configfile.Load(path)
+			if err != nil {
+				return err
+			}
+			if err := file.Apply(cmd.Flags()); err != nil {
+				return err
+			}
+			prompts = file.Prompts
+		}
+
 		cfg, err := config.LoadConfig(cmd)
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
 
+		confirmBuild, err := cmd.Flags().GetBool("confirm-build")
+		if err != nil {
+			return err
+		}
+		checkpoints, err := cmd.Flags().GetBool("checkpoints")
+		if err != nil {
+			return err
+		}
+		searchGuidance, err := cmd.Flags().GetBool("search-guidance")
+		if err != nil {
+			return err
+		}
+		minSlides, err := cmd.Flags().GetInt("ppt-min-slides")
+		if err != nil {
+			return err
+		}
+		maxSlides, err := cmd.Flags().GetInt("ppt-max-slides")
+		if err != nil {
+			return err
+		}
+		compactThreshold, err := cmd.Flags().GetInt("compact-threshold")
+		if err != nil {
+			return err
+		}
+		plannerHistoryLimit, err := cmd.Flags().GetInt("planner-history-limit")
+		if err != nil {
+			return err
+		}
+		maxReportContext, err := cmd.Flags().GetInt("max-report-context")
+		if err != nil {
+			return err
+		}
+		liveOutput, err := cmd.Flags().GetBool("live-output")
+		if err != nil {
+			return err
+		}
+		planTimeout, err := cmd.Flags().GetDuration("plan-timeout")
+		if err != nil {
+			return err
+		}
+		fallbackModel, err := cmd.Flags().GetString("fallback-model")
+		if err != nil {
+			return err
+		}
+		ensembleModels, err := cmd.Flags().GetStringSlice("ensemble-models")
+		if err != nil {
+			return err
+		}
+		ensembleSynthesizer, err := cmd.Flags().GetString("ensemble-synthesizer")
+		if err != nil {
+			return err
+		}
+		ensembleAll, err := cmd.Flags().GetBool("ensemble")
+		if err != nil {
+			return err
+		}
+		maxCost, err := cmd.Flags().GetFloat64("max-cost")
+		if err != nil {
+			return err
+		}
+		maxAPICalls, err := cmd.Flags().GetInt("max-concurrent-api-calls")
+		if err != nil {
+			return err
+		}
+		trace, err := cmd.Flags().GetBool("trace")
+		if err != nil {
+			return err
+		}
+		capabilities, err := cmd.Flags().GetString("capabilities")
+		if err != nil {
+			return err
+		}
+		planMinTasks, err := cmd.Flags().GetInt("plan-min-tasks")
+		if err != nil {
+			return err
+		}
+		planMaxTasks, err := cmd.Flags().GetInt("plan-max-tasks")
+		if err != nil {
+			return err
+		}
+		planGuidance, err := cmd.Flags().GetString("plan-guidance")
+		if err != nil {
+			return err
+		}
+		language, err := cmd.Flags().GetString("language")
+		if err != nil {
+			return err
+		}
+		finalFormatName, err := cmd.Flags().GetString("final-format")
+		if err != nil {
+			return err
+		}
+		finalFormat, err := agent.ParseFinalFormat(finalFormatName)
+		if err != nil {
+			return err
+		}
+		renderWidth, err := cmd.Flags().GetInt("render-width")
+		if err != nil {
+			return err
+		}
+		renderLeftPad, err := cmd.Flags().GetInt("render-left-pad")
+		if err != nil {
+			return err
+		}
+		noColor, err := cmd.Flags().GetBool("no-color")
+		if err != nil {
+			return err
+		}
+		outputStrategyName, err := cmd.Flags().GetString("output-strategy")
+		if err != nil {
+			return err
+		}
+		outputStrategy, err := agent.ParseOutputStrategy(outputStrategyName)
+		if err != nil {
+			return err
+		}
+		reportRuleName, err := cmd.Flags().GetString("report-rule")
+		if err != nil {
+			return err
+		}
+		reportRule, err := agent.ParseReportRule(reportRuleName)
+		if err != nil {
+			return err
+		}
+		contextModeName, err := cmd.Flags().GetString("conversation-context")
+		if err != nil {
+			return err
+		}
+		contextMode, err := agent.ParseContextMode(contextModeName)
+		if err != nil {
+			return err
+		}
+		manifest, err := cmd.Flags().GetBool("manifest")
+		if err != nil {
+			return err
+		}
+		sourceZip, err := cmd.Flags().GetBool("ppt-source-zip")
+		if err != nil {
+			return err
+		}
+		keepProjects, err := cmd.Flags().GetInt("ppt-keep-projects")
+		if err != nil {
+			return err
+		}
+		podcastWPM, err := cmd.Flags().GetInt("podcast-wpm")
+		if err != nil {
+			return err
+		}
+		includeDomains, err := cmd.Flags().GetStringSlice("include-domains")
+		if err != nil {
+			return err
+		}
+		excludeDomains, err := cmd.Flags().GetStringSlice("exclude-domains")
+		if err != nil {
+			return err
+		}
+		wikipediaLanguage, err := cmd.Flags().GetString("wikipedia-language")
+		if err != nil {
+			return err
+		}
+		noWikipedia, err := cmd.Flags().GetBool("no-wikipedia")
+		if err != nil {
+			return err
+		}
+		noWebSearch, err := cmd.Flags().GetBool("no-web-search")
+		if err != nil {
+			return err
+		}
+		httpProxy, err := cmd.Flags().GetString("http-proxy")
+		if err != nil {
+			return err
+		}
+		userAgent, err := cmd.Flags().GetString("user-agent")
+		if err != nil {
+			return err
+		}
+		httpClient, err := tool.NewHTTPClient(tool.HTTPOptions{Proxy: httpProxy, UserAgent: userAgent})
+		if err != nil {
+			return err
+		}
+		tool.SetHTTPClient(httpClient)
+		noRephrase, err := cmd.Flags().GetBool("no-search-rephrase")
+		if err != nil {
+			return err
+		}
+		searchProviders, err := cmd.Flags().GetStringSlice("search-providers")
+		if err != nil {
+			return err
+		}
+		breakerThreshold, err := cmd.Flags().GetInt("search-breaker-threshold")
+		if err != nil {
+			return err
+		}
+		breakerCooldown, err := cmd.Flags().GetDuration("search-breaker-cooldown")
+		if err != nil {
+			return err
+		}
+		reflectionModel, err := cmd.Flags().GetString("reflection-model")
+		if err != nil {
+			return err
+		}
+		minNovelty, err := cmd.Flags().GetFloat64("search-min-novelty")
+		if err != nil {
+			return err
+		}
+		minRelevance, err := cmd.Flags().GetFloat64("search-min-relevance")
+		if err != nil {
+			return err
+		}
+		heuristicRelevance, err := cmd.Flags().GetBool("heuristic-relevance")
+		if err != nil {
+			return err
+		}
+		knowledge, err := cmd.Flags().GetStringSlice("knowledge")
+		if err != nil {
+			return err
+		}
+		knowledgeTopK, err := cmd.Flags().GetInt("knowledge-top-k")
+		if err != nil {
+			return err
+		}
+		embeddingModel, err := cmd.Flags().GetString("embedding-model")
+		if err != nil {
+			return err
+		}
+		smtpHost, err := cmd.Flags().GetString("smtp-host")
+		if err != nil {
+			return err
+		}
+		smtpPort, err := cmd.Flags().GetInt("smtp-port")
+		if err != nil {
+			return err
+		}
+		smtpUser, err := cmd.Flags().GetString("smtp-user")
+		if err != nil {
+			return err
+		}
+		smtpFrom, err := cmd.Flags().GetString("smtp-from")
+		if err != nil {
+			return err
+		}
+		// Verbose subagents print directly to stdout, which would garble the view
+		liveOutput = liveOutput && !cfg.Verbose && isatty.IsTerminal(os.Stdout.Fd())
+
 		agentConfig := agent.AgentConfig{
-			APIKey:  cfg.APIKey,
-			APIBase: cfg.APIBase,
-			Model:   cfg.Model,
-			Verbose: cfg.Verbose,
+			APIKey:                cfg.APIKey,
+			APIBase:               cfg.APIBase,
+			Model:                 cfg.Model,
+			FallbackModel:         fallbackModel,
+			Ensemble:              agent.EnsembleConfig{Models: ensembleModels, Synthesizer: ensembleSynthesizer, Enabled: ensembleAll},
+			MaxCostUSD:            maxCost,
+			MaxConcurrentAPICalls: maxAPICalls,
+			Trace:                 trace,
+			Verbose:               cfg.Verbose,
+			Prompts:               prompts,
+			Checkpoints:           checkpoints,
+			CompactThreshold:      compactThreshold,
+			PlannerHistoryLimit:   plannerHistoryLimit,
+			MaxReportContextBytes: maxReportContext,
+			SearchGuidance:        searchGuidance,
+			Language:              language,
+			FinalFormat:           finalFormat,
+			OutputStrategy:        outputStrategy,
+			Manifest:              manifest,
+			ReportRule:            reportRule,
+			ConversationContext:   contextMode,
+			DisableWebSearch:      noWebSearch,
+			Render:                terminalRenderConfig(renderWidth, renderLeftPad, noColor),
+			Planner: agent.PlanConfig{
+				MinTasks: planMinTasks,
+				MaxTasks: planMaxTasks,
+				Guidance: planGuidance,
+			},
+			Search: agent.SearchConfig{
+				IncludeDomains:     includeDomains,
+				ExcludeDomains:     excludeDomains,
+				DisableWikipedia:   noWikipedia,
+				DisableRephrase:    noRephrase,
+				Providers:          searchProviders,
+				BreakerThreshold:   breakerThreshold,
+				BreakerCooldown:    breakerCooldown,
+				WikipediaLanguage:  wikipediaLanguage,
+				ReflectionModel:    reflectionModel,
+				MinNovelty:         minNovelty,
+				MinRelevance:       minRelevance,
+				HeuristicRelevance: heuristicRelevance,
+			},
+			Knowledge: agent.KnowledgeConfig{
+				Paths:          knowledge,
+				TopK:           knowledgeTopK,
+				EmbeddingModel: embeddingModel,
+			},
+			Email: agent.EmailConfig{
+				Host:     smtpHost,
+				Port:     smtpPort,
+				Username: smtpUser,
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     smtpFrom,
+			},
+			PPT: agent.PPTConfig{
+				ConfirmBuild: confirmBuild,
+				MinSlides:    minSlides,
+				MaxSlides:    maxSlides,
+				SourceZip:    sourceZip,
+				KeepProjects: keepProjects,
+			},
+			Podcast: agent.PodcastConfig{
+				WordsPerMinute: podcastWPM,
+			},
 		}
 
 		ctx := context.Background()
+		if capabilities == "auto" {
+			agentConfig.Capabilities, err = agent.ProbeCapabilities(ctx, agentConfig)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("🔍 检测到模型支持的功能: %s\n", agentConfig.Capabilities)
+		} else if agentConfig.Capabilities, err = agent.ParseCapabilities(capabilities); err != nil {
+			return err
+		}
 		scanner := bufio.NewScanner(os.Stdin)
 		interactionHandler := NewCLIInteractionHandler(scanner)
 
@@ -114,6 +560,9 @@ Special commands:
 		fmt.Println("Type \033[1;33m\\help\033[0m for available commands, \033[1;33m\\exit\033[0m to quit")
 		fmt.Println(strings.Repeat("-", 60))
 
+		// Warn about subagents whose dependencies are missing
+		planningAgent.Preflight()
+
 		var lastReport string
 
 		for {
@@ -129,20 +578,60 @@ Special commands:
 				continue
 			}
 
+			// Re-run one task of the last plan, e.g. "\retry report"
+			if arg, ok := strings.CutPrefix(input, "\\retry"); ok && (arg == "" || arg[0] == ' ') {
+				taskType := agent.TaskType(strings.ToUpper(strings.TrimSpace(arg)))
+				if taskType == "" {
+					fmt.Println("❌ Usage: \\retry <task type>, e.g. \\retry report")
+					continue
+				}
+				fmt.Printf("🔁 Retrying %s task...\n", taskType)
+
+				runCtx, _, stop := interruptible(ctx, planTimeout)
+				results, err := planningAgent.Retry(runCtx, taskType)
+				stop()
+				if err != nil {
+					printRunError(err)
+					continue
+				}
+				finalOutput := planningAgent.FinalOutput(results)
+				if taskType == agent.TaskTypeReport || taskType == agent.TaskTypeRender {
+					lastReport = finalOutput
+				}
+				fmt.Println("\n" + finalOutput)
+				continue
+			}
+
 			// Handle special commands
 			switch input {
 			case "\\help":
 				fmt.Println("\n📚 Available Commands:")
 				fmt.Println("  \\help    - Show this help message")
-				fmt.Println("  \\clear   - Clear conversation history")
+				fmt.Println("  \\clear   - Clear conversation history (\\clear context keeps the conversation and drops added context)")
+				fmt.Println("  \\compact - Summarize older turns to shrink the history")
 				fmt.Println("  \\podcast - Generate a podcast script from the last report")
+				fmt.Println("  \\retry   - Re-run one task of the last plan, e.g. \\retry report")
 				fmt.Println("  \\exit    - Exit the chat session")
 				fmt.Println("  \\quit    - Exit the chat session")
 				continue
-			case "\\clear":
+			case "\\clear", "\\clear all":
 				planningAgent.ClearHistory()
 				fmt.Println("✨ Conversation history cleared")
 				continue
+			case "\\clear context":
+				planningAgent.ClearContext()
+				fmt.Println("✨ Context instructions cleared, conversation kept")
+				continue
+			case "\\compact":
+				runCtx, _, stop := interruptible(ctx, planTimeout)
+				err := planningAgent.CompactHistory(runCtx)
+				stop()
+				if err != nil {
+					printRunError(err)
+					continue
+				}
+				fmt.Printf("✨ Conversation history compacted (%d messages)\n", len(planningAgent.History()))
+				continue
 			case "\\podcast":
 				if lastReport == "" {
 					fmt.Println("❌ No report available to convert to podcast. Please generate a report first.")
@@ -164,9 +653,11 @@ Special commands:
 					},
 				}
 
-				results, err := planningAgent.Execute(ctx, podcastPlan)
+				runCtx, _, stop := interruptible(ctx, planTimeout)
+				results, err := planningAgent.Execute(runCtx, podcastPlan)
+				stop()
 				if err != nil {
-					fmt.Printf("\n❌ Error: %v\n", err)
+					printRunError(err)
 					continue
 				}
 
@@ -184,34 +675,39 @@ Special commands:
 			// Add user message to history
 			planningAgent.AddUserMessage(input)
 
-			plan, err := planningAgent.PlanWithReview(ctx, input)
+			// Ctrl-C cancels planning and the plan run and returns to the prompt
+			runCtx, cancel, stop := interruptible(ctx, planTimeout)
+			plan, err := planningAgent.PlanWithReview(runCtx, input)
 			if err != nil {
-				fmt.Printf("\n❌ Error: %v\n", err)
+				stop()
+				printRunError(err)
 				continue
 			}
 
-			results, err := planningAgent.Execute(ctx, plan)
-			if err != nil {
-				fmt.Printf("\n❌ Error: %v\n", err)
-				continue
+			var results []agent.Result
+			execute := func() {
+				results, err = planningAgent.Execute(runCtx, plan)
 			}
-
-			// Extract final output
-			var finalOutput string
-			for i := len(results) - 1; i >= 0; i-- {
-				if (results[i].TaskType == agent.TaskTypeRender || results[i].TaskType == agent.TaskTypeReport) && results[i].Success {
-					finalOutput = results[i].Output
-					break
+			if liveOutput {
+				if viewErr := RunWithOutputView(interactionHandler, cancel, execute); viewErr != nil {
+					fmt.Printf("\n❌ Output view error: %v\n", viewErr)
 				}
+			} else {
+				execute()
 			}
-			if finalOutput == "" {
-				for _, result := range results {
-					if result.Success {
-						finalOutput += result.Output + "\n\n"
-					}
-				}
+			stop()
+			if errors.Is(err, agent.ErrBudgetExceeded) {
+				// Show what was produced before the budget ran out
+				fmt.Printf("\n⚠️  %v\n", err)
+			} else if err != nil {
+				printRunError(err)
+				continue
 			}
 
+			// Extract final output
+			output := planningAgent.Output(results)
+			finalOutput := output.Report
+
 			// Update lastReport if we have a valid output
 			if finalOutput != "" {
 				lastReport = finalOutput
@@ -226,6 +722,14 @@ Special commands:
 			}
 			fmt.Println(finalOutput)
 
+			if manifest {
+				if err := planningAgent.SaveManifest(output); err != nil {
+					fmt.Printf("\n⚠️  %v\n", err)
+				} else {
+					fmt.Printf("\n🗂️  Artifacts (%d): %s\n", len(output.Manifest.Artifacts), output.Manifest.Path)
+				}
+			}
+
 			// Podcast generation is now handled by the planner based on user request.
 			// We no longer automatically prompt for it here.
 		}
@@ -237,6 +741,63 @@ Special commands:
 	},
 }
 
+// cancelMessage is printed when Ctrl-C cancels the running command.
+const cancelMessage = "\n⏹️  正在取消当前任务... (再次按 Ctrl-C 退出)"
+
+// interruptible returns the context of one command of the chat loop. The
+// first Ctrl-C cancels it, aborting the running plan, and restores the
+// default handling so that a second Ctrl-C exits. cancel does the same for
+// views that receive Ctrl-C as a key press. A positive timeout also limits
+// the command. Call stop when the command returns.
+func interruptible(parent context.Context, timeout time.Duration) (ctx context.Context, cancel context.CancelFunc, stop func()) {
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	sigCtx, stopSignal := signal.NotifyContext(ctx, os.Interrupt)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigCtx.Done():
+			stopSignal()
+			if ctx.Err() == nil {
+				fmt.Println(cancelMessage)
+			}
+		case <-done:
+		}
+	}()
+
+	return sigCtx, cancel, func() {
+		close(done)
+		stopSignal()
+		cancel()
+	}
+}
+
+// printRunError reports the error of a command of the chat loop, telling
+// a cancellation or timeout apart from a failure.
+func printRunError(err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		fmt.Println("\n⏹️  已取消")
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Printf("\n⏱️  已超时: %v\n", err)
+	default:
+		var taskErr *agent.TaskError
+		if !errors.As(err, &taskErr) {
+			fmt.Printf("\n❌ Error: %v\n", err)
+			return
+		}
+		fmt.Printf("\n❌ Error (%s): %v\n", taskErr.Result.ErrorKind, err)
+		switch taskErr.Result.ErrorKind {
+		case agent.ErrRateLimit, agent.ErrAPI, agent.ErrTool:
+			fmt.Printf("💡 稍后可使用 \\retry %s 重试该任务\n", strings.ToLower(string(taskErr.Result.TaskType)))
+		}
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 func Execute() {
 	// Disable the default completion command
@@ -250,4 +811,79 @@ func Execute() {
 
 func init() {
 	config.SetupFlags(rootCmd)
+	rootCmd.Flags().String("config", "", "YAML file setting flags by name and system prompts under \"prompts\"; command line flags take precedence")
+	rootCmd.Flags().Bool("confirm-build", false, "Ask before running npm to build presentations")
+	rootCmd.Flags().Int("ppt-min-slides", 5, "Minimum number of slides per presentation")
+	rootCmd.Flags().Int("ppt-max-slides", 20, "Maximum number of slides per presentation")
+	rootCmd.Flags().Bool("ppt-source-zip", false, "Also pack the editable Slidev source of presentations as a zip")
+	rootCmd.Flags().Int("ppt-keep-projects", 0, "Number of newest presentation projects kept on disk (0 keeps all)")
+	rootCmd.Flags().Int("podcast-wpm", 150, "Speaking rate used to estimate podcast durations, in words per minute")
+	rootCmd.Flags().Int("max-report-context", 100000, "Summarize the report context in chunks first when it exceeds this many bytes (negative disables)")
+	rootCmd.Flags().Int("compact-threshold", 0, "Summarize older turns when the history exceeds this many estimated tokens (0 disables)")
+	rootCmd.Flags().Int("planner-history-limit", 0, "Give the planner the instructions and only the most recent requests of the conversation that fit in this many estimated tokens (0 for no limit)")
+	rootCmd.Flags().Bool("live-output", true, "Show a live view of progress and the streaming report")
+	rootCmd.Flags().Duration("plan-timeout", 0, "Cancel a request when planning and running its plan take longer than this (0 disables); Ctrl-C cancels it at any time")
+	rootCmd.Flags().Bool("search-guidance", false, "Ask for guidance between search reflection iterations")
+	rootCmd.Flags().Bool("checkpoints", false, "Pause for confirmation before PPT and podcast generation")
+	rootCmd.Flags().Bool("trace", false, "Record every model request and response of each task under generated/traces")
+	rootCmd.Flags().Int("plan-min-tasks", 0, "Minimum number of tasks in a plan, e.g. for deep research (0 for no minimum)")
+	rootCmd.Flags().Int("plan-max-tasks", 0, "Maximum number of tasks in a plan (0 for the planner's default of about 3-5)")
+	rootCmd.Flags().String("plan-guidance", "", "Extra planner instruction about how to decompose requests")
+	rootCmd.Flags().String("capabilities", "streaming", "Model API features to use: a comma separated list of json, tools, streaming and vision, \"none\", or \"auto\" to detect them")
+	rootCmd.Flags().Int("max-concurrent-api-calls", 0, "Maximum model API requests in flight at once (0 disables)")
+	rootCmd.Flags().Float64("max-cost", 0, "Stop a plan when its estimated cost would exceed this many US dollars (0 disables)")
+	rootCmd.Flags().String("fallback-model", "", "Model the planner switches to when the primary model fails twice")
+	rootCmd.Flags().StringSlice("ensemble-models", nil, "Models that analyze independently in ensemble ANALYZE tasks, e.g. gpt-4o,claude-3-5-sonnet (at least two)")
+	rootCmd.Flags().String("ensemble-synthesizer", "", "Model that reconciles the ensemble analyses (default the main model)")
+	rootCmd.Flags().Bool("ensemble", false, "Run every ANALYZE task as an ensemble instead of only those the planner marks")
+	rootCmd.Flags().StringSlice("include-domains", nil, "Only search these domains and their subdomains, e.g. wikipedia.org,*.gov")
+	rootCmd.Flags().StringSlice("exclude-domains", nil, "Never return search results from these domains")
+	rootCmd.Flags().String("wikipedia-language", "", "Wikipedia language code such as zh or en (default follows the query)")
+	rootCmd.Flags().Bool("no-web-search", false, "Run offline: plan without SEARCH tasks and never call a search API")
+	rootCmd.Flags().String("http-proxy", os.Getenv("AGENT_HTTP_PROXY"), "Proxy URL for search and Wikipedia requests (default from AGENT_HTTP_PROXY, else HTTPS_PROXY)")
+	rootCmd.Flags().String("user-agent", os.Getenv("AGENT_USER_AGENT"), "User-Agent of search and Wikipedia requests (default from AGENT_USER_AGENT)")
+	rootCmd.Flags().Bool("no-wikipedia", false, "Skip the Wikipedia lookup of searches unless the plan asks for it")
+	rootCmd.Flags().StringSlice("knowledge", nil, "Files or directories (.md, .txt) to index as a knowledge base searched by RETRIEVE tasks")
+	rootCmd.Flags().Int("knowledge-top-k", 0, "Number of knowledge base chunks retrieved per query (default 4)")
+	rootCmd.Flags().String("embedding-model", "", "Embedding model used to index the knowledge base (default text-embedding-3-small)")
+	rootCmd.Flags().Bool("no-search-rephrase", false, "Do not retry searches that found nothing with a rephrased query")
+	rootCmd.Flags().StringSlice("search-providers", nil, "Search providers to try in order: tavily, duckduckgo (default tavily,duckduckgo)")
+	rootCmd.Flags().Int("search-breaker-threshold", 3, "Skip a search provider after this many consecutive failures (negative disables)")
+	rootCmd.Flags().Duration("search-breaker-cooldown", time.Minute, "How long to skip a failing search provider")
+	rootCmd.Flags().Float64("search-min-novelty", 0, "Stop search reflection when a follow-up search adds less than this fraction of new content (default 0.2, negative disables)")
+	rootCmd.Flags().Float64("search-min-relevance", 0, "Drop search results scored below this relevance to the query, from 0 to 1, before they reach the report (0 disables)")
+	rootCmd.Flags().Bool("heuristic-relevance", false, "Score search relevance by matching query terms instead of asking the model")
+	rootCmd.Flags().String("reflection-model", "", "Model for the search reflection and query rephrasing steps (default: --model)")
+	rootCmd.Flags().String("smtp-host", "", "SMTP server for sending reports by email (password from SMTP_PASSWORD)")
+	rootCmd.Flags().Int("smtp-port", 587, "SMTP server port")
+	rootCmd.Flags().String("smtp-user", "", "SMTP user name")
+	rootCmd.Flags().String("smtp-from", "", "Sender address of report emails (default the SMTP user)")
+	rootCmd.Flags().String("final-format", "term", "Format of the final report: term, markdown (raw, e.g. for piping) or none")
+	rootCmd.Flags().Int("render-width", 0, "Line width of the rendered report (default the terminal width, or 80)")
+	rootCmd.Flags().Int("render-left-pad", 6, "Indentation of the rendered report")
+	rootCmd.Flags().Bool("no-color", false, "Render the report without ANSI colors (default when the output is not a terminal or NO_COLOR is set)")
+	rootCmd.Flags().Bool("manifest", false, "Save the report, podcast script and a manifest.json listing every artifact of each run under <output>/runs")
+	rootCmd.Flags().String("conversation-context", "all", "Conversation messages given to the planner and subagents as context: all (instructions and earlier requests), instructions or none")
+	rootCmd.Flags().String("report-rule", "auto", "Fix plans whose PPT, PODCAST or RENDER tasks have no REPORT before them: auto (move or insert a REPORT), reorder (only move one) or off")
+	rootCmd.Flags().String("output-strategy", "prefer-render", "Final output of a run: prefer-render, prefer-report (the markdown) or concatenate-all")
+	rootCmd.Flags().String("language", "", "Output language such as English, or \"auto\" to follow the request (default Chinese)")
+}
+
+// terminalRenderConfig returns the layout of the rendered report. A zero
+// width follows the terminal, and colors are only kept for a terminal.
+func terminalRenderConfig(width, leftPad int, noColor bool) agent.RenderConfig {
+	tty := isatty.IsTerminal(os.Stdout.Fd())
+	if width <= 0 && tty {
+		if w, _, err := term.GetSize(os.Stdout.Fd()); err == nil && w > 0 {
+			width = w
+		}
+	}
+	if width <= 0 {
+		width = agent.DefaultRenderConfig.Width
+	}
+	return agent.RenderConfig{
+		Width:   width,
+		LeftPad: leftPad,
+		Color:   !noColor && tty && os.Getenv("NO_COLOR") == "",
+	}
 }
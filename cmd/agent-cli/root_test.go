@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestFormatDetails(t *testing.T) {
+	details := map[string]interface{}{
+		"command":   "npm install",
+		"directory": "generated/slides",
+		"attempts":  2,
+		"task_type": "PPT",
+	}
+	want := "  attempts: 2\n  command: npm install\n  directory: generated/slides\n  task_type: PPT\n"
+	for i := 0; i < 10; i++ {
+		if got := formatDetails(details); got != want {
+			t.Fatalf("formatDetails() = %q, want %q", got, want)
+		}
+	}
+	if got := formatDetails(nil); got != "" {
+		t.Errorf("expected no lines without details, got %q", got)
+	}
+}
+
+func TestConfirmAction(t *testing.T) {
+	tests := map[string]bool{
+		"y\n":   true,
+		"YES\n": true,
+		"n\n":   false,
+		"\n":    false,
+		"":      false,
+	}
+	for input, want := range tests {
+		h := NewCLIInteractionHandler(bufio.NewScanner(strings.NewReader(input)))
+		got, err := h.ConfirmAction("Install npm packages", map[string]interface{}{"command": "npm install"})
+		if err != nil || got != want {
+			t.Errorf("ConfirmAction with %q = %v, %v, want %v", input, got, err, want)
+		}
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
@@ -95,3 +98,194 @@ func GetInput(prompt string) (string, error) {
 
 	return "", fmt.Errorf("could not assert model")
 }
+
+// Messages sent to the output view while a plan runs.
+type (
+	outputLogMsg   string
+	outputDeltaMsg string
+	outputDoneMsg  struct{}
+	// outputBatchMsg carries the messages queued while the view was busy,
+	// applied with a single refresh.
+	outputBatchMsg []tea.Msg
+)
+
+// outputQueue forwards messages to the live view from its own goroutine,
+// so a view that is slow to render never blocks the agent. Messages queued
+// while a send is in flight are delivered together as one batch.
+type outputQueue struct {
+	send     func(tea.Msg)
+	mu       sync.Mutex
+	pending  []tea.Msg
+	wake     chan struct{}
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+func newOutputQueue(send func(tea.Msg)) *outputQueue {
+	q := &outputQueue{
+		send:     send,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues msg without blocking.
+func (q *outputQueue) push(msg tea.Msg) {
+	q.mu.Lock()
+	q.pending = append(q.pending, msg)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close delivers the queued messages and stops the queue.
+func (q *outputQueue) close() {
+	close(q.stop)
+	<-q.finished
+}
+
+func (q *outputQueue) run() {
+	defer close(q.finished)
+	for {
+		select {
+		case <-q.wake:
+			q.flush()
+		case <-q.stop:
+			q.flush()
+			return
+		}
+	}
+}
+
+// flush sends the queued messages as one batch.
+func (q *outputQueue) flush() {
+	q.mu.Lock()
+	batch := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	if len(batch) > 0 {
+		q.send(outputBatchMsg(batch))
+	}
+}
+
+// outputModel is a scrolling live view of the agent logs and the report as it streams in.
+type outputModel struct {
+	viewport viewport.Model
+	logs     []string
+	report   strings.Builder
+	ready    bool
+	quitting bool
+	// cancel aborts the run on Ctrl-C, which the view receives as a key
+	// press rather than SIGINT
+	cancel    func()
+	cancelled bool
+}
+
+func (m *outputModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *outputModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		height := msg.Height - 2 // header line and newline
+		if !m.ready {
+			m.viewport = viewport.New(msg.Width, height)
+			m.ready = true
+		} else {
+			m.viewport.Width = msg.Width
+			m.viewport.Height = height
+		}
+		m.refresh()
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyCtrlC {
+			// Cancel the plan and hide the view until it stops
+			if m.cancel != nil {
+				m.cancel()
+				m.cancelled = true
+			}
+			m.quitting = true
+			return m, tea.Quit
+		}
+	case outputBatchMsg:
+		for _, msg := range msg {
+			switch msg := msg.(type) {
+			case outputLogMsg:
+				m.logs = append(m.logs, string(msg))
+			case outputDeltaMsg:
+				m.report.WriteString(string(msg))
+			}
+		}
+		m.refresh()
+	case outputDoneMsg:
+		m.quitting = true
+		return m, tea.Quit
+	}
+
+	var cmd tea.Cmd
+	m.viewport, cmd = m.viewport.Update(msg)
+	return m, cmd
+}
+
+// refresh updates the viewport content, following the output if it was scrolled to the bottom.
+func (m *outputModel) refresh() {
+	if !m.ready {
+		return
+	}
+	follow := m.viewport.AtBottom()
+
+	content := strings.Join(m.logs, "\n")
+	if m.report.Len() > 0 {
+		content += "\n\n📄 Report:\n" + m.report.String()
+	}
+	m.viewport.SetContent(lipgloss.NewStyle().Width(m.viewport.Width).Render(content))
+
+	if follow {
+		m.viewport.GotoBottom()
+	}
+}
+
+func (m *outputModel) View() string {
+	if m.quitting {
+		return ""
+	}
+	if !m.ready {
+		return "⏳ Running..."
+	}
+	header := lipgloss.NewStyle().Foreground(lipgloss.Color("62")).Render("⏳ Running... (↑/↓ to scroll, ctrl+c to cancel)")
+	return header + "\n" + m.viewport.View()
+}
+
+// RunWithOutputView runs fn while showing its logs and streamed report in a
+// live view. The handler forwards its output to the view until fn returns.
+// Ctrl-C in the view calls cancel, which should make fn return.
+func RunWithOutputView(h *CLIInteractionHandler, cancel func(), fn func()) error {
+	m := &outputModel{cancel: cancel}
+	p := tea.NewProgram(m)
+	h.attach(p)
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		fn()
+		h.detach()
+		p.Send(outputDoneMsg{})
+	}()
+
+	_, err := p.Run()
+	if err != nil {
+		h.detach()
+	}
+	if m.cancelled {
+		fmt.Println(cancelMessage)
+	}
+	<-finished
+	return err
+}
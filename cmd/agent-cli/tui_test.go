@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestOutputQueueStalledView(t *testing.T) {
+	// A view that does not take messages until released
+	release := make(chan struct{})
+	var batches []outputBatchMsg
+	q := newOutputQueue(func(msg tea.Msg) {
+		<-release
+		batches = append(batches, msg.(outputBatchMsg))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			q.push(outputLogMsg(fmt.Sprintf("log %d", i)))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push blocked on a stalled view")
+	}
+
+	close(release)
+	q.close()
+
+	var got []tea.Msg
+	for _, batch := range batches {
+		got = append(got, batch...)
+	}
+	if len(got) != 1000 {
+		t.Fatalf("expected every message to be delivered, got %d", len(got))
+	}
+	for i, msg := range got {
+		if want := outputLogMsg(fmt.Sprintf("log %d", i)); msg != want {
+			t.Fatalf("message %d is %q, want %q", i, msg, want)
+		}
+	}
+	if len(batches) > 3 {
+		t.Errorf("expected the stalled messages to be batched, got %d batches", len(batches))
+	}
+}
+
+func TestOutputModelCtrlC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &outputModel{cancel: cancel}
+
+	_, cmd := m.Update(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if ctx.Err() == nil {
+		t.Error("expected Ctrl-C to cancel the run")
+	}
+	if cmd == nil || cmd() != tea.Quit() || !m.cancelled || m.View() != "" {
+		t.Error("expected Ctrl-C to hide the view")
+	}
+}
+
+func TestInterruptible(t *testing.T) {
+	ctx, cancel, stop := interruptible(context.Background(), 0)
+	defer stop()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a timeout")
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("expected cancel to cancel the command")
+	}
+
+	ctx, _, stop = interruptible(context.Background(), time.Hour)
+	defer stop()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("expected the timeout to set a deadline")
+	}
+}
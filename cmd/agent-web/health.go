@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/smallnest/aiagents/agent"
+)
+
+// readyCheckTimeout bounds a single readiness probe of the model endpoint.
+const readyCheckTimeout = 10 * time.Second
+
+// readinessChecker caches the result of a readiness probe for ttl, so that
+// frequent /readyz requests cost at most one API call per ttl.
+type readinessChecker struct {
+	ttl   time.Duration
+	check func(ctx context.Context) error
+
+	mu        sync.Mutex // held during a probe so concurrent requests share it
+	checkedAt time.Time
+	err       error
+}
+
+func newReadinessChecker(ttl time.Duration, check func(ctx context.Context) error) *readinessChecker {
+	return &readinessChecker{ttl: ttl, check: check}
+}
+
+// Check returns the cached result, probing again when it is older than ttl.
+func (c *readinessChecker) Check(ctx context.Context) (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.checkedAt.IsZero() || time.Since(c.checkedAt) >= c.ttl {
+		probeCtx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+		c.err = c.check(probeCtx)
+		cancel()
+		c.checkedAt = time.Now()
+	}
+	return c.checkedAt, c.err
+}
+
+// pingModel returns a probe that checks the configured API is reachable and
+// the key is accepted. It lists the models, falling back to a one-token
+// completion for endpoints that do not implement the models API.
+func pingModel(config agent.AgentConfig) func(ctx context.Context) error {
+	openaiConfig := openai.DefaultConfig(config.APIKey)
+	if config.APIBase != "" {
+		openaiConfig.BaseURL = config.APIBase
+	}
+	client := openai.NewClientWithConfig(openaiConfig)
+	model := config.Model
+	if model == "" {
+		model = "gpt-4o"
+	}
+
+	return func(ctx context.Context) error {
+		_, err := client.ListModels(ctx)
+		if !isNotImplemented(err) {
+			return err
+		}
+
+		_, err = client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model:     model,
+			Messages:  []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ping"}},
+			MaxTokens: 1,
+		})
+		return err
+	}
+}
+
+// isNotImplemented reports whether err is an HTTP 404 or 405 from the API.
+func isNotImplemented(err error) bool {
+	status := 0
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	if errors.As(err, &apiErr) {
+		status = apiErr.HTTPStatusCode
+	} else if errors.As(err, &reqErr) {
+		status = reqErr.HTTPStatusCode
+	}
+	return status == http.StatusNotFound || status == http.StatusMethodNotAllowed
+}
+
+// handleHealthz reports that the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler reports whether the model endpoint is reachable, answering
+// 503 with the error when it is not.
+func readyzHandler(checker *readinessChecker, model string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkedAt, err := checker.Check(r.Context())
+
+		status := map[string]interface{}{
+			"ready":      err == nil,
+			"model":      model,
+			"checked_at": checkedAt,
+		}
+		code := http.StatusOK
+		if err != nil {
+			status["error"] = err.Error()
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestReadinessCheckerCaches(t *testing.T) {
+	var calls atomic.Int32
+	fail := errors.New("unreachable")
+	checker := newReadinessChecker(time.Hour, func(ctx context.Context) error {
+		calls.Add(1)
+		return fail
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := checker.Check(context.Background()); !errors.Is(err, fail) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected one probe within the TTL, got %d", got)
+	}
+
+	checker.ttl = 0
+	checker.Check(context.Background())
+	if got := calls.Load(); got != 2 {
+		t.Errorf("expected a new probe after the TTL, got %d", got)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	var modelsStatus atomic.Int32
+	modelsStatus.Store(http.StatusOK)
+	var completions atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/models":
+			w.WriteHeader(int(modelsStatus.Load()))
+			w.Write([]byte(`{"object": "list", "data": []}`))
+		case "/chat/completions":
+			completions.Add(1)
+			w.Write([]byte(`{"object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "p"}}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	config := agent.AgentConfig{APIKey: "test", APIBase: api.URL, Model: "m"}
+	get := func() (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handler := readyzHandler(newReadinessChecker(0, pingModel(config)), config.Model)
+		handler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body
+	}
+
+	if code, body := get(); code != http.StatusOK || body["ready"] != true {
+		t.Errorf("expected ready, got %d %v", code, body)
+	}
+
+	// Endpoints without a models API fall back to a tiny completion
+	modelsStatus.Store(http.StatusNotFound)
+	if code, body := get(); code != http.StatusOK || completions.Load() != 1 {
+		t.Errorf("expected ready via completion fallback, got %d %v", code, body)
+	}
+
+	// A rejected key makes the server not ready
+	modelsStatus.Store(http.StatusUnauthorized)
+	if code, body := get(); code != http.StatusServiceUnavailable || body["ready"] != false || body["error"] == "" {
+		t.Errorf("expected not ready, got %d %v", code, body)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// idempotencyKeyTTL is how long the key of a completed /api/chat request is
+// remembered. Keys of running plans are kept until they finish.
+const idempotencyKeyTTL = 10 * time.Minute
+
+// ClaimKey records an idempotency key for a new request and reports whether
+// it is new. It returns false for a key whose plan is still running or
+// finished less than idempotencyKeyTTL ago. An empty key is always new.
+func (s *Session) ClaimKey(key string) bool {
+	if key == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired keys; a zero time marks a running plan
+	for k, finished := range s.keys {
+		if !finished.IsZero() && time.Since(finished) > idempotencyKeyTTL {
+			delete(s.keys, k)
+		}
+	}
+	if _, ok := s.keys[key]; ok {
+		return false
+	}
+	if s.keys == nil {
+		s.keys = make(map[string]time.Time)
+	}
+	s.keys[key] = time.Time{}
+	return true
+}
+
+// ReleaseKey forgets a claimed key whose request was rejected, so that it
+// can be retried.
+func (s *Session) ReleaseKey(key string) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
+
+// finishKey starts the TTL of the running plan's key. s.mu must be held.
+func (s *Session) finishKey() {
+	if _, ok := s.keys[s.runningKey]; ok {
+		s.keys[s.runningKey] = time.Now()
+	}
+	s.runningKey = ""
+}
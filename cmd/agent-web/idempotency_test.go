@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	s := &Session{}
+
+	if !s.ClaimKey("a") || !s.TryStart("a") {
+		t.Fatal("first request should start a plan")
+	}
+	if s.ClaimKey("a") {
+		t.Error("a resend while the plan runs should be a duplicate")
+	}
+
+	// A different request is rejected while the plan runs and can retry later
+	if !s.ClaimKey("b") {
+		t.Fatal("a new key should be claimed")
+	}
+	if s.TryStart("b") {
+		t.Fatal("expected the running plan to block a second one")
+	}
+	s.ReleaseKey("b")
+
+	s.Finish()
+	if s.ClaimKey("a") {
+		t.Error("a resend after the plan finished should be a duplicate")
+	}
+	if !s.ClaimKey("b") {
+		t.Error("a released key should be claimable again")
+	}
+
+	// Completed keys expire after the TTL
+	s.keys["a"] = time.Now().Add(-idempotencyKeyTTL - time.Second)
+	if !s.ClaimKey("a") {
+		t.Error("an expired key should be claimable again")
+	}
+
+	if !s.ClaimKey("") || !s.ClaimKey("") {
+		t.Error("requests without a key are never duplicates")
+	}
+}
@@ -2,18 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/smallnest/goskills/agent"
+	"github.com/smallnest/aiagents/agent"
+	"github.com/smallnest/aiagents/configfile"
+	"github.com/smallnest/aiagents/tool"
 	"github.com/spf13/cobra"
 )
 
@@ -21,6 +30,8 @@ import (
 var uiAssets embed.FS
 
 var (
+	configPath string
+
 	apiKey  string
 	apiBase string
 	model   string
@@ -28,47 +39,198 @@ var (
 	verbose bool
 	ppt     bool
 	podcast bool
+
+	fallbackModel    string
+	ensembleModels   []string
+	ensembleSynth    string
+	ensembleAll      bool
+	maxCost          float64
+	maxAPICalls      int
+	trace            bool
+	capabilities     string
+	planMinTasks     int
+	planMaxTasks     int
+	planGuidance     string
+	pptImageGen      bool
+	pptMinSlides     int
+	pptMaxSlides     int
+	pptSourceZip     bool
+	pptKeepProjects  int
+	pptPreview       bool
+	podcastWPM       int
+	checkpoints      bool
+	htmlFragment     bool
+	maxRenderBytes   int
+	language         string
+	finalFormat      string
+	outputStrategy   string
+	manifest         bool
+	reportRule       string
+	contextMode      string
+	includeDomains   []string
+	excludeDomains   []string
+	wikipediaLang    string
+	noWikipedia      bool
+	noWebSearch      bool
+	httpProxy        string
+	userAgent        string
+	noRephrase       bool
+	searchProviders  []string
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	reflectionModel  string
+	minNovelty       float64
+	minRelevance     float64
+	termRelevance    bool
+	knowledge        []string
+	knowledgeTopK    int
+	embeddingModel   string
+	smtpHost         string
+	smtpPort         int
+	smtpUser         string
+	smtpPassword     string
+	smtpFrom         string
+	searchGuidance   bool
+	compactThreshold int
+	plannerHistory   int
+	maxReportContext int
+
+	authToken  string
+	authStatic bool
+
+	rateLimit float64
+	rateBurst int
+
+	shutdownTimeout time.Duration
+	sessionsDir     string
+	plansDir        string
+	readyCacheTTL   time.Duration
+
+	autoApprove bool
+)
+
+const (
+	// eventBufferSize is the number of events queued for each SSE stream.
+	eventBufferSize = 100
+	// maxSessionEvents caps the events kept in memory (and saved) per session.
+	maxSessionEvents = 5000
 )
 
 // WebInteractionHandler implements agent.InteractionHandler for the web interface.
 type WebInteractionHandler struct {
-	eventChan    chan Event
+	subscribers  map[chan Event]struct{} // SSE streams watching the session
 	responseChan chan string
 	events       []Event
 	mu           sync.Mutex
 	sessionID    string
 	userRequest  string
+	turn         int             // number of requests in this session, used in the file name
+	planCtx      context.Context // context of the running plan, set by Session.Start
+	store        SessionStore    // where SaveSession writes the events; nil disables saving
+	appendedID   string          // store ID of the turn being appended
+	appendFailed bool            // an Append failed and was logged
+	autoApprove  bool            // approve plans without waiting for the user
 }
 
 type Event struct {
-	Type      string      `json:"type"`
-	Content   string      `json:"content,omitempty"`
-	Plan      *agent.Plan `json:"plan,omitempty"`
-	Podcast   interface{} `json:"podcast,omitempty"`
-	PPT       string      `json:"ppt,omitempty"`
-	Timestamp time.Time   `json:"timestamp"`
+	Type      string               `json:"type"`
+	Content   string               `json:"content,omitempty"`
+	Plan      *agent.Plan          `json:"plan,omitempty"`
+	Podcast   []agent.DialogueLine `json:"podcast,omitempty"`
+	PPT       string               `json:"ppt,omitempty"`
+	PPTSource string               `json:"ppt_source,omitempty"`
+	More      []string             `json:"more,omitempty"`       // report pages after the first
+	Format    agent.FinalFormat    `json:"format,omitempty"`     // format of a response; empty means HTML
+	HTML      string               `json:"html,omitempty"`       // markdown response rendered safely for display
+	Manifest  *agent.Manifest      `json:"manifest,omitempty"`   // files produced by the run of a response
+	Task      agent.TaskType       `json:"task,omitempty"`       // task of a heartbeat
+	Elapsed   float64              `json:"elapsed,omitempty"`    // seconds since the call of a heartbeat started
+	Slide     *agent.Slide         `json:"slide,omitempty"`      // previewed slide of a slide event
+	Number    int                  `json:"number,omitempty"`     // position of a previewed slide, from 1
+	ErrorKind agent.ErrorKind      `json:"error_kind,omitempty"` // kind of the failure of an error event
+	Timestamp time.Time            `json:"timestamp"`
+}
+
+// responseEvent returns the response event of a finished run. Markdown
+// reports are also rendered by the server, so the browser never inserts
+// HTML written by the model or found on the web; their remaining pages are
+// sent rendered.
+func responseEvent(output *agent.RunOutput, format agent.FinalFormat) Event {
+	var more []string
+	if len(output.ReportPages) > 1 {
+		more = output.ReportPages[1:]
+	}
+	event := Event{
+		Type:      "response",
+		Content:   output.Report,
+		Podcast:   output.PodcastScript,
+		PPT:       output.PPTUrl,
+		PPTSource: output.PPTSourceZip,
+		More:      more,
+		Format:    format,
+		Manifest:  output.Manifest,
+	}
+	if format == agent.FinalFormatMarkdown {
+		event.HTML = agent.RenderMarkdownSafeHTML(output.Report)
+		event.More = make([]string, len(more))
+		for i, page := range more {
+			event.More[i] = agent.RenderMarkdownSafeHTML(page)
+		}
+	}
+	return event
 }
 
-func NewWebInteractionHandler(sessionID, userRequest string) *WebInteractionHandler {
+func NewWebInteractionHandler(sessionID, userRequest string, store SessionStore) *WebInteractionHandler {
 	return &WebInteractionHandler{
-		eventChan:    make(chan Event, 100),
+		subscribers:  make(map[chan Event]struct{}),
 		responseChan: make(chan string),
 		events:       make([]Event, 0),
 		sessionID:    sessionID,
 		userRequest:  userRequest,
+		store:        store,
 	}
 }
 
 func (h *WebInteractionHandler) ReviewPlan(plan *agent.Plan) (string, error) {
+	h.mu.Lock()
+	auto := h.autoApprove
+	h.mu.Unlock()
+	if auto {
+		// Show the plan but approve it right away, like podcasts
+		h.Broadcast(Event{
+			Type: "plan",
+			Plan: plan,
+		})
+		return "", nil
+	}
+
 	event := Event{
 		Type:      "plan_review",
 		Plan:      plan,
 		Timestamp: time.Now(),
 	}
 	h.Broadcast(event)
-	// Wait for user response
-	response := <-h.responseChan
-	return response, nil
+
+	ctx := h.context()
+
+	// Wait for user response, unless the plan is stopped
+	select {
+	case response := <-h.responseChan:
+		return response, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// context returns the context of the running plan, used to stop waiting
+// for user responses when the plan is cancelled.
+func (h *WebInteractionHandler) context() context.Context {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.planCtx == nil {
+		return context.Background()
+	}
+	return h.planCtx
 }
 
 func (h *WebInteractionHandler) ConfirmPodcastGeneration(report string) (bool, error) {
@@ -76,6 +238,48 @@ func (h *WebInteractionHandler) ConfirmPodcastGeneration(report string) (bool, e
 	return true, nil
 }
 
+func (h *WebInteractionHandler) ConfirmAction(description string, details map[string]interface{}) (bool, error) {
+	// Auto-approve for web interface, except plan checkpoints
+	if checkpoint, _ := details["checkpoint"].(bool); !checkpoint {
+		return true, nil
+	}
+
+	h.Broadcast(Event{
+		Type:      "checkpoint",
+		Content:   description,
+		Timestamp: time.Now(),
+	})
+
+	ctx := h.context()
+
+	// Wait for the user to continue or stop
+	select {
+	case response := <-h.responseChan:
+		return response != "stop", nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (h *WebInteractionHandler) RequestGuidance(context string) (string, bool) {
+	h.Broadcast(Event{
+		Type:      "guidance",
+		Content:   context,
+		Timestamp: time.Now(),
+	})
+
+	ctx := h.context()
+
+	// Wait for guidance; an empty response lets the search continue
+	select {
+	case response := <-h.responseChan:
+		response = strings.TrimSpace(response)
+		return response, response != ""
+	case <-ctx.Done():
+		return "", false
+	}
+}
+
 func (h *WebInteractionHandler) Log(message string) {
 	h.Broadcast(Event{
 		Type:      "log",
@@ -84,6 +288,36 @@ func (h *WebInteractionHandler) Log(message string) {
 	})
 }
 
+// Heartbeat sends a heartbeat event to the viewers of the session. Unlike
+// Broadcast it does not record the event, so heartbeats are neither saved
+// nor replayed.
+func (h *WebInteractionHandler) Heartbeat(taskType agent.TaskType, activity string, elapsed time.Duration) {
+	event := Event{
+		Type:      "heartbeat",
+		Content:   activity,
+		Task:      taskType,
+		Elapsed:   elapsed.Seconds(),
+		Timestamp: time.Now(),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		send(ch, event)
+	}
+}
+
+// PreviewSlide sends a generated slide to the viewers of the session before
+// the presentation is built.
+func (h *WebInteractionHandler) PreviewSlide(number int, slide agent.Slide) {
+	h.Broadcast(Event{
+		Type:      "slide",
+		Slide:     &slide,
+		Number:    number,
+		Timestamp: time.Now(),
+	})
+}
+
 func (h *WebInteractionHandler) Broadcast(event Event) {
 	if event.Timestamp.IsZero() {
 		event.Timestamp = time.Now()
@@ -91,72 +325,270 @@ func (h *WebInteractionHandler) Broadcast(event Event) {
 
 	h.mu.Lock()
 	h.events = append(h.events, event)
+	if len(h.events) > maxSessionEvents {
+		h.events = h.events[len(h.events)-maxSessionEvents:]
+	}
+	for ch := range h.subscribers {
+		send(ch, event)
+	}
+	h.appendEvent(event)
 	h.mu.Unlock()
 
-	h.eventChan <- event
-
 	if event.Type == "done" {
 		h.SaveSession()
 	}
 }
 
-func (h *WebInteractionHandler) SaveSession() {
+// Subscribe registers a viewer of the session. It returns the events
+// broadcast so far, so the viewer can catch up, and a channel that receives
+// every later event. Call unsubscribe when the viewer disconnects.
+func (h *WebInteractionHandler) Subscribe() (backlog []Event, events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, eventBufferSize)
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.subscribers[ch] = struct{}{}
+	backlog = append([]Event(nil), h.events...)
+
+	return backlog, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers, ch)
+	}
+}
 
-	if len(h.events) == 0 {
+// send queues event for an SSE stream without blocking. When the buffer is
+// full because the client is slow, the oldest event is dropped.
+func send(ch chan Event, event Event) {
+	for {
+		select {
+		case ch <- event:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// appendEvent records event in the store's append log, if it has one, so
+// the session survives a crash before SaveSession. The log of a new turn
+// starts with the events of the earlier turns, like the saved session. The
+// caller holds h.mu, which keeps the events in order.
+func (h *WebInteractionHandler) appendEvent(event Event) {
+	appender, ok := h.store.(SessionAppender)
+	if !ok || !h.saved() {
 		return
 	}
 
-	// Do not save session if request is /clear
-	if strings.TrimSpace(h.userRequest) == "/clear" {
+	id := h.storeID()
+	events := []Event{event}
+	if id != h.appendedID {
+		h.appendedID = id
+		events = h.events // already ends with event
+	}
+	var err error
+	for _, e := range events {
+		var data []byte
+		if data, err = json.Marshal(e); err == nil {
+			err = appender.Append(id, data)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil && !h.appendFailed {
+		h.appendFailed = true
+		log.Printf("Failed to append session event: %v", err)
+	}
+}
+
+// SaveSession writes all events of the session to the store, replacing the
+// events appended so far.
+func (h *WebInteractionHandler) SaveSession() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.events) == 0 || h.store == nil || !h.saved() {
 		return
 	}
 
-	// Create sessions directory if not exists
-	if err := os.MkdirAll("sessions", 0755); err != nil {
-		log.Printf("Failed to create sessions directory: %v", err)
+	data, err := json.MarshalIndent(h.events, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode session: %v", err)
 		return
 	}
 
+	if err := h.store.Save(h.storeID(), data); err != nil {
+		log.Printf("Failed to save session: %v", err)
+	}
+}
+
+// saved reports whether the session is stored. The caller holds h.mu.
+func (h *WebInteractionHandler) saved() bool {
+	// Do not save session if request is a command such as /clear
+	return h.store != nil && !isCommand(h.userRequest)
+}
+
+// webHelp lists the commands of the chat box, answered to /help.
+const webHelp = `可用命令:
+  /help           显示此帮助
+  /clear          清除对话历史
+  /clear context  仅清除以 \ 添加的上下文指令，保留对话
+  \<指令>         添加上下文指令，不执行计划`
+
+// isCommand reports whether message is a command run by runCommand.
+func isCommand(message string) bool {
+	_, clear := clearCommand(message)
+	return clear || strings.TrimSpace(message) == "/help"
+}
+
+// runCommand runs message if it is a command, /help or a clear command,
+// broadcasting its outcome as a command event followed by done, and
+// reports whether it was one.
+func runCommand(planningAgent *agent.PlanningAgent, handler *WebInteractionHandler, message string) bool {
+	content, ok := applyCommand(planningAgent, message)
+	if !ok {
+		return false
+	}
+	handler.Broadcast(Event{
+		Type:    "command",
+		Content: content,
+	})
+	handler.Broadcast(Event{
+		Type: "done",
+	})
+	return true
+}
+
+// applyCommand runs message if it is a command and returns its outcome.
+func applyCommand(planningAgent *agent.PlanningAgent, message string) (string, bool) {
+	if scope, ok := clearCommand(message); ok {
+		if scope == "context" {
+			planningAgent.ClearContext()
+			return "✨ 已清除上下文指令，保留对话", true
+		}
+		planningAgent.ClearHistory()
+		return "✨ 已清除对话历史", true
+	}
+	if strings.TrimSpace(message) == "/help" {
+		return webHelp, true
+	}
+	return "", false
+}
+
+// addDirectMessage adds message to the context of the agent if it is a
+// direct chat message, starting with a backslash, and reports whether it
+// was one.
+func addDirectMessage(planningAgent *agent.PlanningAgent, handler *WebInteractionHandler, message string) bool {
+	msg, ok := strings.CutPrefix(message, "\\")
+	if !ok {
+		return false
+	}
+	planningAgent.AddDeveloperMessage(msg)
+
+	// Log user request
+	handler.Broadcast(Event{
+		Type:    "log",
+		Content: fmt.Sprintf("> User Request: %s", msg),
+	})
+	return true
+}
+
+// runAside runs message if it is a command or a direct chat message, which
+// need not wait for the running plan of session, and reports whether it was
+// one. Unlike runCommand it leaves the done event to the plan.
+func runAside(session *Session, message string) bool {
+	if !isCommand(message) && !strings.HasPrefix(message, "\\") {
+		return false
+	}
+	session.Handler.Broadcast(Event{
+		Type:    "request",
+		Content: message,
+	})
+	if content, ok := applyCommand(session.Agent, message); ok {
+		session.Handler.Broadcast(Event{
+			Type:    "command",
+			Content: content,
+		})
+	} else {
+		addDirectMessage(session.Agent, session.Handler, message)
+	}
+	return true
+}
+
+// clearCommand reports whether message is a clear command, "/clear" or
+// "/clear all" to clear the history and "/clear context" to drop only the
+// context messages, and returns its scope.
+func clearCommand(message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || fields[0] != "/clear" || len(fields) > 2 {
+		return "", false
+	}
+	if len(fields) == 1 {
+		return "all", true
+	}
+	if fields[1] != "all" && fields[1] != "context" {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// storeID returns the ID of the current turn in the store. The caller
+// holds h.mu.
+func (h *WebInteractionHandler) storeID() string {
+	return strings.TrimSuffix(sessionFilename(h.userRequest, h.sessionID, h.turn), ".json")
+}
+
+// sessionFilename returns the file name for a turn of a session. The session
+// ID and turn index keep it unique even when requests share the same prefix.
+func sessionFilename(userRequest, sessionID string, turn int) string {
 	// Sanitize user request for filename
-	safeRequest := sanitizeFilename(h.userRequest)
+	safeRequest := sanitizeFilename(userRequest)
 
 	// Truncate to first 50 chars (rune-aware)
 	runes := []rune(safeRequest)
 	if len(runes) > 50 {
-		safeRequest = string(runes[:50])
+		safeRequest = sanitizeFilename(string(runes[:50]))
 	}
 
 	// Ensure filename is not empty
 	if safeRequest == "" {
-		safeRequest = h.sessionID
+		safeRequest = "session"
 	}
 
-	// Append session ID to ensure uniqueness
-	filename := fmt.Sprintf("sessions/%s-%s.json", safeRequest, h.sessionID)
-
-	file, err := os.Create(filename)
-	if err != nil {
-		log.Printf("Failed to create session file: %v", err)
-		return
-	}
-	defer file.Close()
+	return fmt.Sprintf("%s-%s-%d.json", safeRequest, sanitizeFilename(sessionID), turn)
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(h.events); err != nil {
-		log.Printf("Failed to save session: %v", err)
-	}
+// windowsReserved are device names that cannot be used as file names on Windows.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
 }
 
+// sanitizeFilename makes name safe to use as a file name on Linux, macOS and Windows.
 func sanitizeFilename(name string) string {
-	// Replace invalid characters with underscore
-	invalid := []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|", "\n", "\r", "\t"}
-	for _, char := range invalid {
-		name = strings.ReplaceAll(name, char, "_")
+	// Replace invalid and control characters with underscore
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Hidden files on Unix; Windows drops trailing dots and spaces
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	// Reserved device names, also with an extension such as "con.txt"
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
 	}
-	return strings.TrimSpace(name)
+	return name
 }
 
 // Session represents a user session
@@ -165,17 +597,168 @@ type Session struct {
 	Agent     *agent.PlanningAgent
 	Handler   *WebInteractionHandler
 	CreatedAt time.Time
+
+	limiter  *tokenBucket
+	mu       sync.Mutex
+	inFlight bool
+	cancel   context.CancelFunc
+
+	keys       map[string]time.Time // idempotency keys, by finish time (zero while running)
+	runningKey string               // key of the running plan
+}
+
+// TryStart marks a plan started by the request with the given idempotency
+// key as running, returning false if one is already in flight.
+func (s *Session) TryStart(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight {
+		return false
+	}
+	s.inFlight = true
+	s.runningKey = key
+	return true
+}
+
+// Running reports whether a plan started with TryStart has not finished.
+func (s *Session) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight
+}
+
+// Start returns the context for a plan started with TryStart. The context is
+// cancelled by Stop, Finish or cancellation of parent.
+func (s *Session) Start(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	s.Handler.mu.Lock()
+	s.Handler.planCtx = ctx
+	s.Handler.mu.Unlock()
+
+	return ctx
+}
+
+// Stop cancels the running plan, if any, and reports whether there was one.
+func (s *Session) Stop() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	return s.inFlight
+}
+
+// Finish marks the running plan as complete.
+func (s *Session) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.inFlight = false
+	s.finishKey()
+}
+
+// Abort undoes TryStart for a plan that was not run, forgetting its key so
+// that the request can be retried.
+func (s *Session) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, s.runningKey)
+	s.runningKey = ""
+	s.inFlight = false
 }
 
 // SessionManager manages user sessions
 type SessionManager struct {
 	sessions map[string]*Session
 	mu       sync.RWMutex
+	store    SessionStore // saved sessions
+
+	// ctx is the parent of every plan and event stream; cancel ends them all on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // running plans
+	closed bool           // set by Shutdown; no plan starts after it, guarded by mu
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(store SessionStore) *SessionManager {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &SessionManager{
 		sessions: make(map[string]*Session),
+		store:    store,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Go runs fn for a plan of session started with TryStart, tracking it so
+// Shutdown can wait for it. Once Shutdown has begun it aborts the plan
+// instead and returns false.
+func (sm *SessionManager) Go(session *Session, fn func(ctx context.Context)) bool {
+	sm.mu.RLock()
+	if sm.closed {
+		sm.mu.RUnlock()
+		session.Abort()
+		return false
+	}
+	sm.wg.Add(1)
+	sm.mu.RUnlock()
+
+	ctx := session.Start(sm.ctx)
+	go func() {
+		defer sm.wg.Done()
+		defer session.Finish()
+		fn(ctx)
+	}()
+	return true
+}
+
+// StopAll cancels the running plan of every session and returns how many were stopped.
+func (sm *SessionManager) StopAll() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	stopped := 0
+	for _, session := range sm.sessions {
+		if session.Stop() {
+			stopped++
+		}
+	}
+	return stopped
+}
+
+// Shutdown stops new plans from starting, cancels all plans and event
+// streams, waits up to timeout for the plans to return, and saves every
+// session to the store.
+func (sm *SessionManager) Shutdown(timeout time.Duration) {
+	sm.mu.Lock()
+	sm.closed = true
+	sm.mu.Unlock()
+	sm.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		sm.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out after %s waiting for running plans", timeout)
+	}
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, session := range sm.sessions {
+		session.Handler.SaveSession()
 	}
 }
 
@@ -194,7 +777,7 @@ func (sm *SessionManager) CreateSession(id string, config agent.AgentConfig) (*S
 		return session, nil
 	}
 
-	handler := NewWebInteractionHandler(id, "")
+	handler := NewWebInteractionHandler(id, "", sm.store)
 	planningAgent, err := agent.NewPlanningAgent(config, handler)
 	if err != nil {
 		return nil, err
@@ -205,12 +788,170 @@ func (sm *SessionManager) CreateSession(id string, config agent.AgentConfig) (*S
 		Agent:     planningAgent,
 		Handler:   handler,
 		CreatedAt: time.Now(),
+		limiter:   newTokenBucket(rateLimit, rateBurst),
 	}
 
 	sm.sessions[id] = session
 	return session, nil
 }
 
+// ResumeSession creates a session whose agent history is rebuilt from a
+// previously saved session, so the conversation can continue from it.
+func (sm *SessionManager) ResumeSession(id, savedID string, config agent.AgentConfig) (*Session, error) {
+	events, err := sm.loadSavedEvents(savedID)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := sm.CreateSession(id, config)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreHistory(session.Agent, events)
+	return session, nil
+}
+
+// loadSavedEvents reads the events of a saved session.
+func (sm *SessionManager) loadSavedEvents(savedID string) ([]Event, error) {
+	data, err := sm.store.Load(savedID)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("invalid session data: %w", err)
+	}
+	return events, nil
+}
+
+// restoreHistory replays user requests and assistant responses from saved
+// events into the agent's conversation history. Clear commands among the
+// requests are applied again, and other commands are skipped.
+func restoreHistory(planningAgent *agent.PlanningAgent, events []Event) {
+	// Sessions saved before "request" events existed only logged direct
+	// chat messages; newer ones log them too, after their request
+	legacy := !slices.ContainsFunc(events, func(event Event) bool { return event.Type == "request" })
+	for _, event := range events {
+		switch event.Type {
+		case "request":
+			if scope, ok := clearCommand(event.Content); ok {
+				if scope == "context" {
+					planningAgent.ClearContext()
+				} else {
+					planningAgent.ClearHistory()
+				}
+			} else if isCommand(event.Content) {
+				continue
+			} else if msg, ok := strings.CutPrefix(event.Content, "\\"); ok {
+				planningAgent.AddDeveloperMessage(msg)
+			} else {
+				planningAgent.AddUserMessage(event.Content)
+			}
+		case "log":
+			if msg, ok := strings.CutPrefix(event.Content, "> User Request: "); ok && legacy {
+				planningAgent.AddDeveloperMessage(msg)
+			}
+		case "response":
+			planningAgent.AddAssistantMessage(event.Content)
+		}
+	}
+}
+
+// taskCapability describes a task type of the agent for /api/capabilities.
+type taskCapability struct {
+	Type        agent.TaskType `json:"type"`
+	Description string         `json:"description"`
+	Available   bool           `json:"available"`
+	Error       string         `json:"error,omitempty"` // why it is unavailable
+}
+
+// describeTasks lists the task types supported by a, marking those whose
+// dependencies are missing according to unavailable, the errors of
+// Preflight keyed by task type.
+func describeTasks(a *agent.PlanningAgent, unavailable map[string]string) []taskCapability {
+	capabilities := []taskCapability{}
+	for _, taskType := range a.SupportedTasks() {
+		reason, missing := unavailable[string(taskType)]
+		capabilities = append(capabilities, taskCapability{
+			Type:        taskType,
+			Description: a.DescribeTask(taskType),
+			Available:   !missing,
+			Error:       reason,
+		})
+	}
+	return capabilities
+}
+
+// authCookie is the cookie requireAuth sets once a request is
+// authenticated, so that UI assets and /generated/ links, which carry no
+// token, load with --auth-static.
+const authCookie = "agent_token"
+
+// requireAuth wraps a handler with bearer-token authentication.
+// The token may be sent as an "Authorization: Bearer" header or, for
+// EventSource connections that cannot set headers, as a "token" query parameter.
+// A request authenticated by either also gets an HttpOnly authCookie, which
+// is accepted in their place.
+// When no token is configured the handler is returned unchanged.
+func requireAuth(next http.Handler) http.Handler {
+	if authToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		fromCookie := false
+		if token == "" {
+			if cookie, err := r.Cookie(authCookie); err == nil {
+				token, fromCookie = cookie.Value, true
+			}
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !fromCookie {
+			http.SetCookie(w, &http.Cookie{
+				Name:     authCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAPI registers an API handler behind the auth middleware.
+func handleAPI(pattern string, handler http.HandlerFunc) {
+	http.Handle(pattern, requireAuth(handler))
+}
+
+// handleStopAll serves /api/stop-all, which cancels the running plan of
+// every session of sm.
+func handleStopAll(sm *SessionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stopped := sm.StopAll()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{
+			"stopped": stopped,
+		})
+	}
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "agent-web",
@@ -218,13 +959,77 @@ func main() {
 		Run:   runServer,
 	}
 
+	rootCmd.Flags().StringVar(&configPath, "config", "", "YAML file setting flags by name and system prompts under \"prompts\"; command line flags take precedence")
 	rootCmd.Flags().StringVar(&apiKey, "api-key", os.Getenv("OPENAI_API_KEY"), "OpenAI API Key")
 	rootCmd.Flags().StringVar(&apiBase, "api-base", os.Getenv("OPENAI_API_BASE"), "OpenAI API Base URL")
 	rootCmd.Flags().StringVar(&model, "model", os.Getenv("OPENAI_MODEL"), "OpenAI Model")
+	rootCmd.Flags().BoolVar(&trace, "trace", false, "Record every model request and response of each task under generated/traces")
+	rootCmd.Flags().IntVar(&planMinTasks, "plan-min-tasks", 0, "Minimum number of tasks in a plan, e.g. for deep research (0 for no minimum)")
+	rootCmd.Flags().IntVar(&planMaxTasks, "plan-max-tasks", 0, "Maximum number of tasks in a plan (0 for the planner's default of about 3-5)")
+	rootCmd.Flags().StringVar(&planGuidance, "plan-guidance", "", "Extra planner instruction about how to decompose requests")
+	rootCmd.Flags().StringVar(&capabilities, "capabilities", "streaming", "Model API features to use: a comma separated list of json, tools, streaming and vision, \"none\", or \"auto\" to detect them")
+	rootCmd.Flags().IntVar(&maxAPICalls, "max-concurrent-api-calls", 0, "Maximum model API requests in flight across all sessions (0 disables)")
+	rootCmd.Flags().Float64Var(&maxCost, "max-cost", 0, "Stop a plan when its estimated cost would exceed this many US dollars (0 disables)")
+	rootCmd.Flags().StringVar(&fallbackModel, "fallback-model", "", "Model the planner switches to when the primary model fails twice")
+	rootCmd.Flags().StringSliceVar(&ensembleModels, "ensemble-models", nil, "Models that analyze independently in ensemble ANALYZE tasks, e.g. gpt-4o,claude-3-5-sonnet (at least two)")
+	rootCmd.Flags().StringVar(&ensembleSynth, "ensemble-synthesizer", "", "Model that reconciles the ensemble analyses (default the main model)")
+	rootCmd.Flags().BoolVar(&ensembleAll, "ensemble", false, "Run every ANALYZE task as an ensemble instead of only those the planner marks")
 	rootCmd.Flags().StringVar(&addr, "addr", "127.0.0.1:8080", "Address to listen on")
+	rootCmd.Flags().StringVar(&sessionsDir, "sessions-dir", "sessions", "Directory where sessions are saved")
+	rootCmd.Flags().BoolVar(&autoApprove, "auto-approve", false, "Approve plans without waiting for review, for headless API use (overridable per request with auto_approve)")
+	rootCmd.Flags().StringVar(&plansDir, "plans-dir", "plans", "Directory where approved plans are saved for reuse")
 	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Verbose output")
 	rootCmd.Flags().BoolVar(&ppt, "ppt", false, "Enable PPT generation")
 	rootCmd.Flags().BoolVar(&podcast, "podcast", true, "Enable Podcast generation")
+	rootCmd.Flags().IntVar(&maxReportContext, "max-report-context", 100000, "Summarize the report context in chunks first when it exceeds this many bytes (negative disables)")
+	rootCmd.Flags().IntVar(&compactThreshold, "compact-threshold", 0, "Summarize older turns when the history exceeds this many estimated tokens (0 disables)")
+	rootCmd.Flags().IntVar(&plannerHistory, "planner-history-limit", 0, "Give the planner the instructions and only the most recent requests of the conversation that fit in this many estimated tokens (0 for no limit)")
+	rootCmd.Flags().BoolVar(&searchGuidance, "search-guidance", false, "Ask for guidance between search reflection iterations")
+	rootCmd.Flags().StringSliceVar(&includeDomains, "include-domains", nil, "Only search these domains and their subdomains, e.g. wikipedia.org,*.gov")
+	rootCmd.Flags().StringSliceVar(&excludeDomains, "exclude-domains", nil, "Never return search results from these domains")
+	rootCmd.Flags().StringVar(&wikipediaLang, "wikipedia-language", "", "Wikipedia language code such as zh or en (default follows the query)")
+	rootCmd.Flags().BoolVar(&noWebSearch, "no-web-search", false, "Run offline: plan without SEARCH tasks and never call a search API")
+	rootCmd.Flags().StringVar(&httpProxy, "http-proxy", os.Getenv("AGENT_HTTP_PROXY"), "Proxy URL for search and Wikipedia requests (default from AGENT_HTTP_PROXY, else HTTPS_PROXY)")
+	rootCmd.Flags().StringVar(&userAgent, "user-agent", os.Getenv("AGENT_USER_AGENT"), "User-Agent of search and Wikipedia requests (default from AGENT_USER_AGENT)")
+	rootCmd.Flags().BoolVar(&noWikipedia, "no-wikipedia", false, "Skip the Wikipedia lookup of searches unless the plan asks for it")
+	rootCmd.Flags().StringSliceVar(&knowledge, "knowledge", nil, "Files or directories (.md, .txt) to index as a knowledge base searched by RETRIEVE tasks")
+	rootCmd.Flags().IntVar(&knowledgeTopK, "knowledge-top-k", 0, "Number of knowledge base chunks retrieved per query (default 4)")
+	rootCmd.Flags().StringVar(&embeddingModel, "embedding-model", "", "Embedding model used to index the knowledge base (default text-embedding-3-small)")
+	rootCmd.Flags().BoolVar(&noRephrase, "no-search-rephrase", false, "Do not retry searches that found nothing with a rephrased query")
+	rootCmd.Flags().StringSliceVar(&searchProviders, "search-providers", nil, "Search providers to try in order: tavily, duckduckgo (default tavily,duckduckgo)")
+	rootCmd.Flags().IntVar(&breakerThreshold, "search-breaker-threshold", 3, "Skip a search provider after this many consecutive failures (negative disables)")
+	rootCmd.Flags().DurationVar(&breakerCooldown, "search-breaker-cooldown", time.Minute, "How long to skip a failing search provider")
+	rootCmd.Flags().Float64Var(&minNovelty, "search-min-novelty", 0, "Stop search reflection when a follow-up search adds less than this fraction of new content (default 0.2, negative disables)")
+	rootCmd.Flags().Float64Var(&minRelevance, "search-min-relevance", 0, "Drop search results scored below this relevance to the query, from 0 to 1, before they reach the report (0 disables)")
+	rootCmd.Flags().BoolVar(&termRelevance, "heuristic-relevance", false, "Score search relevance by matching query terms instead of asking the model")
+	rootCmd.Flags().StringVar(&reflectionModel, "reflection-model", "", "Model for the search reflection and query rephrasing steps (default: --model)")
+	rootCmd.Flags().StringVar(&smtpHost, "smtp-host", "", "SMTP server for sending reports by email")
+	rootCmd.Flags().IntVar(&smtpPort, "smtp-port", 587, "SMTP server port")
+	rootCmd.Flags().StringVar(&smtpUser, "smtp-user", "", "SMTP user name")
+	rootCmd.Flags().StringVar(&smtpPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	rootCmd.Flags().StringVar(&smtpFrom, "smtp-from", "", "Sender address of report emails (default the SMTP user)")
+	rootCmd.Flags().StringVar(&finalFormat, "final-format", "html", "Format of reports sent to the browser: html (rendered by the server) or markdown (sent as is and rendered safely for display)")
+	rootCmd.Flags().BoolVar(&manifest, "manifest", false, "Save the report, podcast script and a manifest.json listing every artifact of each run under generated/runs")
+	rootCmd.Flags().StringVar(&contextMode, "conversation-context", "all", "Conversation messages given to the planner and subagents as context: all (instructions and earlier requests), instructions or none")
+	rootCmd.Flags().StringVar(&reportRule, "report-rule", "auto", "Fix plans whose PPT, PODCAST or RENDER tasks have no REPORT before them: auto (move or insert a REPORT), reorder (only move one) or off")
+	rootCmd.Flags().StringVar(&outputStrategy, "output-strategy", "prefer-render", "Final output of a run: prefer-render, prefer-report (the markdown) or concatenate-all")
+	rootCmd.Flags().StringVar(&language, "language", "", "Output language such as English, or \"auto\" to follow the request (default Chinese)")
+	rootCmd.Flags().IntVar(&maxRenderBytes, "max-render-bytes", 256*1024, "Split reports larger than this many bytes of markdown into pages (0 disables)")
+	rootCmd.Flags().BoolVar(&htmlFragment, "html-fragment", false, "Render reports as embeddable HTML fragments instead of complete pages")
+	rootCmd.Flags().BoolVar(&checkpoints, "checkpoints", false, "Pause for confirmation before PPT and podcast generation")
+	rootCmd.Flags().IntVar(&pptMinSlides, "ppt-min-slides", 5, "Minimum number of slides per presentation")
+	rootCmd.Flags().IntVar(&pptMaxSlides, "ppt-max-slides", 20, "Maximum number of slides per presentation")
+	rootCmd.Flags().BoolVar(&pptSourceZip, "ppt-source-zip", false, "Offer the editable Slidev source of presentations as a zip")
+	rootCmd.Flags().IntVar(&pptKeepProjects, "ppt-keep-projects", 0, "Number of newest presentation projects kept on disk (0 keeps all)")
+	rootCmd.Flags().BoolVar(&pptPreview, "ppt-preview", false, "Preview slides in the browser as they are generated, before the presentation is built")
+	rootCmd.Flags().IntVar(&podcastWPM, "podcast-wpm", 150, "Speaking rate used to estimate podcast durations, in words per minute")
+	rootCmd.Flags().BoolVar(&pptImageGen, "ppt-image-gen", false, "Generate slide images with the image API instead of placeholders")
+	rootCmd.Flags().StringVar(&authToken, "auth-token", os.Getenv("AGENT_AUTH_TOKEN"), "Bearer token required for API access (disabled when empty)")
+	rootCmd.Flags().BoolVar(&authStatic, "auth-static", false, "Also require the auth token for UI assets and /generated/")
+	rootCmd.Flags().Float64Var(&rateLimit, "rate-limit", 10, "Maximum /api/chat requests per minute per session (0 disables)")
+	rootCmd.Flags().IntVar(&rateBurst, "rate-burst", 3, "Burst size for the per-session rate limiter")
+	rootCmd.Flags().DurationVar(&readyCacheTTL, "ready-cache", 30*time.Second, "How long /readyz caches the result of pinging the model API")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for running plans on shutdown")
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -232,35 +1037,184 @@ func main() {
 	}
 }
 
+// hideTraces stops next from serving the trace logs written by --trace,
+// which hold every prompt and response.
+func hideTraces(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := path.Clean(r.URL.Path); p == "/generated/traces" || strings.HasPrefix(p, "/generated/traces/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func runServer(cmd *cobra.Command, args []string) {
+	var prompts map[string]string
+	if configPath != "" {
+		file, err := configfile.Load(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := file.Apply(cmd.Flags()); err != nil {
+			log.Fatal(err)
+		}
+		prompts = file.Prompts
+	}
 	if apiKey == "" {
 		log.Fatal("API key is required")
 	}
+	// The browser either shows the HTML or renders the markdown itself
+	format, err := agent.ParseFinalFormat(finalFormat)
+	if err != nil || (format != agent.FinalFormatHTML && format != agent.FinalFormatMarkdown) {
+		log.Fatalf("--final-format must be html or markdown, got %q", finalFormat)
+	}
+	strategy, err := agent.ParseOutputStrategy(outputStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rule, err := agent.ParseReportRule(reportRule)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conversationContext, err := agent.ParseContextMode(contextMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpClient, err := tool.NewHTTPClient(tool.HTTPOptions{Proxy: httpProxy, UserAgent: userAgent})
+	if err != nil {
+		log.Fatal(err)
+	}
+	tool.SetHTTPClient(httpClient)
+	// Only rendered results are HTML; the browser renders everything else
+	responseFormat := format
+	if strategy != agent.OutputPreferRender {
+		responseFormat = agent.FinalFormatMarkdown
+	}
 
 	// Initialize agent config template
 	configTemplate := agent.AgentConfig{
-		APIKey:     apiKey,
-		APIBase:    apiBase,
-		Model:      model,
-		Verbose:    verbose,
-		RenderHTML: true,
+		APIKey:                apiKey,
+		APIBase:               apiBase,
+		Model:                 model,
+		FallbackModel:         fallbackModel,
+		Ensemble:              agent.EnsembleConfig{Models: ensembleModels, Synthesizer: ensembleSynth, Enabled: ensembleAll},
+		Prompts:               prompts,
+		MaxCostUSD:            maxCost,
+		MaxConcurrentAPICalls: maxAPICalls,
+		Trace:                 trace,
+		Verbose:               verbose,
+		HTMLFragment:          htmlFragment,
+		MaxRenderBytes:        maxRenderBytes,
+		Checkpoints:           checkpoints,
+		CompactThreshold:      compactThreshold,
+		PlannerHistoryLimit:   plannerHistory,
+		MaxReportContextBytes: maxReportContext,
+		SearchGuidance:        searchGuidance,
+		Language:              language,
+		FinalFormat:           format,
+		OutputStrategy:        strategy,
+		Manifest:              manifest,
+		ReportRule:            rule,
+		ConversationContext:   conversationContext,
+		DisableWebSearch:      noWebSearch,
+		Planner: agent.PlanConfig{
+			MinTasks: planMinTasks,
+			MaxTasks: planMaxTasks,
+			Guidance: planGuidance,
+		},
+		Search: agent.SearchConfig{
+			IncludeDomains:     includeDomains,
+			ExcludeDomains:     excludeDomains,
+			DisableWikipedia:   noWikipedia,
+			DisableRephrase:    noRephrase,
+			Providers:          searchProviders,
+			BreakerThreshold:   breakerThreshold,
+			BreakerCooldown:    breakerCooldown,
+			WikipediaLanguage:  wikipediaLang,
+			ReflectionModel:    reflectionModel,
+			MinNovelty:         minNovelty,
+			MinRelevance:       minRelevance,
+			HeuristicRelevance: termRelevance,
+		},
+		Knowledge: agent.KnowledgeConfig{
+			Paths:          knowledge,
+			TopK:           knowledgeTopK,
+			EmbeddingModel: embeddingModel,
+		},
+		Email: agent.EmailConfig{
+			Host:     smtpHost,
+			Port:     smtpPort,
+			Username: smtpUser,
+			Password: smtpPassword,
+			From:     smtpFrom,
+		},
+		PPT: agent.PPTConfig{
+			ImageGen:      pptImageGen,
+			MinSlides:     pptMinSlides,
+			MaxSlides:     pptMaxSlides,
+			SourceZip:     pptSourceZip,
+			KeepProjects:  pptKeepProjects,
+			PreviewSlides: pptPreview,
+		},
+		Podcast: agent.PodcastConfig{
+			WordsPerMinute: podcastWPM,
+		},
 	}
 
-	sessionManager := NewSessionManager()
+	if capabilities == "auto" {
+		caps, err := agent.ProbeCapabilities(context.Background(), configTemplate)
+		if err != nil {
+			log.Fatalf("Failed to detect model capabilities: %v", err)
+		}
+		configTemplate.Capabilities = caps
+		log.Printf("Detected model capabilities: %s", caps)
+	} else {
+		caps, err := agent.ParseCapabilities(capabilities)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configTemplate.Capabilities = caps
+	}
+
+	sessionManager := NewSessionManager(NewFileSessionStore(sessionsDir))
+	planStore := NewFilePlanStore(plansDir)
+
+	// Check subagent dependencies once so the UI can hide what cannot run
+	unavailable := make(map[string]string)
+	var capabilities []taskCapability
+	if preflightAgent, err := agent.NewPlanningAgent(configTemplate, nil); err == nil {
+		for taskType, err := range preflightAgent.Preflight() {
+			log.Printf("Subagent %s unavailable: %v", taskType, err)
+			unavailable[string(taskType)] = err.Error()
+		}
+		capabilities = describeTasks(preflightAgent, unavailable)
+	}
+	_, pptUnavailable := unavailable[string(agent.TaskTypePPT)]
 
 	// Serve static files
 	uiFS, err := fs.Sub(uiAssets, "ui")
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Handle("/", http.FileServer(http.FS(uiFS)))
+	var staticHandler http.Handler = http.FileServer(http.FS(uiFS))
+	var generatedHandler http.Handler = hideTraces(http.StripPrefix("/generated/", http.FileServer(http.Dir("generated"))))
+	if authStatic {
+		staticHandler = requireAuth(staticHandler)
+		generatedHandler = requireAuth(generatedHandler)
+	}
+	http.Handle("/", staticHandler)
 
 	// Serve generated files
 	os.MkdirAll("generated", 0755)
-	http.Handle("/generated/", http.StripPrefix("/generated/", http.FileServer(http.Dir("generated"))))
+	http.Handle("/generated/", generatedHandler)
+
+	// Health checks; /healthz stays open for load balancers
+	http.HandleFunc("/healthz", handleHealthz)
+	handleAPI("/readyz", readyzHandler(newReadinessChecker(readyCacheTTL, pingModel(configTemplate)), configTemplate.Model))
 
 	// API endpoints
-	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI("/events", func(w http.ResponseWriter, r *http.Request) {
 		sessionID := r.URL.Query().Get("session_id")
 		if sessionID == "" {
 			http.Error(w, "Session ID required", http.StatusBadRequest)
@@ -285,16 +1239,26 @@ func runServer(cmd *cobra.Command, args []string) {
 			return
 		}
 
-		handler := session.Handler
+		// Replay the session so far, then follow it
+		backlog, events, unsubscribe := session.Handler.Subscribe()
+		defer unsubscribe()
+
+		writeEvent := func(event Event) {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		for _, event := range backlog {
+			writeEvent(event)
+		}
+		flusher.Flush()
 
 		for {
 			select {
-			case event := <-handler.eventChan:
-				data, err := json.Marshal(event)
-				if err != nil {
-					continue
-				}
-				fmt.Fprintf(w, "data: %s\n\n", data)
+			case event := <-events:
+				writeEvent(event)
 				flusher.Flush()
 			case <-r.Context().Done():
 				return
@@ -302,35 +1266,122 @@ func runServer(cmd *cobra.Command, args []string) {
 		}
 	})
 
-	http.HandleFunc("/api/chat", func(w http.ResponseWriter, r *http.Request) {
+	// startPlan returns the session for a plan request, creating or
+	// resuming it, and marks a plan as running in it. It writes the
+	// response and returns nil if the plan must not run.
+	startPlan := func(w http.ResponseWriter, sessionID, resumeFrom, idempotencyKey string) *Session {
+		if sessionID == "" {
+			http.Error(w, "Session ID required", http.StatusBadRequest)
+			return nil
+		}
+
+		session := sessionManager.GetSession(sessionID)
+		if session == nil && resumeFrom != "" {
+			// Continue the conversation of a saved session
+			var err error
+			session, err = sessionManager.ResumeSession(sessionID, resumeFrom, configTemplate)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to resume session: %v", err), http.StatusNotFound)
+				return nil
+			}
+		}
+		if session == nil {
+			// Try to create it if missing (e.g. server restart)
+			var err error
+			session, err = sessionManager.CreateSession(sessionID, configTemplate)
+			if err != nil {
+				http.Error(w, "Failed to create session", http.StatusInternalServerError)
+				return nil
+			}
+		}
+
+		// A retried request joins the plan it already started; its events
+		// are replayed by /events
+		if !session.ClaimKey(idempotencyKey) {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusOK)
+			return nil
+		}
+		if !session.limiter.Allow() {
+			session.ReleaseKey(idempotencyKey)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return nil
+		}
+		if !session.TryStart(idempotencyKey) {
+			session.ReleaseKey(idempotencyKey)
+			http.Error(w, "A plan is already running for this session", http.StatusTooManyRequests)
+			return nil
+		}
+		return session
+	}
+
+	// respond sends the final output of an executed plan to the session.
+	respond := func(session *Session, results []agent.Result, err error) {
+		handler := session.Handler
+		if err != nil {
+			handler.Broadcast(Event{
+				Type:      "error",
+				Content:   err.Error(),
+				ErrorKind: agent.ErrorKindOf(err),
+			})
+			// Still deliver what was produced before the budget ran out
+			if !errors.Is(err, agent.ErrBudgetExceeded) {
+				return
+			}
+		}
+
+		// Extract final output and artifacts
+		output := session.Agent.Output(results)
+		finalOutput := output.Report
+		if manifest {
+			if err := session.Agent.SaveManifest(output); err != nil {
+				log.Printf("Failed to save manifest: %v", err)
+			}
+		}
+
+		// Add assistant message
+		session.Agent.AddAssistantMessage(finalOutput)
+
+		handler.Broadcast(responseEvent(output, responseFormat))
+
+		handler.Broadcast(Event{
+			Type: "done",
+		})
+	}
+
+	handleAPI("/api/chat", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		var req struct {
-			Message   string `json:"message"`
-			SessionID string `json:"session_id"`
+			Message    string `json:"message"`
+			SessionID  string `json:"session_id"`
+			ResumeFrom string `json:"resume_from,omitempty"`
+			// AutoApprove overrides --auto-approve for this request
+			AutoApprove *bool `json:"auto_approve,omitempty"`
+			// IdempotencyKey identifies retries of the same request
+			IdempotencyKey string `json:"idempotency_key,omitempty"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if req.IdempotencyKey == "" {
+			req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		}
 
-		if req.SessionID == "" {
-			http.Error(w, "Session ID required", http.StatusBadRequest)
+		// Commands and direct chat messages do not wait for a running plan,
+		// nor count against the rate limit
+		if session := sessionManager.GetSession(req.SessionID); session != nil && session.Running() && runAside(session, req.Message) {
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		session := sessionManager.GetSession(req.SessionID)
+		session := startPlan(w, req.SessionID, req.ResumeFrom, req.IdempotencyKey)
 		if session == nil {
-			// Try to create it if missing (e.g. server restart)
-			var err error
-			session, err = sessionManager.CreateSession(req.SessionID, configTemplate)
-			if err != nil {
-				http.Error(w, "Failed to create session", http.StatusInternalServerError)
-				return
-			}
+			return
 		}
 
 		planningAgent := session.Agent
@@ -339,10 +1390,15 @@ func runServer(cmd *cobra.Command, args []string) {
 		// Update user request in handler for filename generation
 		session.Handler.mu.Lock()
 		session.Handler.userRequest = req.Message
+		session.Handler.turn++
+		session.Handler.autoApprove = autoApprove
+		if req.AutoApprove != nil {
+			session.Handler.autoApprove = *req.AutoApprove
+		}
 		session.Handler.mu.Unlock()
 
 		// Run agent in a goroutine
-		go func() {
+		started := sessionManager.Go(session, func(ctx context.Context) {
 			defer func() {
 				if r := recover(); r != nil {
 					handler.Broadcast(Event{
@@ -352,18 +1408,18 @@ func runServer(cmd *cobra.Command, args []string) {
 				}
 			}()
 
-			// Check for direct chat
-			if strings.HasPrefix(req.Message, "\\") {
-				msg := strings.TrimPrefix(req.Message, "\\")
-
-				planningAgent.AddDeveloperMessage(msg)
+			// Record the raw request so the session can be resumed later
+			handler.Broadcast(Event{
+				Type:    "request",
+				Content: req.Message,
+			})
 
-				// Log user request
-				handler.Broadcast(Event{
-					Type:    "log",
-					Content: fmt.Sprintf("> User Request: %s", msg),
-				})
+			if runCommand(planningAgent, handler, req.Message) {
+				return
+			}
 
+			// Check for direct chat
+			if addDirectMessage(planningAgent, handler, req.Message) {
 				handler.Broadcast(Event{
 					Type: "done",
 				})
@@ -374,7 +1430,7 @@ func runServer(cmd *cobra.Command, args []string) {
 			planningAgent.AddUserMessage(req.Message)
 
 			// Plan with review
-			plan, err := planningAgent.PlanWithReview(context.Background(), req.Message)
+			plan, err := planningAgent.PlanWithReview(ctx, req.Message)
 			if err != nil {
 				handler.Broadcast(Event{
 					Type:    "error",
@@ -386,64 +1442,127 @@ func runServer(cmd *cobra.Command, args []string) {
 			// Ensure PODCAST task exists if REPORT task is present - REMOVED logic to force podcast
 			// The user must explicitly request a podcast for it to be included.
 
+			// Keep the approved plan for reuse; saving it before execution
+			// leaves out the tasks added while running
+			if saved, err := newSavedPlan(req.Message, plan); err != nil {
+				log.Printf("Plan not saved: %v", err)
+			} else if err := planStore.Save(saved); err != nil {
+				log.Printf("Failed to save plan: %v", err)
+			}
+
 			// Execute
-			results, err := planningAgent.Execute(context.Background(), plan)
-			if err != nil {
-				handler.Broadcast(Event{
-					Type:    "error",
-					Content: err.Error(),
-				})
+			results, err := planningAgent.Execute(ctx, plan)
+			respond(session, results, err)
+		})
+		if !started {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handleAPI("/api/plans", func(w http.ResponseWriter, r *http.Request) {
+		plans, err := planStore.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if plans == nil {
+			plans = []SavedPlan{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plans)
+	})
+
+	// Runs a saved plan for a new topic without calling the planner
+	handleAPI("/api/plans/{id}/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			SessionID string `json:"session_id"`
+			// Input is the new topic, the value of {{topic}}
+			Input string `json:"input"`
+			// Vars sets other placeholders of the template
+			Vars           map[string]string `json:"vars,omitempty"`
+			IdempotencyKey string            `json:"idempotency_key,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.IdempotencyKey == "" {
+			req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+		}
+
+		saved, err := planStore.Load(r.PathValue("id"))
+		if err != nil {
+			if errors.Is(err, ErrPlanNotFound) {
+				http.Error(w, "Plan not found", http.StatusNotFound)
 				return
 			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vars := make(map[string]string, len(req.Vars)+1)
+		for k, v := range req.Vars {
+			vars[k] = v
+		}
+		if req.Input != "" {
+			vars[agent.TopicVar] = req.Input
+		}
+		if _, err := saved.Template.Instantiate(vars); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			// Extract final output and podcast script
-			var finalOutput string
-			var podcastScript interface{}
-			var pptURL string
+		session := startPlan(w, req.SessionID, "", req.IdempotencyKey)
+		if session == nil {
+			return
+		}
+		message := saved.request(vars[agent.TopicVar])
 
-			for i := len(results) - 1; i >= 0; i-- {
-				if (results[i].TaskType == agent.TaskTypeRender || results[i].TaskType == agent.TaskTypeReport) && results[i].Success {
-					if finalOutput == "" {
-						finalOutput = results[i].Output
-					}
-				}
-				if results[i].TaskType == agent.TaskTypePodcast && results[i].Success {
-					podcastScript = results[i].Metadata["script"]
-				}
-				if results[i].TaskType == agent.TaskTypePPT && results[i].Success {
-					if url, ok := results[i].Metadata["ppt_url"].(string); ok {
-						pptURL = url
-					}
-				}
-			}
+		session.Handler.mu.Lock()
+		session.Handler.userRequest = message
+		session.Handler.turn++
+		session.Handler.mu.Unlock()
 
-			if finalOutput == "" {
-				for _, result := range results {
-					if result.Success {
-						finalOutput += result.Output + "\n\n"
-					}
+		started := sessionManager.Go(session, func(ctx context.Context) {
+			defer func() {
+				if r := recover(); r != nil {
+					session.Handler.Broadcast(Event{
+						Type:    "error",
+						Content: fmt.Sprintf("Panic: %v", r),
+					})
 				}
-			}
-
-			// Add assistant message
-			planningAgent.AddAssistantMessage(finalOutput)
+			}()
 
-			handler.Broadcast(Event{
-				Type:    "response",
-				Content: finalOutput,
-				Podcast: podcastScript,
-				PPT:     pptURL,
+			// Record the request the plan stands for so the session can
+			// be resumed later
+			session.Handler.Broadcast(Event{
+				Type:    "request",
+				Content: message,
 			})
+			session.Agent.AddUserMessage(message)
 
-			handler.Broadcast(Event{
-				Type: "done",
-			})
-		}()
+			results, err := session.Agent.ExecuteTemplate(ctx, saved.Template, vars)
+			respond(session, results, err)
+		})
+		if !started {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 	})
 
-	http.HandleFunc("/api/respond", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI("/api/stop-all", handleStopAll(sessionManager))
+
+	handleAPI("/api/respond", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -479,59 +1598,44 @@ func runServer(cmd *cobra.Command, args []string) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	http.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI("/api/config", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]bool{
-			"ppt":     ppt,
-			"podcast": podcast,
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ppt":         ppt && !pptUnavailable,
+			"podcast":     podcast,
+			"unavailable": unavailable,
 		})
 	})
 
-	http.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
-		entries, err := os.ReadDir("sessions")
+	handleAPI("/api/capabilities", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(capabilities)
+	})
+
+	handleAPI("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := sessionManager.store.List()
 		if err != nil {
-			// If directory doesn't exist, return empty list
-			if os.IsNotExist(err) {
-				json.NewEncoder(w).Encode([]string{})
-				return
-			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		var sessions []map[string]interface{}
-		for _, entry := range entries {
-			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
-				info, err := entry.Info()
-				if err != nil {
-					continue
-				}
-				sessions = append(sessions, map[string]interface{}{
-					"id":        strings.TrimSuffix(entry.Name(), ".json"),
-					"timestamp": info.ModTime(),
-				})
-			}
+		if sessions == nil {
+			sessions = []SessionInfo{}
 		}
 
-		// Sort by timestamp desc
-		// (Simple bubble sort or just leave it to frontend, but let's do it here for convenience if needed,
-		// actually let's just return the list and let frontend sort or just return as is)
-
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(sessions)
 	})
 
-	http.HandleFunc("/api/replay", func(w http.ResponseWriter, r *http.Request) {
+	handleAPI("/api/replay", func(w http.ResponseWriter, r *http.Request) {
 		sessionID := r.URL.Query().Get("session_id")
 		if sessionID == "" {
 			http.Error(w, "Session ID required", http.StatusBadRequest)
 			return
 		}
 
-		filename := fmt.Sprintf("sessions/%s.json", sessionID)
-		data, err := os.ReadFile(filename)
+		data, err := sessionManager.store.Load(sessionID)
 		if err != nil {
-			if os.IsNotExist(err) {
+			if errors.Is(err, ErrSessionNotFound) {
 				http.Error(w, "Session not found", http.StatusNotFound)
 				return
 			}
@@ -543,8 +1647,37 @@ func runServer(cmd *cobra.Command, args []string) {
 		w.Write(data)
 	})
 
-	fmt.Printf("Starting server on http://%s\n", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	handleAPI("/api/replay/stream", handleReplayStream(sessionManager.store))
+
+	handleAPI("/api/export", handleExport(sessionManager.store))
+
+	server := &http.Server{
+		Addr: addr,
+		// Event streams end when the session manager shuts down
+		BaseContext: func(net.Listener) context.Context { return sessionManager.ctx },
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Printf("Starting server on http://%s\n", addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serverErr:
 		log.Fatal(err)
+	case <-sigCtx.Done():
+	}
+
+	fmt.Println("Shutting down...")
+	sessionManager.Shutdown(shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Server shutdown: %v", err)
 	}
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestBroadcastWithoutClient(t *testing.T) {
+	h := NewWebInteractionHandler("test", "", nil)
+	total := maxSessionEvents + eventBufferSize
+
+	// A subscriber that never reads must not block the broadcaster
+	_, events, unsubscribe := h.Subscribe()
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < total; i++ {
+			h.Log(fmt.Sprintf("message %d", i))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast blocked without an SSE client")
+	}
+
+	if got := len(events); got != eventBufferSize {
+		t.Errorf("expected a full buffer of %d events, got %d", eventBufferSize, got)
+	}
+	first := <-events
+	if want := fmt.Sprintf("message %d", total-eventBufferSize); first.Content != want {
+		t.Errorf("expected the oldest events to be dropped, first queued is %q, want %q", first.Content, want)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) != maxSessionEvents {
+		t.Errorf("expected %d stored events, got %d", maxSessionEvents, len(h.events))
+	}
+	if last := h.events[len(h.events)-1].Content; last != fmt.Sprintf("message %d", total-1) {
+		t.Errorf("unexpected last stored event %q", last)
+	}
+}
+
+func TestSubscribers(t *testing.T) {
+	h := NewWebInteractionHandler("test", "", nil)
+	h.Log("before")
+
+	backlogA, a, unsubscribeA := h.Subscribe()
+	defer unsubscribeA()
+	_, b, unsubscribeB := h.Subscribe()
+
+	h.Log("first")
+	unsubscribeB()
+	h.Log("second")
+
+	if len(backlogA) != 1 || backlogA[0].Content != "before" {
+		t.Errorf("unexpected backlog %+v", backlogA)
+	}
+	for _, want := range []string{"first", "second"} {
+		if got := (<-a).Content; got != want {
+			t.Errorf("subscriber A got %q, want %q", got, want)
+		}
+	}
+	if got := (<-b).Content; got != "first" {
+		t.Errorf("subscriber B got %q, want %q", got, "first")
+	}
+	if len(b) != 0 {
+		t.Error("unsubscribed subscriber still receives events")
+	}
+
+	// A late viewer catches up on the whole session
+	backlogC, _, unsubscribeC := h.Subscribe()
+	defer unsubscribeC()
+	if len(backlogC) != 3 || backlogC[2].Content != "second" {
+		t.Errorf("late subscriber backlog %+v", backlogC)
+	}
+}
+
+func TestPlanExecutionWithoutClient(t *testing.T) {
+	h := NewWebInteractionHandler("test", "", nil)
+	a, err := agent.NewPlanningAgent(agent.AgentConfig{APIKey: "test"}, h)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+
+	// Each task logs several events, well beyond the SSE buffer
+	plan := &agent.Plan{}
+	for i := 0; i < eventBufferSize; i++ {
+		plan.Tasks = append(plan.Tasks, agent.Task{
+			Type:       agent.TaskTypeRender,
+			Parameters: map[string]interface{}{"content": "ok"},
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Execute(context.Background(), plan)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("plan execution stalled without an SSE client")
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"hello world", "hello world"},
+		{"a/b\\c:d*e?f\"g<h>i|j", "a_b_c_d_e_f_g_h_i_j"},
+		{"line\nbreak\ttab\x00nul", "line_break_tab_nul"},
+		{"..hidden", "hidden"},
+		{"trailing. . ", "trailing"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Lpt1", "_Lpt1"},
+		{"COM10", "COM10"},
+		{"console", "console"},
+		{"你好，世界", "你好，世界"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.in); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSessionFilename(t *testing.T) {
+	long := strings.Repeat("分析", 40)
+	got := sessionFilename(long, "abc", 1)
+	if want := strings.Repeat("分析", 25) + "-abc-1.json"; got != want {
+		t.Errorf("unicode truncation: got %q, want %q", got, want)
+	}
+	if !utf8.ValidString(got) {
+		t.Errorf("file name is not valid UTF-8: %q", got)
+	}
+
+	// Truncation must not leave a trailing dot or space behind
+	if got := sessionFilename(strings.Repeat("a", 49)+". tail", "abc", 1); got != strings.Repeat("a", 49)+"-abc-1.json" {
+		t.Errorf("unexpected name after truncation: %q", got)
+	}
+
+	if got := sessionFilename("...", "abc", 2); got != "session-abc-2.json" {
+		t.Errorf("empty request: got %q", got)
+	}
+	if a, b := sessionFilename("same", "abc", 1), sessionFilename("same", "abc", 2); a == b {
+		t.Errorf("turns of a session share the file name %q", a)
+	}
+}
+
+func TestClearCommand(t *testing.T) {
+	tests := []struct {
+		message string
+		scope   string
+		ok      bool
+	}{
+		{"/clear", "all", true},
+		{" /clear all ", "all", true},
+		{"/clear context", "context", true},
+		{"/clear everything", "", false},
+		{"/clearance", "", false},
+		{"clear the table", "", false},
+	}
+	for _, tt := range tests {
+		scope, ok := clearCommand(tt.message)
+		if scope != tt.scope || ok != tt.ok {
+			t.Errorf("clearCommand(%q) = %q, %v, want %q, %v", tt.message, scope, ok, tt.scope, tt.ok)
+		}
+	}
+
+	h := &WebInteractionHandler{store: &memorySessionStore{data: map[string][]byte{}}, userRequest: "/clear context"}
+	if h.saved() {
+		t.Error("clear commands must not be saved")
+	}
+	h.userRequest = "go vs rust"
+	if !h.saved() {
+		t.Error("requests should be saved")
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	planningAgent, err := agent.NewPlanningAgent(agent.AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewWebInteractionHandler("test", "", nil)
+	_, events, unsubscribe := h.Subscribe()
+	defer unsubscribe()
+
+	planningAgent.AddUserMessage("go vs rust")
+	planningAgent.AddDeveloperMessage("be brief")
+	if !runCommand(planningAgent, h, "/clear context") {
+		t.Fatal("/clear context not run")
+	}
+	if history := planningAgent.History(); len(history) != 1 || history[0].Content != "go vs rust" {
+		t.Errorf("expected only the conversation to be kept, got %+v", history)
+	}
+	if !runCommand(planningAgent, h, "/clear") || len(planningAgent.History()) != 0 {
+		t.Errorf("expected /clear to clear the history, got %+v", planningAgent.History())
+	}
+	if !runCommand(planningAgent, h, "/help") {
+		t.Fatal("/help not run")
+	}
+	if runCommand(planningAgent, h, "go vs rust") {
+		t.Error("a request was run as a command")
+	}
+
+	var types, commands []string
+	for len(events) > 0 {
+		event := <-events
+		types = append(types, event.Type)
+		if event.Type == "command" {
+			commands = append(commands, event.Content)
+		}
+	}
+	if strings.Join(types, ",") != "command,done,command,done,command,done" {
+		t.Errorf("unexpected events %v", types)
+	}
+	if len(commands) == 3 && !strings.Contains(commands[2], "/clear context") {
+		t.Errorf("expected the help text, got %q", commands[2])
+	}
+}
+
+func TestHideTraces(t *testing.T) {
+	h := hideTraces(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := map[string]int{
+		"/generated/report.html":          http.StatusOK,
+		"/generated/traces/trace_1.jsonl": http.StatusNotFound,
+		"/generated/traces":               http.StatusNotFound,
+		"/generated/x/../traces/a.jsonl":  http.StatusNotFound,
+		"/generated/traces_other/a.jsonl": http.StatusOK,
+	}
+	for p, want := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", p, nil))
+		if rec.Code != want {
+			t.Errorf("%s: got %d, want %d", p, rec.Code, want)
+		}
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	authToken = "secret"
+	defer func() { authToken = "" }()
+	h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/app.js", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?token=wrong", nil))
+	if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("expected 401 and no cookie for a wrong token, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/config", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with the bearer header, got %d", rec.Code)
+	}
+
+	// The first page load has the token in its URL; later asset and
+	// /generated/ requests only have the cookie
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?token=secret", nil))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != authCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected 200 and an HttpOnly %s cookie, got %d and %v", authCookie, rec.Code, cookies)
+	}
+	for _, p := range []string{"/app.js", "/generated/report.html"} {
+		req := httptest.NewRequest("GET", p, nil)
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200 with the cookie, got %d", p, rec.Code)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/app.js", nil)
+	req.AddCookie(&http.Cookie{Name: authCookie, Value: "stale"})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a stale cookie, got %d", rec.Code)
+	}
+}
+
+func TestStopAll(t *testing.T) {
+	sm := NewSessionManager(nil)
+	defer sm.Shutdown(time.Second)
+	running, err := sm.CreateSession("running", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := sm.CreateSession("idle", agent.AgentConfig{APIKey: "test"}); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	canceled := make(chan struct{})
+	running.TryStart("")
+	sm.Go(running, func(ctx context.Context) {
+		<-ctx.Done()
+		close(canceled)
+	})
+
+	h := handleStopAll(sm)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/stop-all", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/api/stop-all", nil))
+	var reply map[string]int
+	if err := json.NewDecoder(rec.Body).Decode(&reply); err != nil || reply["stopped"] != 1 {
+		t.Errorf("expected one stopped plan, got %v: %v", reply, err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("running plan was not canceled")
+	}
+}
+
+func TestAutoApprovePlan(t *testing.T) {
+	h := NewWebInteractionHandler("test", "", nil)
+	h.autoApprove = true
+	_, events, unsubscribe := h.Subscribe()
+	defer unsubscribe()
+
+	plan := &agent.Plan{Description: "plan"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if modification, err := h.ReviewPlan(plan); modification != "" || err != nil {
+			t.Errorf("expected immediate approval, got %q, %v", modification, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReviewPlan waited for the user")
+	}
+	if event := <-events; event.Type != "plan" || event.Plan != plan {
+		t.Errorf("expected a plan event, got %+v", event)
+	}
+}
+
+func TestDescribeTasks(t *testing.T) {
+	planningAgent, err := agent.NewPlanningAgent(agent.AgentConfig{APIKey: "test", AllowedTaskTypes: []agent.TaskType{agent.TaskTypeReport, agent.TaskTypePPT}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capabilities := describeTasks(planningAgent, map[string]string{"PPT": "npm not found"})
+	if len(capabilities) != 2 {
+		t.Fatalf("expected REPORT and PPT, got %+v", capabilities)
+	}
+	if report := capabilities[0]; report.Type != agent.TaskTypeReport || !report.Available || report.Description == "" {
+		t.Errorf("unexpected REPORT capability %+v", report)
+	}
+	if ppt := capabilities[1]; ppt.Type != agent.TaskTypePPT || ppt.Available || ppt.Error != "npm not found" {
+		t.Errorf("unexpected PPT capability %+v", ppt)
+	}
+}
+
+func TestPreviewSlide(t *testing.T) {
+	h := NewWebInteractionHandler("test", "", nil)
+	var _ agent.SlideHandler = h
+
+	h.PreviewSlide(1, agent.Slide{Title: "Intro", Content: []string{"a"}})
+	backlog, _, unsubscribe := h.Subscribe()
+	unsubscribe()
+	if len(backlog) != 1 {
+		t.Fatalf("expected one slide event, got %+v", backlog)
+	}
+	data, err := json.Marshal(backlog[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"type":"slide"`) || !strings.Contains(string(data), `"slide":{"title":"Intro","content":["a"]},"number":1`) {
+		t.Errorf("unexpected slide event %s", data)
+	}
+}
+
+func TestResponseEvent(t *testing.T) {
+	output := &agent.RunOutput{
+		Report:      "# Go\n\n<script>alert(1)</script>",
+		ReportPages: []string{"# Go\n\n<script>alert(1)</script>", "## More\n\n<img src=x onerror=alert(2)>"},
+	}
+
+	event := responseEvent(output, agent.FinalFormatMarkdown)
+	if event.Content != output.Report || event.Format != agent.FinalFormatMarkdown {
+		t.Errorf("expected the markdown report, got %+v", event)
+	}
+	if !strings.Contains(event.HTML, "<h1") || strings.Contains(event.HTML, "<script") {
+		t.Errorf("expected the report rendered without scripts, got %q", event.HTML)
+	}
+	if len(event.More) != 1 || !strings.Contains(event.More[0], "<h2") || strings.Contains(event.More[0], "onerror") {
+		t.Errorf("expected the remaining page rendered without scripts, got %q", event.More)
+	}
+
+	// HTML reports were rendered by the RENDER task
+	event = responseEvent(&agent.RunOutput{Report: "<p>Go</p>", ReportPages: []string{"<p>Go</p>", "<p>More</p>"}}, agent.FinalFormatHTML)
+	if event.HTML != "" || event.Content != "<p>Go</p>" || len(event.More) != 1 || event.More[0] != "<p>More</p>" {
+		t.Errorf("expected the HTML report as is, got %+v", event)
+	}
+}
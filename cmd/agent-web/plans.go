@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+// ErrPlanNotFound is returned by PlanStore.Load for unknown IDs.
+var ErrPlanNotFound = errors.New("plan not found")
+
+// SavedPlan is an approved plan kept as a template, so it can be run again
+// for another topic.
+type SavedPlan struct {
+	ID string `json:"id"`
+	// Request is the user request the plan was made for.
+	Request string `json:"request"`
+	// Topic is the topic of the request, replaced by {{topic}} in Template.
+	Topic     string              `json:"topic"`
+	Template  *agent.PlanTemplate `json:"template"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// newSavedPlan turns an approved plan for request into a SavedPlan. It
+// fails if the plan has no topic to parameterize.
+func newSavedPlan(request string, plan *agent.Plan) (SavedPlan, error) {
+	tmpl, err := plan.ToTemplate()
+	if err != nil {
+		return SavedPlan{}, err
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+	now := time.Now()
+	return SavedPlan{
+		ID:        now.Format("20060102-150405") + "-" + hex.EncodeToString(id),
+		Request:   request,
+		Topic:     strings.TrimSpace(plan.Topic),
+		Template:  tmpl,
+		CreatedAt: now,
+	}, nil
+}
+
+// request returns the request of the plan with its topic replaced by topic,
+// e.g. to record a run of the plan in the session history.
+func (p SavedPlan) request(topic string) string {
+	if p.Topic == "" || topic == "" {
+		return p.Request
+	}
+	return strings.ReplaceAll(p.Request, p.Topic, topic)
+}
+
+// PlanStore persists approved plans. The default FilePlanStore keeps them
+// on local disk.
+type PlanStore interface {
+	Save(plan SavedPlan) error
+	// List returns the saved plans, newest first.
+	List() ([]SavedPlan, error)
+	// Load returns the plan saved under id, or ErrPlanNotFound.
+	Load(id string) (SavedPlan, error)
+}
+
+// FilePlanStore saves each plan as a JSON file in Dir.
+type FilePlanStore struct {
+	Dir string
+}
+
+// NewFilePlanStore returns a store that keeps plans in dir.
+func NewFilePlanStore(dir string) *FilePlanStore {
+	return &FilePlanStore{Dir: dir}
+}
+
+// path returns the file for id. Only the base name of id is used so IDs
+// from requests cannot escape the directory.
+func (s *FilePlanStore) path(id string) string {
+	return filepath.Join(s.Dir, filepath.Base(id)+".json")
+}
+
+func (s *FilePlanStore) Save(plan SavedPlan) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(plan.ID), data, 0644)
+}
+
+func (s *FilePlanStore) List() ([]SavedPlan, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		// No plans saved yet
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var plans []SavedPlan
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		plan, err := s.Load(id)
+		if err != nil {
+			// Skip files that are not plans
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].CreatedAt.After(plans[j].CreatedAt)
+	})
+	return plans, nil
+}
+
+func (s *FilePlanStore) Load(id string) (SavedPlan, error) {
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return SavedPlan{}, ErrPlanNotFound
+	}
+	if err != nil {
+		return SavedPlan{}, err
+	}
+	var plan SavedPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return SavedPlan{}, fmt.Errorf("invalid plan %s: %w", id, err)
+	}
+	if plan.Template == nil {
+		return SavedPlan{}, fmt.Errorf("invalid plan %s: no template", id)
+	}
+	return plan, nil
+}
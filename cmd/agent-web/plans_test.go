@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestFilePlanStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "plans")
+	store := NewFilePlanStore(dir)
+
+	// Listing before anything is saved is not an error
+	if plans, err := store.List(); err != nil || len(plans) != 0 {
+		t.Fatalf("List on missing dir = %v, %v", plans, err)
+	}
+
+	plan := &agent.Plan{
+		Description: "Research Go generics",
+		Topic:       "Go generics",
+		Tasks: []agent.Task{
+			{Type: agent.TaskTypeSearch, Description: "Search Go generics", Parameters: map[string]interface{}{"query": "Go generics", agent.OutputsKey: "stale"}},
+			{Type: agent.TaskTypeReport, Description: "Write a report"},
+		},
+	}
+	saved, err := newSavedPlan("Tell me about Go generics", plan)
+	if err != nil {
+		t.Fatalf("newSavedPlan failed: %v", err)
+	}
+	if _, ok := saved.Template.Tasks[0].Parameters[agent.OutputsKey]; ok || saved.Template.Tasks[0].Description != "Search {{topic}}" {
+		t.Errorf("unexpected template task %+v", saved.Template.Tasks[0])
+	}
+	if got := saved.request("Rust traits"); got != "Tell me about Rust traits" {
+		t.Errorf("unexpected request %q", got)
+	}
+
+	older := saved
+	older.ID, older.CreatedAt = "older", saved.CreatedAt.Add(-time.Hour)
+	for _, p := range []SavedPlan{older, saved} {
+		if err := store.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files that are not plans are skipped
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644)
+
+	plans, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 2 || plans[0].ID != saved.ID || plans[1].ID != "older" {
+		t.Errorf("expected plans newest first, got %+v", plans)
+	}
+
+	loaded, err := store.Load(saved.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	instance, err := loaded.Template.Instantiate(map[string]string{agent.TopicVar: "Rust traits"})
+	if err != nil || instance.Tasks[0].Parameters["query"] != "Rust traits" {
+		t.Errorf("Instantiate = %+v, %v", instance, err)
+	}
+	if _, err := store.Load("missing"); !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound, got %v", err)
+	}
+
+	if _, err := newSavedPlan("hi", &agent.Plan{Tasks: plan.Tasks}); err == nil {
+		t.Error("expected an error for a plan without a topic")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a minimal token-bucket rate limiter.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket creates a bucket that refills at ratePerMinute and holds at most burst tokens.
+// A non-positive rate disables limiting.
+func newTokenBucket(ratePerMinute float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:     ratePerMinute / 60,
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+	}
+}
+
+// Allow reports whether a request may proceed, consuming a token if so.
+func (b *tokenBucket) Allow() bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(60, 3)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	if b.Allow() {
+		t.Fatal("expected the request after the burst to be limited")
+	}
+
+	// One token per second at 60 per minute, never more than the burst
+	b.last = b.last.Add(-1500 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("expected a token after a second")
+	}
+	if b.Allow() {
+		t.Error("expected half a token to be too little")
+	}
+	b.last = b.last.Add(-time.Hour)
+	allowed := 0
+	for b.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("expected the refill to stop at the burst of 3, got %d", allowed)
+	}
+
+	unlimited := newTokenBucket(0, 1)
+	for i := 0; i < 10; i++ {
+		if !unlimited.Allow() {
+			t.Fatal("expected a zero rate to disable limiting")
+		}
+	}
+}
+
+func TestSessionTryStart(t *testing.T) {
+	sm := NewSessionManager(nil)
+	session, err := sm.CreateSession("abc", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	if session.Running() || !session.TryStart("first") {
+		t.Fatal("expected the first plan to start")
+	}
+	if !session.Running() || session.TryStart("second") {
+		t.Fatal("expected a second plan to be refused while the first runs")
+	}
+	session.Finish()
+	if session.Running() || !session.TryStart("third") {
+		t.Fatal("expected a plan to start once the first finished")
+	}
+	session.Finish()
+}
+
+func TestRunAside(t *testing.T) {
+	sm := NewSessionManager(nil)
+	session, err := sm.CreateSession("abc", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	_, events, unsubscribe := session.Handler.Subscribe()
+	defer unsubscribe()
+
+	if runAside(session, "go vs rust") {
+		t.Error("a request was run aside of the plan")
+	}
+	if !runAside(session, "\\be brief") || !runAside(session, "/help") {
+		t.Fatal("expected the direct message and /help to run")
+	}
+	if history := session.Agent.History(); len(history) != 1 || history[0].Content != "be brief" {
+		t.Errorf("expected the direct message in the history, got %+v", history)
+	}
+	if !runAside(session, "/clear") || len(session.Agent.History()) != 0 {
+		t.Errorf("expected /clear to clear the history, got %+v", session.Agent.History())
+	}
+
+	var types []string
+	for len(events) > 0 {
+		types = append(types, (<-events).Type)
+	}
+	if got := strings.Join(types, ","); got != "request,log,request,command,request,command" {
+		t.Errorf("unexpected events %s", got)
+	}
+}
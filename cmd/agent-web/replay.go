@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxReplayGap caps the pause between two replayed events, so the time a
+// session waited for the user does not stall the replay.
+const maxReplayGap = 5 * time.Second
+
+// handleReplayStream streams the events of a saved session as SSE, paced by
+// their recorded timestamps divided by the speed parameter (default 1; 0
+// sends them without pauses). A final "end" event tells the client the
+// replay is complete, so it does not reconnect.
+func handleReplayStream(store SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.URL.Query().Get("session_id")
+		if sessionID == "" {
+			http.Error(w, "Session ID required", http.StatusBadRequest)
+			return
+		}
+		speed := 1.0
+		if s := r.URL.Query().Get("speed"); s != "" {
+			var err error
+			speed, err = strconv.ParseFloat(s, 64)
+			if err != nil || speed < 0 {
+				http.Error(w, "speed must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		data, err := store.Load(sessionID)
+		if err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var events []Event
+		if err := json.Unmarshal(data, &events); err != nil {
+			http.Error(w, fmt.Sprintf("invalid session data: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		for i, event := range events {
+			if i > 0 && speed > 0 {
+				gap := event.Timestamp.Sub(events[i-1].Timestamp)
+				gap = min(max(gap, 0), maxReplayGap)
+				select {
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+		fmt.Fprint(w, "event: end\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
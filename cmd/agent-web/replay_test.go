@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayStream(t *testing.T) {
+	start := time.Now()
+	events := []Event{
+		{Type: "request", Content: "go", Timestamp: start},
+		{Type: "log", Content: "searching", Timestamp: start.Add(200 * time.Millisecond)},
+		{Type: "done", Timestamp: start.Add(400 * time.Millisecond)},
+	}
+	data, _ := json.Marshal(events)
+	handler := handleReplayStream(&memorySessionStore{data: map[string][]byte{"s1": data}})
+
+	get := func(query string) (*httptest.ResponseRecorder, time.Duration) {
+		rec := httptest.NewRecorder()
+		began := time.Now()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/replay/stream?"+query, nil))
+		return rec, time.Since(began)
+	}
+
+	rec, elapsed := get("session_id=s1&speed=2")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the 400ms session to replay in about 200ms at speed 2, took %s", elapsed)
+	}
+	var types []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event Event
+		if json.Unmarshal([]byte(payload), &event) == nil && event.Type != "" {
+			types = append(types, event.Type)
+		}
+	}
+	if got := strings.Join(types, ","); got != "request,log,done" {
+		t.Errorf("unexpected replayed events %q", got)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "event: end\ndata: {}\n\n") {
+		t.Errorf("expected a final end event, got %q", rec.Body)
+	}
+
+	if _, elapsed := get("session_id=s1&speed=0"); elapsed > 100*time.Millisecond {
+		t.Errorf("expected speed 0 to replay without pauses, took %s", elapsed)
+	}
+	if rec, _ := get("session_id=missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing session, got %d", rec.Code)
+	}
+	if rec, _ := get("session_id=s1&speed=fast"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid speed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned by SessionStore.Load for unknown IDs.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo describes a saved session.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	// Partial marks a session that never finished, e.g. because the server
+	// crashed, and was recovered from its append log.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// SessionStore persists the event logs of sessions. The default
+// FileSessionStore keeps them on local disk; a shared implementation (S3,
+// Redis, ...) lets several server instances serve the same sessions.
+type SessionStore interface {
+	// Save stores data, the JSON encoded events, under id.
+	Save(id string, data []byte) error
+	// List returns the saved sessions, newest first.
+	List() ([]SessionInfo, error)
+	// Load returns the data saved under id, or ErrSessionNotFound.
+	Load(id string) ([]byte, error)
+}
+
+// SessionAppender is optionally implemented by a SessionStore to record
+// events as they are broadcast, so a session interrupted by a crash can
+// still be loaded. A later Save of the same id replaces the appended log.
+type SessionAppender interface {
+	// Append adds event, a JSON encoded event, to the log of id.
+	Append(id string, event []byte) error
+}
+
+// FileSessionStore saves each session as a JSON file in Dir. Events of
+// unfinished sessions are appended to a JSON lines file next to it.
+type FileSessionStore struct {
+	Dir string
+
+	mu sync.Mutex // serializes appends
+}
+
+// NewFileSessionStore returns a store that keeps sessions in dir.
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+// path returns the file for id. Only the base name of id is used so IDs
+// from requests cannot escape the directory.
+func (s *FileSessionStore) path(id string) string {
+	return filepath.Join(s.Dir, filepath.Base(id)+".json")
+}
+
+// logPath returns the append log for id.
+func (s *FileSessionStore) logPath(id string) string {
+	return s.path(id) + "l"
+}
+
+func (s *FileSessionStore) Save(id string, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path(id), data, 0644); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.logPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Append(id string, event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.logPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// One write per line, so a crash can at worst truncate the last line
+	if _, err := f.Write(append(bytes.TrimSpace(event), '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileSessionStore) List() ([]SessionInfo, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		// No sessions saved yet
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	saved := make(map[string]bool)
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			saved[id] = true
+		}
+	}
+
+	var sessions []SessionInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		id, partial := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !partial {
+			var ok bool
+			if id, ok = strings.CutSuffix(entry.Name(), ".json"); !ok {
+				continue
+			}
+		} else if saved[id] {
+			// The log of a saved session that was not removed
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:        id,
+			Timestamp: info.ModTime(),
+			Partial:   partial,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Timestamp.After(sessions[j].Timestamp)
+	})
+	return sessions, nil
+}
+
+// Load returns the saved session, or the events appended for an unfinished
+// session converted to a JSON array.
+func (s *FileSessionStore) Load(id string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return s.loadLog(id)
+	}
+	return data, err
+}
+
+// loadLog converts the append log of id to a JSON array, skipping lines
+// that are not valid JSON such as a line cut short by a crash.
+func (s *FileSessionStore) loadLog(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.logPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events := []json.RawMessage{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if json.Valid(line) {
+			events = append(events, line)
+		}
+	}
+	return json.MarshalIndent(events, "", "  ")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store := NewFileSessionStore(dir)
+
+	// Listing before anything is saved is not an error
+	if sessions, err := store.List(); err != nil || len(sessions) != 0 {
+		t.Fatalf("List on missing dir = %v, %v", sessions, err)
+	}
+
+	if err := store.Save("old", []byte(`[]`)); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "old.json"), past, past)
+	if err := store.Save("new", []byte(`[{"type":"done"}]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != "new" || sessions[1].ID != "old" {
+		t.Errorf("expected sessions newest first, got %+v", sessions)
+	}
+
+	data, err := store.Load("new")
+	if err != nil || string(data) != `[{"type":"done"}]` {
+		t.Errorf("Load = %q, %v", data, err)
+	}
+	if _, err := store.Load("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	// IDs cannot point outside the directory
+	os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.json"), []byte("secret"), 0644)
+	if _, err := store.Load("../secret"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected traversal to be rejected, got %v", err)
+	}
+}
+
+// memorySessionStore is a SessionStore kept in memory.
+type memorySessionStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (s *memorySessionStore) Save(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[id] = data
+	return nil
+}
+
+func (s *memorySessionStore) List() ([]SessionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []SessionInfo
+	for id := range s.data {
+		sessions = append(sessions, SessionInfo{ID: id})
+	}
+	return sessions, nil
+}
+
+func (s *memorySessionStore) Load(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return data, nil
+}
+
+func TestSaveAndResumeSessionWithStore(t *testing.T) {
+	store := &memorySessionStore{data: make(map[string][]byte)}
+	h := NewWebInteractionHandler("abc", "hello", store)
+	h.turn = 1
+	h.Broadcast(Event{Type: "request", Content: "hello"})
+	h.Broadcast(Event{Type: "response", Content: "hi"})
+	h.Broadcast(Event{Type: "done"})
+
+	data, err := store.Load("hello-abc-1")
+	if err != nil {
+		t.Fatalf("session was not saved to the store: %v", err)
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil || len(events) != 3 {
+		t.Fatalf("unexpected saved events %s: %v", data, err)
+	}
+
+	sm := NewSessionManager(store)
+	session, err := sm.ResumeSession("resumed", "hello-abc-1", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("ResumeSession failed: %v", err)
+	}
+	if history := session.Agent.History(); len(history) != 2 || history[1].Content != "hi" {
+		t.Errorf("unexpected restored history: %+v", history)
+	}
+
+	// A direct chat message is logged after its request, and commands are
+	// replayed only for their effect
+	h = NewWebInteractionHandler("def", "context", store)
+	h.turn = 1
+	for _, event := range []Event{
+		{Type: "request", Content: "old question"},
+		{Type: "response", Content: "old answer"},
+		{Type: "request", Content: "/clear"},
+		{Type: "command", Content: "✨ 已清除对话历史"},
+		{Type: "request", Content: "\\be brief"},
+		{Type: "log", Content: "> User Request: be brief"},
+		{Type: "request", Content: "/help"},
+		{Type: "command", Content: webHelp},
+		{Type: "request", Content: "hello"},
+		{Type: "response", Content: "hi"},
+		{Type: "done"},
+	} {
+		h.Broadcast(event)
+	}
+	session, err = sm.ResumeSession("resumed-commands", "context-def-1", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("ResumeSession failed: %v", err)
+	}
+	var contents []string
+	for _, msg := range session.Agent.History() {
+		contents = append(contents, msg.Role+":"+msg.Content)
+	}
+	if want := []string{"developer:be brief", "user:hello", "assistant:hi"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("restored history %q, want %q", contents, want)
+	}
+
+	// Sessions saved before "request" events existed only have the log
+	legacy, err := agent.NewPlanningAgent(agent.AgentConfig{APIKey: "test"}, nil)
+	if err != nil {
+		t.Fatalf("NewPlanningAgent failed: %v", err)
+	}
+	restoreHistory(legacy, []Event{{Type: "log", Content: "> User Request: be brief"}, {Type: "response", Content: "ok"}})
+	if history := legacy.History(); len(history) != 2 || history[0].Content != "be brief" {
+		t.Errorf("unexpected history of a legacy session: %+v", history)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	store := &memorySessionStore{data: make(map[string][]byte)}
+	sm := NewSessionManager(store)
+	session, err := sm.CreateSession("abc", agent.AgentConfig{APIKey: "test"})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	session.Handler.userRequest = "hello"
+	session.Handler.turn = 1
+
+	// The running plan is canceled and its session saved
+	if !session.TryStart("key") {
+		t.Fatal("TryStart failed")
+	}
+	started := sm.Go(session, func(ctx context.Context) {
+		<-ctx.Done()
+		session.Handler.Broadcast(Event{Type: "log", Content: "canceled"})
+	})
+	if !started {
+		t.Fatal("expected the plan to start")
+	}
+	sm.Shutdown(time.Second)
+	if _, err := store.Load("hello-abc-1"); err != nil {
+		t.Errorf("session was not saved on shutdown: %v", err)
+	}
+
+	// No plan starts once shutdown has begun, and its key can be retried
+	if !session.ClaimKey("late") || !session.TryStart("late") {
+		t.Fatal("expected the session to be idle after shutdown")
+	}
+	if sm.Go(session, func(ctx context.Context) { t.Error("plan ran after shutdown") }) {
+		t.Error("expected Go to refuse a plan after shutdown")
+	}
+	if !session.ClaimKey("late") || !session.TryStart("late") {
+		t.Error("expected the refused plan to be aborted")
+	}
+}
+
+func TestAppendSessionEvents(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileSessionStore(dir)
+	h := NewWebInteractionHandler("abc", "hello", store)
+	h.turn = 1
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Broadcast(Event{Type: "log", Content: "progress"})
+		}()
+	}
+	wg.Wait()
+
+	// Simulate a crash in the middle of writing an event
+	f, err := os.OpenFile(filepath.Join(dir, "hello-abc-1.jsonl"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("events were not appended: %v", err)
+	}
+	f.WriteString(`{"type":"lo`)
+	f.Close()
+
+	sessions, err := store.List()
+	if err != nil || len(sessions) != 1 || sessions[0].ID != "hello-abc-1" || !sessions[0].Partial {
+		t.Fatalf("expected a partial session, got %+v, %v", sessions, err)
+	}
+	data, err := store.Load("hello-abc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	if err := json.Unmarshal(data, &events); err != nil || len(events) != 20 {
+		t.Fatalf("expected 20 recovered events, got %d: %v", len(events), err)
+	}
+
+	h.Broadcast(Event{Type: "done"})
+	if _, err := os.Stat(filepath.Join(dir, "hello-abc-1.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("append log should be removed once the session is saved: %v", err)
+	}
+	sessions, _ = store.List()
+	if len(sessions) != 1 || sessions[0].Partial {
+		t.Errorf("expected one complete session, got %+v", sessions)
+	}
+
+	// The log of the next turn starts with the earlier events
+	h.turn = 2
+	h.Broadcast(Event{Type: "request", Content: "again"})
+	data, err = store.Load("hello-abc-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &events); err != nil || len(events) != 22 {
+		t.Errorf("expected 22 events in the second turn, got %d: %v", len(events), err)
+	}
+}
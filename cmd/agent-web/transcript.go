@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+// renderTranscript renders the saved events of a session as a readable
+// markdown transcript of the requests, plans, responses and errors. Log and
+// interaction events are left out.
+func renderTranscript(id string, events []Event) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# 会话记录: %s\n\n", id))
+
+	for _, event := range events {
+		timestamp := event.Timestamp.Format("2006-01-02 15:04:05")
+		switch event.Type {
+		case "request":
+			sb.WriteString(fmt.Sprintf("## 用户请求 (%s)\n\n", timestamp))
+			for _, line := range strings.Split(event.Content, "\n") {
+				sb.WriteString("> " + line + "\n")
+			}
+			sb.WriteString("\n")
+		case "plan_review":
+			if event.Plan == nil {
+				continue
+			}
+			sb.WriteString("### 计划\n\n")
+			if event.Plan.Description != "" {
+				sb.WriteString(event.Plan.Description + "\n\n")
+			}
+			for i, task := range event.Plan.Tasks {
+				sb.WriteString(fmt.Sprintf("%d. **%s** %s\n", i+1, task.Type, task.Description))
+			}
+			sb.WriteString("\n")
+		case "response":
+			sb.WriteString(fmt.Sprintf("### 回复 (%s)\n\n", timestamp))
+			if content := strings.TrimSpace(event.Content); content != "" {
+				sb.WriteString(content + "\n\n")
+			}
+			for _, page := range event.More {
+				sb.WriteString(strings.TrimSpace(page) + "\n\n")
+			}
+			if len(event.Podcast) > 0 {
+				sb.WriteString("#### 播客脚本\n\n")
+				for _, line := range event.Podcast {
+					sb.WriteString(fmt.Sprintf("**%s**: %s\n\n", line.Speaker, line.Text))
+				}
+			}
+			if event.PPT != "" {
+				sb.WriteString(fmt.Sprintf("[查看演示文稿](%s)\n\n", event.PPT))
+			}
+			if event.PPTSource != "" {
+				sb.WriteString(fmt.Sprintf("[下载演示文稿源码](%s)\n\n", event.PPTSource))
+			}
+		case "error":
+			sb.WriteString(fmt.Sprintf("> ❌ 错误: %s\n\n", event.Content))
+		}
+	}
+	return sb.String()
+}
+
+// handleExport serves the transcript of a saved session as markdown
+// (format=md, the default), a complete HTML page (format=html) or a PDF
+// (format=pdf, which falls back to HTML when Chrome is unavailable).
+func handleExport(store SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.URL.Query().Get("session_id")
+		if sessionID == "" {
+			http.Error(w, "Session ID required", http.StatusBadRequest)
+			return
+		}
+
+		data, err := store.Load(sessionID)
+		if err != nil {
+			if errors.Is(err, ErrSessionNotFound) {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var events []Event
+		if err := json.Unmarshal(data, &events); err != nil {
+			http.Error(w, fmt.Sprintf("invalid session data: %v", err), http.StatusInternalServerError)
+			return
+		}
+		transcript := renderTranscript(sessionID, events)
+		name := sanitizeFilename(sessionID)
+
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "md":
+			serveDownload(w, name+".md", "text/markdown; charset=utf-8", []byte(transcript))
+		case "html":
+			serveDownload(w, name+".html", "text/html; charset=utf-8", []byte(renderTranscriptHTML(r.Context(), transcript)))
+		case "pdf":
+			content, ext, err := exportTranscriptPDF(r.Context(), transcript)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if ext == ".pdf" {
+				serveDownload(w, name+".pdf", "application/pdf", content)
+			} else {
+				serveDownload(w, name+".html", "text/html; charset=utf-8", content)
+			}
+		default:
+			http.Error(w, fmt.Sprintf("unsupported format %q", format), http.StatusBadRequest)
+		}
+	}
+}
+
+// renderTranscriptHTML renders the markdown transcript as a complete HTML page.
+func renderTranscriptHTML(ctx context.Context, transcript string) string {
+	render := agent.NewRenderSubagent(false, agent.FinalFormatHTML, false, 0, agent.RenderConfig{}, nil)
+	result, _ := render.Execute(ctx, agent.Task{
+		Type:       agent.TaskTypeRender,
+		Parameters: map[string]interface{}{"content": transcript},
+	})
+	return result.Output
+}
+
+// exportTranscriptPDF prints the transcript to PDF with the EXPORT subagent.
+// It returns the file content and extension, ".html" if printing failed.
+func exportTranscriptPDF(ctx context.Context, transcript string) ([]byte, string, error) {
+	dir, err := os.MkdirTemp("", "transcript")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	export := agent.NewExportSubagent(false, nil, dir)
+	result, err := export.Execute(ctx, agent.Task{
+		Type:       agent.TaskTypeExport,
+		Parameters: map[string]interface{}{"content": transcript, "format": "pdf"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	path, _ := result.Metadata["path"].(string)
+	content, err := os.ReadFile(path)
+	return content, filepath.Ext(path), err
+}
+
+func serveDownload(w http.ResponseWriter, filename, contentType string, content []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(filename)))
+	w.Write(content)
+}
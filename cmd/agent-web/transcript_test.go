@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smallnest/aiagents/agent"
+)
+
+func TestExportTranscript(t *testing.T) {
+	events := []Event{
+		{Type: "request", Content: "比较 Go 和 Rust"},
+		{Type: "log", Content: "🧠 正在规划..."},
+		{Type: "plan_review", Plan: &agent.Plan{Description: "对比研究", Tasks: []agent.Task{{Type: agent.TaskTypeSearch, Description: "搜索"}}}},
+		{Type: "response", Content: "# 报告\n\nGo 更简单。", Podcast: []agent.DialogueLine{{Speaker: "Host 1", Text: "你好"}}},
+		{Type: "done"},
+	}
+	data, _ := json.Marshal(events)
+	store := &memorySessionStore{data: map[string][]byte{"s1": data}}
+	handler := handleExport(store)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/api/export?"+query, nil))
+		return rec
+	}
+
+	rec := get("session_id=s1&format=md")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	md := rec.Body.String()
+	for _, want := range []string{"> 比较 Go 和 Rust", "1. **SEARCH** 搜索", "# 报告", "**Host 1**: 你好"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("transcript missing %q:\n%s", want, md)
+		}
+	}
+	if strings.Contains(md, "正在规划") {
+		t.Errorf("transcript should not include log events:\n%s", md)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "s1.md") {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+
+	rec = get("session_id=s1&format=html")
+	if !strings.Contains(rec.Body.String(), "<html") || !strings.Contains(rec.Body.String(), "<blockquote>") {
+		t.Errorf("expected an HTML page, got %s", rec.Body)
+	}
+
+	if rec := get("session_id=missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing session, got %d", rec.Code)
+	}
+	if rec := get("session_id=s1&format=xml"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown format, got %d", rec.Code)
+	}
+}
@@ -12,6 +12,35 @@ document.addEventListener('DOMContentLoaded', () => {
     // Current Session ID
     let sessionId = '';
 
+    // Saved session to continue from on the next request (set by replay)
+    let resumeFrom = '';
+
+    // Optional API token, taken from the page URL (?token=...)
+    const authToken = new URLSearchParams(window.location.search).get('token') || '';
+
+    function withToken(url) {
+        if (!authToken) return url;
+        return url + (url.includes('?') ? '&' : '?') + 'token=' + encodeURIComponent(authToken);
+    }
+
+    const artifactLabels = {
+        report: '下载报告 (Markdown)',
+        podcast_script: '下载播客脚本',
+        chart: '下载图表',
+        docx: '下载 Word 文档',
+        pdf: '下载 PDF',
+        html: '下载 HTML',
+        ppt_source: '下载 PPT 源码',
+    };
+
+    // artifactLabel names a manifest artifact for its download link.
+    function artifactLabel(artifact) {
+        const label = artifactLabels[artifact.kind] || '下载 ' + artifact.kind;
+        if (!artifact.size) return label;
+        const kb = artifact.size / 1024;
+        return `${label} (${kb < 1024 ? kb.toFixed(1) + ' KB' : (kb / 1024).toFixed(1) + ' MB'})`;
+    }
+
     function generateSessionId() {
         sessionId = 'session-' + Math.random().toString(36).substr(2, 9) + '-' + Date.now();
         console.log('New Session ID:', sessionId);
@@ -40,16 +69,23 @@ document.addEventListener('DOMContentLoaded', () => {
     const pptCheckbox = document.getElementById('ppt-checkbox');
     const podcastCheckbox = document.getElementById('podcast-checkbox');
 
-    // Fetch config
-    fetch('/api/config')
-        .then(response => response.json())
-        .then(config => {
-            if (config.ppt) {
-                pptCheckbox.disabled = false;
-            }
-            if (config.podcast) {
-                podcastCheckbox.disabled = false;
-            }
+    // Enable the toggles of the features that are turned on and can run
+    Promise.all([
+        fetch(withToken('/api/config')).then(response => response.json()),
+        fetch(withToken('/api/capabilities')).then(response => response.json()),
+    ])
+        .then(([config, capabilities]) => {
+            const tasks = {};
+            (capabilities || []).forEach(task => { tasks[task.type] = task; });
+            [
+                [pptCheckbox, config.ppt, tasks.PPT],
+                [podcastCheckbox, config.podcast, tasks.PODCAST],
+            ].forEach(([checkbox, enabled, task]) => {
+                if (task) {
+                    checkbox.parentElement.title = task.available ? task.description : task.error;
+                }
+                checkbox.disabled = !(enabled && task && task.available);
+            });
         })
         .catch(err => console.error('Failed to load config:', err));
 
@@ -92,16 +128,28 @@ document.addEventListener('DOMContentLoaded', () => {
         addLog('info', `> User Request: ${text}`);
 
         try {
-            const response = await fetch('/api/chat', {
+            // The same key on a resend lets the server ignore the duplicate
+            const body = JSON.stringify({
+                message: text,
+                session_id: sessionId,
+                resume_from: resumeFrom,
+                idempotency_key: 'req-' + Math.random().toString(36).substr(2, 9) + '-' + Date.now()
+            });
+            const send = () => fetch(withToken('/api/chat'), {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
                 },
-                body: JSON.stringify({
-                    message: text,
-                    session_id: sessionId
-                }),
+                body: body,
             });
+            let response;
+            try {
+                response = await send();
+            } catch (networkError) {
+                // Retry once on network failure
+                response = await send();
+            }
+            resumeFrom = '';
 
             if (!response.ok) {
                 throw new Error('网络响应不正常');
@@ -121,7 +169,7 @@ document.addEventListener('DOMContentLoaded', () => {
         if (eventSource) {
             eventSource.close();
         }
-        eventSource = new EventSource(`/events?session_id=${sessionId}`);
+        eventSource = new EventSource(withToken(`/events?session_id=${sessionId}`));
 
         eventSource.onmessage = (event) => {
             const data = JSON.parse(event.data);
@@ -158,7 +206,22 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
-    function createReportTab(content) {
+    // Reports sent as markdown (--final-format markdown) come with the HTML
+    // rendered by the server; without it they are shown as plain text
+    function reportHTML(data) {
+        if (data.format !== 'markdown') {
+            return data.content;
+        }
+        if (data.html) {
+            return data.html;
+        }
+        const pre = document.createElement('pre');
+        pre.textContent = data.content;
+        return pre.outerHTML;
+    }
+
+    // Remaining pages of a long report are appended one at a time
+    function createReportTab(content, more) {
         reportCount++;
         const tabId = `report-${reportCount}`;
 
@@ -177,6 +240,26 @@ document.addEventListener('DOMContentLoaded', () => {
         container.className = 'tab-content';
         container.innerHTML = `<div class="report-content">${content}</div>`;
 
+        if (more && more.length > 0) {
+            const pages = more.slice();
+            const reportContent = container.querySelector('.report-content');
+            const moreBtn = document.createElement('button');
+            moreBtn.className = 'show-more-btn';
+            const updateLabel = () => {
+                moreBtn.textContent = `显示更多 (剩余 ${pages.length} 页)`;
+            };
+            updateLabel();
+            moreBtn.onclick = () => {
+                reportContent.insertAdjacentHTML('beforeend', pages.shift());
+                if (pages.length === 0) {
+                    moreBtn.remove();
+                } else {
+                    updateLabel();
+                }
+            };
+            container.appendChild(moreBtn);
+        }
+
         // Add to DOM
         tabsContainer.appendChild(tab);
         rightPanel.appendChild(container);
@@ -208,8 +291,76 @@ document.addEventListener('DOMContentLoaded', () => {
         content.remove();
     }
 
+    // Heartbeats arrive every few seconds while a model or search call runs;
+    // missing several in a row means the call may have stalled
+    const HEARTBEAT_STALL_MS = 10000;
+    let heartbeatIndicator = null;
+    let heartbeatTimer = null;
+
+    function showHeartbeat(data) {
+        if (!heartbeatIndicator) {
+            heartbeatIndicator = document.createElement('div');
+            heartbeatIndicator.className = 'log-line heartbeat';
+        }
+        // Keep the indicator below the latest log line
+        terminalContainer.appendChild(heartbeatIndicator);
+        const activity = data.content === 'search' ? '搜索' : '模型调用';
+        heartbeatIndicator.innerHTML = `<i class="fas fa-spinner fa-spin"></i> ${data.task || ''} ${activity}进行中 (${Math.round(data.elapsed || 0)} 秒)`;
+        terminalContainer.scrollTop = terminalContainer.scrollHeight;
+
+        clearTimeout(heartbeatTimer);
+        heartbeatTimer = setTimeout(() => {
+            if (heartbeatIndicator) {
+                heartbeatIndicator.textContent = '⚠️ 长时间未收到心跳，任务可能已停滞';
+            }
+        }, HEARTBEAT_STALL_MS);
+    }
+
+    function hideHeartbeat() {
+        clearTimeout(heartbeatTimer);
+        if (heartbeatIndicator) {
+            heartbeatIndicator.remove();
+            heartbeatIndicator = null;
+        }
+    }
+
+    // Slides previewed while a presentation is generated
+    let slidePreview = null;
+
+    function showSlide(data) {
+        if (data.number === 1 || !slidePreview) {
+            slidePreview = document.createElement('div');
+            slidePreview.className = 'log-line info slide-preview';
+            terminalContainer.appendChild(slidePreview);
+        }
+        const card = document.createElement('div');
+        card.className = 'slide-card';
+        const title = document.createElement('strong');
+        title.textContent = `${data.number}. ${data.slide.title}`;
+        card.appendChild(title);
+        (data.slide.content || []).forEach(point => {
+            const line = document.createElement('div');
+            line.textContent = '• ' + point;
+            card.appendChild(line);
+        });
+
+        const existing = slidePreview.children[data.number - 1];
+        if (existing) {
+            existing.replaceWith(card);
+        } else {
+            slidePreview.appendChild(card);
+        }
+        terminalContainer.scrollTop = terminalContainer.scrollHeight;
+    }
+
     function handleEvent(data) {
+        if (data.type !== 'heartbeat') {
+            hideHeartbeat();
+        }
         switch (data.type) {
+            case 'heartbeat':
+                showHeartbeat(data);
+                break;
             case 'log':
                 handleLog(data.content);
                 break;
@@ -217,7 +368,7 @@ document.addEventListener('DOMContentLoaded', () => {
                 addLog('success', '收到响应。');
 
                 // Create new report tab
-                const tabId = createReportTab(data.content);
+                const tabId = createReportTab(reportHTML(data), data.more);
                 activateTab(tabId);
 
                 // Add button to view report
@@ -227,7 +378,8 @@ document.addEventListener('DOMContentLoaded', () => {
                 viewBtn.style.cssText = 'background: #2da44e; border: none; color: white; padding: 5px 10px; border-radius: 4px; cursor: pointer; margin-top: 5px; font-size: 0.85rem; margin-right: 10px;';
 
                 // Capture current content and reportCount for this button
-                const currentContent = data.content;
+                const currentContent = reportHTML(data);
+                const currentMore = data.more;
                 const currentReportCount = reportCount;
                 const currentTabId = tabId;
 
@@ -237,7 +389,7 @@ document.addEventListener('DOMContentLoaded', () => {
                     if (existingTab) {
                         activateTab(currentTabId);
                     } else {
-                        const newTabId = createReportTab(currentContent);
+                        const newTabId = createReportTab(currentContent, currentMore);
                         activateTab(newTabId);
                     }
                 };
@@ -283,9 +435,33 @@ document.addEventListener('DOMContentLoaded', () => {
                     div.appendChild(pptBtn);
                 }
 
+                // Download links for the files of the run; sessions saved
+                // before manifests only have the PPT source
+                const downloads = data.manifest
+                    ? data.manifest.artifacts.filter(a => a.kind !== 'ppt' && a.url)
+                    : (data.ppt_source ? [{ kind: 'ppt_source', url: data.ppt_source }] : []);
+                downloads.forEach(artifact => {
+                    const link = document.createElement('a');
+                    link.textContent = artifactLabel(artifact);
+                    link.href = withToken(artifact.url);
+                    link.download = '';
+                    link.style.cssText = 'color: #8e44ad; margin-left: 10px; font-size: 0.85rem;';
+                    div.appendChild(link);
+                });
+
                 terminalContainer.appendChild(div);
                 terminalContainer.scrollTop = terminalContainer.scrollHeight;
                 break;
+            case 'command':
+                addLog('system', data.content);
+                break;
+            case 'slide':
+                showSlide(data);
+                break;
+            case 'plan':
+                renderPlan(data.plan);
+                addLog('system', '计划已自动确认。');
+                break;
             case 'plan_review':
                 if (isReplaying) {
                     renderPlan(data.plan);
@@ -294,6 +470,26 @@ document.addEventListener('DOMContentLoaded', () => {
                     showPlanReview(data.plan);
                 }
                 break;
+            case 'checkpoint':
+                if (isReplaying) {
+                    addLog('system', data.content);
+                } else {
+                    const proceed = window.confirm(data.content);
+                    sendResponse(proceed ? '' : 'stop');
+                    addLog('system', proceed ? '已确认继续执行。' : '已在检查点停止执行。');
+                }
+                break;
+            case 'guidance':
+                if (isReplaying) {
+                    addLog('system', data.content);
+                } else {
+                    const guidance = window.prompt(data.content + '\n\n留空则继续自动搜索。', '') || '';
+                    sendResponse(guidance.trim());
+                    if (guidance.trim()) {
+                        addLog('system', '已提交搜索指导: ' + guidance.trim());
+                    }
+                }
+                break;
             case 'error':
                 addLog('error', data.content);
                 setLoading(false);
@@ -462,7 +658,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
             item.id = `task-${index}`;
             item.querySelector('.task-desc').textContent = task.description;
-            item.querySelector('.task-meta').textContent = task.type;
+            item.querySelector('.task-meta').textContent = task.id ? `${task.type} · ${task.id}` : task.type;
 
             // Set icon based on state (initial state is pending)
             const icon = item.querySelector('.status-icon i');
@@ -518,7 +714,9 @@ document.addEventListener('DOMContentLoaded', () => {
         // Format plan for preview
         let previewText = `目标: ${plan.description}\n\n任务:\n`;
         plan.tasks.forEach((t, i) => {
-            previewText += `${i + 1}. [${t.type}] ${t.description}\n`;
+            const id = t.id ? `${t.id}: ` : '';
+            const inputs = t.inputs && t.inputs.length > 0 ? ` ← ${t.inputs.join(', ')}` : '';
+            previewText += `${i + 1}. [${t.type}] ${id}${t.description}${inputs}\n`;
         });
         planPreview.textContent = previewText;
 
@@ -554,7 +752,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     async function sendResponse(content) {
         try {
-            await fetch('/api/respond', {
+            await fetch(withToken('/api/respond'), {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
@@ -588,11 +786,25 @@ document.addEventListener('DOMContentLoaded', () => {
     // Load history sessions on startup
     loadHistorySessions();
 
+    // Warn early when the model API is unreachable or misconfigured
+    checkReady();
+
+    function checkReady() {
+        fetch(withToken('/readyz'))
+            .then(res => res.json())
+            .then(status => {
+                if (!status.ready) {
+                    addLog('error', `模型服务不可用 (${status.model || '未知模型'}): ${status.error}`);
+                }
+            })
+            .catch(err => console.error('Readiness check failed:', err));
+    }
+
     function loadHistorySessions() {
         const container = document.getElementById('history-sessions-list');
         if (!container) return;
 
-        fetch('/api/sessions')
+        fetch(withToken('/api/sessions'))
             .then(res => res.json())
             .then(sessions => {
                 container.innerHTML = '';
@@ -626,7 +838,13 @@ document.addEventListener('DOMContentLoaded', () => {
 
                     card.innerHTML = `
                         <div class="history-session-title" title="${displayTitle}">${displayTitle}</div>
+                        <a class="history-session-download" title="下载会话记录 (Markdown)"
+                           href="${withToken('/api/export?format=md&session_id=' + encodeURIComponent(session.id))}">
+                            <i class="fas fa-download"></i> 下载记录
+                        </a>
                     `;
+                    // Downloading should not start a replay
+                    card.querySelector('.history-session-download').addEventListener('click', e => e.stopPropagation());
 
                     card.addEventListener('click', () => {
                         replaySession(session.id);
@@ -645,6 +863,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     function replaySession(sessionId) {
         isReplaying = true;
+        resumeFrom = sessionId;
         // Clear current state
         planContainer.innerHTML = '<div class="empty-state">Replaying session...</div>';
         terminalContainer.innerHTML = '';
@@ -668,7 +887,7 @@ document.addEventListener('DOMContentLoaded', () => {
         }
         addLog('system', `> 开始回放会话: ${displayTitle}`);
 
-        fetch(`/api/replay?session_id=${sessionId}`)
+        fetch(withToken(`/api/replay?session_id=${sessionId}`))
             .then(res => res.json())
             .then(events => {
                 if (!Array.isArray(events)) {
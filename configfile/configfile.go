@@ -0,0 +1,137 @@
+// Package configfile loads YAML configuration files for the agent commands.
+//
+// A file sets command line flags by name; nested maps join their keys with
+// "-", so
+//
+//	search:
+//	  providers: [tavily, duckduckgo]
+//	  breaker-cooldown: 2m
+//
+// sets --search-providers and --search-breaker-cooldown. The "prompts" map
+// overrides the built-in system prompts like agent.AgentConfig.Prompts.
+// Flags given on the command line take precedence over the file, and the
+// file over environment variables.
+package configfile
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// File is a parsed configuration file.
+type File struct {
+	// Values are the flag values keyed by flag name.
+	Values map[string]interface{}
+	// Prompts overrides built-in system prompts, keyed by component such
+	// as "planner" or "report".
+	Prompts map[string]string
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses the YAML content of a configuration file.
+func Parse(data []byte) (*File, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	f := &File{Values: make(map[string]interface{})}
+	if prompts, ok := raw["prompts"]; ok {
+		delete(raw, "prompts")
+		m, ok := prompts.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("prompts must map components to prompts, got %T", prompts)
+		}
+		f.Prompts = make(map[string]string, len(m))
+		for k, v := range m {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("prompt %q must be a string, got %T", k, v)
+			}
+			f.Prompts[k] = s
+		}
+	}
+	flatten(f.Values, "", raw)
+	return f, nil
+}
+
+// flatten copies the values of m into values, joining the keys of nested
+// maps with "-".
+func flatten(values map[string]interface{}, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "-" + k
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			flatten(values, k, nested)
+			continue
+		}
+		values[k] = v
+	}
+}
+
+// Apply sets the flags not given on the command line to the values of the
+// file. Keys that name no flag are an error, to catch typos.
+func (f *File) Apply(flags *pflag.FlagSet) error {
+	names := make([]string, 0, len(f.Values))
+	for name := range f.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("unknown option %q in config file", name)
+		}
+		if flag.Changed {
+			continue
+		}
+		value := f.Values[name]
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			if err := slice.Replace(toStrings(value)); err != nil {
+				return fmt.Errorf("invalid value for %q in config file: %w", name, err)
+			}
+			continue
+		}
+		if _, ok := value.([]interface{}); ok {
+			return fmt.Errorf("invalid value for %q in config file: want a single value, got a list", name)
+		}
+		if err := flags.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid value for %q in config file: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// toStrings converts a list or a comma separated value to strings.
+func toStrings(value interface{}) []string {
+	list, ok := value.([]interface{})
+	if !ok {
+		var s []string
+		for _, item := range strings.Split(fmt.Sprint(value), ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				s = append(s, item)
+			}
+		}
+		return s
+	}
+	s := make([]string, len(list))
+	for i, item := range list {
+		s[i] = fmt.Sprint(item)
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package configfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApply(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	os.WriteFile(path, []byte(`
+model: gpt-4o
+api-key: from-file
+search:
+  providers: [tavily, duckduckgo]
+  breaker-cooldown: 2m
+  min-novelty: 0.3
+exclude-domains: a.com, b.com
+verbose: true
+prompts:
+  report: Write short reports.
+`), 0644)
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	model := flags.String("model", "", "")
+	apiKey := flags.String("api-key", "from-env", "")
+	providers := flags.StringSlice("search-providers", nil, "")
+	cooldown := flags.Duration("search-breaker-cooldown", time.Minute, "")
+	novelty := flags.Float64("search-min-novelty", 0, "")
+	exclude := flags.StringSlice("exclude-domains", nil, "")
+	verbose := flags.Bool("verbose", false, "")
+	if err := flags.Parse([]string{"--model", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := file.Apply(flags); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if *model != "from-flag" {
+		t.Errorf("expected the command line to win, got model %q", *model)
+	}
+	if *apiKey != "from-file" {
+		t.Errorf("expected the file to override the environment, got api key %q", *apiKey)
+	}
+	if strings.Join(*providers, ",") != "tavily,duckduckgo" || strings.Join(*exclude, ",") != "a.com,b.com" {
+		t.Errorf("unexpected lists %q and %q", *providers, *exclude)
+	}
+	if *cooldown != 2*time.Minute || *novelty != 0.3 || !*verbose {
+		t.Errorf("unexpected values %v, %v, %v", *cooldown, *novelty, *verbose)
+	}
+	if file.Prompts["report"] != "Write short reports." {
+		t.Errorf("unexpected prompts %+v", file.Prompts)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for _, content := range []string{
+		"modle: gpt-4o",
+		"model: [a, b]",
+		"retries: many",
+		"prompts: [a]",
+		"model: [",
+	} {
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.String("model", "", "")
+		flags.Int("retries", 0, "")
+
+		file, err := Parse([]byte(content))
+		if err == nil {
+			err = file.Apply(flags)
+		}
+		if err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+}
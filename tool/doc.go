@@ -0,0 +1,10 @@
+// Package tool provides the web search and knowledge lookups used by the
+// subagents.
+//
+// It started as a copy of the tool package of github.com/smallnest/goskills
+// (v0.3.5), whose search functions take only a query and a fixed result
+// limit. The copy adds what the subagents need on top: SearchOptions for the
+// result count, region and domain filters, WikipediaOptions, structured
+// SearchResult values, empty-result detection, sanitizing and a configurable
+// HTTP client. Fixes to the upstream package have to be ported by hand.
+package tool
@@ -0,0 +1,93 @@
+package tool
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultUserAgent identifies the search requests when HTTPOptions.UserAgent
+// is empty. Some endpoints, such as Wikipedia, block the default Go user
+// agent.
+const DefaultUserAgent = "aiagents/1.0 (+https://github.com/smallnest/build-an-agent-from-scratch)"
+
+// HTTPOptions configures the HTTP client of TavilySearch, DuckDuckGoSearch
+// and WikipediaSearch. The zero value uses the proxy of the environment and
+// DefaultUserAgent.
+type HTTPOptions struct {
+	// Proxy is the URL of the outbound proxy, e.g.
+	// "http://proxy.example.com:3128". Empty uses the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string
+	// UserAgent is sent with every request. Empty uses DefaultUserAgent.
+	UserAgent string
+}
+
+// userAgentTransport sets the User-Agent header of requests that have none.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// A RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// NewHTTPClient returns a client that sends requests through the proxy and
+// with the user agent of opts.
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	return &http.Client{Transport: &userAgentTransport{base: transport, userAgent: userAgent}}, nil
+}
+
+// defaultHTTPClient is used until SetHTTPClient sets another client. The
+// zero options always give a valid client.
+var defaultHTTPClient, _ = NewHTTPClient(HTTPOptions{})
+
+var (
+	httpClientMu sync.RWMutex
+	httpClient   = defaultHTTPClient
+)
+
+// SetHTTPClient sets the client used by the search functions, e.g. one
+// returned by NewHTTPClient. nil restores the default client. The timeout of
+// each search applies unless the client has its own.
+func SetHTTPClient(client *http.Client) {
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	httpClientMu.Lock()
+	defer httpClientMu.Unlock()
+	httpClient = client
+}
+
+// doRequest sends req with the configured client, limited to timeout unless
+// the client sets its own.
+func doRequest(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	httpClientMu.RLock()
+	client := *httpClient
+	httpClientMu.RUnlock()
+
+	if client.Timeout == 0 {
+		client.Timeout = timeout
+	}
+	return client.Do(req)
+}
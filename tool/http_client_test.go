@@ -0,0 +1,89 @@
+package tool
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	// The test server acts as the proxy and records what it receives
+	var host, userAgent string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, userAgent = r.URL.Host, r.Header.Get("User-Agent")
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	tests := []struct {
+		opts          HTTPOptions
+		header        string
+		wantUserAgent string
+	}{
+		{HTTPOptions{Proxy: proxy.URL}, "", DefaultUserAgent},
+		{HTTPOptions{Proxy: proxy.URL, UserAgent: "research-bot/2.0"}, "", "research-bot/2.0"},
+		// A User-Agent set on the request is kept
+		{HTTPOptions{Proxy: proxy.URL}, "custom/1.0", "custom/1.0"},
+	}
+	for _, tt := range tests {
+		client, err := NewHTTPClient(tt.opts)
+		if err != nil {
+			t.Fatalf("%+v: NewHTTPClient failed: %v", tt.opts, err)
+		}
+		host, userAgent = "", ""
+		req, _ := http.NewRequest("GET", "http://search.example/api?q=go", nil)
+		if tt.header != "" {
+			req.Header.Set("User-Agent", tt.header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%+v: request failed: %v", tt.opts, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "proxied" || host != "search.example" {
+			t.Errorf("%+v: expected the request to go through the proxy, got %q for host %q", tt.opts, body, host)
+		}
+		if userAgent != tt.wantUserAgent {
+			t.Errorf("%+v: User-Agent = %q, want %q", tt.opts, userAgent, tt.wantUserAgent)
+		}
+		if tt.header != "" && req.Header.Get("User-Agent") != tt.header {
+			t.Errorf("the request was modified: %v", req.Header)
+		}
+	}
+
+	for _, proxyURL := range []string{"proxy.example.com:3128", "://bad"} {
+		if _, err := NewHTTPClient(HTTPOptions{Proxy: proxyURL}); err == nil {
+			t.Errorf("expected an error for the proxy URL %q", proxyURL)
+		}
+	}
+}
+
+func TestSetHTTPClientUserAgent(t *testing.T) {
+	var userAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		fmt.Fprint(w, `{"RelatedTopics": [{"Text": "Go - a language", "FirstURL": "https://duckduckgo.com/Go"}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := NewHTTPClient(HTTPOptions{UserAgent: "research-bot/2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Send the search to the test server instead of DuckDuckGo
+	target, _ := url.Parse(srv.URL)
+	client.Transport.(*userAgentTransport).base = redirectTransport{target}
+	SetHTTPClient(client)
+	t.Cleanup(func() { SetHTTPClient(nil) })
+
+	if _, err := DuckDuckGoSearchResults("go", SearchOptions{}); err != nil {
+		t.Fatalf("DuckDuckGoSearchResults failed: %v", err)
+	}
+	if userAgent != "research-bot/2.0" {
+		t.Errorf("User-Agent = %q, want %q", userAgent, "research-bot/2.0")
+	}
+}
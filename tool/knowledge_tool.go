@@ -0,0 +1,158 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// WikipediaOptions selects the Wikipedia edition and how much of an
+// article is returned. The zero value returns the introduction from the
+// English Wikipedia.
+type WikipediaOptions struct {
+	// Language is the Wikipedia language code such as "zh" or "en".
+	// Empty uses "en".
+	Language string
+	// FullArticle returns the whole article instead of the introduction.
+	FullArticle bool
+	// Section returns only the section with this title, case-insensitively.
+	// An unknown section returns the introduction.
+	Section string
+}
+
+// wikipediaLanguagePattern matches Wikipedia language codes such as "zh"
+// or "zh-yue", which become part of the host name.
+var wikipediaLanguagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]+)*$`)
+
+// BaseURL returns the address of the Wikipedia edition, e.g.
+// "https://zh.wikipedia.org/".
+func (o WikipediaOptions) BaseURL() string {
+	return fmt.Sprintf("https://%s.wikipedia.org/", o.language())
+}
+
+func (o WikipediaOptions) language() string {
+	if o.Language == "" {
+		return "en"
+	}
+	return strings.ToLower(o.Language)
+}
+
+// WikipediaSearch performs a search on Wikipedia for the given query and returns a summary.
+// It uses the Wikipedia API.
+func WikipediaSearch(query string) (string, error) {
+	extract, err := WikipediaSearchWithOptions(query, WikipediaOptions{})
+	if err == nil && extract == "" {
+		return "No relevant Wikipedia entry found.", nil
+	}
+	return extract, err
+}
+
+// WikipediaSearchWithOptions looks up the article titled query in the
+// Wikipedia edition and returns its plain text as selected by opts, or ""
+// if there is no such article.
+func WikipediaSearchWithOptions(query string, opts WikipediaOptions) (string, error) {
+	if !wikipediaLanguagePattern.MatchString(opts.language()) {
+		return "", fmt.Errorf("invalid Wikipedia language code %q", opts.Language)
+	}
+
+	baseURL := opts.BaseURL() + "w/api.php"
+	params := url.Values{}
+	params.Add("action", "query")
+	params.Add("format", "json")
+	params.Add("prop", "extracts")
+	if !opts.FullArticle && opts.Section == "" {
+		params.Add("exintro", "") // Return only content before the first section
+	}
+	params.Add("explaintext", "") // Return plain text
+	params.Add("redirects", "1")  // Resolve redirects
+	params.Add("titles", query)
+
+	searchURL := baseURL + "?" + params.Encode()
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", searchURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := doRequest(req, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to perform Wikipedia search: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Wikipedia API returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var result struct {
+		Query struct {
+			Pages map[string]struct {
+				Extract string `json:"extract"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to unmarshal Wikipedia response: %w", err)
+	}
+
+	for _, page := range result.Query.Pages {
+		if page.Extract != "" {
+			// Clean up some common Wikipedia API artifacts
+			extract := strings.ReplaceAll(SanitizeText(page.Extract), "(listen)", "")
+			if opts.Section != "" {
+				extract = wikipediaSection(extract, opts.Section)
+			}
+			extract = strings.TrimSpace(extract)
+			return extract, nil
+		}
+	}
+
+	return "", nil
+}
+
+// wikipediaHeading matches the "== Title ==" section headings of plain
+// text extracts.
+var wikipediaHeading = regexp.MustCompile(`^(=+)\s*(.*?)\s*=+$`)
+
+// wikipediaSection returns the section titled title, including its
+// subsections, from a plain text extract, or the introduction if there is
+// no such section.
+func wikipediaSection(extract, title string) string {
+	lines := strings.Split(extract, "\n")
+	start, level := -1, 0
+	for i, line := range lines {
+		m := wikipediaHeading.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if start >= 0 && len(m[1]) <= level {
+			return strings.Join(lines[start:i], "\n")
+		}
+		if start < 0 && strings.EqualFold(m[2], strings.TrimSpace(title)) {
+			start, level = i, len(m[1])
+		}
+	}
+	if start >= 0 {
+		return strings.Join(lines[start:], "\n")
+	}
+
+	// Fall back to the introduction
+	for i, line := range lines {
+		if wikipediaHeading.MatchString(strings.TrimSpace(line)) {
+			return strings.Join(lines[:i], "\n")
+		}
+	}
+	return extract
+}
@@ -0,0 +1,32 @@
+package tool
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SanitizeText makes text fetched from the web safe to put in a prompt.
+// Invalid UTF-8 is dropped, together with the replacement characters that
+// decoders substitute for it, and so are control characters other than
+// newlines and tabs, which binary content tends to be full of.
+func SanitizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case r == utf8.RuneError || unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(s, ""))
+}
+
+// sanitizeResults sanitizes the titles and contents of results in place.
+func sanitizeResults(results []SearchResult) []SearchResult {
+	for i := range results {
+		results[i].Title = SanitizeText(results[i].Title)
+		results[i].Content = SanitizeText(results[i].Content)
+	}
+	return results
+}
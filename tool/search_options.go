@@ -0,0 +1,128 @@
+package tool
+
+import (
+	"net/url"
+	"strings"
+)
+
+// SearchOptions controls how many results a search returns and for which locale.
+// The zero value keeps each provider's default behavior.
+type SearchOptions struct {
+	// MaxResults limits the number of results. Zero uses the provider default.
+	MaxResults int
+	// Region is a DuckDuckGo style region code such as "cn-zh" or "us-en".
+	// For Tavily it is translated to the matching country.
+	Region string
+	// IncludeDomains restricts results to these domains and their
+	// subdomains, e.g. "wikipedia.org" or "*.gov". Empty allows all.
+	IncludeDomains []string
+	// ExcludeDomains drops results from these domains and their subdomains.
+	ExcludeDomains []string
+}
+
+// SearchResult is a single result returned by a search provider.
+type SearchResult struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Content string `json:"content,omitempty"`
+}
+
+// Texts returned by the search functions when nothing was found.
+const (
+	noTavilyResults     = "No results found."
+	noDuckDuckGoResults = "No relevant information found."
+)
+
+// IsEmptyResult reports whether the text returned by a search function
+// contains no results.
+func IsEmptyResult(text string) bool {
+	text = strings.TrimSpace(text)
+	return text == "" || text == noTavilyResults || text == noDuckDuckGoResults
+}
+
+// regionCountries maps region codes to the country names accepted by Tavily.
+var regionCountries = map[string]string{
+	"cn": "china",
+	"tw": "taiwan",
+	"hk": "hong kong",
+	"jp": "japan",
+	"kr": "south korea",
+	"us": "united states",
+	"uk": "united kingdom",
+	"de": "germany",
+	"fr": "france",
+	"es": "spain",
+	"it": "italy",
+	"ru": "russia",
+	"in": "india",
+	"ca": "canada",
+	"au": "australia",
+	"br": "brazil",
+}
+
+// country returns the Tavily country name for the region, or "" if unknown.
+func (o SearchOptions) country() string {
+	code, _, _ := strings.Cut(strings.ToLower(o.Region), "-")
+	return regionCountries[code]
+}
+
+// Allows reports whether a result URL passes the domain filters. A domain
+// matches its own host and every subdomain; a leading "*." is optional.
+func (o SearchOptions) Allows(rawURL string) bool {
+	if len(o.IncludeDomains) == 0 && len(o.ExcludeDomains) == 0 {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, domain := range o.ExcludeDomains {
+		if matchDomain(host, domain) {
+			return false
+		}
+	}
+	if len(o.IncludeDomains) == 0 {
+		return true
+	}
+	for _, domain := range o.IncludeDomains {
+		if matchDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the results that pass the domain filters.
+func (o SearchOptions) filter(results []SearchResult) []SearchResult {
+	var kept []SearchResult
+	for _, result := range results {
+		if o.Allows(result.URL) {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
+
+// matchDomain reports whether host is domain or one of its subdomains.
+func matchDomain(host, domain string) bool {
+	domain = normalizeDomain(domain)
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// normalizeDomain strips the wildcard prefix and case from a domain filter.
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "*."))
+}
+
+// normalizeDomains normalizes a list of domain filters for the Tavily API.
+func normalizeDomains(domains []string) []string {
+	var out []string
+	for _, domain := range domains {
+		if d := normalizeDomain(domain); d != "" {
+			out = append(out, d)
+		}
+	}
+	return out
+}
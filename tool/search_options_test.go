@@ -0,0 +1,102 @@
+package tool
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// redirectTransport sends every request to the test server at target,
+// keeping its path and query.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// useTestServer makes the search functions send their requests to a test
+// server running handler.
+func useTestServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	target, _ := url.Parse(srv.URL)
+	SetHTTPClient(&http.Client{Transport: redirectTransport{target}})
+	t.Cleanup(func() {
+		SetHTTPClient(nil)
+		srv.Close()
+	})
+}
+
+func TestTavilyCountAndRegion(t *testing.T) {
+	t.Setenv("TAVILY_API_KEY", "test")
+	var body map[string]interface{}
+	useTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprint(w, `{"results": [{"title": "Go", "url": "https://go.dev", "content": "The Go language"}]}`)
+	})
+
+	tests := []struct {
+		opts        SearchOptions
+		wantResults float64
+		wantCountry string
+	}{
+		{SearchOptions{}, 20, ""},
+		{SearchOptions{MaxResults: 5, Region: "cn-zh"}, 5, "china"},
+		{SearchOptions{MaxResults: -1, Region: "US-EN"}, 20, "united states"},
+		{SearchOptions{MaxResults: 500, Region: "xx-yy"}, 100, ""},
+	}
+	for _, tt := range tests {
+		results, err := TavilySearchResults("go", tt.opts)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("%+v: unexpected results %v, %v", tt.opts, results, err)
+		}
+		if body["max_results"] != tt.wantResults {
+			t.Errorf("%+v: max_results = %v, want %v", tt.opts, body["max_results"], tt.wantResults)
+		}
+		country, _ := body["country"].(string)
+		if country != tt.wantCountry {
+			t.Errorf("%+v: country = %q, want %q", tt.opts, country, tt.wantCountry)
+		}
+	}
+}
+
+func TestDuckDuckGoCountAndRegion(t *testing.T) {
+	var query url.Values
+	useTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"RelatedTopics": [
+			{"Text": "Go - a language", "FirstURL": "https://duckduckgo.com/Go"},
+			{"Text": "Gopher - a mascot", "FirstURL": "https://duckduckgo.com/Gopher"},
+			{"Text": "Golang - another name", "FirstURL": "https://duckduckgo.com/Golang"}
+		]}`)
+	})
+
+	results, err := DuckDuckGoSearchResults("go", SearchOptions{MaxResults: 2, Region: "cn-zh"})
+	if err != nil {
+		t.Fatalf("DuckDuckGoSearchResults failed: %v", err)
+	}
+	if len(results) != 2 || results[0].Title != "Go" {
+		t.Errorf("expected the first 2 topics, got %+v", results)
+	}
+	if query.Get("q") != "go" || query.Get("kl") != "cn-zh" {
+		t.Errorf("expected the query and region in the request, got %v", query)
+	}
+
+	text, err := DuckDuckGoSearchWithOptions("go", SearchOptions{})
+	if err != nil {
+		t.Fatalf("DuckDuckGoSearchWithOptions failed: %v", err)
+	}
+	if !strings.Contains(text, "Golang - another name") || query.Has("kl") {
+		t.Errorf("expected every topic and no region, got %q and %v", text, query)
+	}
+}
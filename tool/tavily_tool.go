@@ -0,0 +1,126 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TavilySearch performs a web search using the Tavily API.
+func TavilySearch(query string) (string, error) {
+	return TavilySearchWithLimit(query, 20)
+}
+
+// TavilySearchWithLimit performs a web search using the Tavily API with a custom result limit.
+func TavilySearchWithLimit(query string, maxResults int) (string, error) {
+	return TavilySearchWithOptions(query, SearchOptions{MaxResults: maxResults})
+}
+
+// TavilySearchWithOptions performs a web search using the Tavily API with the given options.
+// A zero or negative MaxResults uses the default limit of 20, and at most
+// 100 results are requested.
+func TavilySearchWithOptions(query string, opts SearchOptions) (string, error) {
+	results, images, err := tavilySearch(query, opts, true)
+	if err != nil {
+		return "", err
+	}
+
+	var sb bytes.Buffer
+	for _, item := range results {
+		sb.WriteString(fmt.Sprintf("Title: %s\nURL: %s\nContent: %s\n\n", item.Title, item.URL, item.Content))
+	}
+
+	if len(images) > 0 {
+		sb.WriteString("\nRelevant Images:\n")
+		for _, imgURL := range images {
+			sb.WriteString(fmt.Sprintf("- Image URL: %s\n", imgURL))
+		}
+		sb.WriteString("\n")
+	}
+
+	if sb.Len() == 0 {
+		return noTavilyResults, nil
+	}
+
+	return sb.String(), nil
+}
+
+// TavilySearchResults performs a web search using the Tavily API and returns
+// the structured results without images.
+func TavilySearchResults(query string, opts SearchOptions) ([]SearchResult, error) {
+	results, _, err := tavilySearch(query, opts, false)
+	return results, err
+}
+
+func tavilySearch(query string, opts SearchOptions, includeImages bool) ([]SearchResult, []string, error) {
+	maxResults := opts.MaxResults
+	if maxResults <= 0 {
+		maxResults = 20
+	}
+
+	apiKey := os.Getenv("TAVILY_API_KEY")
+	if apiKey == "" {
+		return nil, nil, fmt.Errorf("TAVILY_API_KEY environment variable is not set")
+	}
+
+	if maxResults > 100 {
+		maxResults = 100
+	}
+
+	body := map[string]interface{}{
+		"query":          query,
+		"search_depth":   "basic",
+		"max_results":    maxResults,
+		"include_images": includeImages,
+	}
+	if country := opts.country(); country != "" {
+		body["country"] = country
+	}
+	if domains := normalizeDomains(opts.IncludeDomains); len(domains) > 0 {
+		body["include_domains"] = domains
+	}
+	if domains := normalizeDomains(opts.ExcludeDomains); len(domains) > 0 {
+		body["exclude_domains"] = domains
+	}
+
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), "POST", "https://api.tavily.com/search", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := doRequest(req, 30*time.Second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to perform Tavily search: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("Tavily API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Results []SearchResult `json:"results"`
+		Images  []string       `json:"images"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode Tavily response: %w", err)
+	}
+
+	// Filter again in case the API matched domains more loosely
+	return sanitizeResults(opts.filter(result.Results)), result.Images, nil
+}
@@ -0,0 +1,132 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DuckDuckGoSearch performs a DuckDuckGo search for the given query.
+// It uses the DuckDuckGo Instant Answer API.
+func DuckDuckGoSearch(query string) (string, error) {
+	return DuckDuckGoSearchWithOptions(query, SearchOptions{})
+}
+
+// DuckDuckGoSearchWithOptions performs a DuckDuckGo search with the given options.
+// MaxResults limits the number of related topics returned. The API has no
+// domain filters, so results are filtered by their URLs.
+func DuckDuckGoSearchWithOptions(query string, opts SearchOptions) (string, error) {
+	result, err := duckDuckGoSearch(query, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if result.AbstractText != "" && opts.Allows(result.AbstractURL) {
+		return fmt.Sprintf("%s (Source: %s)", result.AbstractText, result.AbstractURL), nil
+	} else if len(result.RelatedTopics) > 0 {
+		// Fallback to related topics if no abstract
+		var topics []string
+		for _, topic := range result.RelatedTopics {
+			if opts.MaxResults > 0 && len(topics) >= opts.MaxResults {
+				break
+			}
+			if opts.Allows(topic.URL) {
+				topics = append(topics, topic.Text)
+			}
+		}
+		if len(topics) > 0 {
+			return fmt.Sprintf("No direct abstract found. Related topics: %s", strings.Join(topics, "; ")), nil
+		}
+	}
+
+	return noDuckDuckGoResults, nil
+}
+
+// DuckDuckGoSearchResults performs a DuckDuckGo search and returns the
+// abstract source and related topics that have a URL as structured results.
+func DuckDuckGoSearchResults(query string, opts SearchOptions) ([]SearchResult, error) {
+	result, err := duckDuckGoSearch(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	if result.AbstractURL != "" && opts.Allows(result.AbstractURL) {
+		title := result.Heading
+		if title == "" {
+			title = query
+		}
+		results = append(results, SearchResult{Title: title, URL: result.AbstractURL, Content: result.AbstractText})
+	}
+	for _, topic := range result.RelatedTopics {
+		if opts.MaxResults > 0 && len(results) >= opts.MaxResults {
+			break
+		}
+		if topic.URL == "" || !opts.Allows(topic.URL) {
+			continue
+		}
+		// Related topic texts start with the topic name, e.g. "Go - a programming language"
+		title, _, _ := strings.Cut(topic.Text, " - ")
+		results = append(results, SearchResult{Title: title, URL: topic.URL, Content: topic.Text})
+	}
+	return results, nil
+}
+
+type duckDuckGoResponse struct {
+	Heading       string `json:"Heading"`
+	AbstractText  string `json:"AbstractText"`
+	AbstractURL   string `json:"AbstractURL"`
+	RelatedTopics []struct {
+		Text string `json:"Text"`
+		URL  string `json:"FirstURL"`
+	} `json:"RelatedTopics"`
+}
+
+func duckDuckGoSearch(query string, opts SearchOptions) (*duckDuckGoResponse, error) {
+	baseURL := "https://api.duckduckgo.com/?format=json&q="
+	searchURL := baseURL + url.QueryEscape(query)
+	if opts.Region != "" {
+		searchURL += "&kl=" + url.QueryEscape(opts.Region)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", searchURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := doRequest(req, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform DuckDuckGo search: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DuckDuckGo API returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var result duckDuckGoResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal DuckDuckGo response: %w", err)
+	}
+
+	result.Heading = SanitizeText(result.Heading)
+	result.AbstractText = SanitizeText(result.AbstractText)
+	for i := range result.RelatedTopics {
+		result.RelatedTopics[i].Text = SanitizeText(result.RelatedTopics[i].Text)
+	}
+	return &result, nil
+}
+
+// SerpAPISearch is removed as it requires an API key and is complex to implement directly.
+// MetaphorSearch is removed as it requires an API key and is complex to implement directly.
+// ScrapeURL is removed as it requires external libraries for robust scraping.